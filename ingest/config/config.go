@@ -39,6 +39,7 @@
 package config
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -86,6 +87,7 @@ var (
 	ErrGlobalSectionNotFound      = errors.New("Global config section not found")
 	ErrInvalidLineLocation        = errors.New("Invalid line location")
 	ErrInvalidUpdateLineParameter = errors.New("Update line location does not contain the specified paramter")
+	ErrIncompleteClientCert       = errors.New("TLS-Client-Cert and TLS-Client-Key must be set together")
 )
 
 type IngestConfig struct {
@@ -93,6 +95,8 @@ type IngestConfig struct {
 	Connection_Timeout         string
 	Verify_Remote_Certificates bool //legacy, will be removed
 	Insecure_Skip_TLS_Verify   bool
+	TLS_Client_Cert            string // PEM certificate presented to indexers requiring mutual TLS
+	TLS_Client_Key             string // PEM private key for TLS-Client-Cert
 	Cleartext_Backend_Target   []string
 	Encrypted_Backend_Target   []string
 	Pipe_Backend_Target        []string
@@ -100,6 +104,7 @@ type IngestConfig struct {
 	Max_Ingest_Cache           int64 //maximum amount of data to cache in MB
 	Log_Level                  string
 	Log_File                   string
+	Log_Format                 string // text (default) or json
 	Source_Override            string // override normal source if desired
 	Rate_Limit                 string
 	Ingester_UUID              string
@@ -169,6 +174,9 @@ func (ic *IngestConfig) Verify() error {
 	if err := ic.checkLogLevel(); err != nil {
 		return err
 	}
+	if _, err := log.FormatFromString(ic.Log_Format); err != nil {
+		return err
+	}
 
 	// Make sure the log directory exists.
 	logdir := filepath.Dir(ic.Log_File)
@@ -216,6 +224,30 @@ func (ic *IngestConfig) Verify() error {
 			return errors.New("Failed to parse Source_Override")
 		}
 	}
+	if err := ic.checkClientCert(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkClientCert makes sure TLS-Client-Cert and TLS-Client-Key are given
+// together and load as a certificate and matching key.
+func (ic *IngestConfig) checkClientCert() error {
+	if ic.TLS_Client_Cert == `` && ic.TLS_Client_Key == `` {
+		return nil
+	} else if ic.TLS_Client_Cert == `` || ic.TLS_Client_Key == `` {
+		return ErrIncompleteClientCert
+	}
+	for _, f := range []string{ic.TLS_Client_Cert, ic.TLS_Client_Key} {
+		if fi, err := os.Stat(f); err != nil {
+			return err
+		} else if !fi.Mode().IsRegular() {
+			return fmt.Errorf("TLS client certificate file %s is not a regular file", f)
+		}
+	}
+	if _, err := tls.LoadX509KeyPair(ic.TLS_Client_Cert, ic.TLS_Client_Key); err != nil {
+		return fmt.Errorf("Invalid TLS-Client-Cert and TLS-Client-Key: %v", err)
+	}
 	return nil
 }
 
@@ -245,6 +277,12 @@ func (ic *IngestConfig) InsecureSkipTLSVerification() bool {
 	return ic.Insecure_Skip_TLS_Verify
 }
 
+// TLSClientCert returns the certificate and key files presented to indexers
+// over TLS connections, both are empty if no client certificate is configured.
+func (ic *IngestConfig) TLSClientCert() (cert, key string) {
+	return ic.TLS_Client_Cert, ic.TLS_Client_Key
+}
+
 // Timeout returns the timeout for an ingester connection to go live before
 // giving up.
 func (ic *IngestConfig) Timeout() time.Duration {
@@ -280,6 +318,11 @@ func (ic *IngestConfig) LogLevel() string {
 	return ic.Log_Level
 }
 
+// LogFormat returns the specified log format
+func (ic *IngestConfig) LogFormat() string {
+	return ic.Log_Format
+}
+
 func (ic *IngestConfig) checkLogLevel() error {
 	if len(ic.Log_Level) == 0 {
 		ic.Log_Level = defaultLogLevel
@@ -404,6 +447,9 @@ func (ic *IngestConfig) GetLogger() (l *log.Logger, err error) {
 	if err == nil {
 		err = l.SetLevel(ll)
 	}
+	if err == nil {
+		err = l.SetFormatString(ic.Log_Format)
+	}
 	return
 }
 
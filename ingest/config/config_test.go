@@ -9,8 +9,18 @@
 package config
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestParseSourceIP(t *testing.T) {
@@ -53,3 +63,57 @@ func TestParseSourceIntegter(t *testing.T) {
 		}
 	}
 }
+
+// writeClientCert writes a self signed certificate and its key to tempDir.
+func writeClientCert(t *testing.T, name string) (cert, key string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, key = filepath.Join(tempDir, name+`.pem`), filepath.Join(tempDir, name+`.key`)
+	if err = ioutil.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: `CERTIFICATE`, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: `EC PRIVATE KEY`, Bytes: kder}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestClientCert(t *testing.T) {
+	cert, key := writeClientCert(t, `client`)
+	_, otherKey := writeClientCert(t, `other`)
+	tsts := []struct {
+		cert, key string
+		ok        bool
+	}{
+		{``, ``, true},
+		{cert, key, true},
+		{cert, ``, false},
+		{``, key, false},
+		{cert, otherKey, false},
+		{filepath.Join(tempDir, `missing.pem`), key, false},
+		{tempDir, key, false},
+	}
+	for _, v := range tsts {
+		ic := IngestConfig{TLS_Client_Cert: v.cert, TLS_Client_Key: v.key}
+		if err := ic.checkClientCert(); (err == nil) != v.ok {
+			t.Fatalf("TLS-Client-Cert %q, TLS-Client-Key %q: %v", v.cert, v.key, err)
+		}
+	}
+}
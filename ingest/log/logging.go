@@ -9,6 +9,8 @@
 package log
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -29,24 +31,43 @@ const (
 	CRITICAL Level = 5
 )
 
+const (
+	// TEXT is the default format of space delimited timestamp, caller, level, and message
+	TEXT Format = 0
+	// JSON emits one JSON object per line
+	JSON Format = 1
+)
+
 const (
 	DEFAULT_DEPTH = 3
 )
 
 var (
-	ErrNotOpen      = errors.New("Logger is not open")
-	ErrInvalidLevel = errors.New("Log level is invalid")
+	ErrNotOpen       = errors.New("Logger is not open")
+	ErrInvalidLevel  = errors.New("Log level is invalid")
+	ErrInvalidFormat = errors.New("Log format is invalid")
 )
 
 type Level int
 
+type Format int
+
 type Logger struct {
 	wtrs []io.WriteCloser
 	mtx  sync.Mutex
 	lvl  Level
+	fmt  Format
 	hot  bool
 }
 
+// jsonLine is a single log line in the JSON format
+type jsonLine struct {
+	TS     string `json:"ts"`
+	Level  string `json:"level"`
+	Caller string `json:"caller,omitempty"`
+	Msg    string `json:"msg"`
+}
+
 // NewFile creates a new logger with the first writer being a file
 // The file is created if it does not exist, and is opened in append mode
 // it is safe to use NewFile on existing logs
@@ -129,6 +150,30 @@ func (l *Logger) DeleteWriter(wtr io.Writer) error {
 	return nil
 }
 
+// SetFormatString sets the log format using a string, this is a helper function
+// so that you can just hand the config file value directly in
+func (l *Logger) SetFormatString(s string) error {
+	f, err := FormatFromString(s)
+	if err != nil {
+		return err
+	}
+	return l.SetFormat(f)
+}
+
+// SetFormat sets the format of all subsequent log lines
+func (l *Logger) SetFormat(f Format) error {
+	if !f.Valid() {
+		return ErrInvalidFormat
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if err := l.ready(); err != nil {
+		return err
+	}
+	l.fmt = f
+	return nil
+}
+
 // SetLevelString sets the log level using a string, this is a helper function so that you can just hand
 // the config file value directly in
 func (l *Logger) SetLevelString(s string) error {
@@ -235,12 +280,8 @@ func (l *Logger) FatalCode(code int, f string, args ...interface{}) {
 }
 
 func (l *Logger) fatalCode(lvl, code int, f string, args ...interface{}) {
-	var nl string
-	if !strings.HasSuffix(f, "\n") {
-		nl = "\n"
-	}
-	ln := prefix(lvl) + " FATAL " + fmt.Sprintf(f, args...) + nl
 	l.mtx.Lock()
+	ln := l.line(lvl, `FATAL`, fmt.Sprintf(f, args...))
 	for _, w := range l.wtrs {
 		io.WriteString(w, ln)
 		w.Close()
@@ -252,11 +293,7 @@ func (l *Logger) fatalCode(lvl, code int, f string, args ...interface{}) {
 func (l *Logger) output(depth int, lvl Level, f string, args ...interface{}) (err error) {
 	l.mtx.Lock()
 	if err = l.ready(); err == nil && l.lvl <= lvl && l.lvl != OFF {
-		var nl string
-		if !strings.HasSuffix(f, "\n") {
-			nl = "\n"
-		}
-		ln := prefix(depth) + " " + lvl.String() + " " + fmt.Sprintf(f, args...) + nl
+		ln := l.line(depth, lvl.String(), fmt.Sprintf(f, args...))
 		for _, w := range l.wtrs {
 			if _, lerr := io.WriteString(w, ln); lerr != nil {
 				err = lerr
@@ -267,6 +304,29 @@ func (l *Logger) output(depth int, lvl Level, f string, args ...interface{}) (er
 	return
 }
 
+// line renders a log line in the current format, the callDepth is relative to
+// the caller of line. The caller must hold the mutex.
+func (l *Logger) line(callDepth int, lvl, msg string) string {
+	if l.fmt == JSON {
+		ts, caller := callerInfo(callDepth + 1)
+		bb := bytes.NewBuffer(nil)
+		enc := json.NewEncoder(bb)
+		enc.SetEscapeHTML(false)
+		enc.Encode(jsonLine{
+			TS:     ts,
+			Level:  lvl,
+			Caller: caller,
+			Msg:    strings.TrimSuffix(msg, "\n"),
+		}) //Encode adds the trailing newline
+		return bb.String()
+	}
+	var nl string
+	if !strings.HasSuffix(msg, "\n") {
+		nl = "\n"
+	}
+	return prefix(callDepth+1) + " " + lvl + " " + msg + nl
+}
+
 // implement writer interface so it can be handed to a standard loger
 func (l *Logger) Write(b []byte) (n int, err error) {
 	l.mtx.Lock()
@@ -319,6 +379,33 @@ func (l Level) Valid() bool {
 	return false
 }
 
+func (f Format) String() string {
+	switch f {
+	case TEXT:
+		return `text`
+	case JSON:
+		return `json`
+	}
+	return `UNKNOWN`
+}
+
+func (f Format) Valid() bool {
+	return f == TEXT || f == JSON
+}
+
+// FormatFromString parses a log format, an empty string is the default TEXT format
+func FormatFromString(s string) (f Format, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case ``, `text`:
+		f = TEXT
+	case `json`:
+		f = JSON
+	default:
+		err = ErrInvalidFormat
+	}
+	return
+}
+
 func LevelFromString(s string) (l Level, err error) {
 	s = strings.ToUpper(s)
 	switch s {
@@ -350,16 +437,24 @@ func (dc discardCloser) Close() error {
 	return nil
 }
 
-//we have a separate func for error so the call depths are always consistent
+// we have a separate func for error so the call depths are always consistent
 // prefix attaches the timestamp and filepath to the log entry
 // the lvl indicates how far up the caller stack we need to go
 func prefix(callDepth int) (s string) {
-	ts := time.Now().UTC().Format(time.RFC3339)
 	//get the file and line that caused the error
+	if ts, caller := callerInfo(callDepth + 1); caller != `` {
+		s = ts + " " + caller
+	}
+	return
+}
+
+// callerInfo returns the current timestamp and the file and line of the caller
+func callerInfo(callDepth int) (ts, caller string) {
+	ts = time.Now().UTC().Format(time.RFC3339)
 	if _, file, line, ok := runtime.Caller(callDepth); ok {
 		dir, file := filepath.Split(file)
 		file = filepath.Join(filepath.Base(dir), file)
-		s = fmt.Sprintf("%s %s:%d", ts, file, line)
+		caller = fmt.Sprintf("%s:%d", file, line)
 	}
 	return
 }
@@ -9,6 +9,7 @@
 package log
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -236,3 +237,40 @@ func TestAddRemove(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestJSONFormat(t *testing.T) {
+	lgr, err := newLogger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lgr.SetFormatString(`bogus`); err != ErrInvalidFormat {
+		t.Fatal("accepted a bad format")
+	}
+	if err = lgr.SetFormatString(`JSON`); err != nil {
+		t.Fatal(err)
+	}
+	if err = lgr.Warn("test <%d>\n", 99); err != nil {
+		t.Fatal(err)
+	}
+	if err = lgr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bts, err := ioutil.ReadFile(filepath.Join(tempdir, testFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(bts), "\n"), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected a single line: %q", bts)
+	}
+	var jl jsonLine
+	if err = json.Unmarshal([]byte(lines[0]), &jl); err != nil {
+		t.Fatal(err)
+	}
+	if jl.Level != `WARN` || jl.Msg != `test <99>` || jl.TS == `` {
+		t.Fatalf("bad JSON log line: %s", lines[0])
+	}
+	if !strings.HasPrefix(jl.Caller, `log/logging_test.go:`) {
+		t.Fatalf("bad caller: %s", jl.Caller)
+	}
+}
@@ -664,6 +664,53 @@ func (im *IngestMuxer) Hot() (int, error) {
 	return int(atomic.LoadInt32(&im.connHot)), nil
 }
 
+// CacheStats is a snapshot of the ingest cache, the counts are approximate
+// while entries are moving in or out of the cache.
+type CacheStats struct {
+	Active       bool   // no connections are hot, entries are going into the cache
+	Entries      uint64 // entries held in memory and the backing store
+	MemoryBytes  uint64 // size of the entries held in memory
+	HotBlocks    int    // blocks held in memory
+	StoredBlocks int    // blocks held in the backing store
+}
+
+// CacheStats returns a snapshot of the ingest cache, ok is false if the cache
+// is not enabled.
+func (im *IngestMuxer) CacheStats() (cs CacheStats, ok bool) {
+	im.mtx.RLock()
+	defer im.mtx.RUnlock()
+	if !im.cacheEnabled || im.cache == nil {
+		return
+	}
+	cs = CacheStats{
+		Active:       atomic.LoadInt32(&im.connHot) == 0,
+		Entries:      im.cache.Count(),
+		MemoryBytes:  im.cache.MemoryCacheSize(),
+		HotBlocks:    im.cache.HotBlocks(),
+		StoredBlocks: im.cache.StoredBlocks(),
+	}
+	ok = true
+	return
+}
+
+// FlushCache asks the cache routine to unload the cache to the hot
+// connections now rather than waiting on the next connection to come up.
+// ErrAllConnsDown is returned if there is nowhere to flush the cache to.
+func (im *IngestMuxer) FlushCache() error {
+	im.mtx.RLock()
+	defer im.mtx.RUnlock()
+	if im.state != running {
+		return ErrNotRunning
+	} else if !im.cacheEnabled {
+		return nil
+	} else if atomic.LoadInt32(&im.connHot) == 0 {
+		return ErrAllConnsDown
+	}
+	//the state lock keeps Close from closing the cache signal under us
+	im.stopCache()
+	return nil
+}
+
 // unload cache will attempt to push out to the ingest connection
 // the returned boolean indicates whether we were able to entirely unload the cache
 // the cache MUST be stopped when we call this function
@@ -682,17 +729,21 @@ func (im *IngestMuxer) unloadCache() (bool, error) {
 			break //no more blocks
 		}
 		ents := blk.Entries()
-		select {
-		case im.bChan <- ents:
-		case _, ok := <-im.cacheSignal:
-			//push things back into the cache if we have zero connections or
-			// the cacheSignal channel closed
-			v := atomic.LoadInt32(&im.connHot)
-			//if !ok || atomic.LoadInt32(&im.connHot) == 0 {
-			if !ok || v == 0 {
-				//push the block items back into the cache and bail
-				im.cache.addBlock(ents)
-				return false, nil //we need a transition
+	sendLoop:
+		for {
+			select {
+			case im.bChan <- ents:
+				break sendLoop
+			case _, ok := <-im.cacheSignal:
+				//push things back into the cache if we have zero connections or
+				// the cacheSignal channel closed
+				if !ok || atomic.LoadInt32(&im.connHot) == 0 {
+					//push the block items back into the cache and bail
+					im.cache.addBlock(ents)
+					return false, nil //we need a transition
+				}
+				//a connection came up or a flush was requested while we
+				//are already unloading, keep trying to send the block
 			}
 		}
 	}
@@ -59,6 +59,86 @@ func TestNewMuxerCacheStart(t *testing.T) {
 	clean(t)
 }
 
+func TestMuxerCacheStats(t *testing.T) {
+	im, err := NewUniformMuxer(testCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := im.FlushCache(); err != ErrNotRunning {
+		t.Fatalf("flushed a muxer which is not running: %v", err)
+	}
+	if err := im.Start(); err != nil {
+		t.Fatal(err)
+	}
+	//the destinations are unreachable so everything goes to the cache
+	if cs, ok := im.CacheStats(); !ok || !cs.Active {
+		t.Fatalf("bad cache stats %+v %v", cs, ok)
+	}
+	if err := im.FlushCache(); err != ErrAllConnsDown {
+		t.Fatalf("flushed the cache without hot connections: %v", err)
+	}
+	if err := im.Close(); err != nil {
+		t.Fatal(err)
+	}
+	clean(t)
+
+	cfg := testCfg
+	cfg.EnableCache = false
+	if im, err = NewUniformMuxer(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := im.CacheStats(); ok {
+		t.Fatal("stats for a muxer without a cache")
+	}
+}
+
+func TestMuxerFlushDuringUnload(t *testing.T) {
+	ic, err := NewIngestCache(defConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ents []*entry.Entry
+	for i := 0; i < 16; i++ {
+		ents = append(ents, makeEntryWithKey(entry.Now().Sec))
+	}
+	ic.addBlock(ents)
+	im := &IngestMuxer{
+		cache:        ic,
+		cacheEnabled: true,
+		cacheRunning: true,
+		cacheSignal:  make(chan bool),
+		bChan:        make(chan []*entry.Entry),
+		connHot:      1,
+	}
+	type result struct {
+		emptied bool
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		emptied, err := im.unloadCache()
+		done <- result{emptied, err}
+	}()
+
+	//a flush while the unload is blocked sending must not lose the block
+	im.cacheSignal <- false
+	var got int
+	select {
+	case blk := <-im.bChan:
+		got = len(blk)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the block was dropped by the flush")
+	}
+	r := <-done
+	if r.err != nil || !r.emptied || got != len(ents) {
+		t.Fatalf("unloaded %d of %d entries: %v %v", got, len(ents), r.emptied, r.err)
+	}
+	if err := ic.Close(); err != nil {
+		t.Fatal(err)
+	}
+	clean(t)
+}
+
 func TestNewMuxerCacheStartAndWait(t *testing.T) {
 	im, err := NewUniformMuxer(testCfg)
 	if err != nil {
@@ -231,3 +311,28 @@ func TestNewMuxerCacheMultiFeed(t *testing.T) {
 func TestMuxerClean(t *testing.T) {
 	clean(t)
 }
+
+func TestTagTransNegotiated(t *testing.T) {
+	// the connection negotiated testA and testB as remote tags 7 and 9
+	tt := tagTrans{7, 9}
+	// an entry carrying a tag negotiated after the connection came up, e.g.
+	// one a preprocessor routed it to, can't be translated until the tag is
+	// registered with the connection
+	if _, ok := tt.Translate(2); ok {
+		t.Fatal("translated an unregistered tag")
+	}
+	if err := tt.RegisterTag(3, 11); err == nil {
+		t.Fatal("registered a tag out of order")
+	}
+	if err := tt.RegisterTag(2, 11); err != nil {
+		t.Fatal(err)
+	}
+	for local, remote := range map[entry.EntryTag]entry.EntryTag{0: 7, 1: 9, 2: 11, entry.GravwellTagId: entry.GravwellTagId} {
+		if tg, ok := tt.Translate(local); !ok || tg != remote {
+			t.Fatalf("tag %d translated to %d %v, expected %d", local, tg, ok, remote)
+		}
+		if remote != entry.GravwellTagId && tt.Reverse(remote) != local {
+			t.Fatalf("remote tag %d did not reverse to %d", remote, local)
+		}
+	}
+}
@@ -36,6 +36,17 @@ var (
 	ErrInvalidEntry     = errors.New("ErrInvalidEntry")
 )
 
+// BatchError is returned by ProcessBatch when an entry fails to process, the
+// entries before Index were handed to the writer.
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (be *BatchError) Error() string {
+	return fmt.Sprintf("entry %d: %v", be.Index, be.Err)
+}
+
 type ProcessorSet struct {
 	sync.Mutex
 	wtr entWriter
@@ -77,6 +88,12 @@ type entWriter interface {
 	WriteEntryContext(context.Context, *entry.Entry) error
 }
 
+// batchWriter is optionally implemented by writers that can accept many
+// entries at once, such as the ingest muxer.
+type batchWriter interface {
+	WriteBatch([]*entry.Entry) error
+}
+
 type preprocessorBase struct {
 	Type string
 }
@@ -234,6 +251,35 @@ func (pr *ProcessorSet) ProcessContext(ent *entry.Entry, ctx context.Context) er
 	return pr.processItemContext(ent, 0, ctx)
 }
 
+// ProcessBatch hands a batch of entries to the processor set. If the set has no
+// processors and the underlying writer accepts batches, the entries are written
+// in a single call; otherwise each entry is processed in turn. An error means
+// some of the entries in the batch may not have been written; if the failing
+// entry is known the error is a *BatchError.
+func (pr *ProcessorSet) ProcessBatch(ents []*entry.Entry) error {
+	pr.Lock()
+	defer pr.Unlock()
+	if pr == nil || pr.wtr == nil {
+		return ErrNotReady
+	}
+	for _, ent := range ents {
+		if ent == nil {
+			return ErrInvalidEntry
+		}
+	}
+	if len(pr.set) == 0 {
+		if bw, ok := pr.wtr.(batchWriter); ok {
+			return bw.WriteBatch(ents)
+		}
+	}
+	for i, ent := range ents {
+		if err := pr.processItem(ent, 0); err != nil {
+			return &BatchError{Index: i, Err: err}
+		}
+	}
+	return nil
+}
+
 // processItem recurses into each processor generating entries and writing them out
 func (pr *ProcessorSet) processItem(ent *entry.Entry, i int) error {
 	if i >= len(pr.set) {
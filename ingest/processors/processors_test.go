@@ -13,6 +13,7 @@ import (
 	"compress/gzip"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"sync"
@@ -200,6 +201,72 @@ func TestEmptyProcessorSet(t *testing.T) {
 	return
 }
 
+func TestProcessBatch(t *testing.T) {
+	var ents []*entry.Entry
+	for i := 0; i < 8; i++ {
+		ents = append(ents, &entry.Entry{
+			TS:   entry.Now(),
+			SRC:  net.ParseIP("192.168.1.1"),
+			Tag:  0,
+			Data: []byte(fmt.Sprintf("Hello %d", i)),
+		})
+	}
+
+	//writer without batch support
+	var tw testWriter
+	ps := NewProcessorSet(&tw)
+	if err := ps.ProcessBatch(ents); err != nil {
+		t.Fatal(err)
+	}
+	if len(tw.ents) != len(ents) {
+		t.Fatal("process failure")
+	}
+	for i := range ents {
+		if !entryEqual(tw.ents[i], ents[i]) {
+			t.Fatal("resulting ent is bad")
+		}
+	}
+
+	//writer with batch support should see a single batch
+	var tbw testBatchWriter
+	ps = NewProcessorSet(&tbw)
+	if err := ps.ProcessBatch(ents); err != nil {
+		t.Fatal(err)
+	}
+	if tbw.batches != 1 || len(tbw.ents) != len(ents) {
+		t.Fatalf("batch write failure: %d batches %d entries", tbw.batches, len(tbw.ents))
+	}
+
+	//bad entries are rejected
+	if err := ps.ProcessBatch([]*entry.Entry{nil}); err != ErrInvalidEntry {
+		t.Fatal("Failed to catch nil entry")
+	}
+
+	//processing failures report the failing entry
+	bwtr := bytes.NewBuffer(nil)
+	gzw := gzip.NewWriter(bwtr)
+	gzw.Write([]byte("Hello"))
+	gzw.Close()
+	gzp, err := NewGzipDecompressor(GzipDecompressorConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw = testWriter{}
+	ps = NewProcessorSet(&tw)
+	ps.AddProcessor(gzp)
+	err = ps.ProcessBatch([]*entry.Entry{
+		&entry.Entry{Data: bwtr.Bytes()},
+		&entry.Entry{Data: []byte("not gzipped")},
+		&entry.Entry{Data: bwtr.Bytes()},
+	})
+	if be, ok := err.(*BatchError); !ok || be.Index != 1 || be.Err != ErrNotGzipped {
+		t.Fatalf("bad batch error: %v", err)
+	}
+	if len(tw.ents) != 1 {
+		t.Fatalf("wrote %d entries before the failure", len(tw.ents))
+	}
+}
+
 func TestSingleProcessorSet(t *testing.T) {
 	var err error
 	data := []byte("Hello")
@@ -349,6 +416,17 @@ func (tw *testWriter) WriteEntryContext(ctx context.Context, ent *entry.Entry) e
 	return tw.WriteEntry(ent)
 }
 
+type testBatchWriter struct {
+	testWriter
+	batches int
+}
+
+func (tbw *testBatchWriter) WriteBatch(ents []*entry.Entry) error {
+	tbw.batches++
+	tbw.ents = append(tbw.ents, ents...)
+	return nil
+}
+
 func entryEqual(a, b *entry.Entry) bool {
 	if a == nil {
 		return b == nil
@@ -0,0 +1,689 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	avroMaxDepth        = 256 // nesting of decoded values, guards against schemas which recurse without end
+	avroSyncSize        = 16
+	avroSchemaCacheSize = 16 // OCF schemas kept parsed, the cache is emptied when it fills
+	avroFetchTimeout    = 30 * time.Second
+
+	avroCodecNull    = `null`
+	avroCodecDeflate = `deflate`
+	avroCodecSnappy  = `snappy`
+	avroCodecZstd    = `zstandard`
+
+	// the empty value of the CRC-64-AVRO fingerprint of single-object encoding
+	avroFingerprintEmpty uint64 = 0xc15d213aa4d7a795
+)
+
+var (
+	avroOCFMagic          = []byte("Obj\x01")
+	avroSingleObjectMagic = []byte{0xc3, 0x01}
+
+	avroPrimitives = map[string]bool{
+		`null`: true, `boolean`: true, `int`: true, `long`: true,
+		`float`: true, `double`: true, `bytes`: true, `string`: true,
+	}
+	avroFingerprintTable = func() (t [256]uint64) {
+		for i := range t {
+			fp := uint64(i)
+			for j := 0; j < 8; j++ {
+				fp = (fp >> 1) ^ (avroFingerprintEmpty & -(fp & 1))
+			}
+			t[i] = fp
+		}
+		return
+	}()
+
+	ErrAvroTruncated = errors.New("Avro data ends early")
+	ErrAvroNoSchema  = errors.New("Avro record is not an Object Container File and the stream has no Avro-Schema")
+)
+
+// avroSchema is a parsed Avro schema. Named types referenced more than once,
+// including from within themselves, share a single avroSchema.
+type avroSchema struct {
+	kind     string // a primitive type name, record, enum, array, map, fixed, or union
+	name     string // full name of records, enums, and fixed
+	fields   []avroField
+	symbols  []string
+	items    *avroSchema // array items or map values
+	size     int
+	branches []*avroSchema
+}
+
+type avroField struct {
+	name   string
+	schema *avroSchema
+}
+
+// parseAvroSchema parses the JSON form of an Avro schema.
+func parseAvroSchema(js []byte) (*avroSchema, error) {
+	var v interface{}
+	if err := json.Unmarshal(js, &v); err != nil {
+		return nil, fmt.Errorf("invalid Avro schema: %v", err)
+	}
+	p := avroParser{named: make(map[string]*avroSchema)}
+	s, err := p.parse(v, ``)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Avro schema: %v", err)
+	}
+	return s, nil
+}
+
+type avroParser struct {
+	named map[string]*avroSchema
+}
+
+func (p *avroParser) parse(v interface{}, ns string) (*avroSchema, error) {
+	switch t := v.(type) {
+	case string:
+		if avroPrimitives[t] {
+			return &avroSchema{kind: t}, nil
+		}
+		if !strings.Contains(t, `.`) && ns != `` {
+			if s, ok := p.named[ns+`.`+t]; ok {
+				return s, nil
+			}
+		}
+		if s, ok := p.named[t]; ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("unknown type %q", t)
+	case []interface{}:
+		s := &avroSchema{kind: `union`}
+		for _, b := range t {
+			bs, err := p.parse(b, ns)
+			if err != nil {
+				return nil, err
+			} else if bs.kind == `union` {
+				return nil, errors.New("unions may not contain unions")
+			}
+			s.branches = append(s.branches, bs)
+		}
+		return s, nil
+	case map[string]interface{}:
+		return p.parseComplex(t, ns)
+	}
+	return nil, fmt.Errorf("unexpected %T in schema", v)
+}
+
+func (p *avroParser) parseComplex(m map[string]interface{}, ns string) (*avroSchema, error) {
+	typ, ok := m[`type`].(string)
+	if !ok {
+		// e.g. {"type": {"type": "array", ...}}
+		return p.parse(m[`type`], ns)
+	}
+	switch typ {
+	case `record`, `error`, `enum`, `fixed`:
+	case `array`:
+		items, err := p.parse(m[`items`], ns)
+		if err != nil {
+			return nil, err
+		}
+		return &avroSchema{kind: `array`, items: items}, nil
+	case `map`:
+		values, err := p.parse(m[`values`], ns)
+		if err != nil {
+			return nil, err
+		}
+		return &avroSchema{kind: `map`, items: values}, nil
+	default:
+		// primitives, possibly with a logical type which is decoded as
+		// its underlying type
+		return p.parse(typ, ns)
+	}
+
+	name, _ := m[`name`].(string)
+	if name == `` {
+		return nil, fmt.Errorf("%s without a name", typ)
+	}
+	if n, ok := m[`namespace`].(string); ok {
+		ns = n
+	}
+	if i := strings.LastIndex(name, `.`); i >= 0 {
+		ns = name[:i]
+	} else if ns != `` {
+		name = ns + `.` + name
+	}
+	if _, ok := p.named[name]; ok {
+		return nil, fmt.Errorf("%s is defined twice", name)
+	}
+	s := &avroSchema{kind: typ, name: name}
+	if typ == `error` {
+		s.kind = `record`
+	}
+	// registered before the fields so that they may refer to it
+	p.named[name] = s
+
+	switch s.kind {
+	case `record`:
+		fields, ok := m[`fields`].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("record %s without fields", name)
+		}
+		for _, f := range fields {
+			fm, ok := f.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("invalid field in record %s", name)
+			}
+			fname, _ := fm[`name`].(string)
+			if fname == `` {
+				return nil, fmt.Errorf("field without a name in record %s", name)
+			}
+			fs, err := p.parse(fm[`type`], ns)
+			if err != nil {
+				return nil, fmt.Errorf("field %s of record %s: %v", fname, name, err)
+			}
+			s.fields = append(s.fields, avroField{name: fname, schema: fs})
+		}
+	case `enum`:
+		syms, ok := m[`symbols`].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("enum %s without symbols", name)
+		}
+		for _, sym := range syms {
+			str, ok := sym.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid symbol in enum %s", name)
+			}
+			s.symbols = append(s.symbols, str)
+		}
+	case `fixed`:
+		size, ok := m[`size`].(float64)
+		if !ok || size < 0 || size != math.Trunc(size) {
+			return nil, fmt.Errorf("fixed %s without a valid size", name)
+		}
+		s.size = int(size)
+	}
+	return s, nil
+}
+
+// canonical returns the Parsing Canonical Form of the schema, which
+// single-object encoding fingerprints.
+func (s *avroSchema) canonical() string {
+	var b strings.Builder
+	s.writeCanonical(&b, make(map[string]bool))
+	return b.String()
+}
+
+func (s *avroSchema) writeCanonical(b *strings.Builder, seen map[string]bool) {
+	if s.name != `` {
+		if seen[s.name] {
+			b.WriteString(strconv.Quote(s.name))
+			return
+		}
+		seen[s.name] = true
+	}
+	switch s.kind {
+	case `record`:
+		fmt.Fprintf(b, `{"name":%q,"type":"record","fields":[`, s.name)
+		for i, f := range s.fields {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, `{"name":%q,"type":`, f.name)
+			f.schema.writeCanonical(b, seen)
+			b.WriteByte('}')
+		}
+		b.WriteString(`]}`)
+	case `enum`:
+		fmt.Fprintf(b, `{"name":%q,"type":"enum","symbols":[`, s.name)
+		for i, sym := range s.symbols {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(strconv.Quote(sym))
+		}
+		b.WriteString(`]}`)
+	case `fixed`:
+		fmt.Fprintf(b, `{"name":%q,"type":"fixed","size":%d}`, s.name, s.size)
+	case `array`:
+		b.WriteString(`{"type":"array","items":`)
+		s.items.writeCanonical(b, seen)
+		b.WriteByte('}')
+	case `map`:
+		b.WriteString(`{"type":"map","values":`)
+		s.items.writeCanonical(b, seen)
+		b.WriteByte('}')
+	case `union`:
+		b.WriteByte('[')
+		for i, br := range s.branches {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			br.writeCanonical(b, seen)
+		}
+		b.WriteByte(']')
+	default:
+		b.WriteString(strconv.Quote(s.kind))
+	}
+}
+
+// avroFingerprint returns the CRC-64-AVRO fingerprint of a canonical schema.
+func avroFingerprint(canonical string) uint64 {
+	fp := avroFingerprintEmpty
+	for i := 0; i < len(canonical); i++ {
+		fp = (fp >> 8) ^ avroFingerprintTable[byte(fp)^canonical[i]]
+	}
+	return fp
+}
+
+// avroReader reads the binary encoding of Avro values.
+type avroReader struct {
+	b []byte
+}
+
+func (r *avroReader) long() (int64, error) {
+	var u uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		if len(r.b) == 0 {
+			return 0, ErrAvroTruncated
+		}
+		c := r.b[0]
+		r.b = r.b[1:]
+		u |= uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			// zig-zag encoded
+			return int64(u>>1) ^ -int64(u&1), nil
+		}
+	}
+	return 0, errors.New("Avro varint is too long")
+}
+
+func (r *avroReader) fixed(n int64) ([]byte, error) {
+	if n < 0 || n > int64(len(r.b)) {
+		return nil, ErrAvroTruncated
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b, nil
+}
+
+// bytes reads a length prefixed byte string.
+func (r *avroReader) bytes() ([]byte, error) {
+	n, err := r.long()
+	if err != nil {
+		return nil, err
+	}
+	return r.fixed(n)
+}
+
+// blockCount reads the item count of the next block of an array or map, zero
+// at the end of the blocks.
+func (r *avroReader) blockCount() (int64, error) {
+	n, err := r.long()
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		// followed by the size of the block in bytes
+		if _, err = r.long(); err != nil {
+			return 0, err
+		}
+		n = -n
+	}
+	if n > int64(len(r.b)) {
+		// every item but null takes at least a byte
+		return 0, fmt.Errorf("Avro block of %d items overruns the %d bytes left", n, len(r.b))
+	}
+	return n, nil
+}
+
+// decode writes the JSON form of the next value of schema s to buf. Unions
+// are written as the value of their branch, bytes and fixed as base64.
+func (r *avroReader) decode(s *avroSchema, buf *bytes.Buffer, depth int) error {
+	if depth > avroMaxDepth {
+		return errors.New("Avro value is nested too deeply")
+	}
+	switch s.kind {
+	case `null`:
+		buf.WriteString(`null`)
+	case `boolean`:
+		b, err := r.fixed(1)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(strconv.FormatBool(b[0] != 0))
+	case `int`, `long`:
+		v, err := r.long()
+		if err != nil {
+			return err
+		}
+		buf.WriteString(strconv.FormatInt(v, 10))
+	case `float`:
+		b, err := r.fixed(4)
+		if err != nil {
+			return err
+		}
+		writeJSONFloat(buf, float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), 32)
+	case `double`:
+		b, err := r.fixed(8)
+		if err != nil {
+			return err
+		}
+		writeJSONFloat(buf, math.Float64frombits(binary.LittleEndian.Uint64(b)), 64)
+	case `bytes`:
+		b, err := r.bytes()
+		if err != nil {
+			return err
+		}
+		writeJSON(buf, b)
+	case `string`:
+		b, err := r.bytes()
+		if err != nil {
+			return err
+		}
+		writeJSON(buf, string(b))
+	case `fixed`:
+		b, err := r.fixed(int64(s.size))
+		if err != nil {
+			return err
+		}
+		writeJSON(buf, b)
+	case `enum`:
+		i, err := r.long()
+		if err != nil {
+			return err
+		} else if i < 0 || i >= int64(len(s.symbols)) {
+			return fmt.Errorf("Avro enum %s has no symbol %d", s.name, i)
+		}
+		writeJSON(buf, s.symbols[i])
+	case `union`:
+		i, err := r.long()
+		if err != nil {
+			return err
+		} else if i < 0 || i >= int64(len(s.branches)) {
+			return fmt.Errorf("Avro union has no branch %d", i)
+		}
+		return r.decode(s.branches[i], buf, depth+1)
+	case `record`:
+		buf.WriteByte('{')
+		for i, f := range s.fields {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSON(buf, f.name)
+			buf.WriteByte(':')
+			if err := r.decode(f.schema, buf, depth+1); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case `array`, `map`:
+		start, end := byte('['), byte(']')
+		if s.kind == `map` {
+			start, end = '{', '}'
+		}
+		buf.WriteByte(start)
+		first := true
+		for {
+			n, err := r.blockCount()
+			if err != nil {
+				return err
+			} else if n == 0 {
+				break
+			}
+			for ; n > 0; n-- {
+				if !first {
+					buf.WriteByte(',')
+				}
+				first = false
+				if s.kind == `map` {
+					k, err := r.bytes()
+					if err != nil {
+						return err
+					}
+					writeJSON(buf, string(k))
+					buf.WriteByte(':')
+				}
+				if err := r.decode(s.items, buf, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+		buf.WriteByte(end)
+	default:
+		return fmt.Errorf("unknown Avro type %s", s.kind)
+	}
+	return nil
+}
+
+// writeJSON writes the JSON encoding of a string or byte slice, which can't
+// fail.
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, _ := json.Marshal(v)
+	buf.Write(b)
+}
+
+// writeJSONFloat writes a float, JSON has no NaN or infinities so they are
+// written as strings.
+func writeJSONFloat(buf *bytes.Buffer, f float64, bits int) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		writeJSON(buf, strconv.FormatFloat(f, 'g', -1, bits))
+		return
+	}
+	buf.WriteString(strconv.FormatFloat(f, 'g', -1, bits))
+}
+
+// avroDecoder converts Avro records to JSON entries. Object Container Files
+// carry their own schema, single-object encoded and bare binary records are
+// decoded with the stream's schema. It is safe for concurrent use.
+type avroDecoder struct {
+	schema      *avroSchema // nil if the stream has no Avro-Schema
+	fingerprint uint64
+
+	mtx   sync.Mutex
+	cache map[string]*avroSchema // schemas of Object Container Files
+	zstd  *zstd.Decoder
+}
+
+// newAvroDecoder returns a decoder using the writer schema js, which may be
+// empty if only Object Container Files are expected.
+func newAvroDecoder(js string) (*avroDecoder, error) {
+	d := &avroDecoder{cache: make(map[string]*avroSchema)}
+	if js != `` {
+		s, err := parseAvroSchema([]byte(js))
+		if err != nil {
+			return nil, err
+		}
+		d.schema = s
+		d.fingerprint = avroFingerprint(s.canonical())
+	}
+	return d, nil
+}
+
+// Decode returns the JSON form of every value in the record.
+func (d *avroDecoder) Decode(data []byte) ([][]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, avroOCFMagic):
+		return d.decodeOCF(data[len(avroOCFMagic):])
+	case d.schema == nil:
+		return nil, ErrAvroNoSchema
+	case bytes.HasPrefix(data, avroSingleObjectMagic) && len(data) >= 10:
+		if fp := binary.LittleEndian.Uint64(data[2:10]); fp != d.fingerprint {
+			return nil, fmt.Errorf("Avro single-object record has schema fingerprint %016x, the Avro-Schema's is %016x", fp, d.fingerprint)
+		}
+		data = data[10:]
+	}
+	v, err := decodeAvroValue(d.schema, data)
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{v}, nil
+}
+
+// decodeAvroValue decodes data holding exactly one value of schema s.
+func decodeAvroValue(s *avroSchema, data []byte) ([]byte, error) {
+	r := &avroReader{b: data}
+	var buf bytes.Buffer
+	if err := r.decode(s, &buf, 0); err != nil {
+		return nil, err
+	} else if len(r.b) > 0 {
+		return nil, fmt.Errorf("%d bytes left over after the Avro value", len(r.b))
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *avroDecoder) decodeOCF(data []byte) (vals [][]byte, err error) {
+	r := &avroReader{b: data}
+	meta := make(map[string][]byte)
+	for {
+		var n int64
+		if n, err = r.blockCount(); err != nil {
+			return
+		} else if n == 0 {
+			break
+		}
+		for ; n > 0; n-- {
+			var k, v []byte
+			if k, err = r.bytes(); err != nil {
+				return
+			} else if v, err = r.bytes(); err != nil {
+				return
+			}
+			meta[string(k)] = v
+		}
+	}
+	schema, err := d.ocfSchema(meta[`avro.schema`])
+	if err != nil {
+		return nil, err
+	}
+	codec := string(meta[`avro.codec`])
+	marker, err := r.fixed(avroSyncSize)
+	if err != nil {
+		return nil, err
+	}
+	for len(r.b) > 0 {
+		var count, size int64
+		var block, m []byte
+		if count, err = r.long(); err != nil {
+			return
+		} else if size, err = r.long(); err != nil {
+			return
+		} else if block, err = r.fixed(size); err != nil {
+			return
+		} else if m, err = r.fixed(avroSyncSize); err != nil {
+			return
+		} else if !bytes.Equal(m, marker) {
+			return nil, errors.New("Avro Object Container File block has a bad sync marker")
+		}
+		if block, err = d.inflate(codec, block); err != nil {
+			return
+		}
+		br := &avroReader{b: block}
+		for ; count > 0; count-- {
+			var buf bytes.Buffer
+			if err = br.decode(schema, &buf, 0); err != nil {
+				return
+			}
+			vals = append(vals, buf.Bytes())
+		}
+	}
+	return
+}
+
+// ocfSchema returns the parsed schema of an Object Container File.
+func (d *avroDecoder) ocfSchema(js []byte) (*avroSchema, error) {
+	if len(js) == 0 {
+		return nil, errors.New("Avro Object Container File has no schema")
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if s, ok := d.cache[string(js)]; ok {
+		return s, nil
+	}
+	s, err := parseAvroSchema(js)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.cache) >= avroSchemaCacheSize {
+		d.cache = make(map[string]*avroSchema)
+	}
+	d.cache[string(js)] = s
+	return s, nil
+}
+
+// inflate decompresses a block of an Object Container File.
+func (d *avroDecoder) inflate(codec string, block []byte) ([]byte, error) {
+	switch codec {
+	case ``, avroCodecNull:
+		return block, nil
+	case avroCodecDeflate:
+		return ioutil.ReadAll(flate.NewReader(bytes.NewReader(block)))
+	case avroCodecSnappy:
+		// followed by the CRC32 of the uncompressed data
+		if len(block) < 4 {
+			return nil, ErrAvroTruncated
+		}
+		b, err := snappy.Decode(nil, block[:len(block)-4])
+		if err != nil {
+			return nil, err
+		} else if crc32.ChecksumIEEE(b) != binary.BigEndian.Uint32(block[len(block)-4:]) {
+			return nil, errors.New("Avro snappy block has a bad checksum")
+		}
+		return b, nil
+	case avroCodecZstd:
+		d.mtx.Lock()
+		defer d.mtx.Unlock()
+		if d.zstd == nil {
+			var err error
+			if d.zstd, err = zstd.NewReader(nil); err != nil {
+				return nil, err
+			}
+		}
+		return d.zstd.DecodeAll(block, nil)
+	}
+	return nil, fmt.Errorf("unsupported Avro codec %q", codec)
+}
+
+// fetchAvroSchema reads a schema from a schema registry URL. Responses which
+// wrap the schema in a JSON object, such as those of the Confluent schema
+// registry, are unwrapped.
+func fetchAvroSchema(url string) (string, error) {
+	cli := http.Client{Timeout: avroFetchTimeout}
+	resp, err := cli.Get(url)
+	if err != nil {
+		return ``, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ``, err
+	} else if resp.StatusCode != http.StatusOK {
+		return ``, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	var wrapped struct {
+		Schema string `json:"schema"`
+	}
+	if json.Unmarshal(body, &wrapped) == nil && wrapped.Schema != `` {
+		return wrapped.Schema, nil
+	}
+	return string(body), nil
+}
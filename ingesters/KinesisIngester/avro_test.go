@@ -0,0 +1,208 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+const testAvroSchema = `{
+	"type": "record", "name": "Event", "namespace": "com.example",
+	"fields": [
+		{"name": "msg", "type": "string"},
+		{"name": "count", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "tags", "type": {"type": "array", "items": "string"}},
+		{"name": "level", "type": {"type": "enum", "name": "Level", "symbols": ["INFO", "WARN"]}},
+		{"name": "extra", "type": ["null", {"type": "map", "values": "double"}]},
+		{"name": "next", "type": ["null", "Event"]}
+	]
+}`
+
+// avroLong appends the zig-zag varint encoding of v.
+func avroLong(b []byte, v int64) []byte {
+	u := uint64((v << 1) ^ (v >> 63))
+	for u >= 0x80 {
+		b = append(b, byte(u)|0x80)
+		u >>= 7
+	}
+	return append(b, byte(u))
+}
+
+func avroString(b []byte, s string) []byte {
+	return append(avroLong(b, int64(len(s))), s...)
+}
+
+// testAvroEvent encodes an Event, nested once through its next field.
+func testAvroEvent() (b []byte) {
+	b = avroString(b, `hello "world"`)
+	b = avroLong(b, -3)
+	b = avroLong(b, 2)
+	b = avroString(b, `a`)
+	b = avroString(b, `b`)
+	b = avroLong(b, 0)
+	b = avroLong(b, 1) // WARN
+	b = avroLong(b, 1) // the map branch
+	b = avroLong(b, -1)
+	b = avroLong(b, 9) // block size in bytes
+	b = avroString(b, `pi`)
+	var f [8]byte
+	binary.LittleEndian.PutUint64(f[:], 0x400921f9f01b866e) // 3.14159
+	b = append(b, f[:]...)
+	b = avroLong(b, 0)
+	b = avroLong(b, 1) // the Event branch
+	b = avroString(b, `inner`)
+	b = avroLong(b, 7)
+	b = avroLong(b, 0)
+	b = avroLong(b, 0) // INFO
+	b = avroLong(b, 0) // null
+	return avroLong(b, 0)
+}
+
+const testAvroEventJSON = `{"msg":"hello \"world\"","count":-3,"tags":["a","b"],"level":"WARN","extra":{"pi":3.14159},` +
+	`"next":{"msg":"inner","count":7,"tags":[],"level":"INFO","extra":null,"next":null}}`
+
+func TestAvroFingerprint(t *testing.T) {
+	// from the Avro specification's test suite
+	if fp := avroFingerprint(`"null"`); fp != 7195948357588979594 {
+		t.Fatalf("bad fingerprint of null: %d", fp)
+	}
+	s, err := parseAvroSchema([]byte(testAvroSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"name":"com.example.Event","type":"record","fields":[{"name":"msg","type":"string"},{"name":"count","type":"long"},` +
+		`{"name":"tags","type":{"type":"array","items":"string"}},{"name":"level","type":{"name":"com.example.Level","type":"enum","symbols":["INFO","WARN"]}},` +
+		`{"name":"extra","type":["null",{"type":"map","values":"double"}]},{"name":"next","type":["null","com.example.Event"]}]}`
+	if c := s.canonical(); c != want {
+		t.Fatalf("bad canonical form:\n%s\nexpected\n%s", c, want)
+	}
+}
+
+func TestAvroDecode(t *testing.T) {
+	d, err := newAvroDecoder(testAvroSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := testAvroEvent()
+
+	// bare binary
+	vals, err := d.Decode(event)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(vals) != 1 || string(vals[0]) != testAvroEventJSON {
+		t.Fatalf("bad decoded value %q", vals)
+	} else if !json.Valid(vals[0]) {
+		t.Fatalf("decoded value is not valid JSON: %s", vals[0])
+	}
+
+	// single-object encoding
+	so := append([]byte{0xc3, 0x01}, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(so[2:], d.fingerprint)
+	if vals, err = d.Decode(append(so, event...)); err != nil || string(vals[0]) != testAvroEventJSON {
+		t.Fatalf("bad single-object value %q: %v", vals, err)
+	}
+	so[2]++
+	if _, err = d.Decode(append(so, event...)); err == nil {
+		t.Fatal("decoded a single-object record with the wrong fingerprint")
+	}
+
+	// malformed data
+	if _, err = d.Decode(event[:len(event)-3]); err == nil {
+		t.Fatal("decoded a truncated record")
+	}
+	if _, err = d.Decode(append(event, 0)); err == nil {
+		t.Fatal("decoded a record with trailing bytes")
+	}
+	if _, err = d.Decode(avroLong(avroString(nil, `x`), 1<<40)); err == nil {
+		t.Fatal("decoded an array overrunning the record")
+	}
+}
+
+// testAvroOCF builds an Object Container File holding count events in each
+// block, deflated if the codec is deflate.
+func testAvroOCF(t *testing.T, codec string, blocks, count int) []byte {
+	sync := []byte(`0123456789abcdef`)
+	b := append([]byte(nil), avroOCFMagic...)
+	b = avroLong(b, 2)
+	b = avroString(b, `avro.schema`)
+	b = avroString(b, testAvroSchema)
+	b = avroString(b, `avro.codec`)
+	b = avroString(b, codec)
+	b = avroLong(b, 0)
+	b = append(b, sync...)
+	for i := 0; i < blocks; i++ {
+		var data []byte
+		for j := 0; j < count; j++ {
+			data = append(data, testAvroEvent()...)
+		}
+		if codec == avroCodecDeflate {
+			var buf bytes.Buffer
+			fw, _ := flate.NewWriter(&buf, flate.BestSpeed)
+			fw.Write(data)
+			if err := fw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			data = buf.Bytes()
+		}
+		b = avroLong(b, int64(count))
+		b = avroLong(b, int64(len(data)))
+		b = append(b, data...)
+		b = append(b, sync...)
+	}
+	return b
+}
+
+func TestAvroOCF(t *testing.T) {
+	// no schema is needed for container files
+	d, err := newAvroDecoder(``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, codec := range []string{avroCodecNull, avroCodecDeflate} {
+		vals, err := d.Decode(testAvroOCF(t, codec, 2, 3))
+		if err != nil {
+			t.Fatalf("%s: %v", codec, err)
+		} else if len(vals) != 6 {
+			t.Fatalf("%s: decoded %d values, expected 6", codec, len(vals))
+		}
+		for _, v := range vals {
+			if string(v) != testAvroEventJSON {
+				t.Fatalf("%s: bad value %s", codec, v)
+			}
+		}
+	}
+
+	ocf := testAvroOCF(t, avroCodecNull, 1, 1)
+	ocf[len(ocf)-1]++
+	if _, err = d.Decode(ocf); err == nil {
+		t.Fatal("decoded a block with a bad sync marker")
+	}
+	if _, err = d.Decode(testAvroEvent()); err != ErrAvroNoSchema {
+		t.Fatalf("decoded bare binary without a schema: %v", err)
+	}
+}
+
+func TestAvroSchemaErrors(t *testing.T) {
+	for _, js := range []string{
+		`not json`,
+		`"Unknown"`,
+		`{"type": "record", "fields": []}`,
+		`{"type": "record", "name": "A", "fields": [{"name": "a", "type": "B"}]}`,
+		`[["null"]]`,
+		`{"type": "fixed", "name": "F", "size": -1}`,
+	} {
+		if _, err := parseAvroSchema([]byte(js)); err == nil {
+			t.Fatalf("parsed invalid schema %s", js)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// checkpointer persists the position of each shard. Implementations which
+// coordinate multiple ingesters also hand out leases so that each shard is
+// only consumed by a single ingester at a time.
+type checkpointer interface {
+	Start()
+	Flush()
+	Close()
+
+	GetSequenceNum(stream, shard string) string
+	UpdateSequenceNum(stream, shard, seq string)
+	// Persisted returns the sequence number of a shard as of the last
+	// successful write to the store.
+	Persisted(stream, shard string) string
+	MarkShardClosed(stream, shard string)
+	ShardClosed(stream, shard string) bool
+
+	// Acquire attempts to take the lease on a shard, open is the number of
+	// shards in the stream which still need to be consumed.
+	Acquire(stream, shard string, open int) bool
+	// Owns returns false once the lease on a shard has been lost.
+	Owns(stream, shard string) bool
+	// Release gives up the lease on a shard, its position is persisted no
+	// later than Close.
+	Release(stream, shard string)
+}
+
+// stateStore persists the checkpoints of a stateman, a map of stream name to
+// shard ID to sequence number. A utils.State keeps them in a local file and a
+// tagStateStore also backs them up to Gravwell. Read returns utils.ErrNoState
+// if nothing has been stored yet.
+type stateStore interface {
+	Read(interface{}) error
+	Write(interface{}) error
+}
+
+// stateman is a checkpointer backed by a stateStore, usually a local state
+// file. It assumes it is the only consumer of the streams, so leases always
+// succeed.
+//
+// Shards checkpoint after every batch, so updates go to a slot of their own
+// and are only promoted into the shared states when they are flushed. The
+// state lock is not taken on the record path.
+type stateman struct {
+	sync.Mutex
+	states    map[string]map[string]string // map of stream name to shard name to sequence number
+	persisted map[string]map[string]string // states as of the last successful write
+	dirty     bool                         // states changed since the last successful write
+	pending   sync.Map                     // shardKey to *shardSeq, updates not yet promoted
+	store     stateStore
+	wmtx      sync.Mutex // serializes writes to the store, which happen outside the state lock
+	done      chan struct{}
+}
+
+type shardKey struct {
+	stream string
+	shard  string
+}
+
+// shardSeq is the latest sequence number of a shard, its lock is only shared
+// by the shard and the flush.
+type shardSeq struct {
+	sync.Mutex
+	key shardKey
+	seq string
+}
+
+func NewStateman(store stateStore) *stateman {
+	sm := stateman{
+		states:    make(map[string]map[string]string),
+		persisted: make(map[string]map[string]string),
+		store:     store,
+		done:      make(chan struct{}),
+	}
+	store.Read(&sm.states)
+	sm.persisted = copyStates(sm.states)
+	return &sm
+}
+
+func (s *stateman) Acquire(stream, shard string, open int) bool {
+	return true
+}
+
+func (s *stateman) Owns(stream, shard string) bool {
+	return true
+}
+
+// Release does nothing, there is no lease to give up and the position of the
+// shard is written by the next periodic flush or by Close, so that workers
+// exiting together share a single write.
+func (s *stateman) Release(stream, shard string) {
+}
+
+func (s *stateman) Start() {
+	go func() {
+		for {
+			select {
+			case <-time.After(15 * time.Second):
+				s.Flush()
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the periodic flush and writes out the final state. It should
+// only be called once every shard worker has exited.
+func (s *stateman) Close() {
+	close(s.done)
+	s.Flush()
+}
+
+// Flush writes the states out if they have changed since the last write. The
+// write is made from a copy of the states so that a slow store does not hold
+// up the shards.
+func (s *stateman) Flush() {
+	s.wmtx.Lock()
+	defer s.wmtx.Unlock()
+	s.Lock()
+	s.promote()
+	if !s.dirty {
+		s.Unlock()
+		return
+	}
+	snap := copyStates(s.states)
+	s.dirty = false
+	s.Unlock()
+
+	err := s.store.Write(snap)
+	s.Lock()
+	defer s.Unlock()
+	if err != nil {
+		lg.Error("Failed to write checkpoints: %v", err)
+		s.dirty = true
+		return
+	}
+	s.persisted = snap
+}
+
+func copyStates(states map[string]map[string]string) map[string]map[string]string {
+	cp := make(map[string]map[string]string, len(states))
+	for stream, shards := range states {
+		cp[stream] = make(map[string]string, len(shards))
+		for shard, seq := range shards {
+			cp[stream][shard] = seq
+		}
+	}
+	return cp
+}
+
+func (s *stateman) Persisted(stream, shard string) string {
+	s.Lock()
+	defer s.Unlock()
+	return s.persisted[stream][shard]
+}
+
+// UpdateSequenceNum records the position of a shard, it is written out on the
+// next flush.
+func (s *stateman) UpdateSequenceNum(stream, shard, seq string) {
+	k := shardKey{stream: stream, shard: shard}
+	v, ok := s.pending.Load(k)
+	if !ok {
+		v, _ = s.pending.LoadOrStore(k, &shardSeq{key: k})
+	}
+	ss := v.(*shardSeq)
+	ss.Lock()
+	ss.seq = seq
+	ss.Unlock()
+}
+
+// promote moves the pending shard positions into the states, the caller must
+// hold the lock.
+func (s *stateman) promote() {
+	s.pending.Range(func(_, v interface{}) bool {
+		ss := v.(*shardSeq)
+		ss.Lock()
+		seq := ss.seq
+		ss.Unlock()
+		if _, ok := s.states[ss.key.stream]; !ok {
+			// initialize the stream
+			s.states[ss.key.stream] = make(map[string]string)
+		}
+		if s.states[ss.key.stream][ss.key.shard] != seq {
+			s.states[ss.key.stream][ss.key.shard] = seq
+			s.dirty = true
+		}
+		return true
+	})
+}
+
+func (s *stateman) GetSequenceNum(stream, shard string) string {
+	// a pending update is always newer than the states
+	if v, ok := s.pending.Load(shardKey{stream: stream, shard: shard}); ok {
+		ss := v.(*shardSeq)
+		ss.Lock()
+		defer ss.Unlock()
+		return ss.seq
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	_, ok := s.states[stream]
+	if !ok {
+		// initialize the stream
+		s.states[stream] = make(map[string]string)
+	}
+	return s.states[stream][shard]
+}
+
+// MarkShardClosed records that a closed shard has been completely consumed.
+// The marker is persisted in place of the shard's sequence number so that on
+// restart the shard is not read again and its children may begin immediately.
+func (s *stateman) MarkShardClosed(stream, shard string) {
+	s.UpdateSequenceNum(stream, shard, shardClosedMarker)
+}
+
+// ShardClosed returns true if the shard has been marked as completely consumed.
+func (s *stateman) ShardClosed(stream, shard string) bool {
+	return s.GetSequenceNum(stream, shard) == shardClosedMarker
+}
@@ -0,0 +1,148 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+const (
+	cwMaxDatums     = 20   // PutMetricData limit on metrics per request
+	cwMaxPending    = 2000 // metrics kept while throttled, the oldest are dropped beyond this
+	cwFlushInterval = time.Second
+	cwStreamDim     = `StreamName`
+
+	cwBackoffBase = time.Second
+	cwBackoffMax  = 5 * time.Minute
+)
+
+// cwPublisher publishes stream metrics reports to CloudWatch. Reports from
+// every stream in a region are queued and sent in batches, and throttled
+// requests are retried with a backoff rather than blocking the reporters.
+type cwPublisher struct {
+	sync.Mutex
+	svc       cloudwatchiface.CloudWatchAPI
+	namespace string
+	pending   []*cloudwatch.MetricDatum
+	backoff   *awsutils.Backoff
+	retryAt   time.Time
+	warned    bool
+}
+
+func newCWPublisher(svc cloudwatchiface.CloudWatchAPI, namespace string) *cwPublisher {
+	return &cwPublisher{
+		svc:       svc,
+		namespace: namespace,
+		backoff:   awsutils.NewBackoff(cwBackoffBase, cwBackoffMax),
+	}
+}
+
+// Publish queues the lag and throughput of a report, a nil publisher does
+// nothing.
+func (p *cwPublisher) Publish(r metricsReport) {
+	if p == nil {
+		return
+	}
+	now := time.Now()
+	dims := []*cloudwatch.Dimension{{
+		Name:  aws.String(cwStreamDim),
+		Value: aws.String(r.Stream),
+	}}
+	datum := func(name, unit string, v float64) *cloudwatch.MetricDatum {
+		return &cloudwatch.MetricDatum{
+			MetricName: aws.String(name),
+			Dimensions: dims,
+			Timestamp:  aws.Time(now),
+			Unit:       aws.String(unit),
+			Value:      aws.Float64(v),
+		}
+	}
+	p.Lock()
+	p.pending = append(p.pending,
+		datum(`MaxMillisBehindLatest`, cloudwatch.StandardUnitMilliseconds, float64(r.MaxLag)),
+		datum(`AverageMillisBehindLatest`, cloudwatch.StandardUnitMilliseconds, float64(r.AverageLag)),
+		datum(`RecordsPerSecond`, cloudwatch.StandardUnitCountSecond, r.RecordsPerSecond),
+		datum(`BytesPerSecond`, cloudwatch.StandardUnitBytesSecond, r.BytesPerSecond),
+	)
+	if over := len(p.pending) - cwMaxPending; over > 0 {
+		p.pending = append(p.pending[:0], p.pending[over:]...)
+	}
+	p.Unlock()
+}
+
+// Flush sends the queued metrics, stopping early if CloudWatch throttles us.
+func (p *cwPublisher) Flush() {
+	p.Lock()
+	defer p.Unlock()
+	if time.Now().Before(p.retryAt) {
+		return
+	}
+	for len(p.pending) > 0 {
+		n := len(p.pending)
+		if n > cwMaxDatums {
+			n = cwMaxDatums
+		}
+		_, err := p.svc.PutMetricData(&cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(p.namespace),
+			MetricData: p.pending[:n],
+		})
+		if err != nil {
+			if awsErr, ok := err.(awserr.Error); ok && isThrottle(awsErr.Code()) {
+				// keep the metrics and try again later
+				p.retryAt = time.Now().Add(p.backoff.Next())
+				if !p.warned {
+					lg.Warn("CloudWatch is throttling metrics for namespace %s, backing off (request ID %s)", p.namespace, awsutils.RequestID(err))
+					p.warned = true
+				}
+				return
+			}
+			// anything else won't be fixed by retrying the same data
+			lg.Error("Failed to publish %d metrics to CloudWatch namespace %s: %s", n, p.namespace, awsutils.ErrorMessage(err))
+		} else if p.warned {
+			lg.Info("CloudWatch metrics for namespace %s recovered after backing off for %v", p.namespace, p.backoff.Elapsed().Round(time.Second))
+			p.warned = false
+		}
+		p.backoff.Reset()
+		p.pending = p.pending[n:]
+	}
+	p.pending = nil
+}
+
+func isThrottle(code string) bool {
+	switch code {
+	case `Throttling`, `ThrottlingException`, `RequestLimitExceeded`:
+		return true
+	}
+	return false
+}
+
+// run flushes the queued metrics periodically until ctx is cancelled, then
+// makes a final attempt to send whatever is left.
+func (p *cwPublisher) run(ctx context.Context) {
+	ticker := time.NewTicker(cwFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.Flush()
+		case <-ctx.Done():
+			p.Flush()
+			return
+		}
+	}
+}
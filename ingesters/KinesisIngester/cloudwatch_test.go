@@ -0,0 +1,74 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+type testCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	throttle bool
+	batches  []int
+}
+
+func (tc *testCloudWatch) PutMetricData(in *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
+	if tc.throttle {
+		return nil, awserr.New(`Throttling`, `Rate exceeded`, nil)
+	}
+	tc.batches = append(tc.batches, len(in.MetricData))
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func TestCWPublisher(t *testing.T) {
+	tc := &testCloudWatch{throttle: true}
+	p := newCWPublisher(tc, `Gravwell/Kinesis`)
+	for i := 0; i < 6; i++ {
+		p.Publish(metricsReport{Stream: `stream`, MaxLag: 1000, AverageLag: 500})
+	}
+	if len(p.pending) != 24 {
+		t.Fatalf("bad pending count: %d", len(p.pending))
+	}
+	d := p.pending[0]
+	if aws.StringValue(d.MetricName) != `MaxMillisBehindLatest` || aws.Float64Value(d.Value) != 1000 ||
+		aws.StringValue(d.Dimensions[0].Value) != `stream` {
+		t.Fatalf("bad datum: %v", d)
+	}
+
+	p.Flush()
+	if len(p.pending) != 24 || !p.warned {
+		t.Fatal("throttled metrics were not kept")
+	}
+
+	tc.throttle = false
+	p.retryAt = time.Time{}
+	p.Flush()
+	if len(p.pending) != 0 || p.warned {
+		t.Fatal("metrics not flushed after recovering")
+	}
+	if len(tc.batches) != 2 || tc.batches[0] != cwMaxDatums || tc.batches[1] != 4 {
+		t.Fatalf("bad batches: %v", tc.batches)
+	}
+
+	for i := 0; i < cwMaxPending; i++ {
+		p.Publish(metricsReport{Stream: `stream`})
+	}
+	if len(p.pending) != cwMaxPending {
+		t.Fatalf("pending metrics not bounded: %d", len(p.pending))
+	}
+
+	var np *cwPublisher
+	np.Publish(metricsReport{})
+}
@@ -11,17 +11,55 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest"
 	"github.com/gravwell/gravwell/v3/ingest/config"
 	"github.com/gravwell/gravwell/v3/ingest/processors"
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
+	"github.com/gravwell/gravwell/v3/timegrinder"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
 )
 
 const (
 	defaultStateStore = `/opt/gravwell/etc/kinesis_ingest.state`
 	defaultLogFile    = `/opt/gravwell/log/kinesis.log`
+
+	contentTypeRaw    = `raw`
+	contentTypeCWLogs = `cloudwatch-logs`
+	contentTypeAvro   = `avro`
+
+	consumerModePoll   = `poll`
+	consumerModeFanout = `fanout`
+
+	procErrorDrop        = `drop`
+	procErrorPassthrough = `passthrough`
+	procErrorFatal       = `fatal`
+
+	defaultReshardCheckInterval = time.Minute
+	defaultMetricsInterval      = time.Minute
+	defaultBackoffWarnThreshold = 5 * time.Minute
+	defaultWaitForActiveTimeout = 5 * time.Minute
+	defaultIteratorRetryLimit   = 30 * time.Minute
+	defaultListShardsAttempts   = 10
+
+	defaultRecordsPerRequest int64 = 5000
+	maxRecordsPerRequest     int64 = 10000
+
+	checkpointBackendFile   = `file`
+	checkpointBackendDynamo = `dynamodb`
+	defaultLeaseDuration    = 30 * time.Second
+	minLeaseDuration        = 3 * time.Second
+
+	backoffBase = 100 * time.Millisecond
+	backoffMax  = 30 * time.Second
+
+	panicRestartDelay = 5 * time.Second // wait before relaunching a shard worker which panicked
 )
 
 type bindType int
@@ -29,20 +67,98 @@ type readerType int
 
 type global struct {
 	config.IngestConfig
-	State_Store_Location  string
-	AWS_Access_Key_ID     string
-	AWS_Secret_Access_Key string
+	State_Store_Location   string
+	State_Store_Compress   bool // gzip the state file, existing files are read either way
+	AWS_Access_Key_ID      string
+	AWS_Secret_Access_Key  string
+	Role_ARN               string // IAM role to assume with STS
+	External_ID            string
+	Session_Name           string
+	Use_Instance_Role      bool   // use the EC2/ECS instance role rather than static keys
+	AWS_Profile            string // named profile from the shared credentials file
+	Credentials_File       string // shared credentials file, defaults to ~/.aws/credentials
+	Metrics_Interval       string // how often to report per-stream metrics, e.g. 60s
+	Metrics_Tag            string // if set, metrics reports are also ingested as JSON entries
+	Checkpoint_Backend     string // file (default) or dynamodb
+	Checkpoint_Backup_Tag  string // file checkpoints are also written to this tag as JSON entries
+	Checkpoint_Table       string // DynamoDB table holding shard leases and checkpoints
+	Checkpoint_Region      string // region of the DynamoDB table
+	Lease_Duration         string // how long a shard lease lasts without renewal, e.g. 30s
+	Prometheus_Listen      string // address to serve Prometheus metrics on, e.g. :9101
+	Health_Listen          string // address to serve /healthz and /readyz on, e.g. :9102
+	Health_Progress_Window string // not ready if no shard has been read for this long, e.g. 5m
+	Max_In_Flight_Bytes    int64  // pause reading shards while this many bytes await acknowledgement, 0 is unlimited
+	Pause_File             string // ingest is paused while this file exists, SIGTSTP and SIGCONT also pause and resume
+	Max_Concurrent_Shards  int    // shards of every stream read at once, 0 is unlimited
+	Instance_Index         int    // this ingester reads the shards whose ID hashes to this index
+	Instance_Count         int    // number of ingesters sharing every stream by shard hash, 0 reads every shard
+	CloudWatch_Namespace   string // if set, stream lag and throughput are published to CloudWatch
+	Endpoint_URL           string // default Kinesis endpoint, e.g. a VPC endpoint or LocalStack
+	Disable_SSL            bool   // default for talking plain HTTP to the Kinesis endpoint
+	Debug_Tee_File         string // copy raw records to this file or s3://bucket/prefix for debugging
+	Debug_Tee_Max_Size     int64  // rotate the tee file or upload an S3 object at this size
+	Debug_Tee_Region       string // region of an S3 tee bucket, detected if unset
+	Log_Bad_Payloads       bool   // log an excerpt of entries which fail preprocessing or timestamp extraction
+	Log_Bad_Payload_Size   int    // bytes of each bad payload to log, defaults to 256
+	Spool_Dir              string // spool entries here while no indexer takes them, replayed later
+	Spool_Max_Size         int64  // drop the oldest spooled entries beyond this size
+	Shutdown_Grace         string // how long shards get to finish their batch on shutdown, e.g. 10s
 }
 
 type streamDef struct {
-	Stream_Name           string
-	Tag_Name              string
-	Iterator_Type         string
-	Region                string
-	Assume_Local_Timezone bool
-	Timezone_Override     string
-	Parse_Time            bool
-	Preprocessor          []string
+	Stream_Name                 string
+	Tag_Name                    string
+	Iterator_Type               string
+	Iterator_Start_Time         string // RFC3339 start time for the AT_TIMESTAMP iterator type
+	Region                      string
+	Assume_Local_Timezone       bool
+	Timezone_Override           string
+	Timestamp_Format_Override   string // force the timestamp format, see timegrinder for the names
+	Timestamp_JSON_Path         string // take the timestamp of JSON records from this field, e.g. event.time
+	Max_Timestamp_Skew_Past     string // use the arrival time for timestamps further in the past than this, e.g. 720h
+	Max_Timestamp_Skew_Future   string // use the arrival time for timestamps further in the future than this, e.g. 24h
+	Left_Most_Seed              *bool  // use the left most timestamp in a record, defaults to true
+	Parse_Time                  bool
+	Timestamp_Failure_Threshold int      // stop parsing timestamps after this many consecutive failures, 0 never stops
+	Consumer_Mode               string   // poll (default) or fanout
+	Consumer_Name               string   // name of the enhanced fan-out consumer
+	Reshard_Check_Interval      string   // how often to look for new shards, e.g. 60s
+	Wait_For_Active_Timeout     string   // how long to wait on startup for a stream that is being created, e.g. 5m
+	Deaggregate                 bool     // unpack records aggregated by the Kinesis Producer Library
+	Backoff_Warn_Threshold      string   // warn when a shard has been retrying for this long, e.g. 5m
+	Iterator_Retry_Limit        string   // give up on a shard once GetShardIterator has failed this long, 0 retries forever
+	List_Shards_Max_Attempts    int      // consecutive ListShards failures before the ingester exits, defaults to 10
+	List_Shards_Max_Backoff     string   // longest wait between ListShards retries, defaults to 30s
+	Tag_Route                   []string // route records by partition key, <regex>:<tag>
+	Tag_Template                string   // build the tag of each entry from record metadata or a JSON field, Tag-Name is the fallback
+	Partition_Key_Include       []string // only ingest records whose partition key matches one of these
+	Partition_Key_Exclude       []string // skip records whose partition key matches any of these
+	Records_Per_Request         int64    // GetRecords limit, defaults to 5000
+	Max_Concurrent_Shards       int      // shards of the stream read at once, 0 is unlimited
+	Content_Type                string   // raw (default), cloudwatch-logs, or avro
+	Avro_Schema                 string   // JSON schema of single-object encoded or bare binary Avro records
+	Avro_Schema_URL             string   // fetch the Avro-Schema from a schema registry on startup
+	Schema_Registry             string   // glue decodes records written with the AWS Glue Schema Registry serializers
+	Schema_Registry_Region      string   // region of the Glue Schema Registry, defaults to the stream's Region
+	Decompression               string   // gzip, zstd, snappy, auto, or none (default)
+	Endpoint_URL                string   // override the Kinesis endpoint, defaults to the global Endpoint-URL
+	Disable_SSL                 *bool    // defaults to the global Disable-SSL
+	Shard_Source                bool     // set SRC to an address identifying the stream and shard
+	Max_Entry_Size              int64    // entries with more data than this are handled by Oversize-Action, 0 is unlimited
+	Oversize_Action             string   // drop (default) or truncate
+	Split_Lines                 bool     // make an entry of every line in a record, the same as newline Framing
+	Line_Delimiter              string   // separates lines for Split-Lines, defaults to a newline
+	Framing                     string   // none (default), newline, or length-prefix
+	Framing_Prefix_Width        int      // bytes in each length prefix, 1, 2, 4 (default), or 8
+	Framing_Byte_Order          string   // big (default) or little endian length prefixes
+	Unpack_JSON_Array           bool     // make an entry of every top level element of records holding a JSON array
+	Preserve_Order              bool     // never let entry timestamps go backwards within a shard
+	Sample_Rate                 *float64 // ingest this fraction of records, 0.0-1.0, defaults to 1
+	Hot_Shard_Factor            float64  // warn about shards reading more than this multiple of the stream average, 0 disables
+	Preprocessor                []string
+	Preprocessor_Error_Policy   string // drop (default), passthrough, or fatal
+
+	regionSource string // where Region came from, see resolveRegions
 }
 
 type cfgType struct {
@@ -52,6 +168,25 @@ type cfgType struct {
 }
 
 func GetConfig(path string) (*cfgType, error) {
+	c, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	// Verify and set UUID
+	if _, ok := c.Global.IngesterUUID(); !ok {
+		id := uuid.New()
+		if err := c.Global.SetIngesterUUID(id, path); err != nil {
+			return nil, err
+		}
+		if id2, ok := c.Global.IngesterUUID(); !ok || id != id2 {
+			return nil, errors.New("Failed to set a new ingester UUID")
+		}
+	}
+	return c, nil
+}
+
+// loadConfig reads and verifies a config file without modifying it.
+func loadConfig(path string) (*cfgType, error) {
 	var c cfgType
 	if err := config.LoadConfigFile(&c, path); err != nil {
 		return nil, err
@@ -63,25 +198,28 @@ func GetConfig(path string) (*cfgType, error) {
 	if c.Global.Log_File == `` {
 		c.Global.Log_File = defaultLogFile
 	}
-	if err := verifyConfig(c); err != nil {
+	if err := verifyConfig(&c); err != nil {
 		return nil, err
 	} else if err = c.Global.Verify(); err != nil {
 		return nil, err
+	} else if err = c.resolveRegions(); err != nil {
+		return nil, err
 	}
-	// Verify and set UUID
-	if _, ok := c.Global.IngesterUUID(); !ok {
-		id := uuid.New()
-		if err := c.Global.SetIngesterUUID(id, path); err != nil {
-			return nil, err
-		}
-		if id2, ok := c.Global.IngesterUUID(); !ok || id != id2 {
-			return nil, errors.New("Failed to set a new ingester UUID")
+	return &c, nil
+}
+
+// resolveRegions fills in the Region of streams which do not specify one,
+// detecting it from the EC2 instance metadata or the environment.
+func (c *cfgType) resolveRegions() (err error) {
+	for k, v := range c.KinesisStream {
+		if v.Region, v.regionSource, err = awsutils.ResolveRegion(v.Region); err != nil {
+			return fmt.Errorf("Kinesis stream %s: %v", k, err)
 		}
 	}
-	return &c, nil
+	return nil
 }
 
-func verifyConfig(c cfgType) error {
+func verifyConfig(c *cfgType) error {
 	if to, err := c.parseTimeout(); err != nil || to < 0 {
 		if err != nil {
 			return err
@@ -101,6 +239,78 @@ func verifyConfig(c cfgType) error {
 	if len(c.KinesisStream) == 0 {
 		return errors.New("At least one Kinesis stream required.")
 	}
+	if err := c.Global.credentials().Validate(); err != nil {
+		return err
+	}
+	if c.Global.Metrics_Interval != `` {
+		if d, err := time.ParseDuration(c.Global.Metrics_Interval); err != nil || d <= 0 {
+			return fmt.Errorf("Invalid Metrics-Interval %q", c.Global.Metrics_Interval)
+		}
+	}
+	if strings.ContainsAny(c.Global.Metrics_Tag, ingest.FORBIDDEN_TAG_SET) {
+		return errors.New("Invalid characters in the Metrics-Tag")
+	}
+	switch c.Global.Checkpoint_Backend = strings.ToLower(strings.TrimSpace(c.Global.Checkpoint_Backend)); c.Global.Checkpoint_Backend {
+	case ``:
+		c.Global.Checkpoint_Backend = checkpointBackendFile
+	case checkpointBackendFile:
+		if strings.ContainsAny(c.Global.Checkpoint_Backup_Tag, ingest.FORBIDDEN_TAG_SET) {
+			return errors.New("Invalid characters in the Checkpoint-Backup-Tag")
+		}
+	case checkpointBackendDynamo:
+		if c.Global.Checkpoint_Backup_Tag != `` {
+			return errors.New("Checkpoint-Backup-Tag is only supported with the file Checkpoint-Backend")
+		}
+		if c.Global.Checkpoint_Table == `` {
+			return errors.New("Checkpoint-Table is required with the dynamodb Checkpoint-Backend")
+		}
+		if c.Global.Checkpoint_Region == `` {
+			return errors.New("Checkpoint-Region is required with the dynamodb Checkpoint-Backend")
+		}
+	default:
+		return fmt.Errorf("Invalid Checkpoint-Backend %q", c.Global.Checkpoint_Backend)
+	}
+	if c.Global.Shutdown_Grace != `` {
+		if d, err := time.ParseDuration(c.Global.Shutdown_Grace); err != nil || d < 0 {
+			return fmt.Errorf("Invalid Shutdown-Grace %q", c.Global.Shutdown_Grace)
+		}
+	}
+	if c.Global.Health_Progress_Window != `` {
+		if d, err := time.ParseDuration(c.Global.Health_Progress_Window); err != nil || d <= 0 {
+			return fmt.Errorf("Invalid Health-Progress-Window %q", c.Global.Health_Progress_Window)
+		}
+	}
+	if strings.HasPrefix(c.Global.CloudWatch_Namespace, `AWS/`) {
+		return fmt.Errorf("Invalid CloudWatch-Namespace %q, the AWS/ prefix is reserved", c.Global.CloudWatch_Namespace)
+	}
+	if c.Global.Max_In_Flight_Bytes < 0 {
+		return fmt.Errorf("Invalid Max-In-Flight-Bytes %d", c.Global.Max_In_Flight_Bytes)
+	}
+	if c.Global.Instance_Count < 0 {
+		return fmt.Errorf("Invalid Instance-Count %d", c.Global.Instance_Count)
+	} else if c.Global.Instance_Index < 0 || (c.Global.Instance_Index > 0 && c.Global.Instance_Index >= c.Global.Instance_Count) {
+		return fmt.Errorf("Invalid Instance-Index %d, must be less than the Instance-Count of %d", c.Global.Instance_Index, c.Global.Instance_Count)
+	}
+	if c.Global.Max_Concurrent_Shards < 0 {
+		return fmt.Errorf("Invalid Max-Concurrent-Shards %d", c.Global.Max_Concurrent_Shards)
+	}
+	if _, _, _, err := awsutils.ParseS3URL(c.Global.Debug_Tee_File); err != nil {
+		return fmt.Errorf("Invalid Debug-Tee-File %q: %v", c.Global.Debug_Tee_File, err)
+	}
+	if c.Global.Debug_Tee_Max_Size < 0 {
+		return fmt.Errorf("Invalid Debug-Tee-Max-Size %d", c.Global.Debug_Tee_Max_Size)
+	}
+	if c.Global.Spool_Max_Size < 0 {
+		return fmt.Errorf("Invalid Spool-Max-Size %d", c.Global.Spool_Max_Size)
+	}
+	if c.Global.Log_Bad_Payload_Size < 0 {
+		return fmt.Errorf("Invalid Log-Bad-Payload-Size %d", c.Global.Log_Bad_Payload_Size)
+	}
+	if c.Global.Lease_Duration != `` {
+		if d, err := time.ParseDuration(c.Global.Lease_Duration); err != nil || d < minLeaseDuration {
+			return fmt.Errorf("Invalid Lease-Duration %q, must be at least %v", c.Global.Lease_Duration, minLeaseDuration)
+		}
+	}
 	if err := c.Preprocessor.Validate(); err != nil {
 		return err
 	}
@@ -111,14 +321,460 @@ func verifyConfig(c cfgType) error {
 		if err := c.Preprocessor.CheckProcessors(v.Preprocessor); err != nil {
 			return fmt.Errorf("Kinesis stream %s preprocessor invalid: %v", k, err)
 		}
-		if v.Iterator_Type == `` {
+		switch v.Iterator_Type = strings.ToUpper(strings.TrimSpace(v.Iterator_Type)); v.Iterator_Type {
+		case ``:
 			// default to LATEST
-			v.Iterator_Type = "LATEST"
+			v.Iterator_Type = kinesis.ShardIteratorTypeLatest
+		case kinesis.ShardIteratorTypeLatest:
+		case kinesis.ShardIteratorTypeTrimHorizon:
+		case kinesis.ShardIteratorTypeAtTimestamp:
+			if v.Iterator_Start_Time == `` {
+				return fmt.Errorf("Kinesis stream %s requires an Iterator-Start-Time with the %s Iterator-Type", k, v.Iterator_Type)
+			}
+		default:
+			return fmt.Errorf("Kinesis stream %s has invalid Iterator-Type %q", k, v.Iterator_Type)
+		}
+		if v.Iterator_Start_Time != `` {
+			if v.Iterator_Type != kinesis.ShardIteratorTypeAtTimestamp {
+				return fmt.Errorf("Kinesis stream %s Iterator-Start-Time is only valid with the %s Iterator-Type", k, kinesis.ShardIteratorTypeAtTimestamp)
+			}
+			if _, err := time.Parse(time.RFC3339, v.Iterator_Start_Time); err != nil {
+				return fmt.Errorf("Kinesis stream %s has invalid Iterator-Start-Time %q: %v", k, v.Iterator_Start_Time, err)
+			}
+		}
+		if err := v.endpoint(&c.Global).Validate(); err != nil {
+			return fmt.Errorf("Kinesis stream %s: %v", k, err)
+		}
+		switch v.Consumer_Mode = strings.ToLower(strings.TrimSpace(v.Consumer_Mode)); v.Consumer_Mode {
+		case ``:
+			v.Consumer_Mode = consumerModePoll
+		case consumerModePoll:
+		case consumerModeFanout:
+		default:
+			return fmt.Errorf("Kinesis stream %s has invalid Consumer-Mode %q", k, v.Consumer_Mode)
+		}
+		if v.Reshard_Check_Interval != `` {
+			if d, err := time.ParseDuration(v.Reshard_Check_Interval); err != nil || d <= 0 {
+				return fmt.Errorf("Kinesis stream %s has invalid Reshard-Check-Interval %q", k, v.Reshard_Check_Interval)
+			}
+		}
+		if v.Wait_For_Active_Timeout != `` {
+			if d, err := time.ParseDuration(v.Wait_For_Active_Timeout); err != nil || d <= 0 {
+				return fmt.Errorf("Kinesis stream %s has invalid Wait-For-Active-Timeout %q", k, v.Wait_For_Active_Timeout)
+			}
+		}
+		if v.List_Shards_Max_Attempts < 0 {
+			return fmt.Errorf("Kinesis stream %s has invalid List-Shards-Max-Attempts %d", k, v.List_Shards_Max_Attempts)
+		}
+		if v.List_Shards_Max_Backoff != `` {
+			if d, err := time.ParseDuration(v.List_Shards_Max_Backoff); err != nil || d <= 0 {
+				return fmt.Errorf("Kinesis stream %s has invalid List-Shards-Max-Backoff %q", k, v.List_Shards_Max_Backoff)
+			}
+		}
+		switch v.Content_Type = strings.ToLower(strings.TrimSpace(v.Content_Type)); v.Content_Type {
+		case ``:
+			v.Content_Type = contentTypeRaw
+		case contentTypeRaw:
+		case contentTypeCWLogs:
+		case contentTypeAvro:
+		default:
+			return fmt.Errorf("Kinesis stream %s has invalid Content-Type %q", k, v.Content_Type)
+		}
+		switch v.Framing = strings.ToLower(strings.TrimSpace(v.Framing)); v.Framing {
+		case ``:
+			v.Framing = framingNone
+			if v.Split_Lines {
+				v.Framing = framingNewline
+			}
+		case framingNone, framingLengthPrefix:
+			if v.Split_Lines {
+				return fmt.Errorf("Kinesis stream %s Split-Lines can't be combined with %s Framing", k, v.Framing)
+			}
+		case framingNewline:
+		default:
+			return fmt.Errorf("Kinesis stream %s has invalid Framing %q", k, v.Framing)
+		}
+		v.Framing_Byte_Order = strings.ToLower(strings.TrimSpace(v.Framing_Byte_Order))
+		if v.Framing != framingLengthPrefix && (v.Framing_Prefix_Width != 0 || v.Framing_Byte_Order != ``) {
+			return fmt.Errorf("Kinesis stream %s Framing-Prefix-Width and Framing-Byte-Order require %s Framing", k, framingLengthPrefix)
+		} else if _, err := v.framer(); err != nil {
+			return fmt.Errorf("Kinesis stream %s: %v", k, err)
+		}
+		if err := v.verifyAvro(); err != nil {
+			return fmt.Errorf("Kinesis stream %s: %v", k, err)
+		}
+		if err := v.verifySchemaRegistry(); err != nil {
+			return fmt.Errorf("Kinesis stream %s: %v", k, err)
+		}
+		switch v.Preprocessor_Error_Policy = strings.ToLower(strings.TrimSpace(v.Preprocessor_Error_Policy)); v.Preprocessor_Error_Policy {
+		case ``:
+			v.Preprocessor_Error_Policy = procErrorDrop
+		case procErrorDrop:
+		case procErrorPassthrough:
+		case procErrorFatal:
+		default:
+			return fmt.Errorf("Kinesis stream %s has invalid Preprocessor-Error-Policy %q", k, v.Preprocessor_Error_Policy)
+		}
+		dc, err := awsutils.ParseDecompression(v.Decompression)
+		if err != nil {
+			return fmt.Errorf("Kinesis stream %s: %v", k, err)
+		}
+		v.Decompression = dc
+		if _, err := v.sizeGuard(); err != nil {
+			return fmt.Errorf("Kinesis stream %s: %v", k, err)
+		}
+		if v.Max_Concurrent_Shards < 0 {
+			return fmt.Errorf("Kinesis stream %s has invalid Max-Concurrent-Shards %d", k, v.Max_Concurrent_Shards)
+		}
+		if v.Sample_Rate != nil && !(*v.Sample_Rate >= 0 && *v.Sample_Rate <= 1) {
+			return fmt.Errorf("Kinesis stream %s has invalid Sample-Rate %v, must be between 0.0 and 1.0", k, *v.Sample_Rate)
+		}
+		if v.Hot_Shard_Factor != 0 && !(v.Hot_Shard_Factor > 1) {
+			return fmt.Errorf("Kinesis stream %s has invalid Hot-Shard-Factor %v, must be greater than 1", k, v.Hot_Shard_Factor)
+		}
+		if v.Records_Per_Request == 0 {
+			v.Records_Per_Request = defaultRecordsPerRequest
+		} else if v.Records_Per_Request < 1 || v.Records_Per_Request > maxRecordsPerRequest {
+			return fmt.Errorf("Kinesis stream %s Records-Per-Request %d is out of range, must be between 1 and %d", k, v.Records_Per_Request, maxRecordsPerRequest)
+		}
+		if _, err := v.keyFilter(); err != nil {
+			return fmt.Errorf("Kinesis stream %s: %v", k, err)
+		}
+		if _, err := v.tagRoutes(); err != nil {
+			return fmt.Errorf("Kinesis stream %s: %v", k, err)
+		}
+		if _, err := v.tagTemplate(); err != nil {
+			return fmt.Errorf("Kinesis stream %s: %v", k, err)
+		} else if v.Tag_Template != `` && len(v.Tag_Route) > 0 {
+			return fmt.Errorf("Kinesis stream %s cannot use both Tag-Template and Tag-Route", k)
+		}
+		if v.Timezone_Override != `` {
+			if v.Assume_Local_Timezone {
+				// cannot do both
+				return fmt.Errorf("Cannot specify Assume-Local-Timezone and Timezone-Override in the same stream %v", k)
+			}
+			if _, err := time.LoadLocation(v.Timezone_Override); err != nil {
+				return fmt.Errorf("Invalid timezone override %v in stream %v: %v", v.Timezone_Override, k, err)
+			}
+		}
+		if v.Timestamp_Format_Override != `` {
+			if err := timegrinder.ValidateFormatOverride(v.Timestamp_Format_Override); err != nil {
+				return fmt.Errorf("Invalid timestamp format override %v in stream %v: %v", v.Timestamp_Format_Override, k, err)
+			}
+		}
+		if _, err := v.jsonTimestamp(); err != nil {
+			return fmt.Errorf("Kinesis stream %s has invalid Timestamp-JSON-Path: %v", k, err)
+		} else if v.Timestamp_JSON_Path != `` && !v.Parse_Time {
+			return fmt.Errorf("Kinesis stream %s specifies Timestamp-JSON-Path without Parse-Time", k)
+		}
+		if tc, err := v.timestampClamp(); err != nil {
+			return fmt.Errorf("Kinesis stream %s: %v", k, err)
+		} else if tc != nil && !v.Parse_Time {
+			return fmt.Errorf("Kinesis stream %s specifies Max-Timestamp-Skew-Past or Max-Timestamp-Skew-Future without Parse-Time", k)
+		}
+		if v.Timestamp_Failure_Threshold < 0 {
+			return fmt.Errorf("Kinesis stream %s has invalid Timestamp-Failure-Threshold %d", k, v.Timestamp_Failure_Threshold)
+		}
+		if v.Backoff_Warn_Threshold != `` {
+			if d, err := time.ParseDuration(v.Backoff_Warn_Threshold); err != nil || d <= 0 {
+				return fmt.Errorf("Kinesis stream %s has invalid Backoff-Warn-Threshold %q", k, v.Backoff_Warn_Threshold)
+			}
+		}
+		if v.Iterator_Retry_Limit != `` {
+			if d, err := time.ParseDuration(v.Iterator_Retry_Limit); err != nil || d < 0 {
+				return fmt.Errorf("Kinesis stream %s has invalid Iterator-Retry-Limit %q", k, v.Iterator_Retry_Limit)
+			}
+		}
+	}
+	return nil
+}
+
+// credentials returns the AWS credential options shared by all streams.
+func (g *global) credentials() awsutils.Credentials {
+	return awsutils.Credentials{
+		AccessKeyID:     g.AWS_Access_Key_ID,
+		SecretAccessKey: g.AWS_Secret_Access_Key,
+		RoleARN:         g.Role_ARN,
+		ExternalID:      g.External_ID,
+		SessionName:     g.Session_Name,
+		UseInstanceRole: g.Use_Instance_Role,
+		Profile:         g.AWS_Profile,
+		CredentialsFile: g.Credentials_File,
+	}
+}
+
+// consumerName returns the name used to register an enhanced fan-out consumer
+// for the stream, defaulting to one derived from the ingester UUID so that
+// multiple ingesters reading the same stream do not collide.
+func (sd *streamDef) consumerName(id uuid.UUID) string {
+	if sd.Consumer_Name != `` {
+		return sd.Consumer_Name
+	}
+	return `gravwell-` + id.String()
+}
+
+// reshardCheckInterval returns how often the shard list should be re-read.
+func (sd *streamDef) reshardCheckInterval() time.Duration {
+	if d, err := time.ParseDuration(sd.Reshard_Check_Interval); err == nil && d > 0 {
+		return d
+	}
+	return defaultReshardCheckInterval
+}
+
+// iteratorStartTime returns the starting point of an AT_TIMESTAMP iterator.
+func (sd *streamDef) iteratorStartTime() time.Time {
+	t, _ := time.Parse(time.RFC3339, sd.Iterator_Start_Time)
+	return t
+}
+
+// timegrinderConfig returns the TimeGrinder configuration of the stream.
+func (sd *streamDef) timegrinderConfig() timegrinder.Config {
+	return timegrinder.Config{
+		EnableLeftMostSeed: sd.Left_Most_Seed == nil || *sd.Left_Most_Seed,
+		FormatOverride:     sd.Timestamp_Format_Override,
+	}
+}
+
+// keyFilter compiles the partition key filters of the stream, returning nil if
+// every record should be ingested.
+func (sd *streamDef) keyFilter() (*keyFilter, error) {
+	return newKeyFilter(sd.Partition_Key_Include, sd.Partition_Key_Exclude)
+}
+
+// tagTemplate parses the Tag-Template of the stream, nil if there is none.
+func (sd *streamDef) tagTemplate() (*awsutils.TagTemplate, error) {
+	return awsutils.ParseTagTemplate(sd.Tag_Template, tagTemplateVars...)
+}
+
+// tagRoutes parses the partition key tag routes of the stream.
+func (sd *streamDef) tagRoutes() (routes []tagRoute, err error) {
+	for _, v := range sd.Tag_Route {
+		var r tagRoute
+		if r, err = parseTagRoute(v); err != nil {
+			return nil, err
+		}
+		routes = append(routes, r)
+	}
+	return
+}
+
+// endpoint returns the Kinesis endpoint overrides for the stream, falling back
+// to the global defaults.
+func (sd *streamDef) endpoint(g *global) awsutils.Endpoint {
+	e := awsutils.Endpoint{
+		URL:        sd.Endpoint_URL,
+		DisableSSL: g.Disable_SSL,
+	}
+	if e.URL == `` {
+		e.URL = g.Endpoint_URL
+	}
+	if sd.Disable_SSL != nil {
+		e.DisableSSL = *sd.Disable_SSL
+	}
+	return e
+}
+
+// sizeGuard returns the entry size limit of the stream, nil if there is none.
+func (sd *streamDef) sizeGuard() (*awsutils.SizeGuard, error) {
+	return awsutils.NewSizeGuard(sd.Max_Entry_Size, sd.Oversize_Action)
+}
+
+// jsonTimestamp returns the extractor for the Timestamp-JSON-Path, nil if
+// timestamps are only found by scanning records.
+func (sd *streamDef) jsonTimestamp() (*awsutils.JSONTimestamp, error) {
+	return awsutils.NewJSONTimestamp(sd.Timestamp_JSON_Path)
+}
+
+// timestampClamp returns the sanity window of extracted timestamps, nil if
+// the stream allows any timestamp.
+func (sd *streamDef) timestampClamp() (*awsutils.TimestampClamp, error) {
+	return awsutils.NewTimestampClamp(sd.Max_Timestamp_Skew_Past, sd.Max_Timestamp_Skew_Future)
+}
+
+// framer returns the framing which splits the records of the stream into
+// entries, Split-Lines is newline framing.
+func (sd *streamDef) framer() (framer, error) {
+	switch sd.Framing {
+	case framingNewline:
+		return lineFraming{ls: awsutils.NewLineSplitter(true, sd.Line_Delimiter)}, nil
+	case framingLengthPrefix:
+		return newLengthPrefixFraming(sd.Framing_Prefix_Width, sd.Framing_Byte_Order)
+	case ``, framingNone:
+		if sd.Split_Lines {
+			return lineFraming{ls: awsutils.NewLineSplitter(true, sd.Line_Delimiter)}, nil
+		}
+	}
+	return noFraming{}, nil
+}
+
+// sampler returns the record sampler of a shard of the stream, nil unless a
+// Sample-Rate below 1 is set.
+func (sd *streamDef) sampler(shard string) *recordSampler {
+	if sd.Sample_Rate == nil {
+		return nil
+	}
+	return newRecordSampler(*sd.Sample_Rate, shard)
+}
+
+// verifyAvro checks the Avro options of the stream, a schema registry is only
+// contacted when the stream starts.
+func (sd *streamDef) verifyAvro() error {
+	if sd.Content_Type != contentTypeAvro {
+		if sd.Avro_Schema != `` || sd.Avro_Schema_URL != `` {
+			return fmt.Errorf("Avro-Schema and Avro-Schema-URL require the %s Content-Type", contentTypeAvro)
+		}
+		return nil
+	}
+	if sd.Avro_Schema != `` && sd.Avro_Schema_URL != `` {
+		return errors.New("cannot specify both Avro-Schema and Avro-Schema-URL")
+	} else if sd.Framing != framingNone || sd.Unpack_JSON_Array {
+		return fmt.Errorf("the %s Content-Type can't be combined with Framing, Split-Lines, or Unpack-JSON-Array", contentTypeAvro)
+	}
+	if sd.Avro_Schema_URL != `` {
+		if u, err := url.Parse(sd.Avro_Schema_URL); err != nil || (u.Scheme != `http` && u.Scheme != `https`) || u.Host == `` {
+			return fmt.Errorf("invalid Avro-Schema-URL %q", sd.Avro_Schema_URL)
+		}
+	}
+	_, err := newAvroDecoder(sd.Avro_Schema)
+	return err
+}
+
+// avroDecoder returns the decoder of Avro records for the stream, fetching
+// its schema from the Avro-Schema-URL if there is one. It is nil unless the
+// stream's Content-Type is avro.
+func (sd *streamDef) avroDecoder() (*avroDecoder, error) {
+	if sd.Content_Type != contentTypeAvro {
+		return nil, nil
+	}
+	js := sd.Avro_Schema
+	if sd.Avro_Schema_URL != `` {
+		var err error
+		if js, err = fetchAvroSchema(sd.Avro_Schema_URL); err != nil {
+			return nil, fmt.Errorf("failed to fetch the Avro-Schema-URL: %v", err)
+		}
+	}
+	return newAvroDecoder(js)
+}
+
+// verifySchemaRegistry checks the Schema-Registry options of the stream.
+func (sd *streamDef) verifySchemaRegistry() error {
+	switch sd.Schema_Registry = strings.ToLower(strings.TrimSpace(sd.Schema_Registry)); sd.Schema_Registry {
+	case ``:
+		if sd.Schema_Registry_Region != `` {
+			return errors.New("Schema-Registry-Region requires a Schema-Registry")
 		}
+		return nil
+	case schemaRegistryGlue:
+	default:
+		return fmt.Errorf("invalid Schema-Registry %q", sd.Schema_Registry)
+	}
+	if sd.Content_Type != contentTypeRaw {
+		return fmt.Errorf("Schema-Registry can't be combined with the %s Content-Type", sd.Content_Type)
+	} else if sd.Framing != framingNone || sd.Unpack_JSON_Array {
+		return errors.New("Schema-Registry can't be combined with Framing, Split-Lines, or Unpack-JSON-Array")
 	}
 	return nil
 }
 
+// schemaRegistryRegion returns the region of the stream's Glue Schema Registry.
+func (sd *streamDef) schemaRegistryRegion() string {
+	if sd.Schema_Registry_Region != `` {
+		return sd.Schema_Registry_Region
+	}
+	return sd.Region
+}
+
+// waitForActiveTimeout returns how long to wait for the stream to become
+// usable on startup.
+func (sd *streamDef) waitForActiveTimeout() time.Duration {
+	if d, err := time.ParseDuration(sd.Wait_For_Active_Timeout); err == nil && d > 0 {
+		return d
+	}
+	return defaultWaitForActiveTimeout
+}
+
+// shardLister returns the shard lister of the stream using svc.
+func (sd *streamDef) shardLister(svc kinesisiface.KinesisAPI) *shardLister {
+	sl := &shardLister{
+		svc:         svc,
+		name:        sd.Stream_Name,
+		maxAttempts: sd.List_Shards_Max_Attempts,
+		maxBackoff:  backoffMax,
+	}
+	if sl.maxAttempts == 0 {
+		sl.maxAttempts = defaultListShardsAttempts
+	}
+	if d, err := time.ParseDuration(sd.List_Shards_Max_Backoff); err == nil && d > 0 {
+		sl.maxBackoff = d
+	}
+	return sl
+}
+
+// backoffWarnThreshold returns how long a shard may back off before we warn.
+func (sd *streamDef) backoffWarnThreshold() time.Duration {
+	if d, err := time.ParseDuration(sd.Backoff_Warn_Threshold); err == nil && d > 0 {
+		return d
+	}
+	return defaultBackoffWarnThreshold
+}
+
+// iteratorRetryLimit returns how long GetShardIterator may keep failing before
+// the shard is given up on, zero never gives up.
+func (sd *streamDef) iteratorRetryLimit() time.Duration {
+	if d, err := time.ParseDuration(sd.Iterator_Retry_Limit); err == nil && d >= 0 {
+		return d
+	}
+	return defaultIteratorRetryLimit
+}
+
+// metricsInterval returns how often stream metrics should be reported.
+func (g *global) metricsInterval() time.Duration {
+	if d, err := time.ParseDuration(g.Metrics_Interval); err == nil && d > 0 {
+		return d
+	}
+	return defaultMetricsInterval
+}
+
+// healthProgressWindow returns how long the ingester may go without a
+// successful read before it is reported as not ready.
+func (g *global) healthProgressWindow() time.Duration {
+	if d, err := time.ParseDuration(g.Health_Progress_Window); err == nil && d > 0 {
+		return d
+	}
+	return awsutils.DefaultHealthProgressWindow
+}
+
+// partition returns the share of each stream's shards this instance reads.
+func (g *global) partition() shardPartition {
+	return shardPartition{index: g.Instance_Index, count: g.Instance_Count}
+}
+
+// shutdownGrace returns how long shard workers are given to finish the
+// records they have read before shutdown cancels them.
+func (g *global) shutdownGrace() time.Duration {
+	if d, err := time.ParseDuration(g.Shutdown_Grace); err == nil && d >= 0 {
+		return d
+	}
+	return awsutils.DefaultShutdownGrace
+}
+
+// payloadLogger returns the logger for excerpts of bad payloads, nil unless
+// Log-Bad-Payloads is set.
+func (g *global) payloadLogger(logf func(string, ...interface{}) error) *awsutils.PayloadLogger {
+	if !g.Log_Bad_Payloads {
+		return nil
+	}
+	return awsutils.NewPayloadLogger(g.Log_Bad_Payload_Size, logf)
+}
+
+// leaseDuration returns how long a DynamoDB shard lease lasts without renewal.
+func (g *global) leaseDuration() time.Duration {
+	if d, err := time.ParseDuration(g.Lease_Duration); err == nil && d >= minLeaseDuration {
+		return d
+	}
+	return defaultLeaseDuration
+}
+
 func (c *cfgType) Targets() ([]string, error) {
 	var conns []string
 	for _, v := range c.Global.Cleartext_Backend_Target {
@@ -147,10 +803,27 @@ func (c *cfgType) Tags() ([]string, error) {
 			tags = append(tags, v.Tag_Name)
 			tagMp[v.Tag_Name] = true
 		}
+		routes, err := v.tagRoutes()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range routes {
+			if _, ok := tagMp[r.tag]; !ok {
+				tags = append(tags, r.tag)
+				tagMp[r.tag] = true
+			}
+		}
 	}
 	if len(tags) == 0 {
 		return nil, errors.New("No tags specified")
 	}
+	if c.Global.Metrics_Tag != `` && !tagMp[c.Global.Metrics_Tag] {
+		tags = append(tags, c.Global.Metrics_Tag)
+		tagMp[c.Global.Metrics_Tag] = true
+	}
+	if c.Global.Checkpoint_Backup_Tag != `` && !tagMp[c.Global.Checkpoint_Backup_Tag] {
+		tags = append(tags, c.Global.Checkpoint_Backup_Tag)
+	}
 	return tags, nil
 }
 
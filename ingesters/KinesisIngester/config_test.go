@@ -0,0 +1,98 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"testing"
+)
+
+func testConfig(sd *streamDef) *cfgType {
+	c := &cfgType{
+		KinesisStream: map[string]*streamDef{`test`: sd},
+	}
+	c.Global.Ingest_Secret = `secret`
+	c.Global.Pipe_Backend_Target = []string{`/tmp/pipe`}
+	c.Global.Use_Instance_Role = true
+	return c
+}
+
+func TestIteratorStartTime(t *testing.T) {
+	sd := &streamDef{Iterator_Type: `at_timestamp`, Iterator_Start_Time: `2020-06-01T00:00:00Z`}
+	if err := verifyConfig(testConfig(sd)); err != nil {
+		t.Fatal(err)
+	}
+	if sd.Iterator_Type != `AT_TIMESTAMP` {
+		t.Fatalf("iterator type not normalized: %q", sd.Iterator_Type)
+	}
+	if ts := sd.iteratorStartTime(); ts.Unix() != 1590969600 {
+		t.Fatalf("bad start time: %v", ts)
+	}
+
+	bad := []*streamDef{
+		{Iterator_Type: `AT_TIMESTAMP`},
+		{Iterator_Type: `AT_TIMESTAMP`, Iterator_Start_Time: `yesterday`},
+		{Iterator_Type: `TRIM_HORIZON`, Iterator_Start_Time: `2020-06-01T00:00:00Z`},
+		{Iterator_Start_Time: `2020-06-01T00:00:00Z`},
+		{Iterator_Type: `SOMETIME`},
+	}
+	for _, sd := range bad {
+		if err := verifyConfig(testConfig(sd)); err == nil {
+			t.Fatalf("accepted %+v", sd)
+		}
+	}
+}
+
+func TestTimegrinderConfig(t *testing.T) {
+	sd := &streamDef{Timestamp_Format_Override: `RFC3339`}
+	if err := verifyConfig(testConfig(sd)); err != nil {
+		t.Fatal(err)
+	}
+	if tc := sd.timegrinderConfig(); !tc.EnableLeftMostSeed || tc.FormatOverride != `RFC3339` {
+		t.Fatalf("bad timegrinder config: %+v", tc)
+	}
+	off := false
+	sd.Left_Most_Seed = &off
+	if tc := sd.timegrinderConfig(); tc.EnableLeftMostSeed {
+		t.Fatal("left most seed not disabled")
+	}
+
+	bad := []*streamDef{
+		{Timestamp_Format_Override: `NotAFormat`},
+		{Timezone_Override: `Not/AZone`},
+		{Timezone_Override: `UTC`, Assume_Local_Timezone: true},
+	}
+	for _, sd := range bad {
+		if err := verifyConfig(testConfig(sd)); err == nil {
+			t.Fatalf("accepted %+v", sd)
+		}
+	}
+}
+
+func TestStreamEndpoint(t *testing.T) {
+	sd := &streamDef{}
+	c := testConfig(sd)
+	c.Global.Endpoint_URL = `http://localhost:4566`
+	c.Global.Disable_SSL = true
+	if err := verifyConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if e := sd.endpoint(&c.Global); e.URL != `http://localhost:4566` || !e.DisableSSL {
+		t.Fatalf("global defaults not applied: %+v", e)
+	}
+	ssl := false
+	sd.Endpoint_URL = `https://vpce-1234.kinesis.us-east-1.vpce.amazonaws.com`
+	sd.Disable_SSL = &ssl
+	if e := sd.endpoint(&c.Global); e.URL != sd.Endpoint_URL || e.DisableSSL {
+		t.Fatalf("stream overrides not applied: %+v", e)
+	}
+
+	if err := verifyConfig(testConfig(&streamDef{Endpoint_URL: `localhost:4566`})); err == nil {
+		t.Fatal("accepted an endpoint without a scheme")
+	}
+}
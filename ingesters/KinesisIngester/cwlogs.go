@@ -0,0 +1,81 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	cwLogsDataMessage    = `DATA_MESSAGE`
+	cwLogsControlMessage = `CONTROL_MESSAGE`
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+
+	ErrNotCWLogs = errors.New("Record is not a CloudWatch Logs subscription message")
+)
+
+// cwLogsMessage is the payload CloudWatch Logs subscription filters deliver to
+// Kinesis, gzip compressed.
+type cwLogsMessage struct {
+	MessageType         string       `json:"messageType"`
+	Owner               string       `json:"owner"`
+	LogGroup            string       `json:"logGroup"`
+	LogStream           string       `json:"logStream"`
+	SubscriptionFilters []string     `json:"subscriptionFilters"`
+	LogEvents           []cwLogEvent `json:"logEvents"`
+}
+
+type cwLogEvent struct {
+	ID        string `json:"id"`
+	Timestamp int64  `json:"timestamp"` // milliseconds since the epoch
+	Message   string `json:"message"`
+}
+
+// Time returns the time at which the event was logged.
+func (e cwLogEvent) Time() time.Time {
+	return time.Unix(0, e.Timestamp*int64(time.Millisecond))
+}
+
+// decodeCWLogs decompresses and parses a CloudWatch Logs subscription message.
+// Control messages, which CloudWatch sends to check that the stream is
+// writable, decode successfully but carry no log events.
+func decodeCWLogs(data []byte) (msg cwLogsMessage, err error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		err = ErrNotCWLogs
+		return
+	}
+	var gz *gzip.Reader
+	if gz, err = gzip.NewReader(bytes.NewReader(data)); err != nil {
+		return
+	}
+	defer gz.Close()
+	var raw []byte
+	if raw, err = ioutil.ReadAll(gz); err != nil {
+		return
+	}
+	if err = json.Unmarshal(raw, &msg); err != nil {
+		return
+	}
+	switch msg.MessageType {
+	case cwLogsDataMessage:
+	case cwLogsControlMessage:
+		msg.LogEvents = nil
+	default:
+		err = ErrNotCWLogs
+	}
+	return
+}
@@ -0,0 +1,72 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+	"time"
+)
+
+func gzipBytes(t *testing.T, b []byte) []byte {
+	var bb bytes.Buffer
+	gz := gzip.NewWriter(&bb)
+	if _, err := gz.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bb.Bytes()
+}
+
+const testCWLogsMessage = `{"messageType":"DATA_MESSAGE","owner":"123456789012",
+"logGroup":"/aws/lambda/thing","logStream":"2020/01/01/[$LATEST]abcdef",
+"subscriptionFilters":["gravwell"],
+"logEvents":[
+	{"id":"1","timestamp":1577836800123,"message":"first event"},
+	{"id":"2","timestamp":1577836801000,"message":"second event"}
+]}`
+
+func TestDecodeCWLogs(t *testing.T) {
+	msg, err := decodeCWLogs(gzipBytes(t, []byte(testCWLogsMessage)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.LogGroup != `/aws/lambda/thing` || len(msg.LogEvents) != 2 {
+		t.Fatalf("bad message: %+v", msg)
+	}
+	if msg.LogEvents[0].Message != `first event` {
+		t.Fatalf("bad event message %q", msg.LogEvents[0].Message)
+	}
+	if exp := time.Date(2020, 1, 1, 0, 0, 0, 123000000, time.UTC); !msg.LogEvents[0].Time().Equal(exp) {
+		t.Fatalf("bad event time %v != %v", msg.LogEvents[0].Time(), exp)
+	}
+
+	msg, err = decodeCWLogs(gzipBytes(t, []byte(`{"messageType":"CONTROL_MESSAGE","logEvents":[{"id":"","timestamp":0,"message":"CWL CONTROL MESSAGE"}]}`)))
+	if err != nil || len(msg.LogEvents) != 0 {
+		t.Fatalf("bad control message handling: %v %+v", err, msg)
+	}
+}
+
+func TestDecodeCWLogsBadInput(t *testing.T) {
+	bad := [][]byte{
+		[]byte(`plain text`),
+		[]byte(testCWLogsMessage), // not compressed
+		gzipBytes(t, []byte(`not json`)),
+		gzipBytes(t, []byte(`{"foo":"bar"}`)),
+		gzipBytes(t, []byte(testCWLogsMessage))[:20], // truncated
+	}
+	for i, b := range bad {
+		if _, err := decodeCWLogs(b); err == nil {
+			t.Fatalf("bad input %d decoded without error", i)
+		}
+	}
+}
@@ -0,0 +1,426 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// DynamoDB item layout, the table must have a string hash key named leaseKey
+const (
+	attrLeaseKey   = `leaseKey`
+	attrCheckpoint = `checkpoint`
+	attrOwner      = `leaseOwner`
+	attrExpiry     = `leaseExpiry` // milliseconds since the epoch
+
+	leaseKeySep = `/` // stream names cannot contain a slash
+)
+
+type dynamoLease struct {
+	checkpoint string
+	persisted  string // checkpoint as of the last successful write
+	dirty      bool
+	expiry     time.Time // when the lease runs out if we fail to renew it
+	shed       bool      // given up so that another ingester can take it
+}
+
+// dynamoCheckpointer is a checkpointer backed by a DynamoDB table, allowing
+// multiple ingesters to share the shards of a stream. Each shard has a lease
+// which must be held to consume it; leases are renewed as checkpoints are
+// flushed and expire if the holder dies, letting another ingester take over
+// from the last checkpoint. Ingesters holding more than their share of a
+// stream's open shards give up leases until the shards are spread evenly.
+type dynamoCheckpointer struct {
+	sync.Mutex
+	svc           dynamodbiface.DynamoDBAPI
+	table         string
+	owner         string
+	leaseDuration time.Duration
+
+	leases  map[string]*dynamoLease
+	closed  map[string]bool      // shards known to be fully consumed
+	retryAt map[string]time.Time // when to next ask DynamoDB about a shard we don't hold
+	open    map[string]int       // open shards per stream
+	owners  map[string]int       // live lease owners per stream, including us
+	done    chan struct{}
+}
+
+func newDynamoCheckpointer(svc dynamodbiface.DynamoDBAPI, table, owner string, leaseDuration time.Duration) *dynamoCheckpointer {
+	return &dynamoCheckpointer{
+		svc:           svc,
+		table:         table,
+		owner:         owner,
+		leaseDuration: leaseDuration,
+		leases:        make(map[string]*dynamoLease),
+		closed:        make(map[string]bool),
+		retryAt:       make(map[string]time.Time),
+		open:          make(map[string]int),
+		owners:        make(map[string]int),
+		done:          make(chan struct{}),
+	}
+}
+
+func leaseKey(stream, shard string) string {
+	return stream + leaseKeySep + shard
+}
+
+func expiryValue(t time.Time) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10))}
+}
+
+func isConditionFailed(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+	}
+	return false
+}
+
+// Start renews leases, flushes checkpoints, and rebalances shards in the
+// background until Close is called.
+func (d *dynamoCheckpointer) Start() {
+	go func() {
+		for {
+			select {
+			case <-time.After(d.leaseDuration / 3):
+				d.Flush()
+				d.rebalance()
+			case <-d.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the background renewals and writes out the final checkpoints.
+// It should only be called once every shard worker has exited.
+func (d *dynamoCheckpointer) Close() {
+	close(d.done)
+	d.Flush()
+}
+
+// Flush writes dirty checkpoints and renews every lease we hold. Leases which
+// another ingester has taken, or which we could not renew before they expired,
+// are dropped so that their shard workers stop.
+func (d *dynamoCheckpointer) Flush() {
+	d.Lock()
+	held := make(map[string]dynamoLease, len(d.leases))
+	for k, l := range d.leases {
+		held[k] = *l
+	}
+	d.Unlock()
+
+	for k, l := range held {
+		now := time.Now()
+		expiry := now.Add(d.leaseDuration)
+		upd := `SET #e = :exp`
+		vals := map[string]*dynamodb.AttributeValue{
+			`:me`:  {S: aws.String(d.owner)},
+			`:exp`: expiryValue(expiry),
+		}
+		names := map[string]*string{`#o`: aws.String(attrOwner), `#e`: aws.String(attrExpiry)}
+		if l.checkpoint != `` {
+			upd += `, #c = :cp`
+			vals[`:cp`] = &dynamodb.AttributeValue{S: aws.String(l.checkpoint)}
+			names[`#c`] = aws.String(attrCheckpoint)
+		}
+		_, err := d.svc.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:                 aws.String(d.table),
+			Key:                       map[string]*dynamodb.AttributeValue{attrLeaseKey: {S: aws.String(k)}},
+			UpdateExpression:          aws.String(upd),
+			ConditionExpression:       aws.String(`#o = :me`),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: vals,
+		})
+
+		d.Lock()
+		cur, ok := d.leases[k]
+		if !ok {
+			d.Unlock()
+			continue
+		}
+		if err == nil {
+			cur.expiry = expiry
+			if l.checkpoint != `` {
+				cur.persisted = l.checkpoint
+			}
+			if cur.checkpoint == l.checkpoint {
+				cur.dirty = false
+			}
+		} else if isConditionFailed(err) {
+			lg.Warn("Lost the lease on %s to another ingester", k)
+			delete(d.leases, k)
+		} else {
+			lg.Error("Failed to renew the lease on %s: %s", k, awsutils.ErrorMessage(err))
+			if now.After(cur.expiry) {
+				// someone else may already be reading the shard
+				lg.Warn("Lease on %s expired, giving up the shard", k)
+				delete(d.leases, k)
+			}
+		}
+		d.Unlock()
+	}
+}
+
+func (d *dynamoCheckpointer) GetSequenceNum(stream, shard string) string {
+	d.Lock()
+	defer d.Unlock()
+	if l, ok := d.leases[leaseKey(stream, shard)]; ok {
+		return l.checkpoint
+	}
+	return ``
+}
+
+func (d *dynamoCheckpointer) Persisted(stream, shard string) string {
+	d.Lock()
+	defer d.Unlock()
+	if l, ok := d.leases[leaseKey(stream, shard)]; ok {
+		return l.persisted
+	}
+	return ``
+}
+
+func (d *dynamoCheckpointer) UpdateSequenceNum(stream, shard, seq string) {
+	d.Lock()
+	defer d.Unlock()
+	if l, ok := d.leases[leaseKey(stream, shard)]; ok {
+		l.checkpoint = seq
+		l.dirty = true
+	}
+}
+
+func (d *dynamoCheckpointer) MarkShardClosed(stream, shard string) {
+	d.UpdateSequenceNum(stream, shard, shardClosedMarker)
+	d.Lock()
+	d.closed[leaseKey(stream, shard)] = true
+	d.Unlock()
+}
+
+// ShardClosed returns true if the shard has been fully consumed by any of the
+// ingesters sharing the table. Shards we don't hold are looked up at most once
+// per lease period.
+func (d *dynamoCheckpointer) ShardClosed(stream, shard string) bool {
+	k := leaseKey(stream, shard)
+	d.Lock()
+	if d.closed[k] {
+		d.Unlock()
+		return true
+	}
+	if l, ok := d.leases[k]; ok {
+		d.Unlock()
+		return l.checkpoint == shardClosedMarker
+	}
+	if time.Now().Before(d.retryAt[k]) {
+		d.Unlock()
+		return false
+	}
+	d.retryAt[k] = time.Now().Add(d.leaseDuration)
+	d.Unlock()
+
+	out, err := d.svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(d.table),
+		Key:            map[string]*dynamodb.AttributeValue{attrLeaseKey: {S: aws.String(k)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		lg.Error("Failed to read checkpoint for %s: %s", k, awsutils.ErrorMessage(err))
+		return false
+	}
+	if cp, ok := out.Item[attrCheckpoint]; ok && aws.StringValue(cp.S) == shardClosedMarker {
+		d.Lock()
+		d.closed[k] = true
+		d.Unlock()
+		return true
+	}
+	return false
+}
+
+// Acquire takes the lease on a shard if it is free or expired and we do not
+// already hold our share of the stream's open shards.
+func (d *dynamoCheckpointer) Acquire(stream, shard string, open int) bool {
+	k := leaseKey(stream, shard)
+	now := time.Now()
+	d.Lock()
+	d.open[stream] = open
+	if _, ok := d.leases[k]; ok {
+		d.Unlock()
+		return true
+	}
+	if now.Before(d.retryAt[k]) || d.heldLocked(stream) >= d.targetLocked(stream) {
+		d.Unlock()
+		return false
+	}
+	d.retryAt[k] = now.Add(d.leaseDuration / 3)
+	d.Unlock()
+
+	expiry := now.Add(d.leaseDuration)
+	out, err := d.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(d.table),
+		Key:                 map[string]*dynamodb.AttributeValue{attrLeaseKey: {S: aws.String(k)}},
+		UpdateExpression:    aws.String(`SET #o = :me, #e = :exp`),
+		ConditionExpression: aws.String(`attribute_not_exists(#o) OR #o = :me OR #e < :now`),
+		ExpressionAttributeNames: map[string]*string{
+			`#o`: aws.String(attrOwner),
+			`#e`: aws.String(attrExpiry),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			`:me`:  {S: aws.String(d.owner)},
+			`:exp`: expiryValue(expiry),
+			`:now`: expiryValue(now),
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+	})
+	if err != nil {
+		if !isConditionFailed(err) {
+			lg.Error("Failed to acquire the lease on %s: %s", k, awsutils.ErrorMessage(err))
+		}
+		return false
+	}
+	l := &dynamoLease{expiry: expiry}
+	if cp, ok := out.Attributes[attrCheckpoint]; ok {
+		l.checkpoint = aws.StringValue(cp.S)
+		l.persisted = l.checkpoint
+	}
+	d.Lock()
+	d.leases[k] = l
+	d.Unlock()
+	debugout("Acquired the lease on %s\n", k)
+	return true
+}
+
+func (d *dynamoCheckpointer) Owns(stream, shard string) bool {
+	d.Lock()
+	defer d.Unlock()
+	l, ok := d.leases[leaseKey(stream, shard)]
+	return ok && !l.shed
+}
+
+// Release writes the final checkpoint of a shard and frees its lease.
+func (d *dynamoCheckpointer) Release(stream, shard string) {
+	k := leaseKey(stream, shard)
+	d.Lock()
+	l, ok := d.leases[k]
+	if !ok {
+		d.Unlock()
+		return
+	}
+	delete(d.leases, k)
+	if l.shed {
+		// give the other ingesters a chance to pick it up
+		d.retryAt[k] = time.Now().Add(d.leaseDuration)
+	}
+	d.Unlock()
+
+	upd := `REMOVE #o, #e`
+	vals := map[string]*dynamodb.AttributeValue{`:me`: {S: aws.String(d.owner)}}
+	names := map[string]*string{`#o`: aws.String(attrOwner), `#e`: aws.String(attrExpiry)}
+	if l.checkpoint != `` {
+		upd = `SET #c = :cp ` + upd
+		vals[`:cp`] = &dynamodb.AttributeValue{S: aws.String(l.checkpoint)}
+		names[`#c`] = aws.String(attrCheckpoint)
+	}
+	_, err := d.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(d.table),
+		Key:                       map[string]*dynamodb.AttributeValue{attrLeaseKey: {S: aws.String(k)}},
+		UpdateExpression:          aws.String(upd),
+		ConditionExpression:       aws.String(`#o = :me`),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: vals,
+	})
+	if err != nil && !isConditionFailed(err) {
+		lg.Error("Failed to release the lease on %s: %s", k, awsutils.ErrorMessage(err))
+	}
+}
+
+// rebalance counts the live lease owners of each stream and, if we hold more
+// than our share of a stream's open shards, sheds one lease.
+func (d *dynamoCheckpointer) rebalance() {
+	owners := make(map[string]map[string]bool)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	err := d.svc.ScanPages(&dynamodb.ScanInput{
+		TableName:            aws.String(d.table),
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String(`#k, #o, #e`),
+		ExpressionAttributeNames: map[string]*string{
+			`#k`: aws.String(attrLeaseKey),
+			`#o`: aws.String(attrOwner),
+			`#e`: aws.String(attrExpiry),
+		},
+	}, func(out *dynamodb.ScanOutput, last bool) bool {
+		for _, item := range out.Items {
+			k, o, e := item[attrLeaseKey], item[attrOwner], item[attrExpiry]
+			if k == nil || o == nil || e == nil {
+				continue
+			}
+			if exp, err := strconv.ParseInt(aws.StringValue(e.N), 10, 64); err != nil || exp < now {
+				continue
+			}
+			stream := strings.SplitN(aws.StringValue(k.S), leaseKeySep, 2)[0]
+			if owners[stream] == nil {
+				owners[stream] = make(map[string]bool)
+			}
+			owners[stream][aws.StringValue(o.S)] = true
+		}
+		return true
+	})
+	if err != nil {
+		lg.Error("Failed to scan lease table %s: %s", d.table, awsutils.ErrorMessage(err))
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	for stream := range d.open {
+		if owners[stream] == nil {
+			owners[stream] = make(map[string]bool)
+		}
+		owners[stream][d.owner] = true
+		d.owners[stream] = len(owners[stream])
+		if d.heldLocked(stream) <= d.targetLocked(stream) {
+			continue
+		}
+		for k, l := range d.leases {
+			if !l.shed && strings.HasPrefix(k, stream+leaseKeySep) {
+				lg.Info("Shedding the lease on %s to balance shards across %d ingesters", k, d.owners[stream])
+				l.shed = true
+				break
+			}
+		}
+	}
+}
+
+// heldLocked returns the number of leases held on a stream, not counting
+// leases being shed.
+func (d *dynamoCheckpointer) heldLocked(stream string) (n int) {
+	for k, l := range d.leases {
+		if !l.shed && strings.HasPrefix(k, stream+leaseKeySep) {
+			n++
+		}
+	}
+	return
+}
+
+// targetLocked returns our share of a stream's open shards.
+func (d *dynamoCheckpointer) targetLocked(stream string) int {
+	owners := d.owners[stream]
+	if owners < 1 {
+		owners = 1
+	}
+	open := d.open[stream]
+	return (open + owners - 1) / owners
+}
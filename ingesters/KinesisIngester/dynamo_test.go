@@ -0,0 +1,51 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeaseBalancing(t *testing.T) {
+	// a nil client panics if Acquire goes to DynamoDB
+	d := newDynamoCheckpointer(nil, `table`, `me`, time.Minute)
+	d.owners[`stream`] = 2
+	d.leases[leaseKey(`stream`, `shard-0`)] = &dynamoLease{checkpoint: `1`}
+	d.leases[leaseKey(`stream`, `shard-1`)] = &dynamoLease{checkpoint: `2`}
+	d.leases[leaseKey(`other`, `shard-0`)] = &dynamoLease{}
+
+	if !d.Acquire(`stream`, `shard-1`, 4) {
+		t.Fatal("failed to re-acquire a held lease")
+	}
+	if d.Acquire(`stream`, `shard-2`, 4) {
+		t.Fatal("acquired more than our share of the stream")
+	}
+	if n := d.targetLocked(`stream`); n != 2 {
+		t.Fatalf("bad target: %d", n)
+	}
+	d.open[`stream`] = 5
+	if n := d.targetLocked(`stream`); n != 3 {
+		t.Fatalf("bad target with an odd shard count: %d", n)
+	}
+
+	d.leases[leaseKey(`stream`, `shard-0`)].shed = true
+	if d.Owns(`stream`, `shard-0`) {
+		t.Fatal("still own a shed lease")
+	}
+	if !d.Owns(`stream`, `shard-1`) {
+		t.Fatal("lost a held lease")
+	}
+	if n := d.heldLocked(`stream`); n != 1 {
+		t.Fatalf("shed lease counted as held: %d", n)
+	}
+	if s := d.GetSequenceNum(`stream`, `shard-1`); s != `2` {
+		t.Fatalf("bad checkpoint: %q", s)
+	}
+}
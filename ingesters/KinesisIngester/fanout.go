@@ -0,0 +1,82 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+const (
+	consumerActiveTimeout = 2 * time.Minute
+	consumerPollInterval  = 2 * time.Second
+)
+
+var (
+	ErrConsumerNotActive = errors.New("Stream consumer did not become active")
+)
+
+// registerConsumer registers an enhanced fan-out consumer on the stream, or
+// picks up an existing consumer with the same name, and waits for it to become
+// active. It returns the consumer ARN.
+func registerConsumer(svc *kinesis.Kinesis, streamARN, name string) (arn string, err error) {
+	rsci := &kinesis.RegisterStreamConsumerInput{}
+	rsci.SetStreamARN(streamARN)
+	rsci.SetConsumerName(name)
+	var out *kinesis.RegisterStreamConsumerOutput
+	if out, err = svc.RegisterStreamConsumer(rsci); err == nil {
+		arn = *out.Consumer.ConsumerARN
+	} else if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == kinesis.ErrCodeResourceInUseException {
+		// the consumer is already registered, probably from a previous run
+		dsci := &kinesis.DescribeStreamConsumerInput{}
+		dsci.SetStreamARN(streamARN)
+		dsci.SetConsumerName(name)
+		var desc *kinesis.DescribeStreamConsumerOutput
+		if desc, err = svc.DescribeStreamConsumer(dsci); err != nil {
+			return
+		}
+		arn = *desc.ConsumerDescription.ConsumerARN
+	} else {
+		return
+	}
+
+	//wait for the consumer to go active
+	dsci := &kinesis.DescribeStreamConsumerInput{}
+	dsci.SetConsumerARN(arn)
+	deadline := time.Now().Add(consumerActiveTimeout)
+	for time.Now().Before(deadline) {
+		var desc *kinesis.DescribeStreamConsumerOutput
+		if desc, err = svc.DescribeStreamConsumer(dsci); err != nil {
+			return
+		}
+		switch status := *desc.ConsumerDescription.ConsumerStatus; status {
+		case kinesis.ConsumerStatusActive:
+			return
+		case kinesis.ConsumerStatusCreating:
+			time.Sleep(consumerPollInterval)
+		default:
+			err = fmt.Errorf("consumer %s is %s", name, status)
+			return
+		}
+	}
+	err = ErrConsumerNotActive
+	return
+}
+
+// deregisterConsumer removes an enhanced fan-out consumer from its stream.
+func deregisterConsumer(svc *kinesis.Kinesis, arn string) error {
+	dsci := &kinesis.DeregisterStreamConsumerInput{}
+	dsci.SetConsumerARN(arn)
+	_, err := svc.DeregisterStreamConsumer(dsci)
+	return err
+}
@@ -0,0 +1,110 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
+)
+
+const (
+	framingNone         = `none`
+	framingNewline      = `newline`
+	framingLengthPrefix = `length-prefix`
+
+	byteOrderBig    = `big`
+	byteOrderLittle = `little`
+
+	defaultPrefixWidth = 4
+)
+
+// framer splits the data of a record into the entries a producer packed into
+// it. A framing error is returned along with the frames when the end of the
+// data does not form a whole frame, the remaining bytes are then the last
+// frame so that nothing is lost.
+type framer interface {
+	frames(data []byte) ([][]byte, error)
+}
+
+// noFraming ingests every record as a single entry.
+type noFraming struct{}
+
+func (noFraming) frames(data []byte) ([][]byte, error) {
+	return [][]byte{data}, nil
+}
+
+// lineFraming splits records into lines, as Split-Lines does.
+type lineFraming struct {
+	ls *awsutils.LineSplitter
+}
+
+func (lf lineFraming) frames(data []byte) ([][]byte, error) {
+	return lf.ls.Split(data), nil
+}
+
+// lengthPrefixFraming splits records made of frames which each start with
+// their length as an unsigned integer of width bytes. Empty frames are
+// skipped.
+type lengthPrefixFraming struct {
+	width int
+	order binary.ByteOrder
+}
+
+func newLengthPrefixFraming(width int, order string) (*lengthPrefixFraming, error) {
+	lpf := &lengthPrefixFraming{width: width, order: binary.BigEndian}
+	switch width {
+	case 0:
+		lpf.width = defaultPrefixWidth
+	case 1, 2, 4, 8:
+	default:
+		return nil, fmt.Errorf("invalid Framing-Prefix-Width %d, must be 1, 2, 4, or 8", width)
+	}
+	switch order {
+	case ``, byteOrderBig:
+	case byteOrderLittle:
+		lpf.order = binary.LittleEndian
+	default:
+		return nil, fmt.Errorf("invalid Framing-Byte-Order %q, must be %s or %s", order, byteOrderBig, byteOrderLittle)
+	}
+	return lpf, nil
+}
+
+func (lpf *lengthPrefixFraming) length(b []byte) uint64 {
+	switch lpf.width {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(lpf.order.Uint16(b))
+	case 4:
+		return uint64(lpf.order.Uint32(b))
+	}
+	return lpf.order.Uint64(b)
+}
+
+func (lpf *lengthPrefixFraming) frames(data []byte) (frames [][]byte, err error) {
+	for len(data) > 0 {
+		if len(data) < lpf.width {
+			err = fmt.Errorf("%d bytes left over, too few for a %d byte length prefix", len(data), lpf.width)
+			return append(frames, data), err
+		}
+		n := lpf.length(data)
+		if n > uint64(len(data)-lpf.width) {
+			err = fmt.Errorf("frame of %d bytes overruns the %d bytes left in the record", n, len(data)-lpf.width)
+			return append(frames, data), err
+		}
+		end := lpf.width + int(n)
+		if n > 0 {
+			frames = append(frames, data[lpf.width:end])
+		}
+		data = data[end:]
+	}
+	return
+}
@@ -0,0 +1,78 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLengthPrefixFraming(t *testing.T) {
+	tests := []struct {
+		width  int
+		order  string
+		data   string
+		frames []string
+		bad    bool
+	}{
+		{0, ``, "\x00\x00\x00\x03one\x00\x00\x00\x00\x00\x00\x00\x03two", []string{`one`, `two`}, false},
+		{1, ``, "\x03one\x05three", []string{`one`, `three`}, false},
+		{2, `little`, "\x03\x00one\x05\x00three", []string{`one`, `three`}, false},
+		{8, `big`, "\x00\x00\x00\x00\x00\x00\x00\x03one", []string{`one`}, false},
+		// the bytes which can't be framed are kept as the last entry
+		{1, ``, "\x03one\x09short", []string{`one`, "\x09short"}, true},
+		{4, ``, "\x03one\x00\x00", []string{"\x03one\x00\x00"}, true},
+		{2, ``, "\x00\x03one\x00", []string{`one`, "\x00"}, true},
+	}
+	for i, tc := range tests {
+		lpf, err := newLengthPrefixFraming(tc.width, tc.order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames, err := lpf.frames([]byte(tc.data))
+		if (err != nil) != tc.bad {
+			t.Fatalf("%d: bad framing error %v", i, err)
+		}
+		if fmt.Sprintf("%q", frames) != fmt.Sprintf("%q", tc.frames) {
+			t.Fatalf("%d: got frames %q, expected %q", i, frames, tc.frames)
+		}
+	}
+	if _, err := newLengthPrefixFraming(3, ``); err == nil {
+		t.Fatal("accepted a 3 byte prefix")
+	}
+	if _, err := newLengthPrefixFraming(4, `middle`); err == nil {
+		t.Fatal("accepted an invalid byte order")
+	}
+}
+
+func TestFramingConfig(t *testing.T) {
+	for _, sd := range []*streamDef{
+		{Framing: `length-prefix`, Framing_Prefix_Width: 3},
+		{Framing: `length-prefix`, Split_Lines: true},
+		{Framing: `newline`, Framing_Byte_Order: `little`},
+		{Framing: `chunked`},
+	} {
+		if err := verifyConfig(testConfig(sd)); err == nil {
+			t.Fatalf("accepted %+v", sd)
+		}
+	}
+	sd := &streamDef{Split_Lines: true}
+	if err := verifyConfig(testConfig(sd)); err != nil {
+		t.Fatal(err)
+	} else if sd.Framing != framingNewline {
+		t.Fatalf("Split-Lines gave %s framing", sd.Framing)
+	}
+	sd = &streamDef{Framing: ` Length-Prefix `, Framing_Byte_Order: `Little`}
+	if err := verifyConfig(testConfig(sd)); err != nil {
+		t.Fatal(err)
+	}
+	if f, _ := sd.framer(); f.(*lengthPrefixFraming).width != defaultPrefixWidth {
+		t.Fatalf("bad framer %+v", f)
+	}
+}
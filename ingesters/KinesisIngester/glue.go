@@ -0,0 +1,216 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/glue"
+)
+
+const (
+	schemaRegistryGlue = `glue`
+
+	glueHeaderVersion   = 3
+	glueCompressionNone = 0
+	glueCompressionZlib = 5
+	glueHeaderSize      = 18 // version, compression, and the schema version ID
+
+	glueFormatAvro     = `AVRO`
+	glueFormatJSON     = `JSON`
+	glueFormatProtobuf = `PROTOBUF`
+
+	// a schema version which could not be resolved is looked up again after
+	// this long, so that a registry outage doesn't cost a call per record
+	glueRetryInterval = time.Minute
+)
+
+// glueSchemaVersion is a schema version fetched from the Glue Schema Registry.
+type glueSchemaVersion struct {
+	Format     string
+	Definition string
+}
+
+// glueRegistry fetches schema versions by ID, it is satisfied by a Glue client
+// and faked in the tests.
+type glueRegistry interface {
+	SchemaVersion(id string) (*glueSchemaVersion, error)
+}
+
+// glueClient looks up schema versions with the Glue API. The SDK we build with
+// predates the Schema Registry, so the GetSchemaVersion operation is described
+// here and sent through the SDK's Glue client, which signs and retries it like
+// any other call.
+type glueClient struct {
+	svc *glue.Glue
+}
+
+type getSchemaVersionInput struct {
+	_               struct{} `type:"structure"`
+	SchemaVersionId *string  `type:"string"`
+}
+
+type getSchemaVersionOutput struct {
+	_                struct{} `type:"structure"`
+	DataFormat       *string  `type:"string"`
+	SchemaDefinition *string  `type:"string"`
+	Status           *string  `type:"string"`
+}
+
+func (gc glueClient) SchemaVersion(id string) (*glueSchemaVersion, error) {
+	out := &getSchemaVersionOutput{}
+	req := gc.svc.NewRequest(&request.Operation{
+		Name:       `GetSchemaVersion`,
+		HTTPMethod: `POST`,
+		HTTPPath:   `/`,
+	}, &getSchemaVersionInput{SchemaVersionId: aws.String(id)}, out)
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
+	if st := aws.StringValue(out.Status); st != `` && st != `AVAILABLE` {
+		return nil, fmt.Errorf("schema version %s is %s", id, st)
+	}
+	return &glueSchemaVersion{
+		Format:     aws.StringValue(out.DataFormat),
+		Definition: aws.StringValue(out.SchemaDefinition),
+	}, nil
+}
+
+// glueSchema is a resolved schema version ready to decode records, or the
+// error resolving it until the next attempt.
+type glueSchema struct {
+	decode func([]byte) ([]byte, error)
+	err    error
+	retry  time.Time
+}
+
+// glueDecoder decodes records in the Glue Schema Registry wire format to JSON:
+// a version byte, a compression byte, the 16 byte schema version ID, and the
+// data, zlib compressed if the compression byte says so. Schema versions are
+// fetched from the registry once and cached. Records without the header are
+// returned as they are. It is safe for concurrent use.
+type glueDecoder struct {
+	reg     glueRegistry
+	mtx     sync.Mutex
+	schemas map[uuid.UUID]*glueSchema
+}
+
+func newGlueDecoder(reg glueRegistry) *glueDecoder {
+	return &glueDecoder{
+		reg:     reg,
+		schemas: make(map[uuid.UUID]*glueSchema),
+	}
+}
+
+// Decode returns the JSON form of a record, or the record itself if it is not
+// in the Glue wire format.
+func (gd *glueDecoder) Decode(data []byte) ([][]byte, error) {
+	if len(data) < glueHeaderSize || data[0] != glueHeaderVersion {
+		return [][]byte{data}, nil
+	}
+	var id uuid.UUID
+	copy(id[:], data[2:glueHeaderSize])
+	payload := data[glueHeaderSize:]
+	switch data[1] {
+	case glueCompressionNone:
+	case glueCompressionZlib:
+		zr, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		if payload, err = ioutil.ReadAll(zr); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown Glue Schema Registry compression %d", data[1])
+	}
+	s := gd.schema(id)
+	if s.err != nil {
+		return nil, s.err
+	}
+	v, err := s.decode(payload)
+	if err != nil {
+		return nil, fmt.Errorf("schema version %s: %v", id, err)
+	}
+	return [][]byte{v}, nil
+}
+
+// schema returns the cached schema version, fetching it if it isn't cached
+// or the last attempt failed long enough ago.
+func (gd *glueDecoder) schema(id uuid.UUID) *glueSchema {
+	gd.mtx.Lock()
+	defer gd.mtx.Unlock()
+	if s, ok := gd.schemas[id]; ok && (s.err == nil || time.Now().Before(s.retry)) {
+		return s
+	}
+	s := &glueSchema{}
+	if sv, err := gd.reg.SchemaVersion(id.String()); err != nil {
+		s.err = fmt.Errorf("failed to fetch schema version %s: %v", id, err)
+	} else if s.decode, err = glueSchemaDecoder(sv); err != nil {
+		s.err = fmt.Errorf("schema version %s: %v", id, err)
+	}
+	if s.err != nil {
+		s.retry = time.Now().Add(glueRetryInterval)
+	}
+	gd.schemas[id] = s
+	return s
+}
+
+// glueSchemaDecoder returns a function decoding data of a schema version.
+func glueSchemaDecoder(sv *glueSchemaVersion) (func([]byte) ([]byte, error), error) {
+	switch sv.Format {
+	case glueFormatAvro:
+		s, err := parseAvroSchema([]byte(sv.Definition))
+		if err != nil {
+			return nil, err
+		}
+		return func(data []byte) ([]byte, error) {
+			return decodeAvroValue(s, data)
+		}, nil
+	case glueFormatJSON:
+		return func(data []byte) ([]byte, error) {
+			return data, nil
+		}, nil
+	case glueFormatProtobuf:
+		pf, err := parseProto(sv.Definition)
+		if err != nil {
+			return nil, err
+		}
+		return pf.decodeGlue, nil
+	}
+	return nil, fmt.Errorf("unsupported data format %q", sv.Format)
+}
+
+// decodeGlue decodes a protobuf message as written by the Glue Schema
+// Registry serializer, which precedes the message with the index of its type
+// among every message of the schema sorted by full name.
+func (pf *protoFile) decodeGlue(data []byte) ([]byte, error) {
+	idx, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, errors.New("missing protobuf message index")
+	} else if idx >= uint64(len(pf.order)) {
+		return nil, fmt.Errorf("protobuf message index %d is out of range, the schema has %d messages", idx, len(pf.order))
+	}
+	var buf bytes.Buffer
+	if err := decodeProtoMessage(pf.order[idx], data[n:], &buf, 0); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,168 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glue"
+)
+
+type fakeGlueRegistry struct {
+	sync.Mutex
+	versions map[string]*glueSchemaVersion
+	calls    int
+}
+
+func (f *fakeGlueRegistry) SchemaVersion(id string) (*glueSchemaVersion, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.calls++
+	if sv, ok := f.versions[id]; ok {
+		return sv, nil
+	}
+	return nil, errors.New("EntityNotFoundException")
+}
+
+// glueRecord wraps data in the Glue Schema Registry header.
+func glueRecord(id uuid.UUID, compression byte, data []byte) []byte {
+	b := append([]byte{glueHeaderVersion, compression}, id[:]...)
+	return append(b, data...)
+}
+
+func TestGlueDecoder(t *testing.T) {
+	avroID, jsonID, protoID, badID := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	reg := &fakeGlueRegistry{versions: map[string]*glueSchemaVersion{
+		avroID.String():  {Format: glueFormatAvro, Definition: testAvroSchema},
+		jsonID.String():  {Format: glueFormatJSON, Definition: `{"type":"object"}`},
+		protoID.String(): {Format: glueFormatProtobuf, Definition: testProtoSchema},
+	}}
+	gd := newGlueDecoder(reg)
+
+	var zb bytes.Buffer
+	zw := zlib.NewWriter(&zb)
+	zw.Write(testAvroEvent())
+	zw.Close()
+	addr := protoBytes(nil, 1, []byte(`Boise`))
+	tests := []struct {
+		data []byte
+		json string
+	}{
+		{glueRecord(avroID, glueCompressionNone, testAvroEvent()), testAvroEventJSON},
+		{glueRecord(avroID, glueCompressionZlib, zb.Bytes()), testAvroEventJSON},
+		{glueRecord(jsonID, glueCompressionNone, []byte(`{"a":1}`)), `{"a":1}`},
+		{glueRecord(protoID, glueCompressionNone, append([]byte{0}, testProtoEvent()...)), testProtoEventJSON},
+		{glueRecord(protoID, glueCompressionNone, append([]byte{1}, addr...)), `{"city":"Boise"}`},
+		// records without the header are passed through
+		{[]byte(`plain text`), `plain text`},
+	}
+	for i, tt := range tests {
+		vals, err := gd.Decode(tt.data)
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		} else if len(vals) != 1 || string(vals[0]) != tt.json {
+			t.Fatalf("record %d: bad values %q", i, vals)
+		} else if i < 5 && !json.Valid(vals[0]) {
+			t.Fatalf("record %d: invalid JSON %s", i, vals[0])
+		}
+	}
+	if reg.calls != 3 {
+		t.Fatalf("fetched %d schema versions rather than caching 3", reg.calls)
+	}
+
+	// failed lookups aren't repeated for every record
+	for i := 0; i < 3; i++ {
+		if _, err := gd.Decode(glueRecord(badID, glueCompressionNone, []byte(`x`))); err == nil {
+			t.Fatal("decoded a record with an unknown schema version")
+		}
+	}
+	if reg.calls != 4 {
+		t.Fatalf("fetched %d schema versions, the failed lookup wasn't cached", reg.calls)
+	}
+	gd.schemas[badID].retry = gd.schemas[badID].retry.Add(-glueRetryInterval)
+	reg.versions[badID.String()] = &glueSchemaVersion{Format: glueFormatJSON}
+	if vals, err := gd.Decode(glueRecord(badID, glueCompressionNone, []byte(`{}`))); err != nil || string(vals[0]) != `{}` {
+		t.Fatalf("failed lookup wasn't retried: %q %v", vals, err)
+	}
+
+	bad := [][]byte{
+		glueRecord(avroID, 9, testAvroEvent()),
+		glueRecord(avroID, glueCompressionZlib, testAvroEvent()),
+		glueRecord(avroID, glueCompressionNone, []byte{0x01}),
+		glueRecord(protoID, glueCompressionNone, []byte{7}),
+		glueRecord(protoID, glueCompressionNone, nil),
+	}
+	for i, b := range bad {
+		if _, err := gd.Decode(b); err == nil {
+			t.Fatalf("decoded bad record %d", i)
+		}
+	}
+}
+
+func TestGlueClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(`X-Amz-Target`) != `AWSGlue.GetSchemaVersion` || string(body) != `{"SchemaVersionId":"abc"}` {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"InvalidInputException","message":"bad request"}`))
+			return
+		}
+		w.Write([]byte(`{"DataFormat":"AVRO","SchemaDefinition":"\"string\"","Status":"AVAILABLE"}`))
+	}))
+	defer srv.Close()
+	sess, err := session.NewSession(aws.NewConfig().
+		WithRegion(`us-east-1`).
+		WithEndpoint(srv.URL).
+		WithCredentials(credentials.NewStaticCredentials(`id`, `secret`, ``)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc := glueClient{svc: glue.New(sess)}
+	sv, err := gc.SchemaVersion(`abc`)
+	if err != nil {
+		t.Fatal(err)
+	} else if sv.Format != glueFormatAvro || sv.Definition != `"string"` {
+		t.Fatalf("bad schema version %+v", sv)
+	}
+	if _, err = gc.SchemaVersion(`def`); err == nil {
+		t.Fatal("no error from a failed request")
+	}
+}
+
+func TestVerifySchemaRegistry(t *testing.T) {
+	sd := streamDef{Region: `us-east-1`, Content_Type: contentTypeRaw, Framing: framingNone, Schema_Registry: ` Glue `}
+	if err := sd.verifySchemaRegistry(); err != nil {
+		t.Fatal(err)
+	} else if sd.Schema_Registry != schemaRegistryGlue || sd.schemaRegistryRegion() != `us-east-1` {
+		t.Fatalf("bad stream %+v", sd)
+	}
+	for _, bad := range []streamDef{
+		{Content_Type: contentTypeRaw, Framing: framingNone, Schema_Registry: `confluent`},
+		{Content_Type: contentTypeAvro, Framing: framingNone, Schema_Registry: `glue`},
+		{Content_Type: contentTypeRaw, Framing: framingNewline, Schema_Registry: `glue`},
+		{Content_Type: contentTypeRaw, Framing: framingNone, Schema_Registry_Region: `us-west-2`},
+	} {
+		if err := bad.verifySchemaRegistry(); err == nil {
+			t.Fatalf("accepted %+v", bad)
+		}
+	}
+}
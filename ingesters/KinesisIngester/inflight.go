@@ -0,0 +1,124 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
+)
+
+const (
+	inFlightSyncInterval = time.Second
+	inFlightSyncTimeout  = 10 * time.Second
+	inFlightPollInterval = 100 * time.Millisecond
+)
+
+type syncer interface {
+	SyncContext(context.Context, time.Duration) error
+}
+
+// inFlightLimiter bounds the bytes of entries handed to the processor sets but
+// not yet acknowledged by an indexer. Entries are considered acknowledged once
+// a sync of the muxer completes after they were written. Shards wait for the
+// budget before reading more records, which pushes back onto Kinesis rather
+// than buffering without limit when the indexers are slow.
+type inFlightLimiter struct {
+	bytes int64 // first for 64-bit alignment of atomic operations
+	max   int64
+	sync  syncer
+	gauge *awsutils.PromValue
+	kick  chan struct{}
+}
+
+// newInFlightLimiter creates a limiter with a budget of max bytes, a max of
+// zero or less disables the limit and returns nil.
+func newInFlightLimiter(max int64, s syncer) *inFlightLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &inFlightLimiter{
+		max:  max,
+		sync: s,
+		kick: make(chan struct{}, 1),
+	}
+}
+
+// SetProm exports the current in-flight bytes as a gauge.
+func (l *inFlightLimiter) SetProm(pm *promMetrics) {
+	if l != nil && pm != nil {
+		l.gauge = pm.inFlight
+	}
+}
+
+// Add counts n bytes handed off for processing, a nil limiter does nothing.
+func (l *inFlightLimiter) Add(n uint64) {
+	if l == nil {
+		return
+	}
+	v := atomic.AddInt64(&l.bytes, int64(n))
+	l.gauge.Set(float64(v))
+	if v >= l.max {
+		// get the syncer going rather than waiting for the next tick
+		select {
+		case l.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Bytes returns the bytes currently in flight.
+func (l *inFlightLimiter) Bytes() int64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.bytes)
+}
+
+// Wait blocks while the budget is exceeded and active returns true. It returns
+// true if the caller had to wait.
+func (l *inFlightLimiter) Wait(active func() bool) (waited bool) {
+	if l == nil {
+		return
+	}
+	for l.Bytes() >= l.max && active() {
+		waited = true
+		time.Sleep(inFlightPollInterval)
+	}
+	return
+}
+
+// run periodically syncs the muxer and releases the bytes written before the
+// sync started, until ctx is cancelled.
+func (l *inFlightLimiter) run(ctx context.Context) {
+	ticker := time.NewTicker(inFlightSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.kick:
+		case <-ctx.Done():
+			return
+		}
+		n := l.Bytes()
+		if n == 0 {
+			continue
+		}
+		sctx, cancel := context.WithTimeout(ctx, inFlightSyncTimeout)
+		err := l.sync.SyncContext(sctx, inFlightSyncTimeout)
+		cancel()
+		if err != nil {
+			debugout("Failed to sync %d in-flight bytes: %v\n", n, err)
+			continue
+		}
+		l.gauge.Set(float64(atomic.AddInt64(&l.bytes, -n)))
+	}
+}
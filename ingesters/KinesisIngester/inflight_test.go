@@ -0,0 +1,84 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testSyncer struct {
+	fail  int32
+	syncs int32
+}
+
+func (ts *testSyncer) SyncContext(ctx context.Context, to time.Duration) error {
+	atomic.AddInt32(&ts.syncs, 1)
+	if atomic.LoadInt32(&ts.fail) != 0 {
+		return errors.New("all connections down")
+	}
+	return nil
+}
+
+func TestInFlightLimiter(t *testing.T) {
+	if l := newInFlightLimiter(0, &testSyncer{}); l != nil {
+		t.Fatal("zero budget did not disable the limiter")
+	}
+	var nl *inFlightLimiter
+	nl.Add(100)
+	if nl.Wait(func() bool { return true }) || nl.Bytes() != 0 {
+		t.Fatal("nil limiter is not a no-op")
+	}
+
+	ts := &testSyncer{fail: 1}
+	l := newInFlightLimiter(1000, ts)
+	l.Add(600)
+	if l.Wait(func() bool { return true }) {
+		t.Fatal("waited while under budget")
+	}
+	l.Add(600)
+	if l.Bytes() != 1200 {
+		t.Fatalf("bad in-flight bytes: %d", l.Bytes())
+	}
+	if l.Wait(func() bool { return false }) {
+		t.Fatal("waited on an inactive shard")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// failed syncs must not release anything
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&ts.syncs) == 0 {
+		t.Fatal("exceeding the budget did not trigger a sync")
+	}
+	if l.Bytes() != 1200 {
+		t.Fatalf("failed sync released bytes: %d", l.Bytes())
+	}
+
+	atomic.StoreInt32(&ts.fail, 0)
+	start := time.Now()
+	if !l.Wait(func() bool { return time.Since(start) < 5*time.Second }) {
+		t.Fatal("did not wait while over budget")
+	}
+	if l.Bytes() != 0 {
+		t.Fatalf("successful sync did not release bytes: %d", l.Bytes())
+	}
+}
@@ -0,0 +1,162 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// The Kinesis Producer Library packs multiple user records into a single
+// Kinesis record. An aggregated record is the magic header, a protobuf encoded
+// AggregatedRecord message, and the MD5 digest of the message:
+//
+//	message AggregatedRecord {
+//		repeated string partition_key_table     = 1;
+//		repeated string explicit_hash_key_table = 2;
+//		repeated Record records                 = 3;
+//	}
+//	message Record {
+//		required uint64 partition_key_index     = 1;
+//		optional uint64 explicit_hash_key_index = 2;
+//		required bytes  data                    = 3;
+//		repeated Tag    tags                    = 4;
+//	}
+
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+)
+
+var (
+	kplMagic = []byte{0xF3, 0x89, 0x9A, 0xC2}
+
+	ErrNotAggregated     = errors.New("Record is not a KPL aggregated record")
+	ErrBadKPLChecksum    = errors.New("KPL aggregated record checksum mismatch")
+	ErrMalformedProtobuf = errors.New("Malformed protobuf in KPL aggregated record")
+	ErrBadPartitionKey   = errors.New("KPL user record references an invalid partition key")
+)
+
+// isAggregated returns true if the data looks like a KPL aggregated record.
+func isAggregated(data []byte) bool {
+	return len(data) >= len(kplMagic)+md5.Size && bytes.HasPrefix(data, kplMagic)
+}
+
+// deaggregate unpacks a KPL aggregated record into its user records. Each user
+// record inherits the sequence number and arrival time of the Kinesis record
+// that carried it, and carries its own partition key.
+func deaggregate(r *kinesis.Record) (recs []*kinesis.Record, err error) {
+	if !isAggregated(r.Data) {
+		err = ErrNotAggregated
+		return
+	}
+	msg := r.Data[len(kplMagic) : len(r.Data)-md5.Size]
+	sum := md5.Sum(msg)
+	if !bytes.Equal(sum[:], r.Data[len(r.Data)-md5.Size:]) {
+		err = ErrBadKPLChecksum
+		return
+	}
+
+	var keys []string
+	var records [][]byte
+	err = walkProtobuf(msg, func(field uint64, val []byte) error {
+		switch field {
+		case 1:
+			keys = append(keys, string(val))
+		case 3:
+			records = append(records, val)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	recs = make([]*kinesis.Record, 0, len(records))
+	for _, rec := range records {
+		var keyIdx uint64
+		var data []byte
+		err = walkProtobuf(rec, func(field uint64, val []byte) error {
+			switch field {
+			case 1:
+				v, n := binary.Uvarint(val)
+				if n <= 0 {
+					return ErrMalformedProtobuf
+				}
+				keyIdx = v
+			case 3:
+				data = val
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		} else if keyIdx >= uint64(len(keys)) {
+			return nil, ErrBadPartitionKey
+		}
+		key := keys[keyIdx]
+		recs = append(recs, &kinesis.Record{
+			ApproximateArrivalTimestamp: r.ApproximateArrivalTimestamp,
+			Data:                        data,
+			EncryptionType:              r.EncryptionType,
+			PartitionKey:                &key,
+			SequenceNumber:              r.SequenceNumber,
+		})
+	}
+	return
+}
+
+// walkProtobuf calls fn with the field number and raw value of every field in
+// a protobuf message. Varint values are handed over still encoded, length
+// delimited values are handed over without their length prefix.
+func walkProtobuf(b []byte, fn func(field uint64, val []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return ErrMalformedProtobuf
+		}
+		b = b[n:]
+		var val []byte
+		switch key & 0x7 {
+		case pbVarint:
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return ErrMalformedProtobuf
+			}
+			val, b = b[:n], b[n:]
+		case pbFixed64:
+			if len(b) < 8 {
+				return ErrMalformedProtobuf
+			}
+			val, b = b[:8], b[8:]
+		case pbBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return ErrMalformedProtobuf
+			}
+			val, b = b[n:n+int(l)], b[n+int(l):]
+		case pbFixed32:
+			if len(b) < 4 {
+				return ErrMalformedProtobuf
+			}
+			val, b = b[:4], b[4:]
+		default:
+			return ErrMalformedProtobuf
+		}
+		if err := fn(key>>3, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func appendUvarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, v)
+	return append(b, buf[:n]...)
+}
+
+func pbKey(field, wire uint64) []byte {
+	return appendUvarint(nil, field<<3|wire)
+}
+
+func pbLenField(field uint64, val []byte) []byte {
+	b := pbKey(field, pbBytes)
+	b = appendUvarint(b, uint64(len(val)))
+	return append(b, val...)
+}
+
+func pbVarintField(field, val uint64) []byte {
+	return appendUvarint(pbKey(field, pbVarint), val)
+}
+
+type testUserRecord struct {
+	key  uint64
+	data string
+}
+
+func makeAggregated(keys []string, urs []testUserRecord) []byte {
+	var msg []byte
+	for _, k := range keys {
+		msg = append(msg, pbLenField(1, []byte(k))...)
+	}
+	for _, ur := range urs {
+		var rec []byte
+		rec = append(rec, pbVarintField(1, ur.key)...)
+		rec = append(rec, pbVarintField(2, 0)...)
+		rec = append(rec, pbLenField(3, []byte(ur.data))...)
+		msg = append(msg, pbLenField(3, rec)...)
+	}
+	sum := md5.Sum(msg)
+	b := append([]byte{}, kplMagic...)
+	b = append(b, msg...)
+	return append(b, sum[:]...)
+}
+
+func TestDeaggregate(t *testing.T) {
+	keys := []string{`tenantA`, `tenantB`}
+	urs := []testUserRecord{
+		{key: 0, data: `first record`},
+		{key: 1, data: `second record`},
+		{key: 0, data: `third record`},
+	}
+	ts := time.Now()
+	r := &kinesis.Record{
+		ApproximateArrivalTimestamp: &ts,
+		Data:                        makeAggregated(keys, urs),
+		PartitionKey:                aws.String(`aggregate`),
+		SequenceNumber:              aws.String(`12345`),
+	}
+	if !isAggregated(r.Data) {
+		t.Fatal("aggregated record not detected")
+	}
+	recs, err := deaggregate(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != len(urs) {
+		t.Fatalf("got %d records, expected %d", len(recs), len(urs))
+	}
+	for i, rec := range recs {
+		if string(rec.Data) != urs[i].data {
+			t.Fatalf("record %d data %q != %q", i, rec.Data, urs[i].data)
+		}
+		if *rec.PartitionKey != keys[urs[i].key] {
+			t.Fatalf("record %d partition key %q != %q", i, *rec.PartitionKey, keys[urs[i].key])
+		}
+		if *rec.SequenceNumber != `12345` || !rec.ApproximateArrivalTimestamp.Equal(ts) {
+			t.Fatalf("record %d did not inherit the parent record metadata", i)
+		}
+	}
+}
+
+func TestDeaggregateBadInput(t *testing.T) {
+	if isAggregated([]byte(`just a regular record`)) {
+		t.Fatal("plain record detected as aggregated")
+	}
+	if _, err := deaggregate(&kinesis.Record{Data: []byte(`just a regular record`)}); err != ErrNotAggregated {
+		t.Fatalf("bad error on plain record: %v", err)
+	}
+
+	// flip a bit in the payload so the checksum no longer matches
+	data := makeAggregated([]string{`key`}, []testUserRecord{{key: 0, data: `stuff`}})
+	data[len(kplMagic)+2] ^= 0x1
+	if _, err := deaggregate(&kinesis.Record{Data: data}); err != ErrBadKPLChecksum {
+		t.Fatalf("bad error on corrupt record: %v", err)
+	}
+
+	// reference a partition key that doesn't exist
+	data = makeAggregated([]string{`key`}, []testUserRecord{{key: 4, data: `stuff`}})
+	if _, err := deaggregate(&kinesis.Record{Data: data}); err != ErrBadPartitionKey {
+		t.Fatalf("bad error on invalid partition key: %v", err)
+	}
+
+	// truncated protobuf with a valid checksum
+	msg := pbLenField(1, []byte(`key`))
+	msg = msg[:len(msg)-1]
+	sum := md5.Sum(msg)
+	data = append(append(append([]byte{}, kplMagic...), msg...), sum[:]...)
+	if _, err := deaggregate(&kinesis.Record{Data: data}); err != ErrMalformedProtobuf {
+		t.Fatalf("bad error on malformed protobuf: %v", err)
+	}
+	if !bytes.HasPrefix(data, kplMagic) {
+		t.Fatal("bad test data")
+	}
+}
@@ -9,11 +9,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"os"
 	"path"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -21,18 +24,28 @@ import (
 	"github.com/gravwell/gravwell/v3/ingest"
 	"github.com/gravwell/gravwell/v3/ingest/entry"
 	"github.com/gravwell/gravwell/v3/ingest/log"
+	"github.com/gravwell/gravwell/v3/ingest/processors"
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
 	"github.com/gravwell/gravwell/v3/ingesters/utils"
 	"github.com/gravwell/gravwell/v3/ingesters/version"
-	"github.com/gravwell/gravwell/v3/timegrinder"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/glue"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 )
 
 const (
 	defaultConfigLoc = `/opt/gravwell/etc/kinesis_ingest.conf`
+
+	// sequence numbers are decimal strings, so this can never collide with one
+	shardClosedMarker = `SHARD_END`
+
+	getRecordsMaxBytes = 10 * 1024 * 1024 // GetRecords response size cap
+	maxRecordBytes     = 1024 * 1024      // largest record a producer can put
+
+	streamStatusPollInterval = 5 * time.Second // while waiting for a stream to become active
 )
 
 var (
@@ -40,10 +53,19 @@ var (
 	verbose        = flag.Bool("v", false, "Display verbose status updates to stdout")
 	ver            = flag.Bool("version", false, "Print the version information and exit")
 	stderrOverride = flag.String("stderr", "", "Redirect stderr to a shared memory file")
+	validate       = flag.Bool("validate", false, "Validate the configuration and AWS access, then exit")
+	resetCkpt      = flag.Bool("reset-checkpoint", false, "Rewrite the checkpoints of -stream so the next run replays it, then exit")
+	resetStream    = flag.String("stream", "", "Stream to reset with -reset-checkpoint")
+	toHorizon      = flag.Bool("to-horizon", false, "Replay the stream from the trim horizon")
+	toTimestamp    = flag.String("to-timestamp", "", "Replay the stream from an RFC3339 timestamp")
+	confirm        = flag.Bool("confirm", false, "Actually write the checkpoints with -reset-checkpoint, otherwise they are only listed")
+	selftest       = flag.Bool("selftest", false, "Write a canary entry to every configured tag once connected to the indexers, then exit")
+	restoreCkpt    = flag.String("restore-checkpoint", "", "Replace the checkpoints in the state file with a checkpoint entry saved from the Checkpoint-Backup-Tag, then exit")
+	ignoreCkpt     = flag.Bool("ignore-checkpoint", false, "Start every shard from records arriving after startup, overwriting the stored checkpoints and skipping unread records")
 	lg             *log.Logger
 )
 
-func init() {
+func handleFlags() {
 	flag.Parse()
 	if *ver {
 		version.PrintVersion(os.Stdout)
@@ -75,13 +97,43 @@ func init() {
 }
 
 func main() {
+	handleFlags()
+	if *validate {
+		if err := validateConfig(*configLoc, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Validation failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *resetCkpt {
+		if err := runReset(); err != nil {
+			fmt.Fprintf(os.Stderr, "Reset failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *restoreCkpt != `` {
+		if err := runRestore(); err != nil {
+			fmt.Fprintf(os.Stderr, "Restore failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	var wg sync.WaitGroup
-	running := true
+	// cancelled when everything should exit, shards finish the records in hand
+	ctx, cancel := context.WithCancel(context.Background())
+	// cancelled once the Shutdown-Grace is over, aborting in-flight AWS calls
+	// and writes
+	abort, abortAll := context.WithCancel(context.Background())
+	defer abortAll()
 
 	cfg, err := GetConfig(*configLoc)
 	if err != nil {
 		lg.Fatal("Failed to get configuration: %v", err)
 	}
+	if err = lg.SetFormatString(cfg.Global.Log_Format); err != nil {
+		lg.FatalCode(0, "Invalid Log Format \"%s\": %v", cfg.Global.Log_Format, err)
+	}
 	if len(cfg.Global.Log_File) > 0 {
 		fout, err := os.OpenFile(cfg.Global.Log_File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
 		if err != nil {
@@ -98,15 +150,6 @@ func main() {
 		}
 	}
 
-	// Get the state file
-	stateFile, err := utils.NewState(cfg.Global.State_Store_Location, 0600)
-	if err != nil {
-		lg.Fatal("Couldn't open state file: %v", err)
-	}
-	stateMan := NewStateman(stateFile)
-	stateMan.Start()
-	defer stateMan.Close()
-
 	tags, err := cfg.Tags()
 	if err != nil {
 		lg.Fatal("Failed to get tags from configuration: %v", err)
@@ -136,6 +179,7 @@ func main() {
 		ingestConfig.EnableCache = true
 		ingestConfig.CacheConfig.FileBackingLocation = cfg.CachePath()
 	}
+	ingestConfig.PublicKey, ingestConfig.PrivateKey = cfg.Global.TLSClientCert()
 	igst, err := ingest.NewUniformMuxer(ingestConfig)
 	if err != nil {
 		lg.Fatal("Failed build our ingest system: %v", err)
@@ -152,17 +196,165 @@ func main() {
 		lg.FatalCode(0, "Timedout waiting for backend connections: %v\n", err)
 	}
 	debugout("Successfully connected to ingesters\n")
+	if *selftest {
+		if err := awsutils.SelfTest(igst, "Kinesis", id.String(), tags, os.Stdout); err != nil {
+			lg.FatalCode(0, "Self-test failed: %v", err)
+		}
+		igst.Close()
+		os.Exit(0)
+	}
+
+	spool, err := awsutils.NewSpool(cfg.Global.Spool_Dir, cfg.Global.Spool_Max_Size, igst, func(err error) {
+		lg.Warn("Failed to replay spooled entries from %s: %v", cfg.Global.Spool_Dir, err)
+	})
+	if err != nil {
+		lg.Fatal("Failed to open Spool-Dir %s: %v", cfg.Global.Spool_Dir, err)
+	}
+	// entries are written through the spool if there is one
+	var writer ingestWriter = igst
+	if spool != nil {
+		writer = spool
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			spool.Run(ctx)
+		}()
+	}
+
+	if cfg.Global.credentials().TemporaryStaticKeys() {
+		lg.Warn("AWS-Access-Key-ID looks like temporary STS credentials, which are never refreshed and stop working once they expire, " +
+			"use Role-ARN, Use-Instance-Role, AWS-Profile, or no keys for the default AWS credential chain")
+	}
+	// make an aws session, each stream gets a client for its own region
+	sess, err := awsutils.NewSession(``, cfg.Global.credentials())
+	if err != nil {
+		lg.Fatal("Failed to create AWS session: %v", err)
+	}
+
+	tee, err := awsutils.NewTee(cfg.Global.Debug_Tee_File, cfg.Global.Debug_Tee_Max_Size, cfg.Global.Debug_Tee_Region, cfg.Global.credentials(), func(err error) {
+		lg.Warn("Failed to write to Debug-Tee-File %s: %v", cfg.Global.Debug_Tee_File, err)
+	})
+	if err != nil {
+		lg.Fatal("Failed to open Debug-Tee-File %s: %v", cfg.Global.Debug_Tee_File, err)
+	} else if tee != nil {
+		lg.Warn("Copying raw records to Debug-Tee-File %s", cfg.Global.Debug_Tee_File)
+	}
+	payloads := cfg.Global.payloadLogger(lg.Warn)
+
+	var stateMan checkpointer
+	if cfg.Global.Checkpoint_Backend == checkpointBackendDynamo {
+		// leases are shared with other ingesters, so the owner must be unique
+		// even if they were all started from the same config file
+		hostname, _ := os.Hostname()
+		owner := fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), id)
+		dsvc := dynamodb.New(sess, aws.NewConfig().WithRegion(cfg.Global.Checkpoint_Region))
+		stateMan = newDynamoCheckpointer(dsvc, cfg.Global.Checkpoint_Table, owner, cfg.Global.leaseDuration())
+		debugout("Using DynamoDB table %s for checkpoints as %s\n", cfg.Global.Checkpoint_Table, owner)
+	} else {
+		stateFile, err := utils.NewState(cfg.Global.State_Store_Location, 0600)
+		if err != nil {
+			lg.Fatal("Couldn't open state file: %v", err)
+		}
+		stateFile.SetCompression(cfg.Global.State_Store_Compress)
+		if cfg.Global.Checkpoint_Backup_Tag != `` {
+			ckptTag, err := igst.GetTag(cfg.Global.Checkpoint_Backup_Tag)
+			if err != nil {
+				lg.Fatal("Can't resolve checkpoint backup tag %v: %v", cfg.Global.Checkpoint_Backup_Tag, err)
+			}
+			stateMan = NewStateman(newTagStateStore(stateFile, igst, ckptTag, id.String()))
+			debugout("Backing up checkpoints to tag %s\n", cfg.Global.Checkpoint_Backup_Tag)
+		} else {
+			stateMan = NewStateman(stateFile)
+		}
+	}
+	stateMan.Start()
+
+	// with -ignore-checkpoint every shard we read starts from now, the old
+	// checkpoints are overwritten as the shards are launched
+	var tailFrom time.Time
+	if *ignoreCkpt {
+		tailFrom = time.Now()
+		lg.Warn("-ignore-checkpoint is set, every shard starts from records arriving after %v, unread records before then are skipped and their checkpoints overwritten",
+			tailFrom.Format(time.RFC3339))
+	}
+
+	// processor sets are shared by every shard of a stream, so we close them
+	// only after all of the shard workers have exited
+	var procsets []*processors.ProcessorSet
+	// enhanced fan-out consumers we registered, removed on clean shutdown
+	var consumers []registeredConsumer
+
+	var metricsTag entry.EntryTag
+	if cfg.Global.Metrics_Tag != `` {
+		if metricsTag, err = igst.GetTag(cfg.Global.Metrics_Tag); err != nil {
+			lg.Fatal("Can't resolve metrics tag %v: %v", cfg.Global.Metrics_Tag, err)
+		}
+	}
+
+	var prom *promMetrics
+	var promServer *awsutils.HTTPServer
+	var reg *awsutils.PromRegistry
+	if cfg.Global.Prometheus_Listen != `` {
+		reg = awsutils.NewPromRegistry()
+		prom = newPromMetrics(reg)
+		if promServer, err = awsutils.ServeProm(cfg.Global.Prometheus_Listen, reg); err != nil {
+			lg.Fatal("Failed to start Prometheus listener on %s: %v", cfg.Global.Prometheus_Listen, err)
+		}
+		debugout("Serving Prometheus metrics on %s\n", cfg.Global.Prometheus_Listen)
+	}
 
-	// Set up environment variables for AWS auth, if extant
-	if cfg.Global.AWS_Access_Key_ID != "" {
-		os.Setenv("AWS_ACCESS_KEY_ID", cfg.Global.AWS_Access_Key_ID)
+	// report the ingest cache while indexers are away, SIGUSR1 flushes it
+	cm := awsutils.NewCacheMonitor(igst, reg, `kinesis`, func(f string, args ...interface{}) {
+		lg.Info(f, args...)
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cm.Run(ctx, cfg.Global.metricsInterval())
+	}()
+
+	// SIGTSTP or the Pause-File pause every shard until SIGCONT or its removal
+	pause := awsutils.NewPauser(cfg.Global.Pause_File, reg, `kinesis`, func(f string, args ...interface{}) {
+		lg.Info(f, args...)
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pause.Run(ctx)
+	}()
+
+	var progress *awsutils.ProgressTracker
+	var healthServer *awsutils.HTTPServer
+	if cfg.Global.Health_Listen != `` {
+		progress = awsutils.NewProgressTracker()
+		hot := func() bool {
+			n, err := igst.Hot()
+			return err == nil && n > 0
+		}
+		h := awsutils.NewHealthHandler(hot, progress, pause, cfg.Global.healthProgressWindow())
+		if healthServer, err = awsutils.ListenAndServe(cfg.Global.Health_Listen, h); err != nil {
+			lg.Fatal("Failed to start health listener on %s: %v", cfg.Global.Health_Listen, err)
+		}
+		debugout("Serving health probes on %s\n", cfg.Global.Health_Listen)
 	}
-	if cfg.Global.AWS_Secret_Access_Key != "" {
-		os.Setenv("AWS_SECRET_ACCESS_KEY", cfg.Global.AWS_Secret_Access_Key)
+
+	inflight := newInFlightLimiter(cfg.Global.Max_In_Flight_Bytes, igst)
+	if inflight != nil {
+		inflight.SetProm(prom)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			inflight.run(ctx)
+		}()
 	}
 
-	// make an aws session
-	sess := session.Must(session.NewSession())
+	// shards of every stream take turns for these slots
+	slots := newShardSlots(cfg.Global.Max_Concurrent_Shards, nil)
+
+	// CloudWatch metrics go to the region of each stream, streams in the same
+	// region share a publisher so that their metrics are batched together
+	publishers := make(map[string]*cwPublisher)
+	glueDecoders := make(map[string]*glueDecoder)
 
 	for _, stream := range cfg.KinesisStream {
 		tagid, err := igst.GetTag(stream.Tag_Name)
@@ -170,243 +362,245 @@ func main() {
 			lg.Fatal("Can't resolve tag %v: %v", stream.Tag_Name, err)
 		}
 
-		procset, err := cfg.Preprocessor.ProcessorSet(igst, stream.Preprocessor)
+		routes, err := stream.tagRoutes()
+		if err != nil {
+			lg.Fatal("Invalid tag routes on stream %v: %v", stream.Stream_Name, err)
+		}
+		resolved, err := resolveTagRoutes(routes, igst.GetTag)
+		if err != nil {
+			lg.Fatal("Failed to resolve tag routes on stream %v: %v", stream.Stream_Name, err)
+		}
+		templ, err := stream.tagTemplate()
+		if err != nil {
+			lg.Fatal("Invalid Tag-Template on stream %v: %v", stream.Stream_Name, err)
+		}
+		filter, err := stream.keyFilter()
+		if err != nil {
+			lg.Fatal("Invalid partition key filters on stream %v: %v", stream.Stream_Name, err)
+		}
+
+		procset, err := cfg.Preprocessor.ProcessorSet(writer, stream.Preprocessor)
 		if err != nil {
 			lg.Fatal("Preprocessor construction error: %v", err)
 		}
+		procsets = append(procsets, procset)
 
 		// get a handle on kinesis
-		svc := kinesis.New(sess, aws.NewConfig().WithRegion(stream.Region))
+		lg.Info("Kinesis stream %s using region %s from the %s", stream.Stream_Name, stream.Region, stream.regionSource)
+		svc := kinesis.New(sess, stream.endpoint(&cfg.Global).Config().WithRegion(stream.Region))
 
 		// Get the list of shards
-		shards := []*kinesis.Shard{}
-		dsi := &kinesis.DescribeStreamInput{}
-		dsi.SetStreamName(stream.Stream_Name)
-		for {
-			streamdesc, err := svc.DescribeStream(dsi)
-			if err != nil {
-				lg.Error("Failed to get stream description: %v", err)
-				continue
-			}
-			newshards := streamdesc.StreamDescription.Shards
-			shards = append(shards, newshards...)
-			if *streamdesc.StreamDescription.HasMoreShards {
-				dsi.SetExclusiveStartShardId(*(newshards[len(newshards)-1].ShardId))
+		streamARN, shards, err := waitForStream(ctx, stream.shardLister(svc), stream.waitForActiveTimeout(), streamStatusPollInterval)
+		if err != nil {
+			lg.Fatal("Can't consume Kinesis stream %s: %s", stream.Stream_Name, awsutils.ErrorMessage(err))
+		}
+		debugout("Read %d shards from stream %s\n", len(shards), stream.Stream_Name)
+		partition := cfg.Global.partition()
+		if partition.count > 0 {
+			owned := partition.owned(shards)
+			lg.Info("Instance %d of %d reads %d of the %d shards of stream %s: %s", partition.index, partition.count, len(owned), len(shards), stream.Stream_Name, strings.Join(owned, ", "))
+		}
+		streamSlots := newShardSlots(stream.Max_Concurrent_Shards, slots)
+		if n := stream.Max_Concurrent_Shards; n > 0 && n < len(shards) {
+			lg.Info("Reading at most %d of the %d shards of stream %s at once", n, len(shards), stream.Stream_Name)
+		}
+
+		var consumerARN string
+		if stream.Consumer_Mode == consumerModeFanout {
+			name := stream.consumerName(id)
+			if consumerARN, err = registerConsumer(svc, streamARN, name); err != nil {
+				lg.Error("Failed to register enhanced fan-out consumer %s on stream %s, falling back to polling: %s", name, stream.Stream_Name, awsutils.ErrorMessage(err))
+				consumerARN = ``
 			} else {
-				break
+				debugout("Registered consumer %s on stream %s\n", name, stream.Stream_Name)
+				consumers = append(consumers, registeredConsumer{svc: svc, arn: consumerARN})
 			}
 		}
-		debugout("Read %d shards from stream %s\n", len(shards), stream.Stream_Name)
-		for i, shard := range shards {
-			// Detect and skip closed shards
-			if shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil {
-				lg.Info("Shard %v on stream %s appears to be closed, skipping", *shard.ShardId, stream.Stream_Name)
-				continue
+
+		var src net.IP
+		if cfg.Global.Source_Override != `` {
+			// global override
+			src = net.ParseIP(cfg.Global.Source_Override)
+			if src == nil {
+				lg.Fatal("Global Source-Override is invalid")
+			}
+		}
+
+		decomp, err := awsutils.NewDecompressor(stream.Decompression)
+		if err != nil {
+			lg.Fatal("Failed to create decompressor for stream %v: %v", stream.Stream_Name, err)
+		}
+		avro, err := stream.avroDecoder()
+		if err != nil {
+			lg.Fatal("Failed to create the Avro decoder for stream %v: %v", stream.Stream_Name, err)
+		}
+		var gd *glueDecoder
+		if stream.Schema_Registry == schemaRegistryGlue {
+			// streams share the schema cache of a registry region
+			region := stream.schemaRegistryRegion()
+			if gd = glueDecoders[region]; gd == nil {
+				gd = newGlueDecoder(glueClient{svc: glue.New(sess, aws.NewConfig().WithRegion(region))})
+				glueDecoders[region] = gd
 			}
-			go func(stream streamDef, shard kinesis.Shard, tagid entry.EntryTag, shardid int) {
+		}
+
+		metrics := newMetricsReporter(stream.Stream_Name)
+		if cfg.Global.Metrics_Tag != `` {
+			metrics.SetEntryTag(igst, metricsTag)
+		}
+		if prom != nil {
+			metrics.SetProm(prom)
+		}
+		metrics.SetProgress(progress)
+		metrics.SetInFlight(inflight)
+		metrics.SetPauser(pause)
+		metrics.SetCheckpointer(stateMan)
+		metrics.SetHotShardFactor(stream.Hot_Shard_Factor)
+		if cfg.Global.CloudWatch_Namespace != `` {
+			p, ok := publishers[stream.Region]
+			if !ok {
+				p = newCWPublisher(cloudwatch.New(sess, aws.NewConfig().WithRegion(stream.Region)), cfg.Global.CloudWatch_Namespace)
+				publishers[stream.Region] = p
 				wg.Add(1)
-				defer wg.Done()
-
-				// set up timegrinder and other long-lived stuff
-				tcfg := timegrinder.Config{
-					EnableLeftMostSeed: true,
-				}
-				tg, err := timegrinder.NewTimeGrinder(tcfg)
-				if err != nil {
-					stream.Parse_Time = false
-				}
-				if stream.Assume_Local_Timezone {
-					tg.SetLocalTime()
-				}
-				if stream.Timezone_Override != `` {
-					err = tg.SetTimezone(stream.Timezone_Override)
-					if err != nil {
-						fmt.Fprintf(os.Stderr, "Failed to set timezone to %v: %v\n", stream.Timezone_Override, err)
-						return
-					}
-				}
-				var src net.IP
-				if cfg.Global.Source_Override != `` {
-					// global override
-					src = net.ParseIP(cfg.Global.Source_Override)
-					if src == nil {
-						lg.Fatal("Global Source-Override is invalid")
-					}
-				}
-
-			reconnectLoop:
-				for {
-					gsii := &kinesis.GetShardIteratorInput{}
-					gsii.SetShardId(*shard.ShardId)
-					gsii.SetStreamName(stream.Stream_Name)
-					seqnum := stateMan.GetSequenceNum(stream.Stream_Name, *shard.ShardId)
-					if seqnum == `` {
-						// we don't have a previous state
-						debugout("No previous sequence number for stream %v shard %v, defaulting to %v\n", stream.Stream_Name, *shard.ShardId, stream.Iterator_Type)
-						gsii.SetShardIteratorType(stream.Iterator_Type)
-					} else {
-						gsii.SetShardIteratorType(`AFTER_SEQUENCE_NUMBER`)
-						gsii.SetStartingSequenceNumber(seqnum)
-					}
-
-					output, err := svc.GetShardIterator(gsii)
-					if err != nil {
-						lg.Error("error on shard #%d (%s): %v", shardid, *shard.ShardId, err)
-						time.Sleep(5 * time.Second)
-						continue
-					}
-					if output.ShardIterator == nil {
-						// this is weird, we are going to bail out
-						lg.Error("Got nil initial shard iterator, sleeping and retrying")
-						time.Sleep(5 * time.Second)
-						continue
-					}
-					iter := *output.ShardIterator
-
-					var lastSeqNum string
-					for running {
-						gri := &kinesis.GetRecordsInput{}
-						gri.SetLimit(5000)
-						gri.SetShardIterator(iter)
-						var res *kinesis.GetRecordsOutput
-						var err error
-						for {
-							res, err = svc.GetRecords(gri)
-							if res != nil {
-								if res.NextShardIterator != nil {
-									iter = *res.NextShardIterator
-								}
-							}
-							if err != nil {
-								if awsErr, ok := err.(awserr.Error); ok {
-									// process SDK error
-									if awsErr.Code() == kinesis.ErrCodeProvisionedThroughputExceededException {
-										lg.Warn("Throughput exceeded, trying again")
-										time.Sleep(500 * time.Millisecond)
-									} else if awsErr.Code() == kinesis.ErrCodeExpiredIteratorException {
-										lg.Info("Iterator expired, re-initializing")
-										time.Sleep(100 * time.Millisecond)
-										continue reconnectLoop
-									} else {
-										lg.Error("%s: %s", awsErr.Code(), awsErr.Message())
-										time.Sleep(500 * time.Millisecond)
-									}
-								} else {
-									lg.Error("unknown error: %v", err)
-								}
-							} else {
-								// if we got no records, chill for a sec before we hit it again
-								if len(res.Records) == 0 {
-									time.Sleep(100 * time.Millisecond)
-								}
-								break
-							}
-						}
-
-						for _, r := range res.Records {
-							lastSeqNum = *r.SequenceNumber
-							ent := &entry.Entry{
-								Tag:  tagid,
-								SRC:  src,
-								Data: r.Data,
-							}
-							if stream.Parse_Time == false {
-								ent.TS = entry.FromStandard(*r.ApproximateArrivalTimestamp)
-							} else {
-								ts, ok, err := tg.Extract(ent.Data)
-								if !ok || err != nil {
-									// something went wrong, switch to using kinesis timestamps
-									stream.Parse_Time = false
-									ent.TS = entry.FromStandard(*r.ApproximateArrivalTimestamp)
-								} else {
-									ent.TS = entry.FromStandard(ts)
-								}
-							}
-							if err = procset.Process(ent); err != nil {
-								lg.Error("Failed to handle entry: %v", err)
-							}
-						}
-						// Now update the most recent sequence number
-						if lastSeqNum != `` {
-							stateMan.UpdateSequenceNum(stream.Stream_Name, *shard.ShardId, lastSeqNum)
-						}
-					}
-					if err = procset.Close(); err != nil {
-						lg.Error("Failed to close processor set: %v", err)
-					}
-					// if we get to this point, exit the for loop
-					break
-				}
-			}(*stream, *shard, tagid, i)
+				go func() {
+					defer wg.Done()
+					p.run(ctx)
+				}()
+			}
+			metrics.SetCloudWatch(p)
+		}
+
+		st := &streamConsumer{
+			ctx:         ctx,
+			abort:       abort,
+			stream:      stream,
+			tag:         tagid,
+			routes:      resolved,
+			tagger:      awsutils.NewTagResolver(templ, tagid, igst.NegotiateTag),
+			filter:      filter,
+			src:         src,
+			svc:         svc,
+			procset:     procset,
+			igst:        writer,
+			stateMan:    stateMan,
+			consumerARN: consumerARN,
+			decomp:      decomp,
+			avro:        avro,
+			glue:        gd,
+			metrics:     metrics,
+			inflight:    inflight,
+			pause:       pause,
+			slots:       streamSlots,
+			partition:   partition,
+			tee:         tee,
+			payloads:    payloads,
+			tailFrom:    tailFrom,
+			wg:          &wg,
+			shards:      shards,
+			started:     make(map[string]bool),
+			closed:      make(chan string, 1),
 		}
+		wg.Add(2)
+		go st.run(stream.reshardCheckInterval())
+		go func() {
+			defer wg.Done()
+			metrics.run(ctx, igst, cfg.Global.metricsInterval())
+		}()
 	}
 
 	utils.WaitForQuit()
 
-	running = false
+	cancel()
+	if grace := cfg.Global.shutdownGrace(); !awsutils.WaitTimeout(&wg, grace) {
+		lg.Warn("Shard workers did not finish within the Shutdown-Grace of %v, cancelling them", grace)
+	}
+	abortAll()
 	wg.Wait()
-}
 
-func debugout(format string, args ...interface{}) {
-	if !*verbose {
-		return
+	if err := tee.Close(); err != nil {
+		lg.Error("Failed to close Debug-Tee-File %s: %v", cfg.Global.Debug_Tee_File, err)
+	}
+	if n := tee.Dropped(); n > 0 {
+		lg.Warn("Debug-Tee-File %s fell behind and skipped %d records", cfg.Global.Debug_Tee_File, n)
 	}
-	fmt.Printf(format, args...)
-}
 
-type stateman struct {
-	sync.Mutex
-	states    map[string]map[string]string // map of stream name to shard name to sequence number
-	stateFile *utils.State
-}
+	if spool != nil {
+		if err := spool.Close(); err != nil {
+			lg.Error("Failed to close Spool-Dir %s: %v", cfg.Global.Spool_Dir, err)
+		}
+		spooled, replayed, dropped, size := spool.Stats()
+		lg.Info("Spooled %d entries, replayed %d, dropped %d, %d bytes left in %s", spooled, replayed, dropped, size, cfg.Global.Spool_Dir)
+	}
 
-func NewStateman(stateFile *utils.State) *stateman {
-	sm := stateman{
-		states:    make(map[string]map[string]string),
-		stateFile: stateFile,
+	// every shard has written its final sequence number, persist them
+	stateMan.Close()
+
+	if promServer != nil {
+		if err := promServer.Close(); err != nil {
+			lg.Error("Failed to stop Prometheus listener: %v", err)
+		}
+	}
+	if healthServer != nil {
+		if err := healthServer.Close(); err != nil {
+			lg.Error("Failed to stop health listener: %v", err)
+		}
 	}
-	stateFile.Read(&sm.states)
-	return &sm
-}
 
-func (s *stateman) Start() {
-	go func() {
-		for {
-			select {
-			case <-time.After(15 * time.Second):
-				s.Flush()
-			}
+	for _, procset := range procsets {
+		if err := procset.Close(); err != nil {
+			lg.Error("Failed to close processor set: %v", err)
 		}
-	}()
+	}
+	for _, c := range consumers {
+		if err := deregisterConsumer(c.svc, c.arn); err != nil {
+			lg.Error("Failed to deregister stream consumer %s: %s", c.arn, awsutils.ErrorMessage(err))
+		}
+	}
 }
 
-func (s *stateman) Close() {
-	s.Flush()
+type registeredConsumer struct {
+	svc *kinesis.Kinesis
+	arn string
 }
 
-func (s *stateman) Flush() {
-	s.Lock()
-	defer s.Unlock()
-	s.stateFile.Write(s.states)
+// runReset checks the -reset-checkpoint flags and resets the checkpoints.
+func runReset() error {
+	if *resetStream == `` {
+		return errors.New("-stream is required")
+	}
+	var ts time.Time
+	if *toHorizon == (*toTimestamp != ``) {
+		return errors.New("exactly one of -to-horizon and -to-timestamp is required")
+	} else if *toTimestamp != `` {
+		var err error
+		if ts, err = time.Parse(time.RFC3339, *toTimestamp); err != nil {
+			return fmt.Errorf("invalid -to-timestamp: %v", err)
+		}
+	}
+	cfg, err := loadConfig(*configLoc)
+	if err != nil {
+		return err
+	}
+	return resetCheckpoint(cfg, *resetStream, ts, *confirm, os.Stdout)
 }
 
-func (s *stateman) UpdateSequenceNum(stream, shard, seq string) {
-	s.Lock()
-	defer s.Unlock()
-
-	_, ok := s.states[stream]
-	if !ok {
-		// initialize the stream
-		s.states[stream] = make(map[string]string)
+// runRestore replaces the checkpoints with the -restore-checkpoint entry.
+func runRestore() error {
+	fin, err := os.Open(*restoreCkpt)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+	cfg, err := loadConfig(*configLoc)
+	if err != nil {
+		return err
 	}
-	s.states[stream][shard] = seq
+	return restoreCheckpoint(cfg, fin, *confirm, os.Stdout)
 }
 
-func (s *stateman) GetSequenceNum(stream, shard string) string {
-	_, ok := s.states[stream]
-	if !ok {
-		// initialize the stream
-		s.states[stream] = make(map[string]string)
+func debugout(format string, args ...interface{}) {
+	if !*verbose {
+		return
 	}
-	return s.states[stream][shard]
+	fmt.Printf(format, args...)
 }
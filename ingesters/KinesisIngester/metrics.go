@@ -0,0 +1,650 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// maxSeqMarks bounds the checkpoints remembered per shard while the store is
+// not being written, older ones are forgotten.
+const maxSeqMarks = 4096
+
+// seqMark is the number of records read from a shard up to and including a
+// checkpointed sequence number.
+type seqMark struct {
+	seq  string
+	read uint64
+}
+
+// seqLess compares Kinesis sequence numbers, which are decimal integers too
+// large for a uint64.
+func seqLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// shardMetrics accumulates statistics for a single shard between reports.
+type shardMetrics struct {
+	sync.Mutex
+	shard        string
+	records      uint64
+	bytes        uint64
+	millisBehind int64
+	dropped      uint64 // oversized entries
+	truncated    uint64
+	procDropped  uint64 // entries the preprocessors failed on
+	procPassed   uint64
+	panics       uint64 // worker panics
+	sampledIn    uint64 // records kept and skipped by the Sample-Rate
+	sampledOut   uint64
+	clamped      uint64 // timestamps outside the Max-Timestamp-Skew window
+
+	// records read since the consumer started and the checkpoints taken
+	// since the last one written to the store, used to count the records
+	// which would be read again after a crash
+	read  uint64
+	marks []seqMark
+	base  uint64 // read as of the last persisted checkpoint
+
+	// optional Prometheus values, these are never reset
+	promRecords   *awsutils.PromValue
+	promBytes     *awsutils.PromValue
+	promLag       *awsutils.PromValue
+	promErrors    *awsutils.PromValue
+	promDropped   *awsutils.PromValue
+	promTruncated *awsutils.PromValue
+	promBehind    *awsutils.PromValue
+	promProcDrop  *awsutils.PromValue
+	promProcPass  *awsutils.PromValue
+	promPanics    *awsutils.PromValue
+	promSampleIn  *awsutils.PromValue
+	promSampleOut *awsutils.PromValue
+	promClamped   *awsutils.PromValue
+
+	progress *awsutils.ProgressTracker
+}
+
+// Update records a batch of records read from the shard along with how far
+// behind the tip of the stream the shard is.
+func (sm *shardMetrics) Update(records []*kinesis.Record, millisBehind *int64) {
+	sm.progress.Mark()
+	sm.Lock()
+	defer sm.Unlock()
+	var n int
+	for _, r := range records {
+		if r == nil {
+			continue
+		}
+		n++
+		sm.read++
+		sm.records++
+		sm.bytes += uint64(len(r.Data))
+		sm.promBytes.Add(float64(len(r.Data)))
+	}
+	sm.promRecords.Add(float64(n))
+	if millisBehind != nil {
+		sm.millisBehind = *millisBehind
+		sm.promLag.Set(float64(*millisBehind))
+	}
+}
+
+// Error counts a failed read or processing error on the shard.
+func (sm *shardMetrics) Error() {
+	if sm != nil {
+		sm.promErrors.Inc()
+	}
+}
+
+// Oversize counts an entry over the Max-Entry-Size which was dropped or
+// truncated.
+func (sm *shardMetrics) Oversize(dropped bool) {
+	if sm == nil {
+		return
+	}
+	sm.Lock()
+	defer sm.Unlock()
+	if dropped {
+		sm.dropped++
+		sm.promDropped.Inc()
+	} else {
+		sm.truncated++
+		sm.promTruncated.Inc()
+	}
+}
+
+// PreprocessorFailure counts an entry the preprocessors failed on, which was
+// either ingested unprocessed or dropped.
+func (sm *shardMetrics) PreprocessorFailure(passed bool) {
+	if sm == nil {
+		return
+	}
+	sm.Lock()
+	defer sm.Unlock()
+	if passed {
+		sm.procPassed++
+		sm.promProcPass.Inc()
+	} else {
+		sm.procDropped++
+		sm.promProcDrop.Inc()
+	}
+}
+
+// Sampled counts a record kept or skipped by the Sample-Rate.
+func (sm *shardMetrics) Sampled(in bool) {
+	if sm == nil {
+		return
+	}
+	sm.Lock()
+	defer sm.Unlock()
+	if in {
+		sm.sampledIn++
+		sm.promSampleIn.Inc()
+	} else {
+		sm.sampledOut++
+		sm.promSampleOut.Inc()
+	}
+}
+
+// Clamped counts an extracted timestamp replaced by the arrival time for
+// being outside the Max-Timestamp-Skew window.
+func (sm *shardMetrics) Clamped() {
+	if sm == nil {
+		return
+	}
+	sm.Lock()
+	defer sm.Unlock()
+	sm.clamped++
+	sm.promClamped.Inc()
+}
+
+// Panic counts a panic of the shard worker.
+func (sm *shardMetrics) Panic() {
+	if sm == nil {
+		return
+	}
+	sm.Lock()
+	defer sm.Unlock()
+	sm.panics++
+	sm.promPanics.Inc()
+}
+
+// ReadAndResetFailures returns the preprocessor failure and worker panic
+// counters accumulated since the last call and resets them.
+func (sm *shardMetrics) ReadAndResetFailures() (procDropped, procPassed, panics uint64) {
+	sm.Lock()
+	defer sm.Unlock()
+	procDropped, procPassed, panics = sm.procDropped, sm.procPassed, sm.panics
+	sm.procDropped, sm.procPassed, sm.panics = 0, 0, 0
+	return
+}
+
+// ReadAndResetSampled returns the records kept and skipped by the Sample-Rate
+// since the last call and resets them.
+func (sm *shardMetrics) ReadAndResetSampled() (in, out uint64) {
+	sm.Lock()
+	defer sm.Unlock()
+	in, out = sm.sampledIn, sm.sampledOut
+	sm.sampledIn, sm.sampledOut = 0, 0
+	return
+}
+
+// ReadAndResetClamped returns the timestamps clamped since the last call and
+// resets the count.
+func (sm *shardMetrics) ReadAndResetClamped() (clamped uint64) {
+	sm.Lock()
+	defer sm.Unlock()
+	clamped, sm.clamped = sm.clamped, 0
+	return
+}
+
+// Checkpoint records that the shard has been checkpointed at seq, which
+// covers every record read so far.
+func (sm *shardMetrics) Checkpoint(seq string) {
+	if sm == nil {
+		return
+	}
+	sm.Lock()
+	defer sm.Unlock()
+	if n := len(sm.marks); n > 0 && sm.marks[n-1].seq == seq {
+		return
+	} else if n >= maxSeqMarks {
+		sm.marks = append(sm.marks[:0], sm.marks[1:]...)
+	}
+	sm.marks = append(sm.marks, seqMark{seq: seq, read: sm.read})
+}
+
+// Persisted compares the checkpoint last written to the store with the
+// records read, returning how many records are not covered by it. An empty
+// seq means nothing has been written since the consumer started.
+func (sm *shardMetrics) Persisted(seq string) uint64 {
+	sm.Lock()
+	defer sm.Unlock()
+	var i int
+	for ; i < len(sm.marks); i++ {
+		if seq != shardClosedMarker && (seq == `` || seqLess(seq, sm.marks[i].seq)) {
+			break
+		}
+		sm.base = sm.marks[i].read
+	}
+	sm.marks = append(sm.marks[:0], sm.marks[i:]...)
+	behind := sm.read - sm.base
+	sm.promBehind.Set(float64(behind))
+	return behind
+}
+
+// ReadAndReset returns the counters accumulated since the last call and the
+// most recently reported lag, then zeroes the counters.
+func (sm *shardMetrics) ReadAndReset() (records, bytes uint64, millisBehind int64, dropped, truncated uint64) {
+	sm.Lock()
+	defer sm.Unlock()
+	records, bytes, millisBehind = sm.records, sm.bytes, sm.millisBehind
+	dropped, truncated = sm.dropped, sm.truncated
+	sm.records, sm.bytes, sm.dropped, sm.truncated = 0, 0, 0, 0
+	return
+}
+
+// metricsReport summarizes a stream over a single reporting interval.
+type metricsReport struct {
+	Stream            string
+	Shards            int
+	Records           uint64
+	Bytes             uint64
+	RecordsPerSecond  float64
+	BytesPerSecond    float64
+	AverageLag        int64 // milliseconds behind the tip of the stream
+	MaxLag            int64
+	InFlightBytes     int64 `json:",omitempty"` // shared by every stream
+	Paused            bool  `json:",omitempty"` // ingest paused by signal or Pause-File
+	OversizeDropped   uint64
+	OversizeTruncated uint64
+
+	// entries the preprocessors failed on, by Preprocessor-Error-Policy
+	PreprocessorDropped       uint64
+	PreprocessorPassedThrough uint64
+	WorkerPanics              uint64 // shard workers relaunched after a panic
+	ShardsClosed              uint64 // shards read to their end after a reshard
+	ShardsFailed              uint64 // shards stopped until restart by an error
+	SampledIn                 uint64 // records kept by the Sample-Rate
+	SampledOut                uint64 // records skipped by the Sample-Rate, still checkpointed
+	TimestampsClamped         uint64 // timestamps replaced by the arrival time for being outside the Max-Timestamp-Skew window
+
+	// records read but not yet covered by a checkpoint written to the
+	// store, summed over the shards and on the worst shard
+	RecordsBehindCheckpoint    uint64
+	MaxRecordsBehindCheckpoint uint64
+
+	// shards reading more than Hot-Shard-Factor times the stream average
+	HotShards []hotShard `json:"hot_shards,omitempty"`
+}
+
+// hotShard is a shard whose read rate is well above the average of its
+// stream, usually because of an uneven distribution of partition keys.
+type hotShard struct {
+	Shard            string
+	RecordsPerSecond float64
+	BytesPerSecond   float64
+	Factor           float64 // multiple of the stream average, the larger of records and bytes
+}
+
+// shardLoad is what a shard read over a reporting interval.
+type shardLoad struct {
+	shard          string
+	records, bytes uint64
+}
+
+// findHotShards returns the shards whose record or byte count is more than
+// factor times the average over every shard. Loads are only compared with at
+// least two shards, and a factor of zero finds nothing.
+func findHotShards(loads []shardLoad, factor float64, elapsed time.Duration) (hot []hotShard) {
+	if factor <= 0 || len(loads) < 2 {
+		return
+	}
+	var records, bytes uint64
+	for _, l := range loads {
+		records += l.records
+		bytes += l.bytes
+	}
+	avgRecords := float64(records) / float64(len(loads))
+	avgBytes := float64(bytes) / float64(len(loads))
+	for _, l := range loads {
+		var f float64
+		if avgRecords > 0 {
+			f = float64(l.records) / avgRecords
+		}
+		if avgBytes > 0 && float64(l.bytes)/avgBytes > f {
+			f = float64(l.bytes) / avgBytes
+		}
+		if f <= factor {
+			continue
+		}
+		hs := hotShard{Shard: l.shard, Factor: f}
+		if secs := elapsed.Seconds(); secs > 0 {
+			hs.RecordsPerSecond = float64(l.records) / secs
+			hs.BytesPerSecond = float64(l.bytes) / secs
+		}
+		hot = append(hot, hs)
+	}
+	return
+}
+
+// metricsReporter periodically summarizes the shard metrics of a stream,
+// logging the report and optionally ingesting it as a JSON entry.
+type metricsReporter struct {
+	sync.Mutex
+	stream   string
+	trackers []*shardMetrics
+
+	wtr     contextWriter
+	tag     entry.EntryTag
+	emitTag bool
+
+	prom     *promMetrics
+	progress *awsutils.ProgressTracker
+	inflight *inFlightLimiter
+	pause    *awsutils.Pauser
+	cw       *cwPublisher
+	cp       checkpointer
+	hot      float64 // Hot-Shard-Factor, zero doesn't look for hot shards
+
+	closed uint64 // shards read to their end since the last report
+	failed uint64 // shards given up on since the last report
+}
+
+// promMetrics are the Prometheus metric families shared by every stream.
+type promMetrics struct {
+	records  *awsutils.PromVec
+	bytes    *awsutils.PromVec
+	lag      *awsutils.PromVec
+	errors   *awsutils.PromVec
+	oversize *awsutils.PromVec
+	behind   *awsutils.PromVec
+	procErrs *awsutils.PromVec
+	panics   *awsutils.PromVec
+	sampled  *awsutils.PromVec
+	clamped  *awsutils.PromVec
+	closed   *awsutils.PromVec
+	failed   *awsutils.PromVec
+
+	inFlight *awsutils.PromValue
+}
+
+func newPromMetrics(r *awsutils.PromRegistry) *promMetrics {
+	return &promMetrics{
+		records:  r.Counter(`kinesis_records_total`, `Records read from the shard.`, `stream`, `shard`),
+		bytes:    r.Counter(`kinesis_bytes_total`, `Bytes of record data read from the shard.`, `stream`, `shard`),
+		lag:      r.Gauge(`kinesis_millis_behind_latest`, `How far the shard consumer is behind the tip of the stream.`, `stream`, `shard`),
+		errors:   r.Counter(`kinesis_errors_total`, `Failed reads and processing errors on the shard.`, `stream`, `shard`),
+		oversize: r.Counter(`kinesis_oversize_entries_total`, `Entries over the Max-Entry-Size, by how they were handled.`, `stream`, `shard`, `action`),
+		behind:   r.Gauge(`kinesis_records_behind_checkpoint`, `Records read from the shard but not yet covered by a persisted checkpoint.`, `stream`, `shard`),
+		procErrs: r.Counter(`kinesis_preprocessor_failures_total`, `Entries the preprocessors failed on, by how they were handled.`, `stream`, `shard`, `action`),
+		panics:   r.Counter(`kinesis_worker_panics_total`, `Shard workers which panicked and were relaunched.`, `stream`, `shard`),
+		sampled:  r.Counter(`kinesis_sampled_records_total`, `Records kept or skipped by the Sample-Rate.`, `stream`, `shard`, `result`),
+		clamped:  r.Counter(`kinesis_timestamps_clamped_total`, `Timestamps outside the Max-Timestamp-Skew window replaced by the arrival time.`, `stream`, `shard`),
+		closed:   r.Counter(`kinesis_shards_closed_total`, `Shards read to their end after being closed by a split or merge.`, `stream`),
+		failed:   r.Counter(`kinesis_shards_failed_total`, `Shards which are no longer read until the ingester is restarted.`, `stream`),
+
+		inFlight: r.Gauge(`kinesis_in_flight_bytes`, `Bytes of entries handed off for processing but not yet acknowledged.`).With(),
+	}
+}
+
+func newMetricsReporter(stream string) *metricsReporter {
+	return &metricsReporter{
+		stream: stream,
+	}
+}
+
+// SetEntryTag causes reports to be written as entries with the given tag.
+func (mr *metricsReporter) SetEntryTag(wtr contextWriter, tag entry.EntryTag) {
+	mr.Lock()
+	mr.wtr = wtr
+	mr.tag = tag
+	mr.emitTag = true
+	mr.Unlock()
+}
+
+// SetProm causes shard metrics to also be exported to Prometheus.
+func (mr *metricsReporter) SetProm(pm *promMetrics) {
+	mr.Lock()
+	mr.prom = pm
+	mr.Unlock()
+}
+
+// SetProgress causes successful reads on any shard to be recorded in the
+// progress tracker used by the readiness probe.
+func (mr *metricsReporter) SetProgress(pt *awsutils.ProgressTracker) {
+	mr.Lock()
+	mr.progress = pt
+	mr.Unlock()
+}
+
+// SetInFlight causes reports to include the bytes awaiting acknowledgement.
+func (mr *metricsReporter) SetInFlight(l *inFlightLimiter) {
+	mr.Lock()
+	mr.inflight = l
+	mr.Unlock()
+}
+
+// SetPauser causes reports to note when ingest is paused.
+func (mr *metricsReporter) SetPauser(p *awsutils.Pauser) {
+	mr.Lock()
+	mr.pause = p
+	mr.Unlock()
+}
+
+// SetCloudWatch causes reports to also be published to CloudWatch.
+func (mr *metricsReporter) SetCloudWatch(p *cwPublisher) {
+	mr.Lock()
+	mr.cw = p
+	mr.Unlock()
+}
+
+// SetCheckpointer causes reports to include how many records each shard has
+// read beyond the checkpoint last written to the store.
+func (mr *metricsReporter) SetCheckpointer(cp checkpointer) {
+	mr.Lock()
+	mr.cp = cp
+	mr.Unlock()
+}
+
+// SetHotShardFactor causes reports to list the shards reading more than
+// factor times the stream average.
+func (mr *metricsReporter) SetHotShardFactor(factor float64) {
+	mr.Lock()
+	mr.hot = factor
+	mr.Unlock()
+}
+
+// Add registers a tracker for a newly started shard.
+func (mr *metricsReporter) Add(shard string) *shardMetrics {
+	sm := &shardMetrics{shard: shard}
+	mr.Lock()
+	sm.progress = mr.progress
+	if pm := mr.prom; pm != nil {
+		sm.promRecords = pm.records.With(mr.stream, shard)
+		sm.promBytes = pm.bytes.With(mr.stream, shard)
+		sm.promLag = pm.lag.With(mr.stream, shard)
+		sm.promErrors = pm.errors.With(mr.stream, shard)
+		sm.promDropped = pm.oversize.With(mr.stream, shard, awsutils.OversizeDrop)
+		sm.promTruncated = pm.oversize.With(mr.stream, shard, awsutils.OversizeTruncate)
+		sm.promBehind = pm.behind.With(mr.stream, shard)
+		sm.promProcDrop = pm.procErrs.With(mr.stream, shard, procErrorDrop)
+		sm.promProcPass = pm.procErrs.With(mr.stream, shard, procErrorPassthrough)
+		sm.promPanics = pm.panics.With(mr.stream, shard)
+		sm.promSampleIn = pm.sampled.With(mr.stream, shard, sampledIn)
+		sm.promSampleOut = pm.sampled.With(mr.stream, shard, sampledOut)
+		sm.promClamped = pm.clamped.With(mr.stream, shard)
+	}
+	mr.trackers = append(mr.trackers, sm)
+	mr.Unlock()
+	return sm
+}
+
+// ShardClosed counts a shard which was read to its end.
+func (mr *metricsReporter) ShardClosed() {
+	mr.Lock()
+	defer mr.Unlock()
+	mr.closed++
+	if pm := mr.prom; pm != nil {
+		pm.closed.With(mr.stream).Inc()
+	}
+}
+
+// ShardFailed counts a shard which was given up on until restart, by the
+// Iterator-Retry-Limit or the fatal Preprocessor-Error-Policy.
+func (mr *metricsReporter) ShardFailed() {
+	mr.Lock()
+	defer mr.Unlock()
+	mr.failed++
+	if pm := mr.prom; pm != nil {
+		pm.failed.With(mr.stream).Inc()
+	}
+}
+
+// Remove drops the tracker of a shard whose consumer has exited.
+func (mr *metricsReporter) Remove(sm *shardMetrics) {
+	mr.Lock()
+	defer mr.Unlock()
+	if pm := mr.prom; pm != nil {
+		// the lag of a closed shard is meaningless, drop it
+		pm.lag.Delete(mr.stream, sm.shard)
+		pm.behind.Delete(mr.stream, sm.shard)
+	}
+	for i, t := range mr.trackers {
+		if t == sm {
+			mr.trackers = append(mr.trackers[:i], mr.trackers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Report reads and resets every shard tracker and summarizes the results over
+// the elapsed time.
+func (mr *metricsReporter) Report(elapsed time.Duration) (r metricsReport) {
+	mr.Lock()
+	trackers := append([]*shardMetrics(nil), mr.trackers...)
+	inflight := mr.inflight
+	pause := mr.pause
+	cp := mr.cp
+	hot := mr.hot
+	r.ShardsClosed, r.ShardsFailed = mr.closed, mr.failed
+	mr.closed, mr.failed = 0, 0
+	mr.Unlock()
+
+	r.Stream = mr.stream
+	r.Shards = len(trackers)
+	r.InFlightBytes = inflight.Bytes()
+	r.Paused = pause.Paused()
+	var totalLag int64
+	loads := make([]shardLoad, 0, len(trackers))
+	for _, t := range trackers {
+		records, bytes, lag, dropped, truncated := t.ReadAndReset()
+		loads = append(loads, shardLoad{shard: t.shard, records: records, bytes: bytes})
+		r.Records += records
+		r.Bytes += bytes
+		r.OversizeDropped += dropped
+		r.OversizeTruncated += truncated
+		procDropped, procPassed, panics := t.ReadAndResetFailures()
+		r.PreprocessorDropped += procDropped
+		r.PreprocessorPassedThrough += procPassed
+		r.WorkerPanics += panics
+		in, out := t.ReadAndResetSampled()
+		r.SampledIn += in
+		r.SampledOut += out
+		r.TimestampsClamped += t.ReadAndResetClamped()
+		totalLag += lag
+		if lag > r.MaxLag {
+			r.MaxLag = lag
+		}
+		if cp != nil {
+			behind := t.Persisted(cp.Persisted(mr.stream, t.shard))
+			r.RecordsBehindCheckpoint += behind
+			if behind > r.MaxRecordsBehindCheckpoint {
+				r.MaxRecordsBehindCheckpoint = behind
+			}
+		}
+	}
+	if r.Shards > 0 {
+		r.AverageLag = totalLag / int64(r.Shards)
+	}
+	if secs := elapsed.Seconds(); secs > 0 {
+		r.RecordsPerSecond = float64(r.Records) / secs
+		r.BytesPerSecond = float64(r.Bytes) / secs
+	}
+	r.HotShards = findHotShards(loads, hot, elapsed)
+	return
+}
+
+// run emits a report every interval until ctx is cancelled. Shards come and
+// go while it runs, every report covers a snapshot of them taken under the
+// lock, and a report being written when ctx is cancelled is abandoned.
+func (mr *metricsReporter) run(ctx context.Context, lgr ingest.IngestLogger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if ctx.Err() != nil {
+			// the tick and shutdown raced
+			return
+		}
+		now := time.Now()
+		r := mr.Report(now.Sub(last))
+		last = now
+		lgr.Info("Stream %s: %d shards, %d records (%.1f/s), %d bytes (%.1f/s), average lag %dms, max lag %dms, %d bytes in flight, %d oversize entries dropped, %d truncated, %d preprocessor failures dropped, %d passed through, %d worker panics, %d shards closed, %d failed, %d records sampled in, %d sampled out, %d timestamps clamped, %d records behind the checkpoint (%d max)",
+			r.Stream, r.Shards, r.Records, r.RecordsPerSecond, r.Bytes, r.BytesPerSecond, r.AverageLag, r.MaxLag, r.InFlightBytes, r.OversizeDropped, r.OversizeTruncated,
+			r.PreprocessorDropped, r.PreprocessorPassedThrough, r.WorkerPanics, r.ShardsClosed, r.ShardsFailed, r.SampledIn, r.SampledOut, r.TimestampsClamped,
+			r.RecordsBehindCheckpoint, r.MaxRecordsBehindCheckpoint)
+		for _, hs := range r.HotShards {
+			lgr.Warn("Stream %s: shard %s is hot, reading %.1fx the stream average (%.1f records/s, %.1f bytes/s), check the distribution of partition keys",
+				r.Stream, hs.Shard, hs.Factor, hs.RecordsPerSecond, hs.BytesPerSecond)
+		}
+		if err := mr.emit(ctx, r); err != nil && ctx.Err() == nil {
+			lg.Error("Failed to write metrics entry for stream %s: %v", r.Stream, err)
+		}
+		mr.Lock()
+		cw := mr.cw
+		mr.Unlock()
+		cw.Publish(r)
+	}
+}
+
+// emit writes the report as a JSON entry if a metrics tag is configured.
+func (mr *metricsReporter) emit(ctx context.Context, r metricsReport) error {
+	mr.Lock()
+	wtr, tag, ok := mr.wtr, mr.tag, mr.emitTag
+	mr.Unlock()
+	if !ok {
+		return nil
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return wtr.WriteEntryContext(ctx, &entry.Entry{
+		TS:   entry.Now(),
+		Tag:  tag,
+		Data: b,
+	})
+}
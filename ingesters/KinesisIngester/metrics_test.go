@@ -0,0 +1,229 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+	"go.uber.org/goleak"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+type testEntryWriter struct {
+	sync.Mutex
+	ents []*entry.Entry
+}
+
+func (tw *testEntryWriter) WriteEntry(ent *entry.Entry) error {
+	tw.Lock()
+	tw.ents = append(tw.ents, ent)
+	tw.Unlock()
+	return nil
+}
+
+func (tw *testEntryWriter) count() int {
+	tw.Lock()
+	defer tw.Unlock()
+	return len(tw.ents)
+}
+
+func (tw *testEntryWriter) WriteEntryContext(ctx context.Context, ent *entry.Entry) error {
+	return tw.WriteEntry(ent)
+}
+
+func TestMetricsReport(t *testing.T) {
+	mr := newMetricsReporter(`stream`)
+	// no shards must not blow up the averages
+	if r := mr.Report(time.Second); r.Shards != 0 || r.AverageLag != 0 {
+		t.Fatalf("bad empty report: %+v", r)
+	}
+
+	a := mr.Add(`shardA`)
+	b := mr.Add(`shardB`)
+	a.Update([]*kinesis.Record{{Data: []byte(`12345`)}, {Data: []byte(`123`)}}, aws.Int64(100))
+	b.Update([]*kinesis.Record{{Data: []byte(`12`)}}, aws.Int64(300))
+	r := mr.Report(2 * time.Second)
+	if r.Shards != 2 || r.Records != 3 || r.Bytes != 10 {
+		t.Fatalf("bad report counts: %+v", r)
+	}
+	if r.AverageLag != 200 || r.MaxLag != 300 || r.RecordsPerSecond != 1.5 || r.BytesPerSecond != 5 {
+		t.Fatalf("bad report rates: %+v", r)
+	}
+
+	// counters reset, lag sticks until updated, removed shards are dropped
+	mr.Remove(a)
+	if r = mr.Report(time.Second); r.Shards != 1 || r.Records != 0 || r.MaxLag != 300 {
+		t.Fatalf("bad report after reset: %+v", r)
+	}
+}
+
+func TestHotShards(t *testing.T) {
+	mr := newMetricsReporter(`stream`)
+	shards := []*shardMetrics{mr.Add(`shardA`), mr.Add(`shardB`), mr.Add(`shardC`), mr.Add(`shardD`)}
+	update := func(sm *shardMetrics, n, size int) {
+		recs := make([]*kinesis.Record, n)
+		for i := range recs {
+			recs[i] = &kinesis.Record{Data: make([]byte, size)}
+		}
+		sm.Update(recs, nil)
+	}
+	load := func() {
+		update(shards[0], 10, 10)
+		update(shards[1], 10, 10)
+		update(shards[2], 10, 10)
+		update(shards[3], 50, 10)
+	}
+	load()
+	if r := mr.Report(time.Second); len(r.HotShards) != 0 {
+		t.Fatalf("hot shards without a Hot-Shard-Factor: %+v", r.HotShards)
+	}
+
+	// shardD reads 50 of the 80 records, 2.5x the average of 20
+	mr.SetHotShardFactor(2)
+	load()
+	r := mr.Report(2 * time.Second)
+	if len(r.HotShards) != 1 {
+		t.Fatalf("bad hot shards: %+v", r.HotShards)
+	} else if hs := r.HotShards[0]; hs.Shard != `shardD` || hs.Factor != 2.5 || hs.RecordsPerSecond != 25 || hs.BytesPerSecond != 250 {
+		t.Fatalf("bad hot shard: %+v", hs)
+	}
+
+	// a few large records make a shard hot by bytes
+	update(shards[0], 10, 10)
+	update(shards[1], 10, 10)
+	update(shards[2], 10, 10)
+	update(shards[3], 2, 1000)
+	if r = mr.Report(time.Second); len(r.HotShards) != 1 || r.HotShards[0].Shard != `shardD` {
+		t.Fatalf("bad hot shards by bytes: %+v", r.HotShards)
+	}
+
+	// idle streams and lone shards are never hot
+	if r = mr.Report(time.Second); len(r.HotShards) != 0 {
+		t.Fatalf("hot shards on an idle stream: %+v", r.HotShards)
+	}
+	mr.Remove(shards[0])
+	mr.Remove(shards[1])
+	mr.Remove(shards[2])
+	update(shards[3], 50, 10)
+	if r = mr.Report(time.Second); len(r.HotShards) != 0 {
+		t.Fatalf("a lone shard is hot: %+v", r.HotShards)
+	}
+}
+
+func TestMetricsEmit(t *testing.T) {
+	mr := newMetricsReporter(`stream`)
+	r := metricsReport{Stream: `stream`, Shards: 4, Records: 10, HotShards: []hotShard{{Shard: `shardA`, Factor: 3}}}
+	if err := mr.emit(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+
+	var tw testEntryWriter
+	mr.SetEntryTag(&tw, entry.EntryTag(7))
+	if err := mr.emit(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	if len(tw.ents) != 1 || tw.ents[0].Tag != 7 {
+		t.Fatalf("bad metrics entries: %+v", tw.ents)
+	}
+	var out metricsReport
+	if err := json.Unmarshal(tw.ents[0].Data, &out); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(out, r) {
+		t.Fatalf("report mismatch: %+v != %+v", out, r)
+	}
+}
+
+// stalledWriter holds up every write until its context is cancelled.
+type stalledWriter struct {
+	started chan struct{}
+}
+
+func (sw *stalledWriter) WriteEntryContext(ctx context.Context, ent *entry.Entry) error {
+	select {
+	case sw.started <- struct{}{}:
+	default:
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestMetricsReporterStops(t *testing.T) {
+	defer goleak.VerifyNone(t)
+	lgr := log.NewDiscardLogger()
+	mr := newMetricsReporter(`stream`)
+	sw := &stalledWriter{started: make(chan struct{}, 1)}
+	mr.SetEntryTag(sw, entry.EntryTag(7))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		mr.run(ctx, lgr, time.Millisecond)
+		close(done)
+	}()
+	// shards come and go while reports are made
+	for i := 0; i < 100; i++ {
+		mr.Remove(mr.Add(fmt.Sprintf("shard-%d", i)))
+	}
+	// shut down while a report is being written
+	<-sw.started
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("metrics reporter did not stop")
+	}
+}
+
+func TestRecordsBehindCheckpoint(t *testing.T) {
+	if !seqLess(`999`, `1000`) || seqLess(`1001`, `1000`) || seqLess(`1000`, `1000`) {
+		t.Fatal("bad sequence number ordering")
+	}
+
+	sm := newTestStateman(t, filepath.Join(tdir, `behind.state`))
+	mr := newMetricsReporter(`stream`)
+	mr.SetCheckpointer(sm)
+	a := mr.Add(`shardA`)
+	batch := func(first, n int) {
+		recs := testRecords(first, n)
+		a.Update(recs, aws.Int64(0))
+		seq := aws.StringValue(recs[n-1].SequenceNumber)
+		sm.UpdateSequenceNum(`stream`, `shardA`, seq)
+		a.Checkpoint(seq)
+	}
+
+	// nothing written to the store yet
+	batch(0, 3)
+	batch(3, 2)
+	if r := mr.Report(time.Second); r.RecordsBehindCheckpoint != 5 || r.MaxRecordsBehindCheckpoint != 5 {
+		t.Fatalf("bad lag before a flush: %+v", r)
+	}
+	sm.Flush()
+	batch(5, 4)
+	if r := mr.Report(time.Second); r.RecordsBehindCheckpoint != 4 {
+		t.Fatalf("bad lag after a flush: %+v", r)
+	}
+	sm.Flush()
+	if r := mr.Report(time.Second); r.RecordsBehindCheckpoint != 0 {
+		t.Fatalf("bad lag when caught up: %+v", r)
+	}
+	if len(a.marks) != 0 {
+		t.Fatalf("%d persisted checkpoints not forgotten", len(a.marks))
+	}
+}
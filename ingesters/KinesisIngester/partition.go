@@ -0,0 +1,47 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"hash/fnv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// shardPartition statically divides the shards of every stream between count
+// ingester instances by a hash of the shard ID, this instance reads the shards
+// that hash to index. A zero count reads every shard. Nothing is coordinated
+// between instances, when a stream is resharded the new shards are spread by
+// the same hash, but a child shard doesn't wait on parents read by another
+// instance.
+type shardPartition struct {
+	index int
+	count int
+}
+
+// Owns returns true if the shard belongs to this instance.
+func (p shardPartition) Owns(id string) bool {
+	if p.count <= 0 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32()%uint32(p.count)) == p.index
+}
+
+// owned returns the IDs of the shards which belong to this instance.
+func (p shardPartition) owned(shards []*kinesis.Shard) (ids []string) {
+	for _, s := range shards {
+		if id := aws.StringValue(s.ShardId); p.Owns(id) {
+			ids = append(ids, id)
+		}
+	}
+	return
+}
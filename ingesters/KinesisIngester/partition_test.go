@@ -0,0 +1,69 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestShardPartition(t *testing.T) {
+	var shards []*kinesis.Shard
+	for i := 0; i < 100; i++ {
+		shards = append(shards, &kinesis.Shard{ShardId: aws.String(fmt.Sprintf("shardId-%012d", i))})
+	}
+	if ids := (shardPartition{}).owned(shards); len(ids) != len(shards) {
+		t.Fatalf("unpartitioned instance owns %d of %d shards", len(ids), len(shards))
+	}
+
+	// every shard belongs to exactly one of the instances
+	owners := make(map[string]int)
+	for i := 0; i < 3; i++ {
+		p := shardPartition{index: i, count: 3}
+		ids := p.owned(shards)
+		if len(ids) == 0 {
+			t.Fatalf("instance %d owns no shards", i)
+		}
+		for _, id := range ids {
+			owners[id]++
+		}
+	}
+	if len(owners) != len(shards) {
+		t.Fatalf("%d of %d shards owned", len(owners), len(shards))
+	}
+	for id, n := range owners {
+		if n != 1 {
+			t.Fatalf("shard %s owned by %d instances", id, n)
+		}
+	}
+}
+
+func TestInstancePartitionConfig(t *testing.T) {
+	for _, tc := range []struct {
+		index, count int
+		ok           bool
+	}{
+		{0, 0, true},
+		{0, 3, true},
+		{2, 3, true},
+		{3, 3, false},
+		{1, 0, false},
+		{-1, 3, false},
+		{0, -1, false},
+	} {
+		c := testConfig(&streamDef{})
+		c.Global.Instance_Index, c.Global.Instance_Count = tc.index, tc.count
+		if err := verifyConfig(c); (err == nil) != tc.ok {
+			t.Fatalf("Instance-Index %d, Instance-Count %d: %v", tc.index, tc.count, err)
+		}
+	}
+}
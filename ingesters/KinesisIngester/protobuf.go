@@ -0,0 +1,679 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	protoMaxDepth = 256 // nesting of decoded messages
+
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+	protoWireFixed32 = 5
+)
+
+var ErrProtoTruncated = errors.New("protobuf data ends early")
+
+// protoFile is a parsed .proto schema. Only what is needed to decode messages
+// is kept: messages, their fields, and enums. Options, services, and
+// extensions are skipped, and types from imported files are unknown, fields of
+// those types are decoded as bytes.
+type protoFile struct {
+	pkg      string
+	messages map[string]*protoMessage // by full name
+	enums    map[string]*protoEnum
+	order    []*protoMessage // every message sorted by full name
+}
+
+type protoMessage struct {
+	name   string // full name
+	fields []*protoField
+	byNum  map[int]*protoField
+}
+
+type protoField struct {
+	name     string
+	num      int
+	typ      string // a scalar type name, or the full name of a message or enum once resolved
+	repeated bool
+	mapKey   string // set for map fields, typ is then the value type
+	scope    string // full name of the message the field was declared in, for resolving typ
+	message  *protoMessage
+	enum     *protoEnum
+}
+
+type protoEnum struct {
+	names map[int64]string
+}
+
+var protoScalars = map[string]bool{
+	`double`: true, `float`: true, `int32`: true, `int64`: true, `uint32`: true,
+	`uint64`: true, `sint32`: true, `sint64`: true, `fixed32`: true, `fixed64`: true,
+	`sfixed32`: true, `sfixed64`: true, `bool`: true, `string`: true, `bytes`: true,
+}
+
+// protoTokens splits .proto source into tokens, dropping comments.
+func protoTokens(src string) (toks []string, err error) {
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case strings.HasPrefix(src[i:], `//`):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], `/*`):
+			end := strings.Index(src[i+2:], `*/`)
+			if end < 0 {
+				return nil, errors.New("unterminated comment")
+			}
+			i += end + 4
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, errors.New("unterminated string")
+			}
+			toks = append(toks, src[i:j+1])
+			i = j + 1
+		case c == '_' || c == '.' || c == '-' || c == '+' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)):
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || src[j] == '.' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			toks = append(toks, src[i:j])
+			i = j
+		default:
+			toks = append(toks, src[i:i+1])
+			i++
+		}
+	}
+	return
+}
+
+type protoParser struct {
+	toks []string
+	f    *protoFile
+}
+
+// parseProto parses the source of a .proto file.
+func parseProto(src string) (*protoFile, error) {
+	toks, err := protoTokens(src)
+	if err != nil {
+		return nil, fmt.Errorf("invalid protobuf schema: %v", err)
+	}
+	p := &protoParser{
+		toks: toks,
+		f: &protoFile{
+			messages: make(map[string]*protoMessage),
+			enums:    make(map[string]*protoEnum),
+		},
+	}
+	if err = p.parseFile(); err == nil {
+		err = p.resolve()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid protobuf schema: %v", err)
+	}
+	for _, m := range p.f.messages {
+		p.f.order = append(p.f.order, m)
+	}
+	sort.Slice(p.f.order, func(i, j int) bool { return p.f.order[i].name < p.f.order[j].name })
+	return p.f, nil
+}
+
+func (p *protoParser) next() string {
+	if len(p.toks) == 0 {
+		return ``
+	}
+	t := p.toks[0]
+	p.toks = p.toks[1:]
+	return t
+}
+
+func (p *protoParser) peek() string {
+	if len(p.toks) == 0 {
+		return ``
+	}
+	return p.toks[0]
+}
+
+func (p *protoParser) expect(t string) error {
+	if got := p.next(); got != t {
+		return fmt.Errorf("expected %q, found %q", t, got)
+	}
+	return nil
+}
+
+// skipStatement skips to the end of a statement, including any block it opens.
+func (p *protoParser) skipStatement() error {
+	depth := 0
+	for {
+		switch p.next() {
+		case ``:
+			return errors.New("unexpected end of schema")
+		case `;`:
+			if depth == 0 {
+				return nil
+			}
+		case `{`:
+			depth++
+		case `}`:
+			if depth--; depth <= 0 {
+				if p.peek() == `;` {
+					p.next()
+				}
+				return nil
+			}
+		}
+	}
+}
+
+func (p *protoParser) parseFile() error {
+	for len(p.toks) > 0 {
+		switch t := p.peek(); t {
+		case `package`:
+			p.next()
+			p.f.pkg = p.next()
+			if err := p.expect(`;`); err != nil {
+				return err
+			}
+		case `message`:
+			p.next()
+			if err := p.parseMessage(p.f.pkg); err != nil {
+				return err
+			}
+		case `enum`:
+			p.next()
+			if err := p.parseEnum(p.f.pkg); err != nil {
+				return err
+			}
+		case `;`:
+			p.next()
+		default:
+			// syntax, import, option, service, extend
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func joinProtoName(scope, name string) string {
+	if scope == `` {
+		return name
+	}
+	return scope + `.` + name
+}
+
+func (p *protoParser) parseMessage(scope string) error {
+	m := &protoMessage{name: joinProtoName(scope, p.next()), byNum: make(map[int]*protoField)}
+	if _, ok := p.f.messages[m.name]; ok {
+		return fmt.Errorf("message %s is defined twice", m.name)
+	}
+	p.f.messages[m.name] = m
+	if err := p.expect(`{`); err != nil {
+		return err
+	}
+	for {
+		switch t := p.peek(); t {
+		case ``:
+			return fmt.Errorf("message %s is not closed", m.name)
+		case `}`:
+			p.next()
+			return nil
+		case `message`:
+			p.next()
+			if err := p.parseMessage(m.name); err != nil {
+				return err
+			}
+		case `enum`:
+			p.next()
+			if err := p.parseEnum(m.name); err != nil {
+				return err
+			}
+		case `oneof`:
+			// the fields of a oneof are fields of the message
+			p.next()
+			p.next()
+			if err := p.expect(`{`); err != nil {
+				return err
+			}
+			for p.peek() != `}` {
+				if p.peek() == `option` {
+					if err := p.skipStatement(); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := p.parseField(m); err != nil {
+					return err
+				}
+			}
+			p.next()
+		case `option`, `reserved`, `extensions`, `extend`:
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		case `;`:
+			p.next()
+		default:
+			if err := p.parseField(m); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// parseField parses [label] type name = number [options];
+func (p *protoParser) parseField(m *protoMessage) error {
+	f := &protoField{scope: m.name}
+	switch p.peek() {
+	case `repeated`:
+		f.repeated = true
+		p.next()
+	case `optional`, `required`:
+		p.next()
+	case `group`:
+		return fmt.Errorf("groups are not supported, in message %s", m.name)
+	}
+	if f.typ = p.next(); f.typ == `map` {
+		if err := p.expect(`<`); err != nil {
+			return err
+		}
+		f.mapKey = p.next()
+		if err := p.expect(`,`); err != nil {
+			return err
+		}
+		f.typ = p.next()
+		if err := p.expect(`>`); err != nil {
+			return err
+		}
+		f.repeated = true
+	}
+	f.name = p.next()
+	if err := p.expect(`=`); err != nil {
+		return err
+	}
+	num, err := strconv.ParseInt(p.next(), 0, 32)
+	if err != nil || num <= 0 {
+		return fmt.Errorf("invalid number for field %s of message %s", f.name, m.name)
+	}
+	f.num = int(num)
+	if err := p.skipStatement(); err != nil {
+		return err
+	}
+	m.fields = append(m.fields, f)
+	m.byNum[f.num] = f
+	return nil
+}
+
+func (p *protoParser) parseEnum(scope string) error {
+	name := joinProtoName(scope, p.next())
+	e := &protoEnum{names: make(map[int64]string)}
+	p.f.enums[name] = e
+	if err := p.expect(`{`); err != nil {
+		return err
+	}
+	for {
+		switch t := p.next(); t {
+		case ``:
+			return fmt.Errorf("enum %s is not closed", name)
+		case `}`:
+			return nil
+		case `option`, `reserved`:
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		case `;`:
+		default:
+			if err := p.expect(`=`); err != nil {
+				return err
+			}
+			v, err := strconv.ParseInt(p.next(), 0, 32)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s in enum %s", t, name)
+			}
+			if _, ok := e.names[v]; !ok {
+				// the first name of an aliased value
+				e.names[v] = t
+			}
+			if err := p.skipStatement(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// resolve links the message and enum fields to their types, searching the
+// scopes from the innermost outwards as protoc does.
+func (p *protoParser) resolve() error {
+	for _, m := range p.f.messages {
+		for _, f := range m.fields {
+			if protoScalars[f.typ] {
+				continue
+			}
+			name := f.typ
+			if strings.HasPrefix(name, `.`) {
+				name = name[1:]
+				f.message, f.enum = p.f.messages[name], p.f.enums[name]
+				continue
+			}
+			for scope := f.scope; ; {
+				full := joinProtoName(scope, name)
+				if msg, ok := p.f.messages[full]; ok {
+					f.message = msg
+					break
+				} else if e, ok := p.f.enums[full]; ok {
+					f.enum = e
+					break
+				}
+				if scope == `` {
+					break
+				}
+				if i := strings.LastIndex(scope, `.`); i >= 0 {
+					scope = scope[:i]
+				} else {
+					scope = ``
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// protoReader reads the protobuf wire format.
+type protoReader struct {
+	b []byte
+}
+
+func (r *protoReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		return 0, ErrProtoTruncated
+	}
+	r.b = r.b[n:]
+	return v, nil
+}
+
+func (r *protoReader) fixed(n int) ([]byte, error) {
+	if n < 0 || n > len(r.b) {
+		return nil, ErrProtoTruncated
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b, nil
+}
+
+// field reads the number, wire type, and value of the next field, the value is
+// in v for varints and in raw otherwise.
+func (r *protoReader) field() (num, wire int, v uint64, raw []byte, err error) {
+	var key uint64
+	if key, err = r.varint(); err != nil {
+		return
+	}
+	num, wire = int(key>>3), int(key&7)
+	switch wire {
+	case protoWireVarint:
+		v, err = r.varint()
+	case protoWireFixed64:
+		raw, err = r.fixed(8)
+	case protoWireFixed32:
+		raw, err = r.fixed(4)
+	case protoWireBytes:
+		var n uint64
+		if n, err = r.varint(); err == nil {
+			if n > uint64(len(r.b)) {
+				err = ErrProtoTruncated
+			} else {
+				raw, err = r.fixed(int(n))
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported protobuf wire type %d", wire)
+	}
+	return
+}
+
+// decodeProtoMessage writes the JSON form of a message to buf. Fields are
+// written in the order they are declared under their declared names, unset
+// fields are left out, and fields the schema doesn't know are skipped.
+func decodeProtoMessage(m *protoMessage, data []byte, buf *bytes.Buffer, depth int) error {
+	if depth > protoMaxDepth {
+		return errors.New("protobuf message is nested too deeply")
+	}
+	vals := make(map[int][][]byte)
+	r := &protoReader{b: data}
+	for len(r.b) > 0 {
+		num, wire, v, raw, err := r.field()
+		if err != nil {
+			return err
+		}
+		f := m.byNum[num]
+		if f == nil {
+			continue
+		}
+		if wire == protoWireBytes && f.isPackable() {
+			// a packed repeated scalar
+			if err = f.unpack(raw, func(b []byte) { vals[num] = append(vals[num], b) }); err != nil {
+				return err
+			}
+			continue
+		}
+		var out bytes.Buffer
+		if err = f.write(&out, wire, v, raw, depth); err != nil {
+			return err
+		}
+		vals[num] = append(vals[num], out.Bytes())
+	}
+
+	buf.WriteByte('{')
+	first := true
+	for _, f := range m.fields {
+		vs, ok := vals[f.num]
+		if !ok {
+			continue
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		writeJSON(buf, f.name)
+		buf.WriteByte(':')
+		switch {
+		case f.mapKey != ``:
+			buf.WriteByte('{')
+			buf.Write(bytes.Join(vs, []byte{','}))
+			buf.WriteByte('}')
+		case f.repeated:
+			buf.WriteByte('[')
+			buf.Write(bytes.Join(vs, []byte{','}))
+			buf.WriteByte(']')
+		default:
+			// the last value of a singular field wins
+			buf.Write(vs[len(vs)-1])
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// isPackable returns true if the field is a repeated scalar which may be
+// packed into a single length delimited value.
+func (f *protoField) isPackable() bool {
+	if !f.repeated || f.mapKey != `` {
+		return false
+	}
+	if f.enum != nil {
+		return true
+	}
+	return protoScalars[f.typ] && f.typ != `string` && f.typ != `bytes`
+}
+
+// unpack decodes the elements of a packed repeated scalar.
+func (f *protoField) unpack(data []byte, emit func([]byte)) error {
+	r := &protoReader{b: data}
+	for len(r.b) > 0 {
+		var out bytes.Buffer
+		var err error
+		switch protoWireType(f.typ) {
+		case protoWireFixed64:
+			var raw []byte
+			if raw, err = r.fixed(8); err == nil {
+				err = f.write(&out, protoWireFixed64, 0, raw, 0)
+			}
+		case protoWireFixed32:
+			var raw []byte
+			if raw, err = r.fixed(4); err == nil {
+				err = f.write(&out, protoWireFixed32, 0, raw, 0)
+			}
+		default:
+			var v uint64
+			if v, err = r.varint(); err == nil {
+				err = f.write(&out, protoWireVarint, v, nil, 0)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		emit(out.Bytes())
+	}
+	return nil
+}
+
+func protoWireType(typ string) int {
+	switch typ {
+	case `double`, `fixed64`, `sfixed64`:
+		return protoWireFixed64
+	case `float`, `fixed32`, `sfixed32`:
+		return protoWireFixed32
+	case `string`, `bytes`:
+		return protoWireBytes
+	}
+	return protoWireVarint
+}
+
+// write writes the JSON form of a single value of the field.
+func (f *protoField) write(buf *bytes.Buffer, wire int, v uint64, raw []byte, depth int) error {
+	if f.mapKey != `` {
+		return f.writeMapEntry(buf, raw, depth)
+	}
+	switch {
+	case f.message != nil:
+		if wire != protoWireBytes {
+			return fmt.Errorf("field %s has wire type %d, expected a message", f.name, wire)
+		}
+		return decodeProtoMessage(f.message, raw, buf, depth+1)
+	case f.enum != nil:
+		if name, ok := f.enum.names[int64(int32(v))]; ok {
+			writeJSON(buf, name)
+		} else {
+			buf.WriteString(strconv.FormatInt(int64(int32(v)), 10))
+		}
+		return nil
+	}
+	if wire != protoWireType(f.typ) && protoScalars[f.typ] {
+		return fmt.Errorf("field %s has wire type %d, expected %s", f.name, wire, f.typ)
+	}
+	switch f.typ {
+	case `int32`:
+		buf.WriteString(strconv.FormatInt(int64(int32(v)), 10))
+	case `int64`:
+		buf.WriteString(strconv.FormatInt(int64(v), 10))
+	case `uint32`, `uint64`:
+		buf.WriteString(strconv.FormatUint(v, 10))
+	case `sint32`, `sint64`:
+		buf.WriteString(strconv.FormatInt(int64(v>>1)^-int64(v&1), 10))
+	case `bool`:
+		buf.WriteString(strconv.FormatBool(v != 0))
+	case `fixed32`:
+		buf.WriteString(strconv.FormatUint(uint64(binary.LittleEndian.Uint32(raw)), 10))
+	case `sfixed32`:
+		buf.WriteString(strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(raw))), 10))
+	case `float`:
+		writeJSONFloat(buf, float64(math.Float32frombits(binary.LittleEndian.Uint32(raw))), 32)
+	case `fixed64`:
+		buf.WriteString(strconv.FormatUint(binary.LittleEndian.Uint64(raw), 10))
+	case `sfixed64`:
+		buf.WriteString(strconv.FormatInt(int64(binary.LittleEndian.Uint64(raw)), 10))
+	case `double`:
+		writeJSONFloat(buf, math.Float64frombits(binary.LittleEndian.Uint64(raw)), 64)
+	case `string`:
+		writeJSON(buf, string(raw))
+	default:
+		// bytes, or a type from an imported file
+		switch wire {
+		case protoWireBytes:
+			writeJSON(buf, raw)
+		case protoWireVarint:
+			buf.WriteString(strconv.FormatUint(v, 10))
+		default:
+			writeJSON(buf, raw)
+		}
+	}
+	return nil
+}
+
+// writeMapEntry writes a "key":value pair of a map field, whose entries are
+// messages with the key as field 1 and the value as field 2.
+func (f *protoField) writeMapEntry(buf *bytes.Buffer, data []byte, depth int) error {
+	keyField := &protoField{name: f.name, typ: f.mapKey}
+	valField := &protoField{name: f.name, typ: f.typ, message: f.message, enum: f.enum}
+	var key, val bytes.Buffer
+	r := &protoReader{b: data}
+	for len(r.b) > 0 {
+		num, wire, v, raw, err := r.field()
+		switch {
+		case err != nil:
+		case num == 1:
+			key.Reset()
+			err = keyField.write(&key, wire, v, raw, depth)
+		case num == 2:
+			val.Reset()
+			err = valField.write(&val, wire, v, raw, depth)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	switch {
+	case key.Len() == 0:
+		buf.WriteString(`""`)
+	case key.Bytes()[0] != '"':
+		// JSON object keys are strings
+		writeJSON(buf, key.String())
+	default:
+		buf.Write(key.Bytes())
+	}
+	buf.WriteByte(':')
+	if val.Len() == 0 {
+		buf.WriteString(`null`)
+	} else {
+		buf.Write(val.Bytes())
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+const testProtoSchema = `
+syntax = "proto3";
+package com.example;
+
+import "google/protobuf/timestamp.proto";
+option go_package = "example";
+
+// an event, with a nested address
+message Event {
+	string msg = 1;
+	sint64 delta = 2 [deprecated = true];
+	repeated int32 codes = 3;
+	Level level = 4;
+	map<string, double> extra = 5;
+	Address addr = 6;
+	oneof id {
+		uint64 num = 7;
+		string name = 8;
+	}
+	reserved 9, 10 to 12;
+	message Address {
+		string city = 1;
+		fixed32 zip = 2;
+	}
+}
+
+enum Level {
+	INFO = 0;
+	WARN = 1;
+}
+`
+
+func protoKey(b []byte, num, wire int) []byte {
+	return protoVarint(b, uint64(num<<3|wire))
+}
+
+func protoVarint(b []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(b, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func protoBytes(b []byte, num int, v []byte) []byte {
+	b = protoKey(b, num, protoWireBytes)
+	b = protoVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// testProtoEvent encodes an Event with every field set.
+func testProtoEvent() (b []byte) {
+	b = protoBytes(b, 1, []byte(`hello "world"`))
+	b = protoKey(b, 2, protoWireVarint)
+	b = protoVarint(b, 5) // zig-zag encoded -3
+	// packed 1, -1
+	b = protoBytes(b, 3, []byte{1, 0xff, 0xff, 0xff, 0xff, 0x0f})
+	b = protoKey(b, 4, protoWireVarint)
+	b = protoVarint(b, 1)
+	var entry []byte
+	entry = protoBytes(entry, 1, []byte(`pi`))
+	entry = protoKey(entry, 2, protoWireFixed64)
+	var f [8]byte
+	binary.LittleEndian.PutUint64(f[:], math.Float64bits(1.5))
+	entry = append(entry, f[:]...)
+	b = protoBytes(b, 5, entry)
+	var addr []byte
+	addr = protoBytes(addr, 1, []byte(`Boise`))
+	addr = protoKey(addr, 2, protoWireFixed32)
+	addr = append(addr, 0x39, 0x30, 0, 0) // 12345
+	b = protoBytes(b, 6, addr)
+	b = protoKey(b, 7, protoWireVarint)
+	b = protoVarint(b, 300)
+	b = protoKey(b, 99, protoWireVarint) // unknown to the schema
+	b = protoVarint(b, 1)
+	return b
+}
+
+const testProtoEventJSON = `{"msg":"hello \"world\"","delta":-3,"codes":[1,-1],"level":"WARN","extra":{"pi":1.5},"addr":{"city":"Boise","zip":12345},"num":300}`
+
+func TestParseProto(t *testing.T) {
+	pf, err := parseProto(testProtoSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, m := range pf.order {
+		names = append(names, m.name)
+	}
+	if len(names) != 2 || names[0] != `com.example.Event` || names[1] != `com.example.Event.Address` {
+		t.Fatalf("bad message order %v", names)
+	}
+	ev := pf.order[0]
+	if len(ev.fields) != 8 || ev.byNum[6].message != pf.order[1] || ev.byNum[4].enum == nil || ev.byNum[5].mapKey != `string` {
+		t.Fatalf("bad fields %+v", ev.fields)
+	}
+
+	bad := []string{
+		`message A { string a = 1; `,
+		`message A { map<string> a = 1; }`,
+		`message A { string a = x; }`,
+		`message A { string a = 1 }`,
+	}
+	for _, src := range bad {
+		if _, err := parseProto(src); err == nil {
+			t.Fatalf("parsed bad schema %q", src)
+		}
+	}
+}
+
+func TestDecodeProto(t *testing.T) {
+	pf, err := parseProto(testProtoSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = decodeProtoMessage(pf.order[0], testProtoEvent(), &buf, 0); err != nil {
+		t.Fatal(err)
+	} else if buf.String() != testProtoEventJSON {
+		t.Fatalf("bad JSON %s", buf.String())
+	} else if !json.Valid(buf.Bytes()) {
+		t.Fatalf("invalid JSON %s", buf.String())
+	}
+
+	// a singular field repeated on the wire takes the last value
+	b := protoBytes(nil, 1, []byte(`a`))
+	b = protoBytes(b, 1, []byte(`b`))
+	buf.Reset()
+	if err = decodeProtoMessage(pf.order[0], b, &buf, 0); err != nil {
+		t.Fatal(err)
+	} else if buf.String() != `{"msg":"b"}` {
+		t.Fatalf("bad JSON %s", buf.String())
+	}
+
+	ev := testProtoEvent()
+	if err = decodeProtoMessage(pf.order[0], ev[:len(ev)-5], &buf, 0); err == nil {
+		t.Fatal("decoded a truncated message")
+	}
+	// msg with a varint rather than a string
+	if err = decodeProtoMessage(pf.order[0], []byte{0x08, 0x01}, &buf, 0); err == nil {
+		t.Fatal("decoded a mistyped field")
+	}
+}
@@ -0,0 +1,159 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingesters/utils"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// Replay markers are written in place of a shard's sequence number by
+// -reset-checkpoint. Like shardClosedMarker they can never collide with a
+// sequence number, and they are replaced by one as soon as the shard is read.
+const (
+	replayHorizonMarker   = kinesis.ShardIteratorTypeTrimHorizon
+	replayTimestampPrefix = kinesis.ShardIteratorTypeAtTimestamp + ` `
+)
+
+// replayMarker returns the checkpoint which causes a shard to be re-read from
+// the trim horizon, or from ts if it is not zero.
+func replayMarker(ts time.Time) string {
+	if ts.IsZero() {
+		return replayHorizonMarker
+	}
+	return replayTimestampPrefix + ts.UTC().Format(time.RFC3339)
+}
+
+// parseReplayMarker returns the iterator type and timestamp a checkpoint asks
+// for, ok is false if the checkpoint is not a replay marker.
+func parseReplayMarker(seq string) (typ string, ts time.Time, ok bool) {
+	if seq == replayHorizonMarker {
+		return kinesis.ShardIteratorTypeTrimHorizon, ts, true
+	}
+	if strings.HasPrefix(seq, replayTimestampPrefix) {
+		var err error
+		if ts, err = time.Parse(time.RFC3339, strings.TrimPrefix(seq, replayTimestampPrefix)); err == nil {
+			return kinesis.ShardIteratorTypeAtTimestamp, ts, true
+		}
+	}
+	return
+}
+
+// resetCheckpoint rewrites the state file entries of every shard of a stream
+// so that the next run re-reads it from the trim horizon, or from ts if it is
+// not zero. Nothing is changed unless confirm is set, the affected shards are
+// listed on w either way. Shards without an entry are still started from the
+// stream's Iterator-Type.
+func resetCheckpoint(cfg *cfgType, stream string, ts time.Time, confirm bool, w io.Writer) error {
+	if cfg.Global.Checkpoint_Backend == checkpointBackendDynamo {
+		return errors.New("Checkpoints can only be reset with the file Checkpoint-Backend")
+	}
+	var name string
+	for k, v := range cfg.KinesisStream {
+		if k == stream || v.Stream_Name == stream {
+			name = v.Stream_Name
+			break
+		}
+	}
+	if name == `` {
+		return fmt.Errorf("Stream %q is not in the configuration", stream)
+	}
+
+	sf, err := utils.NewState(cfg.Global.State_Store_Location, 0600)
+	if err != nil {
+		return err
+	}
+	sf.SetCompression(cfg.Global.State_Store_Compress)
+	states := make(map[string]map[string]string)
+	if err = sf.Read(&states); err != nil && err != utils.ErrNoState {
+		return fmt.Errorf("Failed to read state file %s: %v", cfg.Global.State_Store_Location, err)
+	}
+	shards := make([]string, 0, len(states[name]))
+	for k := range states[name] {
+		shards = append(shards, k)
+	}
+	if len(shards) == 0 {
+		return fmt.Errorf("No checkpoints for stream %s in %s", name, cfg.Global.State_Store_Location)
+	}
+	sort.Strings(shards)
+
+	marker := replayMarker(ts)
+	for _, k := range shards {
+		fmt.Fprintf(w, "Stream %s %s: %s -> %s\n", name, k, states[name][k], marker)
+		states[name][k] = marker
+	}
+	if !confirm {
+		return errors.New("Checkpoints not changed, add -confirm to reset them")
+	}
+	if err = sf.Write(states); err != nil {
+		return fmt.Errorf("Failed to write state file %s: %v", cfg.Global.State_Store_Location, err)
+	}
+	fmt.Fprintf(w, "Reset %d checkpoints, stream %s will be replayed on the next run\n", len(shards), name)
+	return nil
+}
+
+// restoreCheckpoint replaces the checkpoints in the state file with those of a
+// checkpoint entry read from r, the data of the newest entry written to the
+// Checkpoint-Backup-Tag. This moves an ingester to a new host or
+// recovers a lost state file. Nothing is changed unless confirm is set, the
+// restored checkpoints are listed on w either way.
+func restoreCheckpoint(cfg *cfgType, r io.Reader, confirm bool, w io.Writer) error {
+	if cfg.Global.Checkpoint_Backend == checkpointBackendDynamo {
+		return errors.New("Checkpoints can only be restored with the file Checkpoint-Backend")
+	}
+	var ce checkpointEntry
+	if err := json.NewDecoder(r).Decode(&ce); err != nil {
+		return fmt.Errorf("Invalid checkpoint entry: %v", err)
+	} else if len(ce.Checkpoints) == 0 {
+		return errors.New("No checkpoints in the checkpoint entry")
+	}
+	if id, ok := cfg.Global.IngesterUUID(); ok && ce.Ingester != `` && ce.Ingester != id.String() {
+		fmt.Fprintf(w, "The checkpoint entry was written by ingester %s, this is %s\n", ce.Ingester, id)
+	}
+
+	streams := make([]string, 0, len(ce.Checkpoints))
+	var n int
+	for k := range ce.Checkpoints {
+		streams = append(streams, k)
+	}
+	sort.Strings(streams)
+	for _, name := range streams {
+		shards := make([]string, 0, len(ce.Checkpoints[name]))
+		for k := range ce.Checkpoints[name] {
+			shards = append(shards, k)
+		}
+		sort.Strings(shards)
+		for _, k := range shards {
+			fmt.Fprintf(w, "Stream %s %s: %s\n", name, k, ce.Checkpoints[name][k])
+			n++
+		}
+	}
+	if !confirm {
+		return errors.New("Checkpoints not changed, add -confirm to restore them")
+	}
+	sf, err := utils.NewState(cfg.Global.State_Store_Location, 0600)
+	if err != nil {
+		return err
+	}
+	sf.SetCompression(cfg.Global.State_Store_Compress)
+	if err = sf.Write(ce.Checkpoints); err != nil {
+		return fmt.Errorf("Failed to write state file %s: %v", cfg.Global.State_Store_Location, err)
+	}
+	fmt.Fprintf(w, "Restored %d checkpoints to %s\n", n, cfg.Global.State_Store_Location)
+	return nil
+}
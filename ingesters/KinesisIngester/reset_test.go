@@ -0,0 +1,79 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestResetCheckpoint(t *testing.T) {
+	pth := filepath.Join(tdir, `reset.state`)
+	sm := newTestStateman(t, pth)
+	sm.UpdateSequenceNum(`stream`, `shardId-000000000000`, `1000`)
+	sm.MarkShardClosed(`stream`, `shardId-000000000001`)
+	sm.UpdateSequenceNum(`other`, `shardId-000000000000`, `2000`)
+	sm.Flush()
+
+	sd := &streamDef{Stream_Name: `stream`}
+	c := testConfig(sd)
+	if err := verifyConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	c.Global.State_Store_Location = pth
+
+	// without confirmation nothing is written
+	if err := resetCheckpoint(c, `stream`, time.Time{}, false, ioutil.Discard); err == nil {
+		t.Fatal("reset without confirmation")
+	}
+	if seq := newTestStateman(t, pth).GetSequenceNum(`stream`, `shardId-000000000000`); seq != `1000` {
+		t.Fatalf("unconfirmed reset changed the checkpoint to %q", seq)
+	}
+	if err := resetCheckpoint(c, `missing`, time.Time{}, true, ioutil.Discard); err == nil {
+		t.Fatal("reset a stream which is not configured")
+	}
+
+	ts := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	if err := resetCheckpoint(c, `test`, ts, true, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	sm = newTestStateman(t, pth)
+	if sm.ShardClosed(`stream`, `shardId-000000000001`) {
+		t.Fatal("closed shard will not be replayed")
+	}
+	if seq := sm.GetSequenceNum(`other`, `shardId-000000000000`); seq != `2000` {
+		t.Fatalf("other stream changed to %q", seq)
+	}
+	sc := &shardConsumer{
+		stream:   *sd,
+		shard:    kinesis.Shard{ShardId: aws.String(`shardId-000000000001`)},
+		stateMan: sm,
+	}
+	if typ, seq, start := sc.startingPosition(); typ != kinesis.ShardIteratorTypeAtTimestamp || seq != `` || !start.Equal(ts) {
+		t.Fatalf("bad replay position %s %q %v", typ, seq, start)
+	}
+
+	if err := resetCheckpoint(c, `stream`, time.Time{}, true, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	sc.stateMan = newTestStateman(t, pth)
+	if typ, seq, _ := sc.startingPosition(); typ != kinesis.ShardIteratorTypeTrimHorizon || seq != `` {
+		t.Fatalf("bad replay position %s %q", typ, seq)
+	}
+	// once records are handled the shard resumes after them
+	sc.lastSeq = `3000`
+	if typ, seq, _ := sc.startingPosition(); typ != kinesis.ShardIteratorTypeAfterSequenceNumber || seq != `3000` {
+		t.Fatalf("bad resume position %s %q", typ, seq)
+	}
+}
@@ -0,0 +1,180 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gravwell/gravwell/v3/ingest"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	// cap the number of partition keys a shard remembers, streams keyed on
+	// something like a request ID would otherwise grow the cache forever
+	maxRouteCacheSize = 4096
+)
+
+// record metadata a Tag-Template can use, besides json: fields of the data
+const (
+	tagVarStream = `stream`
+	tagVarRegion = `region`
+	tagVarShard  = `shard`
+	tagVarKey    = `partition-key`
+)
+
+var (
+	ErrInvalidTagRoute = errors.New("Tag-Route must be of the form <regex>:<tag>")
+
+	tagTemplateVars = []string{tagVarStream, tagVarRegion, tagVarShard, tagVarKey}
+)
+
+// tagRoute sends records whose partition key matches a regular expression to
+// a specific tag.
+type tagRoute struct {
+	re  *regexp.Regexp
+	tag string
+}
+
+// parseTagRoute parses a Tag-Route value of the form "regex:tag". Tags cannot
+// contain colons, so the value is split on the last one, leaving the regular
+// expression free to use them.
+func parseTagRoute(v string) (tr tagRoute, err error) {
+	idx := strings.LastIndex(v, `:`)
+	if idx <= 0 {
+		err = ErrInvalidTagRoute
+		return
+	}
+	tr.tag = strings.TrimSpace(v[idx+1:])
+	if err = ingest.CheckTag(tr.tag); err != nil {
+		err = fmt.Errorf("Invalid Tag-Route tag %q: %v", tr.tag, err)
+		return
+	}
+	if tr.re, err = regexp.Compile(v[:idx]); err != nil {
+		err = fmt.Errorf("Invalid Tag-Route regex %q: %v", v[:idx], err)
+	}
+	return
+}
+
+// resolvedRoute is a tagRoute whose tag has been resolved by the muxer.
+type resolvedRoute struct {
+	re  *regexp.Regexp
+	tag entry.EntryTag
+}
+
+// resolveTagRoutes resolves the tags of a set of routes once up front so that
+// the record path never has to call back into the muxer.
+func resolveTagRoutes(routes []tagRoute, getTag func(string) (entry.EntryTag, error)) (rr []resolvedRoute, err error) {
+	for _, r := range routes {
+		var tag entry.EntryTag
+		if tag, err = getTag(r.tag); err != nil {
+			return nil, fmt.Errorf("Can't resolve tag %v: %v", r.tag, err)
+		}
+		rr = append(rr, resolvedRoute{re: r.re, tag: tag})
+	}
+	return
+}
+
+// tagRouter picks the tag for a record based on its partition key. The first
+// matching route wins, records matching no route get the default tag. A
+// tagRouter caches its decisions and is not safe for concurrent use, so each
+// shard gets its own.
+type tagRouter struct {
+	routes []resolvedRoute
+	def    entry.EntryTag
+	cache  map[string]entry.EntryTag
+}
+
+func newTagRouter(def entry.EntryTag, routes []resolvedRoute) *tagRouter {
+	return &tagRouter{
+		routes: routes,
+		def:    def,
+		cache:  make(map[string]entry.EntryTag),
+	}
+}
+
+// Tag returns the tag for records with the given partition key.
+func (tr *tagRouter) Tag(key string) entry.EntryTag {
+	if len(tr.routes) == 0 {
+		return tr.def
+	}
+	if tag, ok := tr.cache[key]; ok {
+		return tag
+	}
+	tag := tr.def
+	for _, r := range tr.routes {
+		if r.re.MatchString(key) {
+			tag = r.tag
+			break
+		}
+	}
+	if len(tr.cache) >= maxRouteCacheSize {
+		tr.cache = make(map[string]entry.EntryTag)
+	}
+	tr.cache[key] = tag
+	return tag
+}
+
+// keyFilter decides which records are ingested based on their partition key.
+// Records must match at least one include expression, if any are given, and
+// no exclude expression. A nil keyFilter accepts everything.
+type keyFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func newKeyFilter(include, exclude []string) (kf *keyFilter, err error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return
+	}
+	kf = &keyFilter{}
+	if kf.include, err = compileAll(include); err != nil {
+		return nil, fmt.Errorf("Invalid Partition-Key-Include: %v", err)
+	}
+	if kf.exclude, err = compileAll(exclude); err != nil {
+		return nil, fmt.Errorf("Invalid Partition-Key-Exclude: %v", err)
+	}
+	return
+}
+
+func compileAll(exprs []string) (res []*regexp.Regexp, err error) {
+	for _, v := range exprs {
+		var re *regexp.Regexp
+		if re, err = regexp.Compile(v); err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return
+}
+
+// Accept returns true if records with the given partition key should be
+// ingested.
+func (kf *keyFilter) Accept(key string) bool {
+	if kf == nil {
+		return true
+	}
+	for _, re := range kf.exclude {
+		if re.MatchString(key) {
+			return false
+		}
+	}
+	if len(kf.include) == 0 {
+		return true
+	}
+	for _, re := range kf.include {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
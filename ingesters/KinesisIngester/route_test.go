@@ -0,0 +1,106 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+func TestParseTagRoute(t *testing.T) {
+	tr, err := parseTagRoute(`^tenant:(a|b)$:tenantab`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.tag != `tenantab` || !tr.re.MatchString(`tenant:a`) {
+		t.Fatalf("bad route: %v %v", tr.re, tr.tag)
+	}
+	for _, v := range []string{``, `notag`, `:tag`, `foo:bad tag`, `([:tag`} {
+		if _, err = parseTagRoute(v); err == nil {
+			t.Fatalf("accepted invalid route %q", v)
+		}
+	}
+}
+
+func TestTagRouter(t *testing.T) {
+	var routes []tagRoute
+	for _, v := range []string{`^alpha-:alpha`, `^beta-:beta`, `-prod$:prod`} {
+		r, err := parseTagRoute(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes = append(routes, r)
+	}
+	tags := map[string]entry.EntryTag{`alpha`: 1, `beta`: 2, `prod`: 3}
+	rr, err := resolveTagRoutes(routes, func(name string) (entry.EntryTag, error) {
+		if tag, ok := tags[name]; ok {
+			return tag, nil
+		}
+		return 0, fmt.Errorf("unknown tag %s", name)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := newTagRouter(0, rr)
+	checks := map[string]entry.EntryTag{
+		`alpha-1`:    1,
+		`beta-prod`:  2, // first match wins
+		`gamma-prod`: 3,
+		`gamma`:      0,
+	}
+	for i := 0; i < 2; i++ { // second pass is served from the cache
+		for key, exp := range checks {
+			if tag := tr.Tag(key); tag != exp {
+				t.Fatalf("key %s routed to %d, expected %d", key, tag, exp)
+			}
+		}
+	}
+	if len(tr.cache) != len(checks) {
+		t.Fatalf("cache has %d entries, expected %d", len(tr.cache), len(checks))
+	}
+}
+
+func TestKeyFilter(t *testing.T) {
+	if kf, err := newKeyFilter(nil, nil); err != nil || kf != nil || !kf.Accept(`anything`) {
+		t.Fatal("empty filter does not accept everything")
+	}
+	kf, err := newKeyFilter([]string{`^tenantA-`, `^tenantB-`}, []string{`-debug$`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := map[string]bool{
+		`tenantA-1`:     true,
+		`tenantB-2`:     true,
+		`tenantC-3`:     false, // not included
+		`tenantA-debug`: false, // excluded wins
+		``:              false,
+	}
+	for key, exp := range checks {
+		if kf.Accept(key) != exp {
+			t.Fatalf("key %q accepted %v, expected %v", key, !exp, exp)
+		}
+	}
+
+	if kf, err = newKeyFilter(nil, []string{`^noise`}); err != nil {
+		t.Fatal(err)
+	}
+	if !kf.Accept(`signal`) || kf.Accept(`noise-1`) {
+		t.Fatal("exclude only filter is wrong")
+	}
+
+	if _, err = newKeyFilter([]string{`([`}, nil); err == nil {
+		t.Fatal("accepted an invalid include")
+	}
+	if _, err = newKeyFilter(nil, []string{`([`}); err == nil {
+		t.Fatal("accepted an invalid exclude")
+	}
+}
@@ -0,0 +1,64 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+const (
+	sampledIn  = `in`
+	sampledOut = `out`
+)
+
+// recordSampler picks a pseudo-random subset of the records of a shard. The
+// choice is a hash of the sequence number seeded with the shard ID, so a
+// record read again after a restart or by another ingester is sampled the
+// same way. Aggregated records are sampled as a whole.
+type recordSampler struct {
+	seed      []byte
+	threshold uint64 // records hashing below this are kept
+}
+
+// newRecordSampler returns a sampler keeping the rate fraction of the records
+// of the shard, nil if every record is kept.
+func newRecordSampler(rate float64, shard string) *recordSampler {
+	if rate >= 1 {
+		return nil
+	}
+	rs := &recordSampler{seed: []byte(shard)}
+	if rate > 0 {
+		rs.threshold = uint64(math.Ldexp(rate, 64))
+	}
+	return rs
+}
+
+// Keep returns true if the record with the sequence number is sampled in. A
+// nil sampler keeps everything.
+func (rs *recordSampler) Keep(seq string) bool {
+	if rs == nil {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write(rs.seed)
+	h.Write([]byte(seq))
+	return mix64(h.Sum64()) < rs.threshold
+}
+
+// mix64 spreads every bit of x over the result, FNV alone leaves the high bits
+// nearly the same for sequence numbers that only differ in their last digits.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
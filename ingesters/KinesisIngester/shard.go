@@ -0,0 +1,825 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/gravwell/gravwell/v3/ingest/processors"
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
+	"github.com/gravwell/gravwell/v3/timegrinder"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+var errNilShardIterator = errors.New("got a nil shard iterator")
+
+// contextWriter writes entries straight to the muxer, bypassing the
+// preprocessors.
+type contextWriter interface {
+	WriteEntryContext(context.Context, *entry.Entry) error
+}
+
+// ingestWriter is the muxer, or the spool in front of it, as used by the
+// preprocessors and shard consumers.
+type ingestWriter interface {
+	contextWriter
+	WriteEntry(*entry.Entry) error
+	NegotiateTag(string) (entry.EntryTag, error)
+	LookupTag(entry.EntryTag) (string, bool)
+}
+
+// shardConsumer reads records from a single shard of a Kinesis stream and
+// hands them to the stream's processor set.
+type shardConsumer struct {
+	ctx         context.Context // cancelled when the ingester shuts down
+	abort       context.Context // cancelled after the Shutdown-Grace, nil to use ctx
+	stream      streamDef
+	shard       kinesis.Shard
+	shardid     int
+	router      *tagRouter
+	tagger      *awsutils.TagResolver // nil unless the stream has a Tag-Template
+	filter      *keyFilter
+	src         net.IP
+	svc         kinesisiface.KinesisAPI
+	procset     *processors.ProcessorSet
+	igst        contextWriter // used by the passthrough Preprocessor-Error-Policy
+	stateMan    checkpointer
+	consumerARN string // set when the stream is consumed via enhanced fan-out
+	decomp      *awsutils.Decompressor
+	avro        *avroDecoder // nil unless the stream's Content-Type is avro
+	glue        *glueDecoder // nil unless the stream has a glue Schema-Registry
+	metrics     *shardMetrics
+	inflight    *inFlightLimiter
+	pause       *awsutils.Pauser
+	slots       *shardSlots // nil unless Max-Concurrent-Shards is set
+	slotHeld    bool
+	tee         *awsutils.Tee
+	payloads    *awsutils.PayloadLogger // nil unless Log-Bad-Payloads is set
+	closed      chan string
+	tg          *timegrinder.TimeGrinder
+	guard       *awsutils.SizeGuard
+	clamp       *awsutils.TimestampClamp
+	framing     framer                  // splits records into entries, nil ingests them whole
+	sampler     *recordSampler          // nil unless the stream has a Sample-Rate
+	jsonTime    *awsutils.JSONTimestamp // nil unless Timestamp-JSON-Path is set
+	warnedSize  bool                    // logged the first oversized entry
+	warnedFrame bool                    // logged the first framing error
+	warnedAvro  bool                    // logged the first Avro decoding error
+	warnedGlue  bool                    // logged the first Glue Schema Registry decoding error
+	parseTime   bool                    // cleared if the stream's timestamps can't be parsed
+	lastTS      entry.Timestamp         // latest entry timestamp, kept with Preserve-Order
+	tsFailures  int                     // consecutive timestamp extraction failures
+	failed      error                   // set when the shard is stopped until restart, see giveUp
+
+	// the last sequence number handed off, authoritative over the checkpointer
+	// for as long as this worker runs so that we never step backwards
+	lastSeq string
+
+	backoff       *awsutils.Backoff
+	backoffWarned bool
+}
+
+func (sc *shardConsumer) shardID() string {
+	return *sc.shard.ShardId
+}
+
+// active returns true while the shard should keep being consumed, which is
+// until the ingester shuts down, we lose the lease on the shard, or a
+// preprocessor failure stops it.
+func (sc *shardConsumer) active() bool {
+	return sc.ctx.Err() == nil && sc.failed == nil && sc.stateMan.Owns(sc.stream.Stream_Name, sc.shardID())
+}
+
+// callCtx returns the context for AWS calls and writes, which are allowed to
+// finish the records in hand after shutdown starts until the Shutdown-Grace
+// is over.
+func (sc *shardConsumer) callCtx() context.Context {
+	if sc.abort != nil {
+		return sc.abort
+	}
+	return sc.ctx
+}
+
+// run consumes the shard until the ingester is shut down or the lease on the
+// shard is lost, using enhanced fan-out if the stream has a registered consumer
+// and polling otherwise. It returns true if the shard was read to its end.
+func (sc *shardConsumer) run() (closed bool) {
+	// set up timegrinder and other long-lived stuff
+	sc.parseTime = sc.stream.Parse_Time
+	tg, err := timegrinder.NewTimeGrinder(sc.stream.timegrinderConfig())
+	if err != nil {
+		lg.Error("Failed to create timegrinder for stream %s: %v", sc.stream.Stream_Name, err)
+		sc.parseTime = false
+	} else {
+		if sc.stream.Assume_Local_Timezone {
+			tg.SetLocalTime()
+		}
+		if sc.stream.Timezone_Override != `` {
+			if err = tg.SetTimezone(sc.stream.Timezone_Override); err != nil {
+				lg.Error("Failed to set timezone to %v: %v", sc.stream.Timezone_Override, err)
+				return
+			}
+		}
+	}
+	sc.tg = tg
+	// the limit was checked with the config
+	sc.guard, _ = sc.stream.sizeGuard()
+	// the framing was checked with the config
+	sc.framing, _ = sc.stream.framer()
+	sc.sampler = sc.stream.sampler(sc.shardID())
+	sc.jsonTime, _ = sc.stream.jsonTimestamp()
+	sc.clamp, _ = sc.stream.timestampClamp()
+	sc.backoff = awsutils.NewBackoff(backoffBase, backoffMax)
+
+	if sc.consumerARN != `` {
+		closed = sc.subscribe()
+	} else {
+		closed = sc.poll()
+	}
+	sc.finish(closed)
+	return
+}
+
+// runRecovered runs the consumer, recovering from a panic so that the shard
+// can be relaunched rather than abandoned. The state kept by the consumer
+// carries over, so a relaunch resumes from the last checkpoint.
+func (sc *shardConsumer) runRecovered() (closed, panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			sc.releaseSlot()
+			sc.metrics.Panic()
+			lg.Critical("Worker for shard %s of stream %s panicked, relaunching it in %v: %v\n%s", sc.shardID(), sc.stream.Stream_Name, panicRestartDelay, r, debug.Stack())
+		}
+	}()
+	closed = sc.run()
+	return
+}
+
+// acquireSlot waits for a Max-Concurrent-Shards slot, returning false if the
+// ingester is shutting down.
+func (sc *shardConsumer) acquireSlot() bool {
+	sc.slotHeld = sc.slots.Acquire(sc.ctx)
+	return sc.slotHeld
+}
+
+// releaseSlot gives up the slot if the consumer holds one.
+func (sc *shardConsumer) releaseSlot() {
+	if sc.slotHeld {
+		sc.slots.Release()
+		sc.slotHeld = false
+	}
+}
+
+// finish records that a drained shard is closed, its final position is
+// persisted when the worker releases the shard.
+func (sc *shardConsumer) finish(closed bool) {
+	if closed {
+		// record that the shard is drained so that its children can start
+		sc.stateMan.MarkShardClosed(sc.stream.Stream_Name, sc.shardID())
+	}
+	if closed {
+		select {
+		case sc.closed <- sc.shardID():
+		default:
+		}
+	}
+}
+
+// poll consumes the shard with GetRecords, sharing read throughput with any
+// other consumers of the stream. It returns true if the end of a closed shard
+// was reached.
+func (sc *shardConsumer) poll() (closed bool) {
+	svc := sc.svc
+	// when GetShardIterator started failing, zero after a success
+	var iterFailing time.Time
+reconnectLoop:
+	for sc.active() {
+		gsii := &kinesis.GetShardIteratorInput{}
+		gsii.SetShardId(sc.shardID())
+		gsii.SetStreamName(sc.stream.Stream_Name)
+		typ, seqnum, ts := sc.startingPosition()
+		gsii.SetShardIteratorType(typ)
+		if seqnum != `` {
+			gsii.SetStartingSequenceNumber(seqnum)
+		} else if typ == kinesis.ShardIteratorTypeAtTimestamp {
+			gsii.SetTimestamp(ts)
+		}
+
+		output, err := svc.GetShardIterator(gsii)
+		if err == nil && output.ShardIterator == nil {
+			// this is weird, treat it like any other failure
+			err = errNilShardIterator
+		}
+		if err != nil {
+			lg.Error("error on shard #%d (%s): %s", sc.shardid, sc.shardID(), awsutils.ErrorMessage(err))
+			if iterFailing.IsZero() {
+				iterFailing = time.Now()
+			}
+			if limit := sc.stream.iteratorRetryLimit(); limit > 0 && time.Since(iterFailing) >= limit {
+				// most likely the stream is gone or we lost permission
+				sc.giveUp(fmt.Errorf("GetShardIterator has failed for %v: %v", time.Since(iterFailing).Round(time.Second), err))
+				return
+			}
+			sc.backoffWait()
+			continue
+		}
+		iterFailing = time.Time{}
+		sc.backoffReset()
+		iter := *output.ShardIterator
+
+		for sc.active() {
+			// an iterator which expires while paused is renewed from lastSeq
+			sc.waitPaused()
+			sc.waitInFlight()
+			gri := &kinesis.GetRecordsInput{}
+			gri.SetLimit(sc.stream.Records_Per_Request)
+			gri.SetShardIterator(iter)
+			var res *kinesis.GetRecordsOutput
+			var err error
+			var capped bool
+			for sc.active() {
+				// with Max-Concurrent-Shards the slot is held until the
+				// response is handled, never while backing off
+				if !sc.acquireSlot() {
+					break
+				}
+				res, err = svc.GetRecordsWithContext(sc.callCtx(), gri)
+				if err == nil && res == nil {
+					// treat a malformed response as an empty poll of the
+					// same iterator rather than giving up on the shard
+					res = &kinesis.GetRecordsOutput{NextShardIterator: aws.String(iter)}
+				}
+				if res != nil {
+					if res.NextShardIterator != nil {
+						iter = *res.NextShardIterator
+					}
+				}
+				if err != nil {
+					sc.releaseSlot()
+					if sc.ctx.Err() != nil {
+						// shut down while the call was in flight
+						break
+					} else if awsErr, ok := err.(awserr.Error); ok {
+						// process SDK error
+						if awsErr.Code() == kinesis.ErrCodeProvisionedThroughputExceededException {
+							lg.Warn("Throughput exceeded on shard %s, trying again (request ID %s)", sc.shardID(), awsutils.RequestID(err))
+							sc.backoffWait()
+						} else if awsErr.Code() == kinesis.ErrCodeExpiredIteratorException {
+							lg.Info("Iterator expired, re-initializing")
+							time.Sleep(100 * time.Millisecond)
+							continue reconnectLoop
+						} else {
+							lg.Error("get records on shard %s: %s", sc.shardID(), awsutils.ErrorMessage(awsErr))
+							sc.backoffWait()
+						}
+					} else {
+						lg.Error("unknown error: %s", awsutils.ErrorMessage(err))
+						sc.backoffWait()
+					}
+				} else {
+					sc.backoffReset()
+					capped = responseCapped(res.Records, sc.stream.Records_Per_Request)
+					break
+				}
+			}
+			if err != nil || res == nil {
+				// we were told to stop while retrying
+				break
+			}
+			sc.handleRecords(res.Records, res.MillisBehindLatest)
+			sc.releaseSlot()
+			if sc.failed != nil {
+				return
+			}
+			if res.NextShardIterator == nil {
+				// the shard has been closed and we have read everything in it
+				closed = true
+				return
+			}
+			// if the response was cut short there is more waiting for us,
+			// otherwise chill for a sec before we hit it again
+			if !capped {
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+		// if we get to this point, exit the for loop
+		break
+	}
+	return
+}
+
+// startingSequence returns the sequence number to resume reading after. Once
+// this worker has handled records its own position is used, the checkpointer
+// may not have caught up with it yet.
+func (sc *shardConsumer) startingSequence() string {
+	if sc.lastSeq != `` {
+		return sc.lastSeq
+	}
+	return sc.stateMan.GetSequenceNum(sc.stream.Stream_Name, sc.shardID())
+}
+
+// startingPosition returns where to start reading the shard: after the last
+// sequence number we have, from a replay requested with -reset-checkpoint, or
+// from the stream's Iterator-Type if there is no checkpoint.
+func (sc *shardConsumer) startingPosition() (typ, seqnum string, ts time.Time) {
+	seqnum = sc.startingSequence()
+	if seqnum == `` {
+		// we don't have a previous state
+		debugout("No previous sequence number for stream %v shard %v, defaulting to %v\n", sc.stream.Stream_Name, sc.shardID(), sc.stream.Iterator_Type)
+		return sc.stream.Iterator_Type, ``, sc.stream.iteratorStartTime()
+	}
+	if typ, ts, ok := parseReplayMarker(seqnum); ok {
+		debugout("Replaying stream %v shard %v from %v\n", sc.stream.Stream_Name, sc.shardID(), seqnum)
+		return typ, ``, ts
+	}
+	return kinesis.ShardIteratorTypeAfterSequenceNumber, seqnum, ts
+}
+
+// responseCapped returns true if a GetRecords response was limited by either
+// the requested record count or the response size cap, meaning more records
+// are immediately available.
+func responseCapped(records []*kinesis.Record, limit int64) bool {
+	if int64(len(records)) >= limit {
+		return true
+	}
+	var sz int
+	for _, r := range records {
+		if r != nil {
+			sz += len(r.Data) + len(aws.StringValue(r.PartitionKey))
+		}
+	}
+	// the next record could be as large as the maximum record size
+	return sz > getRecordsMaxBytes-maxRecordBytes
+}
+
+// subscribe consumes the shard with SubscribeToShard, receiving records pushed
+// over the stream consumer's dedicated throughput. Subscriptions expire after
+// five minutes, so we resubscribe from the last checkpoint until shut down or
+// the end of a closed shard is reached.
+func (sc *shardConsumer) subscribe() (closed bool) {
+	for sc.active() {
+		pos := &kinesis.StartingPosition{}
+		typ, seqnum, ts := sc.startingPosition()
+		pos.SetType(typ)
+		if seqnum != `` {
+			pos.SetSequenceNumber(seqnum)
+		} else if typ == kinesis.ShardIteratorTypeAtTimestamp {
+			pos.SetTimestamp(ts)
+		}
+		stsi := &kinesis.SubscribeToShardInput{}
+		stsi.SetConsumerARN(sc.consumerARN)
+		stsi.SetShardId(sc.shardID())
+		stsi.SetStartingPosition(pos)
+
+		// a subscription holds its slot until it expires after 5 minutes
+		if sc.waitPaused(); !sc.active() || !sc.acquireSlot() {
+			break
+		}
+		out, err := sc.svc.SubscribeToShardWithContext(sc.callCtx(), stsi)
+		if err != nil {
+			sc.releaseSlot()
+			if sc.ctx.Err() != nil {
+				break
+			}
+			lg.Error("failed to subscribe to shard #%d (%s): %s", sc.shardid, sc.shardID(), awsutils.ErrorMessage(err))
+			sc.backoffWait()
+			continue
+		}
+		sc.backoffReset()
+		closed = sc.readEvents(out.EventStream)
+		sc.releaseSlot()
+		if closed {
+			return
+		}
+	}
+	return
+}
+
+// readEvents handles events from a single subscription until it expires or
+// the ingester is shut down. It returns true if the shard has been closed.
+func (sc *shardConsumer) readEvents(es *kinesis.SubscribeToShardEventStream) (closed bool) {
+	defer es.Close()
+	events := es.Events()
+	for sc.active() {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				if err := es.Err(); err != nil {
+					lg.Error("subscription to shard #%d (%s) failed: %s", sc.shardid, sc.shardID(), awsutils.ErrorMessage(err))
+					time.Sleep(500 * time.Millisecond)
+				}
+				return
+			}
+			if e, ok := ev.(*kinesis.SubscribeToShardEvent); ok {
+				if sc.pause.Paused() {
+					// drop the subscription, we resubscribe after the last
+					// record handled once resumed
+					return
+				}
+				// leaving events unread pushes back on the subscription
+				sc.waitInFlight()
+				sc.handleRecords(e.Records, e.MillisBehindLatest)
+				if sc.failed != nil {
+					return
+				}
+				if e.ContinuationSequenceNumber == nil {
+					// no continuation means we have read the end of the shard
+					closed = true
+					return
+				}
+			}
+		case <-time.After(time.Second):
+			// wake up periodically so that we notice lost leases
+		case <-sc.ctx.Done():
+			return
+		}
+	}
+	return
+}
+
+// waitPaused blocks while ingest is paused, until the shard stops being
+// active.
+func (sc *shardConsumer) waitPaused() {
+	for sc.active() {
+		resumed := sc.pause.Resumed()
+		if resumed == nil {
+			return
+		}
+		select {
+		case <-resumed:
+		case <-time.After(time.Second):
+			// wake up periodically so that we notice lost leases
+		case <-sc.ctx.Done():
+		}
+	}
+}
+
+// waitInFlight pauses the shard while the global in-flight budget is exceeded.
+func (sc *shardConsumer) waitInFlight() {
+	start := time.Now()
+	if sc.inflight.Wait(sc.active) {
+		debugout("Shard #%d (%s) paused for %v waiting on in-flight entries\n", sc.shardid, sc.shardID(), time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// backoffWait sleeps after a failed call, warning once the shard has been
+// backing off for longer than the stream's warning threshold.
+func (sc *shardConsumer) backoffWait() {
+	if el := sc.backoff.Elapsed(); !sc.backoffWarned && el >= sc.stream.backoffWarnThreshold() {
+		lg.Warn("Shard #%d (%s) on stream %s has been backing off for %v", sc.shardid, sc.shardID(), sc.stream.Stream_Name, el.Round(time.Second))
+		sc.backoffWarned = true
+	}
+	sc.metrics.Error()
+	tmr := time.NewTimer(sc.backoff.Next())
+	defer tmr.Stop()
+	select {
+	case <-tmr.C:
+	case <-sc.ctx.Done():
+	}
+}
+
+// backoffReset clears the backoff after a successful call.
+func (sc *shardConsumer) backoffReset() {
+	if sc.backoffWarned {
+		lg.Info("Shard #%d (%s) on stream %s recovered after backing off for %v", sc.shardid, sc.shardID(), sc.stream.Stream_Name, sc.backoff.Elapsed().Round(time.Second))
+		sc.backoffWarned = false
+	}
+	sc.backoff.Reset()
+}
+
+// handleRecords converts records into entries, hands them to the processor set,
+// and updates the shard checkpoint and metrics.
+func (sc *shardConsumer) handleRecords(records []*kinesis.Record, millisBehind *int64) {
+	sc.metrics.Update(records, millisBehind)
+	var lastSeqNum string
+	for _, r := range records {
+		if r == nil {
+			continue
+		}
+		sc.tee.Write(sc.stream.Stream_Name+`/`+sc.shardID(), aws.StringValue(r.SequenceNumber), r.Data)
+		// records sampled out are skipped but still covered by the checkpoint
+		if sc.sampled(r) {
+			if sc.stream.Deaggregate && isAggregated(r.Data) {
+				if urs, err := deaggregate(r); err == nil {
+					for _, ur := range urs {
+						sc.handleRecord(ur)
+					}
+				} else {
+					// hand the record over untouched rather than dropping it
+					lg.Warn("Failed to deaggregate record %s on shard %s: %v", aws.StringValue(r.SequenceNumber), sc.shardID(), err)
+					sc.handleRecord(r)
+				}
+			} else {
+				sc.handleRecord(r)
+			}
+		}
+		if sc.callCtx().Err() != nil || sc.failed != nil {
+			// entries of this record may have been abandoned by the shutdown
+			// or a preprocessor failure, leave it to be read again
+			break
+		}
+		if r.SequenceNumber != nil {
+			lastSeqNum = *r.SequenceNumber
+		}
+	}
+	// Now update the most recent sequence number
+	if lastSeqNum != `` {
+		sc.lastSeq = lastSeqNum
+		sc.stateMan.UpdateSequenceNum(sc.stream.Stream_Name, sc.shardID(), lastSeqNum)
+		sc.metrics.Checkpoint(lastSeqNum)
+	}
+}
+
+// sampled returns true if the record falls within the stream's Sample-Rate,
+// counting the decision when the stream is sampled.
+func (sc *shardConsumer) sampled(r *kinesis.Record) bool {
+	if sc.sampler == nil {
+		return true
+	}
+	keep := sc.sampler.Keep(aws.StringValue(r.SequenceNumber))
+	sc.metrics.Sampled(keep)
+	return keep
+}
+
+// handleRecord converts a single record into entries and hands them to the
+// processor set. Records rejected by the partition key filter are dropped, they
+// are still covered by the shard checkpoint.
+func (sc *shardConsumer) handleRecord(r *kinesis.Record) {
+	key := aws.StringValue(r.PartitionKey)
+	if !sc.filter.Accept(key) {
+		return
+	}
+	if sc.stream.Content_Type == contentTypeCWLogs {
+		msg, err := decodeCWLogs(r.Data)
+		if err == nil {
+			for _, ev := range msg.LogEvents {
+				sc.process(&entry.Entry{
+					TS:   entry.FromStandard(ev.Time()),
+					Tag:  sc.entryTag(key, []byte(ev.Message)),
+					SRC:  sc.src,
+					Data: []byte(ev.Message),
+				})
+			}
+			return
+		}
+		// hand the record over untouched rather than dropping it
+		lg.Warn("Failed to decode CloudWatch Logs record %s on shard %s: %v", aws.StringValue(r.SequenceNumber), sc.shardID(), err)
+	}
+
+	data, err := sc.decomp.Decompress(r.Data)
+	if err != nil && sc.decomp.FirstFailure() {
+		// pass the raw record through rather than dropping it
+		lg.Warn("Failed to decompress record %s on stream %s, passing compressed records through: %v", aws.StringValue(r.SequenceNumber), sc.stream.Stream_Name, err)
+	}
+
+	if sc.glue != nil {
+		vals, err := sc.glue.Decode(data)
+		if err == nil {
+			for _, v := range vals {
+				sc.process(&entry.Entry{
+					TS:   sc.timestamp(r, v),
+					Tag:  sc.entryTag(key, v),
+					SRC:  sc.src,
+					Data: v,
+				})
+			}
+			return
+		}
+		// a schema that can't be resolved or applied falls back to the raw record
+		sc.metrics.Error()
+		if !sc.warnedGlue {
+			sc.warnedGlue = true
+			lg.Warn("Failed to decode Glue Schema Registry record %s on shard %s of stream %s, passing undecoded records through: %v", aws.StringValue(r.SequenceNumber), sc.shardID(), sc.stream.Stream_Name, err)
+		}
+		sc.payloads.Log(data, "Failed to decode Glue Schema Registry record %s on shard %s of stream %s: %v", aws.StringValue(r.SequenceNumber), sc.shardID(), sc.stream.Stream_Name, err)
+	}
+
+	if sc.avro != nil {
+		vals, err := sc.avro.Decode(data)
+		if err == nil {
+			// every value is an entry of its own, timestamped from its JSON
+			for _, v := range vals {
+				sc.process(&entry.Entry{
+					TS:   sc.timestamp(r, v),
+					Tag:  sc.entryTag(key, v),
+					SRC:  sc.src,
+					Data: v,
+				})
+			}
+			return
+		}
+		// hand the record over undecoded rather than dropping it
+		sc.metrics.Error()
+		if !sc.warnedAvro {
+			sc.warnedAvro = true
+			lg.Warn("Failed to decode Avro record %s on shard %s of stream %s, passing undecoded records through: %v", aws.StringValue(r.SequenceNumber), sc.shardID(), sc.stream.Stream_Name, err)
+		}
+		sc.payloads.Log(data, "Failed to decode Avro record %s on shard %s of stream %s: %v", aws.StringValue(r.SequenceNumber), sc.shardID(), sc.stream.Stream_Name, err)
+	}
+
+	// every frame, e.g. a line with Split-Lines, gets its own entry and
+	// timestamp, as does every element of a JSON array with Unpack-JSON-Array
+	for _, frame := range sc.frames(r, data) {
+		for _, v := range sc.unpack(frame) {
+			sc.process(&entry.Entry{
+				TS:   sc.timestamp(r, v),
+				Tag:  sc.entryTag(key, v),
+				SRC:  sc.src,
+				Data: v,
+			})
+		}
+	}
+}
+
+// frames splits the data of a record by the stream's Framing. Records which
+// are not framed properly are still ingested, the bytes past the last whole
+// frame are an entry of their own.
+func (sc *shardConsumer) frames(r *kinesis.Record, data []byte) [][]byte {
+	if sc.framing == nil {
+		return [][]byte{data}
+	}
+	frames, err := sc.framing.frames(data)
+	if err != nil && !sc.warnedFrame {
+		sc.warnedFrame = true
+		lg.Warn("Malformed %s framing in record %s on shard %s of stream %s, ingesting the remainder as is: %v",
+			sc.stream.Framing, aws.StringValue(r.SequenceNumber), sc.shardID(), sc.stream.Stream_Name, err)
+	}
+	return frames
+}
+
+// unpack returns the top level elements of data if the stream unpacks JSON
+// arrays and data holds one, nested arrays are left whole. Anything else,
+// including an empty array, is returned as is.
+func (sc *shardConsumer) unpack(data []byte) [][]byte {
+	if !sc.stream.Unpack_JSON_Array {
+		return [][]byte{data}
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '[' {
+		return [][]byte{data}
+	}
+	var elems []json.RawMessage
+	if err := json.Unmarshal(data, &elems); err != nil || len(elems) == 0 {
+		return [][]byte{data}
+	}
+	vals := make([][]byte, len(elems))
+	for i := range elems {
+		vals[i] = elems[i]
+	}
+	return vals
+}
+
+// entryTag returns the tag of an entry, rendered from the Tag-Template if the
+// stream has one and otherwise routed by partition key.
+func (sc *shardConsumer) entryTag(key string, data []byte) entry.EntryTag {
+	if sc.tagger == nil {
+		return sc.router.Tag(key)
+	}
+	tag, err := sc.tagger.Tag(func(name string) string {
+		switch name {
+		case tagVarStream:
+			return sc.stream.Stream_Name
+		case tagVarRegion:
+			return sc.stream.Region
+		case tagVarShard:
+			return sc.shardID()
+		case tagVarKey:
+			return key
+		}
+		return ``
+	}, data)
+	if err != nil {
+		lg.Warn("Falling back to Tag-Name %s on stream %s: %v", sc.stream.Tag_Name, sc.stream.Stream_Name, err)
+	}
+	return tag
+}
+
+// timestamp extracts the timestamp of a record, from its Timestamp-JSON-Path
+// field if there is one, falling back to the time it arrived in Kinesis.
+// Parsing is only given up on once the stream's failure threshold of
+// consecutive failures is reached.
+func (sc *shardConsumer) timestamp(r *kinesis.Record, data []byte) entry.Timestamp {
+	arrival := entry.FromStandard(aws.TimeValue(r.ApproximateArrivalTimestamp))
+	if !sc.parseTime {
+		return arrival
+	}
+	if ts, ok := sc.jsonTime.Extract(sc.tg, data); ok {
+		sc.tsFailures = 0
+		return sc.clampTimestamp(ts, arrival, data)
+	} else if ts, ok, err := sc.tg.Extract(data); ok && err == nil {
+		sc.tsFailures = 0
+		return sc.clampTimestamp(ts, arrival, data)
+	}
+	sc.tsFailures++
+	sc.payloads.Log(data, "Failed to extract a timestamp from an entry of shard %s of stream %s", sc.shardID(), sc.stream.Stream_Name)
+	if th := sc.stream.Timestamp_Failure_Threshold; th > 0 && sc.tsFailures >= th {
+		lg.Warn("Disabling timestamp parsing on shard %s of stream %s after %d consecutive failures, using arrival times", sc.shardID(), sc.stream.Stream_Name, sc.tsFailures)
+		sc.parseTime = false
+	}
+	return arrival
+}
+
+// clampTimestamp returns an extracted timestamp, or the arrival time if it is
+// outside the stream's Max-Timestamp-Skew window.
+func (sc *shardConsumer) clampTimestamp(ts time.Time, arrival entry.Timestamp, data []byte) entry.Timestamp {
+	if _, clamped := sc.clamp.Clamp(ts, arrival.StandardTime()); clamped {
+		sc.metrics.Clamped()
+		sc.payloads.Log(data, "Replaced timestamp %v of an entry of shard %s of stream %s with the arrival time", ts, sc.shardID(), sc.stream.Stream_Name)
+		return arrival
+	}
+	return entry.FromStandard(ts)
+}
+
+// process hands an entry to the processor set, counting it against the
+// in-flight budget. Entries of a shard are processed one at a time in record
+// order, lines and deaggregated or CloudWatch Logs events in the order they
+// appear within their record.
+func (sc *shardConsumer) process(ent *entry.Entry) {
+	if sc.failed != nil {
+		// the rest of the record is left for when the shard is read again
+		return
+	}
+	keep, oversized := sc.guard.Check(ent)
+	if oversized {
+		sc.metrics.Oversize(!keep)
+		if !sc.warnedSize {
+			lg.Warn("Shard %s of stream %s has entries over the Max-Entry-Size of %d bytes, see the metrics for counts", sc.shardID(), sc.stream.Stream_Name, sc.guard.Max())
+			sc.warnedSize = true
+		}
+		if !keep {
+			return
+		}
+	}
+	if sc.stream.Preserve_Order {
+		// entries are submitted in record and line order, but searches order
+		// them by timestamp, so a later entry must never sort ahead
+		if ent.TS.Before(sc.lastTS) {
+			ent.TS = sc.lastTS
+		} else {
+			sc.lastTS = ent.TS
+		}
+	}
+	sc.inflight.Add(ent.Size())
+	var orig entry.Entry
+	if sc.stream.Preprocessor_Error_Policy == procErrorPassthrough {
+		// preprocessors may modify the entry before failing on it
+		orig = ent.DeepCopy()
+	}
+	data := ent.Data
+	if err := sc.procset.ProcessContext(ent, sc.callCtx()); err != nil {
+		sc.processFailed(&orig, data, err)
+	}
+}
+
+// giveUp stops the shard until the ingester is restarted, the worker exits
+// and the shard is not relaunched.
+func (sc *shardConsumer) giveUp(err error) {
+	lg.Critical("Giving up on shard #%d (%s) of stream %s, it will not be read until the ingester is restarted: %v", sc.shardid, sc.shardID(), sc.stream.Stream_Name, err)
+	sc.failed = err
+}
+
+// processFailed applies the stream's Preprocessor-Error-Policy to an entry
+// which the processor set failed to handle, data is what it was handed. With
+// passthrough, orig is the entry as it was handed to the processor set.
+func (sc *shardConsumer) processFailed(orig *entry.Entry, data []byte, err error) {
+	if sc.callCtx().Err() != nil {
+		// the write was abandoned by the shutdown, not a preprocessor
+		return
+	}
+	sc.metrics.Error()
+	sc.payloads.Log(data, "Preprocessors failed on an entry from shard %s of stream %s: %v", sc.shardID(), sc.stream.Stream_Name, err)
+	switch sc.stream.Preprocessor_Error_Policy {
+	case procErrorPassthrough:
+		if werr := sc.igst.WriteEntryContext(sc.callCtx(), orig); werr != nil {
+			lg.Error("Failed to handle entry: %v, and failed to pass it through unprocessed: %v", err, werr)
+			sc.metrics.PreprocessorFailure(false)
+			return
+		}
+		lg.Warn("Preprocessors failed on an entry from shard %s of stream %s, ingested it unprocessed: %v", sc.shardID(), sc.stream.Stream_Name, err)
+		sc.metrics.PreprocessorFailure(true)
+	case procErrorFatal:
+		lg.Critical("Preprocessors failed on an entry from shard %s of stream %s, stopping the shard until the ingester is restarted: %v", sc.shardID(), sc.stream.Stream_Name, err)
+		sc.failed = err
+	default:
+		lg.Error("Failed to handle entry: %v", err)
+		sc.metrics.PreprocessorFailure(false)
+	}
+}
@@ -0,0 +1,1093 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/gravwell/gravwell/v3/ingest/processors"
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
+	"github.com/gravwell/gravwell/v3/timegrinder"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+func TestResponseCapped(t *testing.T) {
+	small := []*kinesis.Record{{Data: make([]byte, 100)}, {Data: make([]byte, 100)}}
+	if responseCapped(small, 5000) {
+		t.Fatal("small response reported as capped")
+	}
+	if !responseCapped(small, 2) {
+		t.Fatal("response at the record limit not reported as capped")
+	}
+	var big []*kinesis.Record
+	for i := 0; i < 10; i++ {
+		big = append(big, &kinesis.Record{Data: make([]byte, maxRecordBytes)})
+	}
+	if !responseCapped(big, 5000) {
+		t.Fatal("response at the size cap not reported as capped")
+	}
+	if responseCapped(nil, 5000) {
+		t.Fatal("empty response reported as capped")
+	}
+}
+
+func TestTimestampFailureThreshold(t *testing.T) {
+	tg, err := timegrinder.NewTimeGrinder(timegrinder.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	arrival := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	rec := &kinesis.Record{ApproximateArrivalTimestamp: aws.Time(arrival)}
+	sc := &shardConsumer{
+		stream:    streamDef{Stream_Name: `test`, Parse_Time: true, Timestamp_Failure_Threshold: 2},
+		shard:     kinesis.Shard{ShardId: aws.String(`shard-0`)},
+		tg:        tg,
+		parseTime: true,
+	}
+	good := []byte(`2019-06-01T12:00:00Z hello`)
+	bad := []byte(`no timestamp here`)
+	var logged []string
+	sc.payloads = awsutils.NewPayloadLogger(0, func(format string, args ...interface{}) error {
+		logged = append(logged, fmt.Sprintf(format, args...))
+		return nil
+	})
+
+	// a single failure falls back to the arrival time without giving up
+	if ts := sc.timestamp(rec, bad); !ts.StandardTime().Equal(arrival) {
+		t.Fatalf("bad fallback timestamp: %v", ts)
+	}
+	if ts := sc.timestamp(rec, good); ts.StandardTime().Year() != 2019 {
+		t.Fatalf("bad parsed timestamp: %v", ts)
+	}
+	if len(logged) != 1 || !strings.HasSuffix(logged[0], `shard shard-0 of stream test, payload "no timestamp here"`) {
+		t.Fatalf("bad payload log %q", logged)
+	}
+	// failures must be consecutive
+	sc.timestamp(rec, bad)
+	if !sc.parseTime {
+		t.Fatal("parsing disabled before the threshold")
+	}
+	sc.timestamp(rec, bad)
+	if sc.parseTime {
+		t.Fatal("parsing not disabled at the threshold")
+	}
+	if ts := sc.timestamp(rec, good); !ts.StandardTime().Equal(arrival) {
+		t.Fatalf("parsed timestamp after parsing was disabled: %v", ts)
+	}
+}
+
+// testShard serves a closed shard of records, expiring the iterator once after
+// the first batch unless noExpiry is set. The first throttle GetRecords calls
+// fail as if the shard's throughput was exceeded. Iterators are simply the
+// index of the next record.
+type testShard struct {
+	kinesisiface.KinesisAPI
+	records   []*kinesis.Record
+	batch     int
+	gets      int
+	expired   bool
+	noExpiry  bool
+	throttle  int
+	throttled int
+}
+
+func (ts *testShard) GetShardIterator(in *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	pos := 0
+	if aws.StringValue(in.ShardIteratorType) == kinesis.ShardIteratorTypeAfterSequenceNumber {
+		for i, r := range ts.records {
+			if aws.StringValue(r.SequenceNumber) == aws.StringValue(in.StartingSequenceNumber) {
+				pos = i + 1
+			}
+		}
+	}
+	return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String(strconv.Itoa(pos))}, nil
+}
+
+func (ts *testShard) GetRecordsWithContext(ctx aws.Context, in *kinesis.GetRecordsInput, opts ...request.Option) (*kinesis.GetRecordsOutput, error) {
+	ts.gets++
+	if ts.throttled < ts.throttle {
+		ts.throttled++
+		return nil, awserr.New(kinesis.ErrCodeProvisionedThroughputExceededException, `Rate exceeded for shard`, nil)
+	}
+	if ts.gets == 2 && !ts.expired && !ts.noExpiry {
+		ts.expired = true
+		return nil, awserr.New(kinesis.ErrCodeExpiredIteratorException, `Iterator expired`, nil)
+	}
+	pos, _ := strconv.Atoi(aws.StringValue(in.ShardIterator))
+	end := pos + ts.batch
+	out := &kinesis.GetRecordsOutput{MillisBehindLatest: aws.Int64(0)}
+	if end >= len(ts.records) {
+		end = len(ts.records)
+	} else {
+		out.NextShardIterator = aws.String(strconv.Itoa(end))
+	}
+	out.Records = ts.records[pos:end]
+	return out, nil
+}
+
+// staleCheckpointer never reports the positions it is given, like a shared
+// checkpoint that has not caught up with the worker.
+type staleCheckpointer struct {
+	*stateman
+}
+
+func (sc staleCheckpointer) GetSequenceNum(stream, shard string) string {
+	return ``
+}
+
+func TestExpiredIteratorNoDuplicates(t *testing.T) {
+	ts := &testShard{batch: 3, records: testRecords(0, 9)}
+
+	var tw testEntryWriter
+	sc := &shardConsumer{
+		ctx:      context.Background(),
+		stream:   streamDef{Stream_Name: `stream`, Iterator_Type: kinesis.ShardIteratorTypeTrimHorizon, Records_Per_Request: 3},
+		shard:    kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+		router:   newTagRouter(0, nil),
+		svc:      ts,
+		procset:  processors.NewProcessorSet(&tw),
+		stateMan: staleCheckpointer{newTestStateman(t, filepath.Join(tdir, `expired.state`))},
+		metrics:  newMetricsReporter(`stream`).Add(`shardId-000000000000`),
+		backoff:  awsutils.NewBackoff(backoffBase, backoffMax),
+	}
+
+	closed := sc.poll()
+	if !closed {
+		t.Fatal("shard not read to its end")
+	}
+	if !ts.expired {
+		t.Fatal("iterator never expired")
+	}
+	if len(tw.ents) != len(ts.records) {
+		t.Fatalf("emitted %d entries for %d records", len(tw.ents), len(ts.records))
+	}
+	for i, ent := range tw.ents {
+		if exp := fmt.Sprintf("record %d", i); string(ent.Data) != exp {
+			t.Fatalf("entry %d is %q, expected %q", i, ent.Data, exp)
+		}
+	}
+	if sc.lastSeq != `1008` {
+		t.Fatalf("bad last sequence %q", sc.lastSeq)
+	}
+}
+
+// testRecords returns n records numbered from first.
+func testRecords(first, n int) (recs []*kinesis.Record) {
+	now := time.Now()
+	for i := first; i < first+n; i++ {
+		recs = append(recs, &kinesis.Record{
+			ApproximateArrivalTimestamp: &now,
+			Data:                        []byte(fmt.Sprintf("record %d", i)),
+			PartitionKey:                aws.String(`key`),
+			SequenceNumber:              aws.String(fmt.Sprintf("%d", 1000+i)),
+		})
+	}
+	return
+}
+
+func TestPollThrottledCheckpoints(t *testing.T) {
+	ts := &testShard{batch: 2, noExpiry: true, throttle: 3, records: testRecords(0, 5)}
+	var tw testEntryWriter
+	mr := newMetricsReporter(`stream`)
+	sm := newTestStateman(t, filepath.Join(tdir, `throttled.state`))
+	newConsumer := func() *shardConsumer {
+		return &shardConsumer{
+			ctx:      context.Background(),
+			stream:   streamDef{Stream_Name: `stream`, Iterator_Type: kinesis.ShardIteratorTypeTrimHorizon, Records_Per_Request: 2},
+			shard:    kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+			router:   newTagRouter(0, nil),
+			svc:      ts,
+			procset:  processors.NewProcessorSet(&tw),
+			stateMan: sm,
+			metrics:  mr.Add(`shardId-000000000000`),
+			backoff:  awsutils.NewBackoff(time.Millisecond, 10*time.Millisecond),
+		}
+	}
+
+	sc := newConsumer()
+	if !sc.poll() {
+		t.Fatal("shard not read to its end")
+	}
+	if ts.throttled != 3 || ts.gets != 3+3 {
+		t.Fatalf("throttled calls were not retried: %d throttled, %d calls", ts.throttled, ts.gets)
+	}
+	if sc.backoff.Attempts() != 0 {
+		t.Fatal("backoff not reset after a successful call")
+	}
+	if tw.count() != 5 {
+		t.Fatalf("emitted %d entries for 5 records", tw.count())
+	}
+	if seq := sm.GetSequenceNum(`stream`, `shardId-000000000000`); seq != `1004` {
+		t.Fatalf("bad checkpoint %q", seq)
+	}
+
+	// a new worker picks up after the checkpoint
+	ts.records = append(ts.records, testRecords(5, 3)...)
+	sc = newConsumer()
+	if !sc.poll() {
+		t.Fatal("shard not read to its end")
+	}
+	if tw.count() != 8 {
+		t.Fatalf("emitted %d entries for 8 records", tw.count())
+	}
+	for i, ent := range tw.ents {
+		if exp := fmt.Sprintf("record %d", i); string(ent.Data) != exp {
+			t.Fatalf("entry %d is %q, expected %q", i, ent.Data, exp)
+		}
+	}
+	if seq := sm.GetSequenceNum(`stream`, `shardId-000000000000`); seq != `1007` {
+		t.Fatalf("bad checkpoint %q", seq)
+	}
+}
+
+func TestPollPaused(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	gs := &gatedShard{
+		testShard: testShard{batch: 2, noExpiry: true, records: testRecords(0, 2)},
+		started:   make(chan struct{}, 1),
+		release:   make(chan struct{}),
+	}
+	close(gs.release)
+	var tw testEntryWriter
+	pause := awsutils.NewPauser(``, nil, `kinesis`, t.Logf)
+	pause.Pause(`test`)
+	sc := &shardConsumer{
+		ctx:      ctx,
+		stream:   streamDef{Stream_Name: `stream`, Iterator_Type: kinesis.ShardIteratorTypeTrimHorizon, Records_Per_Request: 2},
+		shard:    kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+		router:   newTagRouter(0, nil),
+		svc:      gs,
+		procset:  processors.NewProcessorSet(&tw),
+		stateMan: newTestStateman(t, filepath.Join(tdir, `paused.state`)),
+		metrics:  newMetricsReporter(`stream`).Add(`shardId-000000000000`),
+		backoff:  awsutils.NewBackoff(backoffBase, backoffMax),
+		pause:    pause,
+	}
+	done := make(chan bool)
+	go func() {
+		done <- sc.poll()
+	}()
+	select {
+	case <-gs.started:
+		t.Fatal("GetRecords called while paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+	pause.Resume(`test`)
+	select {
+	case <-gs.started:
+	case <-time.After(time.Second):
+		t.Fatal("GetRecords not called after resuming")
+	}
+	for deadline := time.Now().Add(time.Second); tw.count() < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	if tw.count() != 2 {
+		t.Fatalf("emitted %d entries after resuming", tw.count())
+	}
+}
+
+func TestShardSource(t *testing.T) {
+	a := shardSource(`stream`, `shardId-000000000042`)
+	if a.String() != shardSource(`stream`, `shardId-000000000042`).String() {
+		t.Fatal("shard source is not deterministic")
+	}
+	if a[0] != 0xfd || a[1] != 0 || a.To4() != nil {
+		t.Fatalf("shard source %v is not a unique local IPv6 address", a)
+	}
+	if !strings.HasSuffix(a.String(), `::2a`) {
+		t.Fatalf("shard number not encoded in %v", a)
+	}
+	b := shardSource(`stream`, `shardId-000000000043`)
+	if !a[:8].Equal(b[:8]) || a.Equal(b) {
+		t.Fatalf("shards of a stream should share a prefix: %v %v", a, b)
+	}
+	c := shardSource(`other`, `shardId-000000000042`)
+	if a[:8].Equal(c[:8]) {
+		t.Fatalf("streams should not share a prefix: %v %v", a, c)
+	}
+	if d := shardSource(`stream`, `custom`); d.Equal(shardSource(`stream`, `other`)) {
+		t.Fatal("non-numeric shard IDs collide")
+	}
+}
+
+// blockedShard never returns records, its GetRecords calls long poll until
+// they are cancelled.
+type blockedShard struct {
+	kinesisiface.KinesisAPI
+	cancelled chan struct{}
+}
+
+func (bs *blockedShard) GetShardIterator(in *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String(`0`)}, nil
+}
+
+func (bs *blockedShard) GetRecordsWithContext(ctx aws.Context, in *kinesis.GetRecordsInput, opts ...request.Option) (*kinesis.GetRecordsOutput, error) {
+	<-ctx.Done()
+	close(bs.cancelled)
+	return nil, awserr.New(request.CanceledErrorCode, `request context canceled`, ctx.Err())
+}
+
+func TestPollCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	bs := &blockedShard{cancelled: make(chan struct{})}
+	sc := &shardConsumer{
+		ctx:      ctx,
+		stream:   streamDef{Stream_Name: `stream`, Iterator_Type: kinesis.ShardIteratorTypeLatest, Records_Per_Request: 10},
+		shard:    kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+		svc:      bs,
+		stateMan: newTestStateman(t, filepath.Join(tdir, `cancelled.state`)),
+		metrics:  newMetricsReporter(`stream`).Add(`shardId-000000000000`),
+		backoff:  awsutils.NewBackoff(backoffBase, backoffMax),
+	}
+	done := make(chan bool)
+	go func() {
+		done <- sc.poll()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case closed := <-done:
+		if closed {
+			t.Fatal("cancelled shard reported as closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("poll did not return after cancellation")
+	}
+	select {
+	case <-bs.cancelled:
+	default:
+		t.Fatal("in-flight GetRecords was not cancelled")
+	}
+}
+
+// gatedShard holds GetRecords calls until release is closed or the call is
+// cancelled, signalling each call on started.
+type gatedShard struct {
+	testShard
+	started chan struct{}
+	release chan struct{}
+}
+
+func (gs *gatedShard) GetRecordsWithContext(ctx aws.Context, in *kinesis.GetRecordsInput, opts ...request.Option) (*kinesis.GetRecordsOutput, error) {
+	gs.started <- struct{}{}
+	select {
+	case <-gs.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return gs.testShard.GetRecordsWithContext(ctx, in, opts...)
+}
+
+func TestPollShutdownGrace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	gs := &gatedShard{
+		testShard: testShard{batch: 2, noExpiry: true, records: testRecords(0, 5)},
+		started:   make(chan struct{}, 1),
+		release:   make(chan struct{}),
+	}
+	var tw testEntryWriter
+	sm := newTestStateman(t, filepath.Join(tdir, `grace.state`))
+	sc := &shardConsumer{
+		ctx:      ctx,
+		abort:    context.Background(),
+		stream:   streamDef{Stream_Name: `stream`, Iterator_Type: kinesis.ShardIteratorTypeTrimHorizon, Records_Per_Request: 2},
+		shard:    kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+		router:   newTagRouter(0, nil),
+		svc:      gs,
+		procset:  processors.NewProcessorSet(&tw),
+		stateMan: sm,
+		metrics:  newMetricsReporter(`stream`).Add(`shardId-000000000000`),
+		backoff:  awsutils.NewBackoff(backoffBase, backoffMax),
+	}
+	done := make(chan bool)
+	go func() {
+		done <- sc.poll()
+	}()
+	// shut down while the first GetRecords is in flight
+	<-gs.started
+	cancel()
+	close(gs.release)
+	select {
+	case closed := <-done:
+		if closed {
+			t.Fatal("stopped shard reported as closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("poll did not return after shutdown")
+	}
+	if tw.count() != 2 || gs.gets != 1 {
+		t.Fatalf("emitted %d entries from %d calls, expected the batch in flight only", tw.count(), gs.gets)
+	}
+	if seq := sm.GetSequenceNum(`stream`, `shardId-000000000000`); seq != `1001` {
+		t.Fatalf("bad checkpoint %q", seq)
+	}
+}
+
+func TestOversizeEntries(t *testing.T) {
+	var tw testEntryWriter
+	mr := newMetricsReporter(`stream`)
+	sc := &shardConsumer{
+		ctx:     context.Background(),
+		stream:  streamDef{Stream_Name: `stream`, Max_Entry_Size: 4},
+		shard:   kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+		procset: processors.NewProcessorSet(&tw),
+		metrics: mr.Add(`shardId-000000000000`),
+	}
+	var err error
+	if sc.guard, err = sc.stream.sizeGuard(); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{`1234`, `12345`, `123`} {
+		sc.process(&entry.Entry{Data: []byte(d)})
+	}
+	if tw.count() != 2 || string(tw.ents[1].Data) != `123` {
+		t.Fatalf("oversized entry was not dropped: %v", tw.ents)
+	}
+
+	sc.stream.Oversize_Action = `truncate`
+	if sc.guard, err = sc.stream.sizeGuard(); err != nil {
+		t.Fatal(err)
+	}
+	sc.process(&entry.Entry{Data: []byte(`123456`)})
+	if tw.count() != 3 || string(tw.ents[2].Data) != `1234` {
+		t.Fatalf("oversized entry was not truncated: %v", tw.ents)
+	}
+	if r := mr.Report(time.Second); r.OversizeDropped != 1 || r.OversizeTruncated != 1 {
+		t.Fatalf("bad oversize counts: %+v", r)
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	var tw testEntryWriter
+	sc := &shardConsumer{
+		ctx:       context.Background(),
+		stream:    streamDef{Stream_Name: `stream`, Split_Lines: true},
+		shard:     kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+		router:    newTagRouter(3, nil),
+		procset:   processors.NewProcessorSet(&tw),
+		parseTime: true,
+	}
+	sc.framing, _ = sc.stream.framer()
+	var err error
+	if sc.tg, err = timegrinder.NewTimeGrinder(sc.stream.timegrinderConfig()); err != nil {
+		t.Fatal(err)
+	}
+	// a blank line and a trailing line without a delimiter
+	sc.handleRecord(&kinesis.Record{
+		Data:                        []byte("2020-01-02T03:04:05Z first\r\n\n2020-05-06T07:08:09Z second"),
+		ApproximateArrivalTimestamp: aws.Time(time.Now()),
+	})
+	if tw.count() != 2 {
+		t.Fatalf("bad entry count %d", tw.count())
+	}
+	for i, want := range []string{`2020-01-02T03:04:05Z first`, `2020-05-06T07:08:09Z second`} {
+		ent := tw.ents[i]
+		if string(ent.Data) != want || ent.Tag != 3 {
+			t.Fatalf("bad entry %d: %q", i, ent.Data)
+		}
+		if ts, _ := time.Parse(time.RFC3339, want[:20]); !ent.TS.StandardTime().Equal(ts) {
+			t.Fatalf("line %d not timestamped on its own: %v", i, ent.TS)
+		}
+	}
+}
+
+func TestShardTagTemplate(t *testing.T) {
+	var tw testEntryWriter
+	sd := streamDef{Stream_Name: `web`, Region: `us-east-1`, Tag_Name: `default`, Tag_Template: `{stream}-{json:app}`}
+	tt, err := sd.tagTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	negotiated := map[string]entry.EntryTag{}
+	sc := &shardConsumer{
+		ctx:    context.Background(),
+		stream: sd,
+		shard:  kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+		router: newTagRouter(3, nil),
+		tagger: awsutils.NewTagResolver(tt, 3, func(name string) (entry.EntryTag, error) {
+			negotiated[name] = entry.EntryTag(10 + len(negotiated))
+			return negotiated[name], nil
+		}),
+		procset: processors.NewProcessorSet(&tw),
+	}
+	for _, data := range []string{`{"app":"api"}`, `{"app":"db"}`, `not json`, `{"app":"api"}`} {
+		sc.handleRecord(&kinesis.Record{Data: []byte(data), PartitionKey: aws.String(`k`), ApproximateArrivalTimestamp: aws.Time(time.Now())})
+	}
+	if tw.count() != 4 {
+		t.Fatalf("bad entry count %d", tw.count())
+	}
+	for i, want := range []entry.EntryTag{10, 11, 3, 10} {
+		if tw.ents[i].Tag != want {
+			t.Fatalf("entry %d has tag %d, expected %d", i, tw.ents[i].Tag, want)
+		}
+	}
+	if len(negotiated) != 2 || negotiated[`web-api`] != 10 || negotiated[`web-db`] != 11 {
+		t.Fatalf("bad negotiated tags %v", negotiated)
+	}
+}
+
+// malformedShard answers the first GetRecords with neither a response nor an
+// error, then closes the shard with a response missing its lag and holding a
+// nil record.
+type malformedShard struct {
+	kinesisiface.KinesisAPI
+	gets int
+}
+
+func (ms *malformedShard) GetShardIterator(in *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String(`0`)}, nil
+}
+
+func (ms *malformedShard) GetRecordsWithContext(ctx aws.Context, in *kinesis.GetRecordsInput, opts ...request.Option) (*kinesis.GetRecordsOutput, error) {
+	if ms.gets++; ms.gets == 1 {
+		return nil, nil
+	}
+	return &kinesis.GetRecordsOutput{Records: append([]*kinesis.Record{nil}, testRecords(0, 1)...)}, nil
+}
+
+func TestPollMalformedResponse(t *testing.T) {
+	var tw testEntryWriter
+	ms := &malformedShard{}
+	mr := newMetricsReporter(`stream`)
+	sc := &shardConsumer{
+		ctx:      context.Background(),
+		stream:   streamDef{Stream_Name: `stream`, Iterator_Type: kinesis.ShardIteratorTypeTrimHorizon, Records_Per_Request: 10},
+		shard:    kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+		router:   newTagRouter(0, nil),
+		svc:      ms,
+		procset:  processors.NewProcessorSet(&tw),
+		stateMan: newTestStateman(t, filepath.Join(tdir, `malformed.state`)),
+		metrics:  mr.Add(`shardId-000000000000`),
+		backoff:  awsutils.NewBackoff(backoffBase, backoffMax),
+	}
+	if !sc.poll() {
+		t.Fatal("worker gave up on an empty response")
+	}
+	if ms.gets != 2 || tw.count() != 1 || sc.lastSeq != `1000` {
+		t.Fatalf("bad result: %d calls, %d entries, sequence %q", ms.gets, tw.count(), sc.lastSeq)
+	}
+	if r := mr.Report(time.Second); r.Records != 1 || r.MaxLag != 0 {
+		t.Fatalf("bad report: %+v", r)
+	}
+}
+
+func TestPreserveOrder(t *testing.T) {
+	// every record holds two lines, the second timestamped before the first
+	var recs []*kinesis.Record
+	for i, r := range testRecords(0, 5) {
+		r.Data = []byte(fmt.Sprintf("2020-01-02T03:%02d:00Z record %d line 0\n2020-01-02T03:00:00Z record %d line 1", 10+i, i, i))
+		recs = append(recs, r)
+	}
+	for _, preserve := range []bool{false, true} {
+		ts := &testShard{batch: 2, noExpiry: true, records: recs}
+		var tw testEntryWriter
+		sc := &shardConsumer{
+			ctx:       context.Background(),
+			stream:    streamDef{Stream_Name: `stream`, Iterator_Type: kinesis.ShardIteratorTypeTrimHorizon, Split_Lines: true, Preserve_Order: preserve},
+			shard:     kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+			router:    newTagRouter(0, nil),
+			svc:       ts,
+			procset:   processors.NewProcessorSet(&tw),
+			stateMan:  newTestStateman(t, filepath.Join(tdir, fmt.Sprintf("order-%v.state", preserve))),
+			metrics:   newMetricsReporter(`stream`).Add(`shardId-000000000000`),
+			backoff:   awsutils.NewBackoff(time.Millisecond, 10*time.Millisecond),
+			parseTime: true,
+		}
+		sc.framing, _ = sc.stream.framer()
+		var err error
+		if sc.tg, err = timegrinder.NewTimeGrinder(sc.stream.timegrinderConfig()); err != nil {
+			t.Fatal(err)
+		}
+		if !sc.poll() {
+			t.Fatal("shard not read to its end")
+		}
+		if tw.count() != 10 {
+			t.Fatalf("emitted %d entries for 10 lines", tw.count())
+		}
+		var backwards bool
+		for i, ent := range tw.ents {
+			if exp := fmt.Sprintf("record %d line %d", i/2, i%2); !strings.HasSuffix(string(ent.Data), exp) {
+				t.Fatalf("entry %d is %q, expected %q", i, ent.Data, exp)
+			}
+			if i > 0 && ent.TS.Before(tw.ents[i-1].TS) {
+				backwards = true
+			}
+		}
+		if preserve && backwards {
+			t.Fatal("timestamps went backwards with Preserve-Order")
+		} else if !preserve && !backwards {
+			t.Fatal("timestamps were changed without Preserve-Order")
+		}
+	}
+}
+
+func TestTimestampJSONPath(t *testing.T) {
+	sd := streamDef{Stream_Name: `test`, Parse_Time: true, Timestamp_JSON_Path: `detail.eventTime`}
+	tg, err := timegrinder.NewTimeGrinder(sd.timegrinderConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &shardConsumer{stream: sd, tg: tg, parseTime: true}
+	if sc.jsonTime, err = sd.jsonTimestamp(); err != nil {
+		t.Fatal(err)
+	}
+	rec := &kinesis.Record{ApproximateArrivalTimestamp: aws.Time(time.Now())}
+	for data, want := range map[string]string{
+		// the field wins over the earlier timestamp that scanning finds first
+		`{"time":"2019-01-01T00:00:00Z","detail":{"eventTime":"2020-05-06T07:08:09Z"}}`: `2020-05-06T07:08:09Z`,
+		// without the field the record is scanned as usual
+		`{"time":"2019-01-01T00:00:00Z"}`: `2019-01-01T00:00:00Z`,
+	} {
+		exp, _ := time.Parse(time.RFC3339, want)
+		if ts := sc.timestamp(rec, []byte(data)); !ts.StandardTime().Equal(exp) {
+			t.Fatalf("bad timestamp %v for %s", ts, data)
+		}
+	}
+}
+
+// failProcessor prefixes entries, failing on those containing fail after it
+// has already modified them.
+type failProcessor struct {
+	fail string
+}
+
+func (fp failProcessor) Process(ent *entry.Entry) ([]*entry.Entry, error) {
+	ent.Data = append([]byte(`processed `), ent.Data...)
+	if strings.HasSuffix(string(ent.Data), fp.fail) {
+		return nil, fmt.Errorf("failed on %q", ent.Data)
+	}
+	return []*entry.Entry{ent}, nil
+}
+
+func (fp failProcessor) Close() error {
+	return nil
+}
+
+func TestTimestampClamp(t *testing.T) {
+	sd := streamDef{Stream_Name: `test`, Parse_Time: true, Max_Timestamp_Skew_Past: `720h`, Max_Timestamp_Skew_Future: `24h`}
+	tg, err := timegrinder.NewTimeGrinder(sd.timegrinderConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := newMetricsReporter(`test`)
+	sc := &shardConsumer{
+		stream:    sd,
+		shard:     kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+		tg:        tg,
+		parseTime: true,
+		metrics:   mr.Add(`shardId-000000000000`),
+	}
+	if sc.clamp, err = sd.timestampClamp(); err != nil {
+		t.Fatal(err)
+	}
+	arrival := time.Now().Truncate(time.Second)
+	rec := &kinesis.Record{ApproximateArrivalTimestamp: aws.Time(arrival)}
+	recent := arrival.Add(-time.Hour).UTC()
+	for data, want := range map[string]time.Time{
+		recent.Format(time.RFC3339) + ` ok`: recent,
+		`1971-01-01T00:00:00Z garbage`:      arrival,
+		`2099-01-01T00:00:00Z garbage`:      arrival,
+	} {
+		if ts := sc.timestamp(rec, []byte(data)); !ts.StandardTime().Equal(want) {
+			t.Fatalf("bad timestamp %v for %s", ts, data)
+		}
+	}
+	if r := mr.Report(time.Second); r.TimestampsClamped != 2 {
+		t.Fatalf("counted %d clamped timestamps", r.TimestampsClamped)
+	}
+}
+
+func TestPreprocessorErrorPolicy(t *testing.T) {
+	for _, policy := range []string{procErrorDrop, procErrorPassthrough, procErrorFatal} {
+		var tw testEntryWriter
+		procset := processors.NewProcessorSet(&tw)
+		procset.AddProcessor(failProcessor{fail: `record 2`})
+		sc := &shardConsumer{
+			ctx:      context.Background(),
+			stream:   streamDef{Stream_Name: `stream`, Iterator_Type: kinesis.ShardIteratorTypeTrimHorizon, Preprocessor_Error_Policy: policy},
+			shard:    kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+			router:   newTagRouter(0, nil),
+			svc:      &testShard{batch: 5, noExpiry: true, records: testRecords(0, 5)},
+			procset:  procset,
+			igst:     &tw,
+			stateMan: newTestStateman(t, filepath.Join(tdir, policy+`.state`)),
+			metrics:  newMetricsReporter(`stream`).Add(`shardId-000000000000`),
+			backoff:  awsutils.NewBackoff(time.Millisecond, 10*time.Millisecond),
+		}
+		closed := sc.poll()
+		var got []string
+		for _, ent := range tw.ents {
+			got = append(got, string(ent.Data))
+		}
+		dropped, passed, _ := sc.metrics.ReadAndResetFailures()
+		switch policy {
+		case procErrorDrop:
+			if !closed || len(got) != 4 || dropped != 1 || passed != 0 {
+				t.Fatalf("drop: closed %v, entries %q, %d dropped, %d passed", closed, got, dropped, passed)
+			}
+		case procErrorPassthrough:
+			if !closed || len(got) != 5 || got[2] != `record 2` || dropped != 0 || passed != 1 {
+				t.Fatalf("passthrough: closed %v, entries %q, %d dropped, %d passed", closed, got, dropped, passed)
+			}
+		case procErrorFatal:
+			// the shard stops with the failed record left to be read again
+			if closed || sc.failed == nil || len(got) != 2 || sc.lastSeq != `1001` {
+				t.Fatalf("fatal: closed %v, failed %v, entries %q, checkpoint %s", closed, sc.failed, got, sc.lastSeq)
+			}
+		}
+	}
+}
+
+// panicOnceProcessor panics the first time it sees an entry ending in fail.
+type panicOnceProcessor struct {
+	fail     string
+	panicked *bool
+}
+
+func (pp panicOnceProcessor) Process(ent *entry.Entry) ([]*entry.Entry, error) {
+	if !*pp.panicked && strings.HasSuffix(string(ent.Data), pp.fail) {
+		*pp.panicked = true
+		panic(`boom`)
+	}
+	return []*entry.Entry{ent}, nil
+}
+
+func (pp panicOnceProcessor) Close() error {
+	return nil
+}
+
+func TestShardPanicRelaunch(t *testing.T) {
+	var tw testEntryWriter
+	var panicked bool
+	procset := processors.NewProcessorSet(&tw)
+	procset.AddProcessor(panicOnceProcessor{fail: `record 2`, panicked: &panicked})
+	slots := newShardSlots(1, nil)
+	sc := &shardConsumer{
+		ctx:      context.Background(),
+		stream:   streamDef{Stream_Name: `stream`, Iterator_Type: kinesis.ShardIteratorTypeTrimHorizon, Records_Per_Request: 2},
+		shard:    kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+		router:   newTagRouter(0, nil),
+		svc:      &testShard{batch: 2, noExpiry: true, records: testRecords(0, 5)},
+		procset:  procset,
+		stateMan: newTestStateman(t, filepath.Join(tdir, `panic.state`)),
+		metrics:  newMetricsReporter(`stream`).Add(`shardId-000000000000`),
+		slots:    slots,
+	}
+	if _, p := sc.runRecovered(); !p {
+		t.Fatal("panic was not recovered")
+	}
+	if sc.lastSeq != `1001` {
+		t.Fatalf("checkpoint %s after panicking on the second batch", sc.lastSeq)
+	}
+	if _, _, panics := sc.metrics.ReadAndResetFailures(); panics != 1 {
+		t.Fatalf("%d panics counted", panics)
+	}
+	// the slot the worker held while it panicked was given back
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !slots.Acquire(ctx) {
+		t.Fatal("slot was leaked by the panic")
+	}
+	slots.Release()
+
+	// the relaunch picks up from the checkpoint
+	if closed, p := sc.runRecovered(); !closed || p {
+		t.Fatalf("relaunched worker closed %v, panicked %v", closed, p)
+	}
+	if tw.count() != 5 {
+		t.Fatalf("%d entries from 5 records", tw.count())
+	}
+	for i, ent := range tw.ents {
+		if exp := fmt.Sprintf("record %d", i); string(ent.Data) != exp {
+			t.Fatalf("entry %d is %q, expected %q", i, ent.Data, exp)
+		}
+	}
+}
+
+func TestUnpackJSONArray(t *testing.T) {
+	var tw testEntryWriter
+	sc := &shardConsumer{
+		ctx:       context.Background(),
+		stream:    streamDef{Stream_Name: `stream`, Unpack_JSON_Array: true, Timestamp_JSON_Path: `ts`},
+		shard:     kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+		router:    newTagRouter(3, nil),
+		procset:   processors.NewProcessorSet(&tw),
+		parseTime: true,
+	}
+	var err error
+	if sc.jsonTime, err = sc.stream.jsonTimestamp(); err != nil {
+		t.Fatal(err)
+	}
+	if sc.tg, err = timegrinder.NewTimeGrinder(sc.stream.timegrinderConfig()); err != nil {
+		t.Fatal(err)
+	}
+	arrival := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, data := range []string{
+		` [{"ts":"2020-01-02T03:04:05Z","a":1}, {"ts":"2020-05-06T07:08:09Z","b":[[1],[2]]}] `,
+		`[[1,2],[3]]`,
+		`{"ts":"2020-09-10T11:12:13Z"}`,
+		`[]`,
+		`[1, 2`,
+	} {
+		sc.handleRecord(&kinesis.Record{Data: []byte(data), ApproximateArrivalTimestamp: aws.Time(arrival)})
+	}
+	want := []struct {
+		data string
+		ts   time.Time
+	}{
+		{`{"ts":"2020-01-02T03:04:05Z","a":1}`, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{`{"ts":"2020-05-06T07:08:09Z","b":[[1],[2]]}`, time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC)},
+		{`[1,2]`, arrival},
+		{`[3]`, arrival},
+		{`{"ts":"2020-09-10T11:12:13Z"}`, time.Date(2020, 9, 10, 11, 12, 13, 0, time.UTC)},
+		{`[]`, arrival},
+		{`[1, 2`, arrival},
+	}
+	if tw.count() != len(want) {
+		t.Fatalf("bad entry count %d", tw.count())
+	}
+	for i, w := range want {
+		ent := tw.ents[i]
+		if string(ent.Data) != w.data || !ent.TS.StandardTime().Equal(w.ts) {
+			t.Fatalf("bad entry %d: %q %v", i, ent.Data, ent.TS)
+		}
+	}
+}
+
+const routingTestConfig = `
+[Global]
+Ingest-Secret = secret
+Pipe-Backend-Target=/tmp/nothing
+[KinesisStream "web"]
+	Region="us-east-1"
+	Stream-Name=web
+	Tag-Name=kinesis
+	Preprocessor=route
+[Preprocessor "route"]
+	Type=regexrouter
+	Regex="^(?P<app>\\S+) "
+	Route-Extraction=app
+	Route=web:kinesis-web
+	Route=db:kinesis-db
+`
+
+// routingWriter lets a testEntryWriter stand in for the muxer, negotiating
+// tags in order.
+type routingWriter struct {
+	testEntryWriter
+	tags []string
+}
+
+func (rw *routingWriter) NegotiateTag(name string) (entry.EntryTag, error) {
+	rw.Lock()
+	defer rw.Unlock()
+	for i, t := range rw.tags {
+		if t == name {
+			return entry.EntryTag(i), nil
+		}
+	}
+	rw.tags = append(rw.tags, name)
+	return entry.EntryTag(len(rw.tags) - 1), nil
+}
+
+func (rw *routingWriter) LookupTag(tag entry.EntryTag) (string, bool) {
+	rw.Lock()
+	defer rw.Unlock()
+	if int(tag) < len(rw.tags) {
+		return rw.tags[tag], true
+	}
+	return ``, false
+}
+
+// A routing preprocessor can send the records of one stream to several tags,
+// the tag it sets replaces the one from Tag-Name, Tag-Route, or Tag-Template.
+func TestPreprocessorRouting(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `kinesisroute`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pth := filepath.Join(dir, `kinesis.conf`)
+	if err := ioutil.WriteFile(pth, []byte(routingTestConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := &routingWriter{tags: []string{`kinesis`}}
+	sd := cfg.KinesisStream[`web`]
+	procset, err := cfg.Preprocessor.ProcessorSet(rw, sd.Preprocessor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &shardConsumer{
+		ctx:     context.Background(),
+		stream:  *sd,
+		shard:   kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+		router:  newTagRouter(0, nil),
+		procset: procset,
+	}
+	for _, data := range []string{`web GET /`, `db SELECT 1`, `cron tick`} {
+		sc.handleRecord(&kinesis.Record{Data: []byte(data), ApproximateArrivalTimestamp: aws.Time(time.Now())})
+	}
+	if rw.count() != 3 {
+		t.Fatalf("bad entry count %d", rw.count())
+	}
+	for i, want := range []string{`kinesis-web`, `kinesis-db`, `kinesis`} {
+		if name, _ := rw.LookupTag(rw.ents[i].Tag); name != want {
+			t.Fatalf("entry %d went to %q, expected %q", i, name, want)
+		}
+	}
+}
+
+func TestShardFraming(t *testing.T) {
+	var tw testEntryWriter
+	sc := &shardConsumer{
+		ctx:       context.Background(),
+		stream:    streamDef{Stream_Name: `stream`, Framing: framingLengthPrefix, Framing_Prefix_Width: 2},
+		shard:     kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+		router:    newTagRouter(3, nil),
+		procset:   processors.NewProcessorSet(&tw),
+		parseTime: true,
+	}
+	var err error
+	if sc.framing, err = sc.stream.framer(); err != nil {
+		t.Fatal(err)
+	}
+	if sc.tg, err = timegrinder.NewTimeGrinder(sc.stream.timegrinderConfig()); err != nil {
+		t.Fatal(err)
+	}
+	first, second := `2020-01-02T03:04:05Z first`, `2020-05-06T07:08:09Z second`
+	data := fmt.Sprintf("\x00%c%s\x00%c%s", len(first), first, len(second), second)
+	sc.handleRecord(&kinesis.Record{Data: []byte(data), ApproximateArrivalTimestamp: aws.Time(time.Now())})
+	if tw.count() != 2 {
+		t.Fatalf("bad entry count %d", tw.count())
+	}
+	for i, want := range []string{first, second} {
+		ent := tw.ents[i]
+		if string(ent.Data) != want {
+			t.Fatalf("bad entry %d: %q", i, ent.Data)
+		}
+		if ts, _ := time.Parse(time.RFC3339, want[:20]); !ent.TS.StandardTime().Equal(ts) {
+			t.Fatalf("frame %d not timestamped on its own: %v", i, ent.TS)
+		}
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	var tw testEntryWriter
+	mr := newMetricsReporter(`stream`)
+	sc := &shardConsumer{
+		ctx:      context.Background(),
+		stream:   streamDef{Stream_Name: `stream`, Sample_Rate: aws.Float64(0.25)},
+		shard:    kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+		router:   newTagRouter(0, nil),
+		procset:  processors.NewProcessorSet(&tw),
+		stateMan: newTestStateman(t, filepath.Join(tdir, `sample.state`)),
+		metrics:  mr.Add(`shardId-000000000000`),
+	}
+	sc.sampler = sc.stream.sampler(sc.shardID())
+	recs := testRecords(0, 1000)
+	sc.handleRecords(recs, aws.Int64(0))
+
+	// sampled out records must not be read again
+	if last := aws.StringValue(recs[len(recs)-1].SequenceNumber); sc.lastSeq != last {
+		t.Fatalf("checkpoint %q did not cover the last record %q", sc.lastSeq, last)
+	}
+	r := mr.Report(time.Second)
+	if r.SampledIn != uint64(tw.count()) || r.SampledIn+r.SampledOut != 1000 {
+		t.Fatalf("bad sample counts with %d entries: %+v", tw.count(), r)
+	}
+	if r.SampledIn < 200 || r.SampledIn > 300 {
+		t.Fatalf("sampled %d of 1000 records at a rate of 0.25", r.SampledIn)
+	}
+
+	// the same records are sampled the same way when read again
+	kept := make(map[string]bool)
+	for _, ent := range tw.ents {
+		kept[string(ent.Data)] = true
+	}
+	rs := newRecordSampler(0.25, sc.shardID())
+	for _, rec := range recs {
+		if rs.Keep(aws.StringValue(rec.SequenceNumber)) != kept[string(rec.Data)] {
+			t.Fatalf("record %s was not sampled the same way twice", aws.StringValue(rec.SequenceNumber))
+		}
+	}
+	if newRecordSampler(1, sc.shardID()) != nil || !newRecordSampler(1, sc.shardID()).Keep(`1000`) {
+		t.Fatal("a Sample-Rate of 1 must keep every record")
+	}
+	if newRecordSampler(0, sc.shardID()).Keep(`1000`) {
+		t.Fatal("a Sample-Rate of 0 kept a record")
+	}
+}
+
+func TestShardAvro(t *testing.T) {
+	var tw testEntryWriter
+	sc := &shardConsumer{
+		ctx:     context.Background(),
+		stream:  streamDef{Stream_Name: `stream`, Content_Type: contentTypeAvro, Avro_Schema: testAvroSchema},
+		shard:   kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+		router:  newTagRouter(3, nil),
+		procset: processors.NewProcessorSet(&tw),
+	}
+	var err error
+	if sc.avro, err = sc.stream.avroDecoder(); err != nil {
+		t.Fatal(err)
+	}
+	now := aws.Time(time.Now())
+	sc.handleRecord(&kinesis.Record{Data: testAvroEvent(), ApproximateArrivalTimestamp: now})
+	// records which don't decode are passed through
+	sc.handleRecord(&kinesis.Record{Data: []byte(`not avro`), ApproximateArrivalTimestamp: now})
+	if tw.count() != 2 || string(tw.ents[0].Data) != testAvroEventJSON || string(tw.ents[1].Data) != `not avro` {
+		t.Fatalf("bad entries: %v", tw.ents)
+	}
+}
+
+func TestShardGlue(t *testing.T) {
+	var tw testEntryWriter
+	id := uuid.New()
+	sc := &shardConsumer{
+		ctx:     context.Background(),
+		stream:  streamDef{Stream_Name: `stream`, Schema_Registry: schemaRegistryGlue},
+		shard:   kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+		router:  newTagRouter(3, nil),
+		procset: processors.NewProcessorSet(&tw),
+		glue: newGlueDecoder(&fakeGlueRegistry{versions: map[string]*glueSchemaVersion{
+			id.String(): {Format: glueFormatAvro, Definition: testAvroSchema},
+		}}),
+	}
+	now := aws.Time(time.Now())
+	sc.handleRecord(&kinesis.Record{Data: glueRecord(id, glueCompressionNone, testAvroEvent()), ApproximateArrivalTimestamp: now})
+	// records whose schema can't be resolved are passed through
+	unknown := glueRecord(uuid.New(), glueCompressionNone, testAvroEvent())
+	sc.handleRecord(&kinesis.Record{Data: unknown, ApproximateArrivalTimestamp: now})
+	if tw.count() != 2 || string(tw.ents[0].Data) != testAvroEventJSON || !bytes.Equal(tw.ents[1].Data, unknown) {
+		t.Fatalf("bad entries: %v", tw.ents)
+	}
+}
@@ -0,0 +1,72 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+)
+
+// shardSlots limits how many shards are read at once. A shard holds a slot
+// while it calls GetRecords and handles the response, or for the life of an
+// enhanced fan-out subscription, then queues up again behind the shards which
+// are already waiting, so that parked shards take turns. A stream's slots may
+// draw on a parent shared by every stream, in which case a slot is needed
+// from both. A nil shardSlots never blocks.
+type shardSlots struct {
+	ch     chan struct{}
+	parent *shardSlots
+}
+
+// newShardSlots returns slots for max shards drawing on parent. A max of zero
+// or less adds no limit of its own and returns the parent.
+func newShardSlots(max int, parent *shardSlots) *shardSlots {
+	if max <= 0 {
+		return parent
+	}
+	return &shardSlots{
+		ch:     make(chan struct{}, max),
+		parent: parent,
+	}
+}
+
+// Acquire waits for a slot, returning false if ctx is cancelled first.
+func (s *shardSlots) Acquire(ctx context.Context) bool {
+	if s == nil {
+		return true
+	}
+	// blocked senders are woken in the order they arrived
+	select {
+	case s.ch <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+	if !s.parent.Acquire(ctx) {
+		<-s.ch
+		return false
+	}
+	return true
+}
+
+// Release returns a slot taken by Acquire.
+func (s *shardSlots) Release() {
+	if s == nil {
+		return
+	}
+	s.parent.Release()
+	<-s.ch
+}
+
+// Max returns the number of shards which may be read at once, zero if there
+// is no limit.
+func (s *shardSlots) Max() int {
+	if s == nil {
+		return 0
+	}
+	return cap(s.ch)
+}
@@ -0,0 +1,108 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/processors"
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestShardSlots(t *testing.T) {
+	if s := newShardSlots(0, nil); s != nil || !s.Acquire(context.Background()) || s.Max() != 0 {
+		t.Fatal("unlimited slots blocked")
+	}
+	global := newShardSlots(2, nil)
+	a := newShardSlots(0, global)
+	b := newShardSlots(1, global)
+	if a != global || b.Max() != 1 {
+		t.Fatal("bad slot parents")
+	}
+
+	ctx := context.Background()
+	if !b.Acquire(ctx) || !a.Acquire(ctx) {
+		t.Fatal("failed to acquire free slots")
+	}
+	// the global limit is reached, and b's own limit with it
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if a.Acquire(cctx) || b.Acquire(cctx) {
+		t.Fatal("acquired a slot over the limit")
+	}
+	b.Release()
+	if !a.Acquire(ctx) {
+		t.Fatal("released slot not handed out")
+	}
+}
+
+// countingShard tracks how many shards have a GetRecords call in flight.
+type countingShard struct {
+	testShard
+	mtx     sync.Mutex
+	active  int32
+	maxSeen int32
+}
+
+func (cs *countingShard) GetRecordsWithContext(ctx aws.Context, in *kinesis.GetRecordsInput, opts ...request.Option) (*kinesis.GetRecordsOutput, error) {
+	n := atomic.AddInt32(&cs.active, 1)
+	defer atomic.AddInt32(&cs.active, -1)
+	cs.mtx.Lock()
+	if n > cs.maxSeen {
+		cs.maxSeen = n
+	}
+	cs.mtx.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	// every shard is an empty closed shard
+	return &kinesis.GetRecordsOutput{MillisBehindLatest: aws.Int64(0)}, nil
+}
+
+func TestMaxConcurrentShards(t *testing.T) {
+	cs := &countingShard{}
+	var tw testEntryWriter
+	sm := newTestStateman(t, filepath.Join(tdir, `slots.state`))
+	slots := newShardSlots(2, nil)
+	mr := newMetricsReporter(`stream`)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		sc := &shardConsumer{
+			ctx:      context.Background(),
+			stream:   streamDef{Stream_Name: `stream`, Iterator_Type: kinesis.ShardIteratorTypeTrimHorizon, Records_Per_Request: 10},
+			shard:    kinesis.Shard{ShardId: aws.String(fmt.Sprintf("shardId-%012d", i))},
+			router:   newTagRouter(0, nil),
+			svc:      cs,
+			procset:  processors.NewProcessorSet(&tw),
+			stateMan: sm,
+			slots:    slots,
+			metrics:  mr.Add(fmt.Sprintf("shardId-%012d", i)),
+			backoff:  awsutils.NewBackoff(time.Millisecond, 10*time.Millisecond),
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !sc.poll() {
+				t.Error("shard not read to its end")
+			}
+		}()
+	}
+	wg.Wait()
+	if cs.maxSeen != 2 {
+		t.Fatalf("%d shards read at once with a limit of 2", cs.maxSeen)
+	}
+}
@@ -0,0 +1,241 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+	"github.com/gravwell/gravwell/v3/ingest/processors"
+	"github.com/gravwell/gravwell/v3/ingesters/utils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+var (
+	tdir string
+)
+
+func TestMain(m *testing.M) {
+	var err error
+	if tdir, err = ioutil.TempDir(os.TempDir(), "kinesis"); err != nil {
+		fmt.Println("Failed to create temp dir", err)
+		os.Exit(-1)
+	}
+	lg = log.NewDiscardLogger()
+	r := m.Run()
+	if err = os.RemoveAll(tdir); err != nil {
+		fmt.Println("Failed to remove tempdir", err)
+		os.Exit(-1)
+	}
+	os.Exit(r)
+}
+
+func newTestStateman(t *testing.T, pth string) *stateman {
+	sf, err := utils.NewState(pth, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewStateman(sf)
+}
+
+func TestShutdownPersistsSequence(t *testing.T) {
+	pth := filepath.Join(tdir, `shutdown.state`)
+	sm := newTestStateman(t, pth)
+	sm.Start()
+
+	var tw testEntryWriter
+	sc := &shardConsumer{
+		ctx:      context.Background(),
+		stream:   streamDef{Stream_Name: `stream`},
+		shard:    kinesis.Shard{ShardId: aws.String(`shardId-000000000000`)},
+		router:   newTagRouter(0, nil),
+		procset:  processors.NewProcessorSet(&tw),
+		stateMan: sm,
+		metrics:  newMetricsReporter(`stream`).Add(`shardId-000000000000`),
+	}
+
+	// handle a few batches, then shut down well before the periodic flush
+	now := time.Now()
+	var last string
+	for i := 0; i < 3; i++ {
+		var recs []*kinesis.Record
+		for j := 0; j < 4; j++ {
+			last = fmt.Sprintf("%d", 1000+i*4+j)
+			recs = append(recs, &kinesis.Record{
+				ApproximateArrivalTimestamp: &now,
+				Data:                        []byte(`record ` + last),
+				PartitionKey:                aws.String(`key`),
+				SequenceNumber:              aws.String(last),
+			})
+		}
+		sc.handleRecords(recs, aws.Int64(0))
+	}
+	sc.finish(false)
+	sm.Close()
+
+	if len(tw.ents) != 12 {
+		t.Fatalf("handled %d entries, expected 12", len(tw.ents))
+	}
+
+	// a restarted ingester must pick up after the last handled record
+	if seq := newTestStateman(t, pth).GetSequenceNum(`stream`, `shardId-000000000000`); seq != last {
+		t.Fatalf("persisted sequence %q != last processed %q", seq, last)
+	}
+}
+
+func TestClosedShardPersisted(t *testing.T) {
+	pth := filepath.Join(tdir, `closed.state`)
+	sm := newTestStateman(t, pth)
+	sc := &shardConsumer{
+		stream:   streamDef{Stream_Name: `stream`},
+		shard:    kinesis.Shard{ShardId: aws.String(`shardId-000000000001`)},
+		stateMan: sm,
+		closed:   make(chan string, 1),
+	}
+	sc.finish(true)
+	if id := <-sc.closed; id != `shardId-000000000001` {
+		t.Fatalf("bad closed shard notification %q", id)
+	}
+	// the marker is written by the flush on close rather than by each shard
+	sm.Close()
+	if !newTestStateman(t, pth).ShardClosed(`stream`, `shardId-000000000001`) {
+		t.Fatal("closed shard marker was not persisted")
+	}
+}
+
+func TestFlushOnlyOnChange(t *testing.T) {
+	pth := filepath.Join(tdir, `dirty.state`)
+	sm := newTestStateman(t, pth)
+	sm.store.(*utils.State).SetCompression(true)
+	sm.UpdateSequenceNum(`stream`, `shard`, `1000`)
+	sm.Flush()
+	if _, err := os.Stat(pth); err != nil {
+		t.Fatalf("changed state was not written: %v", err)
+	}
+
+	// nothing changed, so nothing should be written
+	if err := os.Remove(pth); err != nil {
+		t.Fatal(err)
+	}
+	sm.UpdateSequenceNum(`stream`, `shard`, `1000`)
+	sm.Flush()
+	if _, err := os.Stat(pth); !os.IsNotExist(err) {
+		t.Fatalf("unchanged state was written: %v", err)
+	}
+
+	sm.UpdateSequenceNum(`stream`, `shard`, `1001`)
+	sm.Flush()
+	if seq := newTestStateman(t, pth).GetSequenceNum(`stream`, `shard`); seq != `1001` {
+		t.Fatalf("read back sequence %q from the compressed state", seq)
+	}
+}
+
+func TestUpdatePromotedOnFlush(t *testing.T) {
+	sm := newTestStateman(t, filepath.Join(tdir, `promote.state`))
+	sm.UpdateSequenceNum(`stream`, `shard`, `1000`)
+	sm.UpdateSequenceNum(`stream`, `shard`, `1001`)
+	if seq := sm.GetSequenceNum(`stream`, `shard`); seq != `1001` {
+		t.Fatalf("pending update not visible, got %q", seq)
+	}
+	sm.Lock()
+	promoted, dirty := sm.states[`stream`][`shard`], sm.dirty
+	sm.Unlock()
+	if promoted != `` || dirty {
+		t.Fatal("update reached the shared states before a flush")
+	}
+	sm.Flush()
+	if seq := sm.Persisted(`stream`, `shard`); seq != `1001` {
+		t.Fatalf("flush persisted %q", seq)
+	}
+}
+
+// blockingStore holds every write until it is released.
+type blockingStore struct {
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (bs *blockingStore) Read(interface{}) error {
+	return utils.ErrNoState
+}
+
+func (bs *blockingStore) Write(interface{}) error {
+	bs.writing <- struct{}{}
+	<-bs.release
+	return nil
+}
+
+func TestFlushOutsideLock(t *testing.T) {
+	bs := &blockingStore{writing: make(chan struct{}), release: make(chan struct{})}
+	sm := NewStateman(bs)
+	sm.UpdateSequenceNum(`stream`, `shard`, `1000`)
+	done := make(chan struct{})
+	go func() {
+		sm.Flush()
+		close(done)
+	}()
+	<-bs.writing
+
+	// shards keep going while the store is slow
+	got := make(chan string)
+	go func() {
+		sm.UpdateSequenceNum(`stream`, `other`, `2000`)
+		got <- sm.GetSequenceNum(`stream`, `unseen`) + sm.Persisted(`stream`, `shard`)
+	}()
+	select {
+	case v := <-got:
+		if v != `` {
+			t.Fatalf("persisted %q before the write finished", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("state lock held during the write")
+	}
+	close(bs.release)
+	<-done
+	if seq := sm.Persisted(`stream`, `shard`); seq != `1000` {
+		t.Fatalf("flush persisted %q", seq)
+	}
+}
+
+// BenchmarkUpdateSequenceNum checkpoints hundreds of shards at once, as a
+// large stream does after every GetRecords batch.
+func BenchmarkUpdateSequenceNum(b *testing.B) {
+	sf, err := utils.NewState(filepath.Join(tdir, `bench.state`), 0600)
+	if err != nil {
+		b.Fatal(err)
+	}
+	sm := NewStateman(sf)
+	const shards = 512
+	ids := make([]string, shards)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("shardId-%012d", i)
+	}
+	var next int32
+	b.SetParallelism(shards / runtime.GOMAXPROCS(0))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		id := ids[int(atomic.AddInt32(&next, 1))%shards]
+		var seq int
+		for pb.Next() {
+			seq++
+			sm.UpdateSequenceNum(`stream`, id, strconv.Itoa(seq))
+		}
+	})
+}
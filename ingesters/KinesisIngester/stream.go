@@ -0,0 +1,357 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/gravwell/gravwell/v3/ingest/processors"
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+const shardIDPrefix = `shardId-`
+
+// streamConsumer tracks the shards of a single Kinesis stream, launching a
+// shardConsumer for each shard that is ready to be read. A shard created by a
+// split or merge is only started once all of its parents have been drained so
+// that events are not reordered.
+type streamConsumer struct {
+	ctx         context.Context
+	abort       context.Context
+	stream      *streamDef
+	tag         entry.EntryTag
+	routes      []resolvedRoute
+	tagger      *awsutils.TagResolver
+	filter      *keyFilter
+	src         net.IP
+	svc         kinesisiface.KinesisAPI
+	procset     *processors.ProcessorSet
+	igst        contextWriter
+	stateMan    checkpointer
+	consumerARN string
+	decomp      *awsutils.Decompressor
+	avro        *avroDecoder
+	glue        *glueDecoder
+	metrics     *metricsReporter
+	inflight    *inFlightLimiter
+	pause       *awsutils.Pauser
+	slots       *shardSlots
+	partition   shardPartition
+	tee         *awsutils.Tee
+	payloads    *awsutils.PayloadLogger
+	tailFrom    time.Time // with -ignore-checkpoint shards start here rather than at their checkpoint
+	wg          *sync.WaitGroup
+
+	shards  []*kinesis.Shard
+	mtx     sync.Mutex
+	started map[string]bool
+	closed  chan string // shard consumers report drained shards here
+}
+
+// shardLister reads the shards of a stream with ListShards. A failed page is
+// retried with a backoff, so that an account under API pressure is not
+// hammered, until maxAttempts consecutive calls have failed.
+type shardLister struct {
+	svc         kinesisiface.KinesisAPI
+	name        string
+	maxAttempts int
+	maxBackoff  time.Duration
+}
+
+// list returns the complete list of shards in the stream, including closed
+// shards that are still within the retention period. A missing stream or an
+// invalid request fails at once, the listing restarts if its pagination token
+// expires while retrying.
+func (sl *shardLister) list(ctx context.Context) (shards []*kinesis.Shard, err error) {
+	backoff := awsutils.NewBackoff(backoffBase, sl.maxBackoff)
+	in := &kinesis.ListShardsInput{StreamName: aws.String(sl.name)}
+	for {
+		var out *kinesis.ListShardsOutput
+		if out, err = sl.svc.ListShardsWithContext(ctx, in); err == nil {
+			backoff.Reset()
+			shards = append(shards, out.Shards...)
+			if aws.StringValue(out.NextToken) == `` {
+				return shards, nil
+			}
+			// later pages are named by the token alone
+			in = &kinesis.ListShardsInput{NextToken: out.NextToken}
+			continue
+		}
+		if awsErr, ok := err.(awserr.Error); ok {
+			switch awsErr.Code() {
+			case kinesis.ErrCodeResourceNotFoundException, kinesis.ErrCodeInvalidArgumentException:
+				return nil, err
+			case kinesis.ErrCodeExpiredNextTokenException:
+				shards = nil
+				in = &kinesis.ListShardsInput{StreamName: aws.String(sl.name)}
+			}
+		}
+		if int(backoff.Attempts())+1 >= sl.maxAttempts {
+			return nil, fmt.Errorf("gave up listing the shards of stream %s after %d attempts: %s", sl.name, sl.maxAttempts, awsutils.ErrorMessage(err))
+		}
+		wait := backoff.Next()
+		lg.Warn("Failed to list the shards of stream %s, retrying in %v: %s", sl.name, wait, awsutils.ErrorMessage(err))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// waitForStream waits until the stream can be consumed, then returns its ARN
+// and shards as listed by sl. Streams which do not exist or are being deleted
+// fail immediately, a stream being created is polled every interval until it
+// is active or the timeout expires. Other errors are retried with a backoff
+// until the timeout.
+func waitForStream(ctx context.Context, sl *shardLister, timeout, interval time.Duration) (arn string, shards []*kinesis.Shard, err error) {
+	name := sl.name
+	deadline := time.Now().Add(timeout)
+	backoff := awsutils.NewBackoff(backoffBase, interval)
+	for {
+		var out *kinesis.DescribeStreamSummaryOutput
+		wait := interval
+		if out, err = sl.svc.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{StreamName: aws.String(name)}); err != nil {
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == kinesis.ErrCodeResourceNotFoundException {
+				return ``, nil, fmt.Errorf("stream %s does not exist", name)
+			}
+			lg.Error("Failed to get stream description for %s: %s", name, awsutils.ErrorMessage(err))
+			wait = backoff.Next()
+		} else {
+			switch status := aws.StringValue(out.StreamDescriptionSummary.StreamStatus); status {
+			case kinesis.StreamStatusActive, kinesis.StreamStatusUpdating:
+				shards, err = sl.list(ctx)
+				return aws.StringValue(out.StreamDescriptionSummary.StreamARN), shards, err
+			case kinesis.StreamStatusDeleting:
+				return ``, nil, fmt.Errorf("stream %s is being deleted", name)
+			default:
+				debugout("Stream %s is %s, waiting for it to become %s\n", name, status, kinesis.StreamStatusActive)
+				err = fmt.Errorf("stream %s is %s", name, status)
+			}
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return ``, nil, fmt.Errorf("gave up after %v: %v", timeout, err)
+		}
+		time.Sleep(wait)
+	}
+}
+
+// run launches consumers for the initial set of shards and then periodically
+// re-reads the shard list, picking up shards created by resharding. It returns
+// once the ingester is shut down. The ingester exits if the shards can't be
+// listed within the stream's List-Shards-Max-Attempts.
+func (st *streamConsumer) run(interval time.Duration) {
+	defer st.wg.Done()
+	st.launch()
+	lastCheck := time.Now()
+	for {
+		select {
+		case <-st.closed:
+			// a drained shard may let its children start
+		case <-time.After(time.Second):
+		case <-st.ctx.Done():
+			return
+		}
+		if time.Since(lastCheck) >= interval {
+			lastCheck = time.Now()
+			shards, err := st.stream.shardLister(st.svc).list(st.ctx)
+			if err != nil {
+				if st.ctx.Err() != nil {
+					return
+				}
+				lg.Fatal("Failed to list the shards of stream %s: %v", st.stream.Stream_Name, err)
+			}
+			st.shards = shards
+		}
+		st.launch()
+	}
+}
+
+// ignoreCheckpoint overwrites the checkpoint of a shard with a replay marker
+// for the tailFrom time, so that it is read from records arriving after the
+// ingester started. The marker is persisted like a checkpoint, a restart
+// before the shard has read anything resumes from the same time rather than
+// falling back to the old checkpoint.
+func (st *streamConsumer) ignoreCheckpoint(id string) {
+	prev := st.stateMan.GetSequenceNum(st.stream.Stream_Name, id)
+	if prev == `` {
+		prev = `none`
+	}
+	lg.Warn("Ignoring checkpoint %s of shard %s on stream %s, records which arrived before %v and were not read are skipped",
+		prev, id, st.stream.Stream_Name, st.tailFrom.Format(time.RFC3339))
+	st.stateMan.UpdateSequenceNum(st.stream.Stream_Name, id, replayMarker(st.tailFrom))
+}
+
+// launch starts a consumer for every shard which has not been started, has not
+// already been drained, whose parents have been drained, and whose lease we
+// can acquire.
+func (st *streamConsumer) launch() {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	known := make(map[string]bool, len(st.shards))
+	var open int
+	for _, shard := range st.shards {
+		known[*shard.ShardId] = true
+		if !st.stateMan.ShardClosed(st.stream.Stream_Name, *shard.ShardId) {
+			open++
+		}
+	}
+	for _, shard := range st.shards {
+		id := *shard.ShardId
+		if st.started[id] {
+			continue
+		}
+		if st.stateMan.ShardClosed(st.stream.Stream_Name, id) {
+			st.started[id] = true
+			continue
+		}
+		if !st.partition.Owns(id) {
+			// read by another instance
+			debugout("Shard %v on stream %s belongs to another instance\n", id, st.stream.Stream_Name)
+			st.started[id] = true
+			continue
+		}
+		if !st.parentsDrained(shard, known) {
+			continue
+		}
+		if !st.stateMan.Acquire(st.stream.Stream_Name, id, open) {
+			continue
+		}
+		if shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil {
+			lg.Info("Shard %v on stream %s is closed, draining remaining records", id, st.stream.Stream_Name)
+		}
+		if !st.tailFrom.IsZero() {
+			st.ignoreCheckpoint(id)
+		}
+		sc := &shardConsumer{
+			ctx:         st.ctx,
+			abort:       st.abort,
+			stream:      *st.stream,
+			shard:       *shard,
+			shardid:     len(st.started),
+			router:      newTagRouter(st.tag, st.routes),
+			tagger:      st.tagger,
+			filter:      st.filter,
+			src:         st.source(id),
+			svc:         st.svc,
+			procset:     st.procset,
+			igst:        st.igst,
+			stateMan:    st.stateMan,
+			consumerARN: st.consumerARN,
+			decomp:      st.decomp,
+			avro:        st.avro,
+			glue:        st.glue,
+			metrics:     st.metrics.Add(id),
+			inflight:    st.inflight,
+			pause:       st.pause,
+			slots:       st.slots,
+			tee:         st.tee,
+			payloads:    st.payloads,
+			closed:      st.closed,
+		}
+		st.started[id] = true
+		st.wg.Add(1)
+		go func() {
+			defer st.wg.Done()
+			defer st.metrics.Remove(sc.metrics)
+			closed := st.runShard(sc)
+			st.stateMan.Release(st.stream.Stream_Name, id)
+			if closed {
+				// the end of a shard closed by a split or merge
+				lg.Info("Shard %v on stream %s reached its end and has been fully consumed, stopping its worker", id, st.stream.Stream_Name)
+				st.metrics.ShardClosed()
+			} else if sc.failed != nil {
+				st.metrics.ShardFailed()
+			}
+			if !closed && sc.failed == nil {
+				// we lost the lease or were shut down, the shard may be
+				// picked up again if we manage to get the lease back
+				st.mtx.Lock()
+				delete(st.started, id)
+				st.mtx.Unlock()
+			}
+		}()
+	}
+}
+
+// runShard runs a shard consumer, relaunching it after panicRestartDelay
+// whenever it panics. It returns true if the shard was read to its end.
+func (st *streamConsumer) runShard(sc *shardConsumer) bool {
+	for {
+		closed, panicked := sc.runRecovered()
+		if !panicked {
+			return closed
+		}
+		select {
+		case <-time.After(panicRestartDelay):
+		case <-st.ctx.Done():
+			return false
+		}
+	}
+}
+
+// parentsDrained returns true if every parent of the shard that is still part
+// of the stream, and read by this instance, has been fully consumed. Parents
+// that have aged out of the stream's retention period are no longer listed and
+// cannot hold up a child.
+func (st *streamConsumer) parentsDrained(shard *kinesis.Shard, known map[string]bool) bool {
+	for _, p := range []*string{shard.ParentShardId, shard.AdjacentParentShardId} {
+		if p == nil || !known[*p] || !st.partition.Owns(*p) {
+			continue
+		}
+		if !st.stateMan.ShardClosed(st.stream.Stream_Name, *p) {
+			return false
+		}
+	}
+	return true
+}
+
+// source returns the SRC for entries from a shard, which identifies the shard
+// if the stream is configured to do so.
+func (st *streamConsumer) source(shard string) net.IP {
+	if st.stream.Shard_Source {
+		return shardSource(st.stream.Stream_Name, shard)
+	}
+	return st.src
+}
+
+// shardSource derives a deterministic IPv6 address in the unique local range
+// from a stream and shard. Bits 16-63 are a hash of the stream name and the
+// low 64 bits are the shard number from the shard ID, so that entries from a
+// stream share a prefix and the shard is readable from the address. Shard IDs
+// without the usual numeric suffix are hashed instead.
+func shardSource(stream, shard string) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	h := fnv.New64a()
+	h.Write([]byte(stream))
+	binary.BigEndian.PutUint64(ip[:8], h.Sum64()>>16)
+	ip[0] = 0xfd
+	n, err := strconv.ParseUint(strings.TrimPrefix(shard, shardIDPrefix), 10, 64)
+	if err != nil || !strings.HasPrefix(shard, shardIDPrefix) {
+		h = fnv.New64a()
+		h.Write([]byte(shard))
+		n = h.Sum64()
+	}
+	binary.BigEndian.PutUint64(ip[8:], n)
+	return ip
+}
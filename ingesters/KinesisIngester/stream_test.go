@@ -0,0 +1,366 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/processors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+// busyStream hands every shard a record on each GetRecords call, long polling
+// briefly in between so that calls are usually in flight.
+type busyStream struct {
+	kinesisiface.KinesisAPI
+	gets int64
+}
+
+func (bs *busyStream) GetShardIterator(in *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	return &kinesis.GetShardIteratorOutput{ShardIterator: aws.String(`0`)}, nil
+}
+
+func (bs *busyStream) GetRecordsWithContext(ctx aws.Context, in *kinesis.GetRecordsInput, opts ...request.Option) (*kinesis.GetRecordsOutput, error) {
+	n := atomic.AddInt64(&bs.gets, 1)
+	select {
+	case <-time.After(20 * time.Millisecond):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	now := time.Now()
+	return &kinesis.GetRecordsOutput{
+		MillisBehindLatest: aws.Int64(0),
+		NextShardIterator:  aws.String(`0`),
+		Records: []*kinesis.Record{{
+			ApproximateArrivalTimestamp: &now,
+			Data:                        []byte(`record`),
+			PartitionKey:                aws.String(`key`),
+			SequenceNumber:              aws.String(fmt.Sprintf("%d", n)),
+		}},
+	}, nil
+}
+
+func TestStreamShutdown(t *testing.T) {
+	const nShards = 8
+	var shards []*kinesis.Shard
+	for i := 0; i < nShards; i++ {
+		shards = append(shards, &kinesis.Shard{ShardId: aws.String(fmt.Sprintf("shardId-%012d", i))})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	bs := &busyStream{}
+	var tw testEntryWriter
+	var wg sync.WaitGroup
+	st := &streamConsumer{
+		ctx:      ctx,
+		stream:   &streamDef{Stream_Name: `stream`, Iterator_Type: kinesis.ShardIteratorTypeLatest, Records_Per_Request: 10},
+		svc:      bs,
+		procset:  processors.NewProcessorSet(&tw),
+		stateMan: newTestStateman(t, filepath.Join(tdir, `shutdown-stream.state`)),
+		metrics:  newMetricsReporter(`stream`),
+		wg:       &wg,
+		shards:   shards,
+		started:  make(map[string]bool),
+		closed:   make(chan string, 1),
+	}
+	wg.Add(1)
+	go st.run(time.Hour)
+
+	// let every shard get going before shutting down
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(&bs.gets) < 2*nShards; {
+		if time.Now().After(deadline) {
+			t.Fatal("shards never started reading")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("shard workers did not exit after shutdown")
+	}
+	if tw.count() == 0 {
+		t.Fatal("no records were ingested")
+	}
+}
+
+func TestStreamShardClosed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts := &testShard{batch: 2, noExpiry: true, records: testRecords(0, 3)}
+	var tw testEntryWriter
+	var wg sync.WaitGroup
+	mr := newMetricsReporter(`stream`)
+	st := &streamConsumer{
+		ctx:      ctx,
+		stream:   &streamDef{Stream_Name: `stream`, Iterator_Type: kinesis.ShardIteratorTypeTrimHorizon, Records_Per_Request: 2},
+		svc:      ts,
+		procset:  processors.NewProcessorSet(&tw),
+		stateMan: newTestStateman(t, filepath.Join(tdir, `closed-stream.state`)),
+		metrics:  mr,
+		wg:       &wg,
+		shards:   []*kinesis.Shard{{ShardId: aws.String(`shardId-000000000000`)}},
+		started:  make(map[string]bool),
+		closed:   make(chan string, 1),
+	}
+	st.launch()
+	wg.Wait()
+	if tw.count() != 3 {
+		t.Fatalf("emitted %d entries for 3 records", tw.count())
+	}
+	if !st.stateMan.ShardClosed(`stream`, `shardId-000000000000`) {
+		t.Fatal("shard not marked closed")
+	}
+	if r := mr.Report(time.Second); r.ShardsClosed != 1 || r.Shards != 0 {
+		t.Fatalf("%d shards closed with %d still tracked", r.ShardsClosed, r.Shards)
+	}
+	if r := mr.Report(time.Second); r.ShardsClosed != 0 {
+		t.Fatal("closed shards not reset after a report")
+	}
+}
+
+// deniedStream fails every GetShardIterator call, like a stream we have lost
+// permission to read.
+type deniedStream struct {
+	kinesisiface.KinesisAPI
+	calls int32
+}
+
+func (ds *deniedStream) GetShardIterator(in *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	atomic.AddInt32(&ds.calls, 1)
+	return nil, awserr.New(`AccessDeniedException`, `not authorized to perform kinesis:GetShardIterator`, nil)
+}
+
+func TestStreamIteratorRetryLimit(t *testing.T) {
+	ds := &deniedStream{}
+	var wg sync.WaitGroup
+	mr := newMetricsReporter(`stream`)
+	st := &streamConsumer{
+		ctx:      context.Background(),
+		stream:   &streamDef{Stream_Name: `stream`, Iterator_Type: kinesis.ShardIteratorTypeLatest, Iterator_Retry_Limit: `50ms`},
+		svc:      ds,
+		stateMan: newTestStateman(t, filepath.Join(tdir, `denied-stream.state`)),
+		metrics:  mr,
+		wg:       &wg,
+		shards:   []*kinesis.Shard{{ShardId: aws.String(`shardId-000000000000`)}},
+		started:  make(map[string]bool),
+		closed:   make(chan string, 1),
+	}
+	st.launch()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shard worker did not give up")
+	}
+	if n := atomic.LoadInt32(&ds.calls); n < 2 {
+		t.Fatalf("gave up after %d calls", n)
+	}
+	if r := mr.Report(time.Second); r.ShardsFailed != 1 || r.ShardsClosed != 0 {
+		t.Fatalf("%d shards failed, %d closed", r.ShardsFailed, r.ShardsClosed)
+	}
+	// the shard is not relaunched
+	calls := atomic.LoadInt32(&ds.calls)
+	st.launch()
+	wg.Wait()
+	if n := atomic.LoadInt32(&ds.calls); n != calls {
+		t.Fatalf("failed shard relaunched, %d more calls", n-calls)
+	}
+}
+
+// statusStream reports each of its statuses in turn, sticking on the last.
+type statusStream struct {
+	kinesisiface.KinesisAPI
+	statuses []string
+	err      error
+}
+
+func (ss *statusStream) DescribeStreamSummary(in *kinesis.DescribeStreamSummaryInput) (*kinesis.DescribeStreamSummaryOutput, error) {
+	if ss.err != nil {
+		return nil, ss.err
+	}
+	status := ss.statuses[0]
+	if len(ss.statuses) > 1 {
+		ss.statuses = ss.statuses[1:]
+	}
+	return &kinesis.DescribeStreamSummaryOutput{
+		StreamDescriptionSummary: &kinesis.StreamDescriptionSummary{
+			StreamARN:    aws.String(`arn:aws:kinesis:us-east-1:123456789012:stream/test`),
+			StreamStatus: aws.String(status),
+		},
+	}, nil
+}
+
+func (ss *statusStream) ListShardsWithContext(ctx aws.Context, in *kinesis.ListShardsInput, opts ...request.Option) (*kinesis.ListShardsOutput, error) {
+	return &kinesis.ListShardsOutput{
+		Shards: []*kinesis.Shard{{ShardId: aws.String(`shardId-000000000000`)}},
+	}, nil
+}
+
+func TestWaitForStream(t *testing.T) {
+	ss := &statusStream{statuses: []string{kinesis.StreamStatusCreating, kinesis.StreamStatusCreating, kinesis.StreamStatusActive}}
+	arn, shards, err := waitForStream(context.Background(), &shardLister{svc: ss, name: `test`, maxAttempts: 1}, time.Second, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	} else if arn == `` || len(shards) != 1 {
+		t.Fatalf("bad stream description %q %v", arn, shards)
+	}
+
+	ss = &statusStream{statuses: []string{kinesis.StreamStatusCreating}}
+	if _, _, err = waitForStream(context.Background(), &shardLister{svc: ss, name: `test`, maxAttempts: 1}, 20*time.Millisecond, time.Millisecond); err == nil {
+		t.Fatal("waited forever on a stream being created")
+	}
+
+	start := time.Now()
+	ss = &statusStream{statuses: []string{kinesis.StreamStatusDeleting}}
+	if _, _, err = waitForStream(context.Background(), &shardLister{svc: ss, name: `test`, maxAttempts: 1}, time.Minute, time.Millisecond); err == nil {
+		t.Fatal("accepted a stream being deleted")
+	}
+	ss = &statusStream{err: awserr.New(kinesis.ErrCodeResourceNotFoundException, `Stream test not found`, nil)}
+	if _, _, err = waitForStream(context.Background(), &shardLister{svc: ss, name: `test`, maxAttempts: 1}, time.Minute, time.Millisecond); err == nil || !strings.Contains(err.Error(), `test`) {
+		t.Fatalf("bad error for a missing stream: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("did not fail fast")
+	}
+}
+
+// pagedShards lists one shard per page, failing calls with the scripted
+// errors first.
+type pagedShards struct {
+	kinesisiface.KinesisAPI
+	shards []string
+	errs   []error
+	calls  int
+}
+
+func (ps *pagedShards) ListShardsWithContext(ctx aws.Context, in *kinesis.ListShardsInput, opts ...request.Option) (*kinesis.ListShardsOutput, error) {
+	ps.calls++
+	if len(ps.errs) > 0 {
+		err := ps.errs[0]
+		ps.errs = ps.errs[1:]
+		return nil, err
+	}
+	var i int
+	if in.NextToken != nil {
+		if in.StreamName != nil {
+			return nil, awserr.New(kinesis.ErrCodeInvalidArgumentException, `NextToken and StreamName cannot be provided together`, nil)
+		}
+		i, _ = strconv.Atoi(*in.NextToken)
+	}
+	out := &kinesis.ListShardsOutput{Shards: []*kinesis.Shard{{ShardId: aws.String(ps.shards[i])}}}
+	if i+1 < len(ps.shards) {
+		out.NextToken = aws.String(strconv.Itoa(i + 1))
+	}
+	return out, nil
+}
+
+func TestShardLister(t *testing.T) {
+	throttled := awserr.New(kinesis.ErrCodeLimitExceededException, `Rate exceeded`, nil)
+	ps := &pagedShards{
+		shards: []string{`shardId-000000000000`, `shardId-000000000001`, `shardId-000000000002`},
+		errs:   []error{throttled, throttled},
+	}
+	sl := &shardLister{svc: ps, name: `test`, maxAttempts: 3, maxBackoff: time.Millisecond}
+	shards, err := sl.list(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	} else if len(shards) != 3 || *shards[2].ShardId != `shardId-000000000002` || ps.calls != 5 {
+		t.Fatalf("bad listing of %d shards in %d calls", len(shards), ps.calls)
+	}
+
+	// an expired token restarts the listing rather than duplicating shards
+	ps = &pagedShards{shards: ps.shards}
+	sl.svc = ps
+	ps.errs = nil
+	if shards, err = sl.list(context.Background()); err != nil || len(shards) != 3 {
+		t.Fatalf("bad listing: %v %v", shards, err)
+	}
+	ps.calls = 0
+	ps.errs = []error{awserr.New(kinesis.ErrCodeExpiredNextTokenException, `expired`, nil)}
+	if shards, err = sl.list(context.Background()); err != nil || len(shards) != 3 || ps.calls != 4 {
+		t.Fatalf("bad listing after an expired token: %v %v in %d calls", shards, err, ps.calls)
+	}
+
+	// consecutive failures give up after the limit
+	ps = &pagedShards{shards: ps.shards, errs: []error{throttled, throttled, throttled, throttled}}
+	sl.svc = ps
+	if _, err = sl.list(context.Background()); err == nil || ps.calls != 3 {
+		t.Fatalf("did not give up after 3 attempts: %v, %d calls", err, ps.calls)
+	}
+
+	// a missing stream fails at once
+	ps = &pagedShards{errs: []error{awserr.New(kinesis.ErrCodeResourceNotFoundException, `not found`, nil)}}
+	sl.svc = ps
+	if _, err = sl.list(context.Background()); err == nil || ps.calls != 1 {
+		t.Fatalf("retried a missing stream: %v, %d calls", err, ps.calls)
+	}
+
+	sd := streamDef{Stream_Name: `test`}
+	if sl = sd.shardLister(ps); sl.maxAttempts != defaultListShardsAttempts || sl.maxBackoff != backoffMax {
+		t.Fatalf("bad defaults %+v", sl)
+	}
+}
+
+func TestStreamIgnoreCheckpoint(t *testing.T) {
+	sm := newTestStateman(t, filepath.Join(tdir, `ignore-checkpoint.state`))
+	sm.UpdateSequenceNum(`stream`, `shardId-000000000000`, `49590338271490256608559692538361571095921575989136588802`)
+	// the shards exit at once, leaving their checkpoints as launch set them
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var wg sync.WaitGroup
+	start := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	st := &streamConsumer{
+		ctx:      ctx,
+		stream:   &streamDef{Stream_Name: `stream`, Iterator_Type: kinesis.ShardIteratorTypeTrimHorizon},
+		svc:      &busyStream{},
+		procset:  processors.NewProcessorSet(&testEntryWriter{}),
+		stateMan: sm,
+		metrics:  newMetricsReporter(`stream`),
+		tailFrom: start,
+		wg:       &wg,
+		shards: []*kinesis.Shard{
+			{ShardId: aws.String(`shardId-000000000000`)},
+			{ShardId: aws.String(`shardId-000000000001`)},
+		},
+		started: make(map[string]bool),
+		closed:  make(chan string, 1),
+	}
+	st.launch()
+	wg.Wait()
+	// both the checkpointed and the new shard start from the startup time
+	for _, id := range []string{`shardId-000000000000`, `shardId-000000000001`} {
+		sc := &shardConsumer{stream: *st.stream, shard: kinesis.Shard{ShardId: aws.String(id)}, stateMan: sm}
+		if typ, _, ts := sc.startingPosition(); typ != kinesis.ShardIteratorTypeAtTimestamp || !ts.Equal(start) {
+			t.Fatalf("shard %s starts at %s %v", id, typ, ts)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+// tagStateWriteTimeout bounds writing a checkpoint backup entry and waiting
+// for the indexers to take it.
+const tagStateWriteTimeout = 30 * time.Second
+
+// checkpointEntry is the JSON entry a tagStateStore writes to the
+// Checkpoint-Backup-Tag, holding every checkpoint of the ingester at the time.
+type checkpointEntry struct {
+	Ingester    string                       // UUID of the ingester, ingesters may share a tag
+	Checkpoints map[string]map[string]string // stream name to shard ID to sequence number
+}
+
+// checkpointSink is the muxer, checkpoint entries bypass the spool so that a
+// successful write means an indexer has them.
+type checkpointSink interface {
+	contextWriter
+	syncer
+}
+
+// tagStateStore is a stateStore which backs the checkpoints of a local store
+// up to Gravwell, every write is also an entry in a tag and only succeeds once
+// the muxer has synced it to the indexers. The ingest connection cannot
+// search, so the checkpoints are only ever read from the local store; moving
+// to another host means restoring the newest entry from the tag with
+// -restore-checkpoint.
+type tagStateStore struct {
+	local    stateStore
+	wtr      checkpointSink
+	tag      entry.EntryTag
+	ingester string
+	timeout  time.Duration
+}
+
+func newTagStateStore(local stateStore, wtr checkpointSink, tag entry.EntryTag, ingester string) *tagStateStore {
+	return &tagStateStore{
+		local:    local,
+		wtr:      wtr,
+		tag:      tag,
+		ingester: ingester,
+		timeout:  tagStateWriteTimeout,
+	}
+}
+
+// Read returns the checkpoints last written to the local store.
+func (ts *tagStateStore) Read(f interface{}) error {
+	return ts.local.Read(f)
+}
+
+// Write stores the checkpoints in the local store and then in the tag.
+func (ts *tagStateStore) Write(f interface{}) error {
+	states, ok := f.(map[string]map[string]string)
+	if !ok {
+		return fmt.Errorf("unsupported checkpoint state %T", f)
+	}
+	if err := ts.local.Write(states); err != nil {
+		return err
+	}
+	b, err := json.Marshal(checkpointEntry{Ingester: ts.ingester, Checkpoints: states})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ts.timeout)
+	defer cancel()
+	if err = ts.wtr.WriteEntryContext(ctx, &entry.Entry{
+		TS:   entry.Now(),
+		Tag:  ts.tag,
+		Data: b,
+	}); err != nil {
+		return fmt.Errorf("Failed to write checkpoint entry: %v", err)
+	} else if err = ts.wtr.SyncContext(ctx, ts.timeout); err != nil {
+		return fmt.Errorf("Checkpoint entry not acknowledged by the indexers: %v", err)
+	}
+	return nil
+}
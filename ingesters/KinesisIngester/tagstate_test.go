@@ -0,0 +1,145 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingesters/utils"
+)
+
+// syncingWriter is a checkpointSink whose syncs fail while syncErr is set.
+type syncingWriter struct {
+	testEntryWriter
+	syncs   int
+	syncErr error
+}
+
+func (sw *syncingWriter) SyncContext(ctx context.Context, to time.Duration) error {
+	sw.syncs++
+	return sw.syncErr
+}
+
+func TestTagStateStore(t *testing.T) {
+	pth := filepath.Join(tdir, `tag.state`)
+	local, err := utils.NewState(pth, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sw syncingWriter
+	sm := NewStateman(newTagStateStore(local, &sw, 9, `ingester-id`))
+	sm.UpdateSequenceNum(`stream`, `shardId-000000000000`, `1000`)
+	sm.MarkShardClosed(`stream`, `shardId-000000000001`)
+	sm.Flush()
+
+	if len(sw.ents) != 1 || sw.ents[0].Tag != 9 || sw.syncs != 1 {
+		t.Fatalf("bad checkpoint entries %+v after %d syncs", sw.ents, sw.syncs)
+	}
+	var ce checkpointEntry
+	if err = json.Unmarshal(sw.ents[0].Data, &ce); err != nil {
+		t.Fatal(err)
+	} else if ce.Ingester != `ingester-id` || ce.Checkpoints[`stream`][`shardId-000000000000`] != `1000` || ce.Checkpoints[`stream`][`shardId-000000000001`] != shardClosedMarker {
+		t.Fatalf("bad checkpoint entry %s", sw.ents[0].Data)
+	}
+	if seq := sm.Persisted(`stream`, `shardId-000000000000`); seq != `1000` {
+		t.Fatalf("persisted checkpoint %q", seq)
+	}
+	// the local store is read on startup
+	if seq := newTestStateman(t, pth).GetSequenceNum(`stream`, `shardId-000000000000`); seq != `1000` {
+		t.Fatalf("local checkpoint %q", seq)
+	}
+
+	// a checkpoint the indexers didn't acknowledge isn't persisted, and the
+	// next flush tries again
+	sw.syncErr = errors.New("all connections down")
+	sm.UpdateSequenceNum(`stream`, `shardId-000000000000`, `2000`)
+	sm.Flush()
+	if seq := sm.Persisted(`stream`, `shardId-000000000000`); seq != `1000` {
+		t.Fatalf("unacknowledged checkpoint persisted as %q", seq)
+	}
+	sw.syncErr = nil
+	sm.Flush()
+	if seq := sm.Persisted(`stream`, `shardId-000000000000`); seq != `2000` || len(sw.ents) != 3 {
+		t.Fatalf("checkpoint not retried: %q, %d entries", seq, len(sw.ents))
+	}
+}
+
+func TestRestoreCheckpoint(t *testing.T) {
+	pth := filepath.Join(tdir, `restore.state`)
+	os.Remove(pth)
+	c := testConfig(&streamDef{Stream_Name: `stream`})
+	if err := verifyConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	c.Global.State_Store_Location = pth
+	ent := `{"Ingester":"other","Checkpoints":{"stream":{"shardId-000000000000":"1000","shardId-000000000001":"SHARD_END"}}}`
+
+	var out bytes.Buffer
+	if err := restoreCheckpoint(c, strings.NewReader(ent), false, &out); err == nil {
+		t.Fatal("restored without confirmation")
+	} else if !strings.Contains(out.String(), `shardId-000000000000: 1000`) {
+		t.Fatalf("checkpoints not listed: %s", out.String())
+	}
+	if seq := newTestStateman(t, pth).GetSequenceNum(`stream`, `shardId-000000000000`); seq != `` {
+		t.Fatalf("unconfirmed restore wrote %q", seq)
+	}
+	for _, bad := range []string{`not json`, `{"Ingester":"x"}`} {
+		if err := restoreCheckpoint(c, strings.NewReader(bad), true, ioutil.Discard); err == nil {
+			t.Fatalf("restored %s", bad)
+		}
+	}
+
+	if err := restoreCheckpoint(c, strings.NewReader(ent), true, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	sm := newTestStateman(t, pth)
+	if seq := sm.GetSequenceNum(`stream`, `shardId-000000000000`); seq != `1000` {
+		t.Fatalf("restored checkpoint %q", seq)
+	}
+	c.Global.Checkpoint_Backend = checkpointBackendDynamo
+	if err := restoreCheckpoint(c, strings.NewReader(ent), true, ioutil.Discard); err == nil {
+		t.Fatal("restored with the dynamodb Checkpoint-Backend")
+	}
+}
+
+func TestCheckpointBackupTag(t *testing.T) {
+	c := testConfig(&streamDef{Stream_Name: `stream`, Tag_Name: `kinesis`})
+	c.Global.Checkpoint_Backup_Tag = `kinesis-checkpoints`
+	if err := verifyConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if tags, err := c.Tags(); err != nil {
+		t.Fatal(err)
+	} else if len(tags) != 2 || tags[1] != `kinesis-checkpoints` {
+		t.Fatalf("backup tag not negotiated: %v", tags)
+	}
+
+	// the tag backs up the file backend, it is not a backend of its own
+	c = testConfig(&streamDef{Stream_Name: `stream`})
+	c.Global.Checkpoint_Backend = `gravwell`
+	if err := verifyConfig(c); err == nil {
+		t.Fatal("accepted the gravwell Checkpoint-Backend")
+	}
+	c = testConfig(&streamDef{Stream_Name: `stream`})
+	c.Global.Checkpoint_Backend = checkpointBackendDynamo
+	c.Global.Checkpoint_Table, c.Global.Checkpoint_Region = `table`, `us-west-1`
+	c.Global.Checkpoint_Backup_Tag = `kinesis-checkpoints`
+	if err := verifyConfig(c); err == nil {
+		t.Fatal("accepted a Checkpoint-Backup-Tag with the dynamodb Checkpoint-Backend")
+	}
+}
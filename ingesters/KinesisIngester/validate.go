@@ -0,0 +1,88 @@
+/*************************************************************************
+ * Copyright 2018 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// validateConfig loads and verifies a configuration and confirms that every
+// configured stream can be described with its credentials, writing a summary
+// to w. Nothing is ingested and no state is written; the ingester UUID is not
+// added to the config file if it is missing.
+func validateConfig(path string, w io.Writer) error {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	conns, err := cfg.Targets()
+	if err != nil {
+		return err
+	}
+	tags, err := cfg.Tags()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Configuration %s is valid\n", path)
+	fmt.Fprintf(w, "Targets: %v\n", conns)
+	fmt.Fprintf(w, "Tags: %v\n", tags)
+
+	sess, err := awsutils.NewSession(``, cfg.Global.credentials())
+	if err != nil {
+		return fmt.Errorf("Failed to create AWS session: %v", err)
+	}
+
+	var failed int
+	names := make([]string, 0, len(cfg.KinesisStream))
+	for k := range cfg.KinesisStream {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		stream := cfg.KinesisStream[k]
+		svc := kinesis.New(sess, stream.endpoint(&cfg.Global).Config().WithRegion(stream.Region))
+		shards, err := stream.shardLister(svc).list(context.Background())
+		if err != nil {
+			fmt.Fprintf(w, "Stream %s (%s in %s): FAILED: %v\n", k, stream.Stream_Name, stream.Region, err)
+			failed++
+			continue
+		}
+		var open int
+		for _, s := range shards {
+			if s.SequenceNumberRange == nil || s.SequenceNumberRange.EndingSequenceNumber == nil {
+				open++
+			}
+		}
+		fmt.Fprintf(w, "Stream %s (%s in %s): OK, %d shards, %d open\n", k, stream.Stream_Name, stream.Region, len(shards), open)
+	}
+
+	if cfg.Global.Checkpoint_Backend == checkpointBackendDynamo {
+		dsvc := dynamodb.New(sess, aws.NewConfig().WithRegion(cfg.Global.Checkpoint_Region))
+		if _, err := dsvc.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(cfg.Global.Checkpoint_Table)}); err != nil {
+			fmt.Fprintf(w, "Checkpoint table %s: FAILED: %v\n", cfg.Global.Checkpoint_Table, err)
+			failed++
+		} else {
+			fmt.Fprintf(w, "Checkpoint table %s: OK\n", cfg.Global.Checkpoint_Table)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d AWS checks failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff computes exponential backoff delays with full jitter, as recommended
+// for retrying throttled AWS API calls. Each delay is chosen uniformly between
+// zero and the base delay doubled once per consecutive failure, capped at the
+// maximum. A Backoff is not safe for concurrent use.
+type Backoff struct {
+	base     time.Duration
+	max      time.Duration
+	attempts uint
+	start    time.Time // time of the first failure since the last reset
+	rng      *rand.Rand
+}
+
+// NewBackoff returns a Backoff with the given base and maximum delays.
+func NewBackoff(base, max time.Duration) *Backoff {
+	if max < base {
+		max = base
+	}
+	return &Backoff{
+		base: base,
+		max:  max,
+		rng:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Next records a failure and returns how long to wait before retrying.
+func (b *Backoff) Next() time.Duration {
+	if b.attempts == 0 {
+		b.start = time.Now()
+	}
+	ceil := b.max
+	// stop doubling well before the shift could overflow
+	if b.attempts < 32 {
+		if d := b.base << b.attempts; d > 0 && d < b.max {
+			ceil = d
+		}
+	}
+	b.attempts++
+	return time.Duration(b.rng.Int63n(int64(ceil) + 1))
+}
+
+// Wait records a failure and sleeps for the resulting delay.
+func (b *Backoff) Wait() {
+	time.Sleep(b.Next())
+}
+
+// Reset clears the failure count after a successful call.
+func (b *Backoff) Reset() {
+	b.attempts = 0
+}
+
+// Attempts returns the number of consecutive failures since the last reset.
+func (b *Backoff) Attempts() uint {
+	return b.attempts
+}
+
+// Elapsed returns how long we have been backing off, zero if the last call
+// succeeded.
+func (b *Backoff) Elapsed() time.Duration {
+	if b.attempts == 0 {
+		return 0
+	}
+	return time.Since(b.start)
+}
@@ -0,0 +1,43 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffBounds(t *testing.T) {
+	base, max := 100*time.Millisecond, 30*time.Second
+	b := NewBackoff(base, max)
+	for i := 0; i < 100; i++ {
+		ceil := max
+		if i < 10 {
+			if d := base << uint(i); d < max {
+				ceil = d
+			}
+		}
+		if d := b.Next(); d < 0 || d > ceil {
+			t.Fatalf("attempt %d delay %v outside [0, %v]", i, d, ceil)
+		}
+	}
+	if b.Attempts() != 100 {
+		t.Fatalf("bad attempt count %d", b.Attempts())
+	}
+	if b.Elapsed() <= 0 {
+		t.Fatal("no elapsed time while backing off")
+	}
+	b.Reset()
+	if b.Attempts() != 0 || b.Elapsed() != 0 {
+		t.Fatal("reset did not clear backoff")
+	}
+	if d := b.Next(); d > base {
+		t.Fatalf("delay %v after reset exceeds base %v", d, base)
+	}
+}
@@ -0,0 +1,125 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest"
+)
+
+const (
+	// DefaultCacheReportInterval is how often cache usage is checked when the
+	// ingester has no metrics interval of its own.
+	DefaultCacheReportInterval = time.Minute
+
+	cacheFlushTimeout = 30 * time.Second // how long a flush waits on the muxer to drain
+)
+
+// CacheMuxer is the part of the ingest muxer used by a CacheMonitor.
+type CacheMuxer interface {
+	CacheStats() (ingest.CacheStats, bool)
+	FlushCache() error
+	Sync(time.Duration) error
+}
+
+// CacheMonitor reports the ingest cache of a muxer, logging whenever the cache
+// holds entries and exporting its usage as Prometheus gauges. Operators can
+// send SIGUSR1 to flush the cache to the indexers rather than waiting on the
+// muxer to notice a connection came back, there is no flush signal on Windows.
+type CacheMonitor struct {
+	m       CacheMuxer
+	logf    func(format string, args ...interface{})
+	active  *PromValue
+	entries *PromValue
+	bytes   *PromValue
+	blocks  *PromValue
+}
+
+// NewCacheMonitor creates a monitor for the cache of m, registering its
+// gauges with reg under the prefix, e.g. sqs. A nil reg exports nothing. Cache
+// reports and flush results are passed to logf.
+func NewCacheMonitor(m CacheMuxer, reg *PromRegistry, prefix string, logf func(format string, args ...interface{})) *CacheMonitor {
+	cm := &CacheMonitor{m: m, logf: logf}
+	if reg != nil {
+		cm.active = reg.Gauge(prefix+`_cache_active`, `1 while no indexer is connected and entries go to the ingest cache.`).With()
+		cm.entries = reg.Gauge(prefix+`_cache_entries`, `Entries held in the ingest cache.`).With()
+		cm.bytes = reg.Gauge(prefix+`_cache_memory_bytes`, `Size of the entries the ingest cache holds in memory.`).With()
+		cm.blocks = reg.Gauge(prefix+`_cache_stored_blocks`, `Blocks of entries in the file backing the ingest cache.`).With()
+	}
+	return cm
+}
+
+// Update refreshes the gauges, returning the stats and whether the muxer has
+// a cache at all.
+func (cm *CacheMonitor) Update() (cs ingest.CacheStats, ok bool) {
+	if cs, ok = cm.m.CacheStats(); !ok {
+		return
+	}
+	if cs.Active {
+		cm.active.Set(1)
+	} else {
+		cm.active.Set(0)
+	}
+	cm.entries.Set(float64(cs.Entries))
+	cm.bytes.Set(float64(cs.MemoryBytes))
+	cm.blocks.Set(float64(cs.StoredBlocks))
+	return
+}
+
+// Flush asks the muxer to unload its cache to the hot connections and waits
+// up to cacheFlushTimeout for the entries to be sent.
+func (cm *CacheMonitor) Flush() error {
+	if err := cm.m.FlushCache(); err != nil {
+		return err
+	}
+	return cm.m.Sync(cacheFlushTimeout)
+}
+
+// Run reports the cache every interval and flushes it on SIGUSR1 until ctx is
+// cancelled. It returns immediately if the muxer has no cache.
+func (cm *CacheMonitor) Run(ctx context.Context, interval time.Duration) {
+	if _, ok := cm.Update(); !ok {
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultCacheReportInterval
+	}
+	usr1 := make(chan os.Signal, 1)
+	notifyFlush(usr1)
+	defer signal.Stop(usr1)
+	tckr := time.NewTicker(interval)
+	defer tckr.Stop()
+	var wasActive bool
+	for {
+		select {
+		case <-tckr.C:
+			cs, _ := cm.Update()
+			// stay quiet while the cache is idle and empty
+			if cs.Active || cs.Entries > 0 || wasActive {
+				cm.logf("Ingest cache active %v, holding %d entries, %d bytes in memory, %d stored blocks",
+					cs.Active, cs.Entries, cs.MemoryBytes, cs.StoredBlocks)
+			}
+			wasActive = cs.Active
+		case <-usr1:
+			before, _ := cm.Update()
+			if err := cm.Flush(); err != nil {
+				cm.logf("Failed to flush the ingest cache of %d entries: %v", before.Entries, err)
+			} else {
+				after, _ := cm.Update()
+				cm.logf("Flushed the ingest cache, %d entries before and %d after", before.Entries, after.Entries)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
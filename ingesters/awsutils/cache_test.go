@@ -0,0 +1,77 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest"
+)
+
+type fakeCacheMuxer struct {
+	sync.Mutex
+	stats   ingest.CacheStats
+	enabled bool
+	flushes int
+}
+
+func (fm *fakeCacheMuxer) CacheStats() (ingest.CacheStats, bool) {
+	fm.Lock()
+	defer fm.Unlock()
+	return fm.stats, fm.enabled
+}
+
+func (fm *fakeCacheMuxer) FlushCache() error {
+	fm.Lock()
+	defer fm.Unlock()
+	if fm.stats.Active {
+		return ingest.ErrAllConnsDown
+	}
+	fm.flushes++
+	fm.stats.Entries = 0
+	return nil
+}
+
+func (fm *fakeCacheMuxer) Sync(time.Duration) error {
+	return nil
+}
+
+func TestCacheMonitor(t *testing.T) {
+	fm := &fakeCacheMuxer{enabled: true, stats: ingest.CacheStats{Active: true, Entries: 10, MemoryBytes: 2048, StoredBlocks: 3}}
+	reg := NewPromRegistry()
+	cm := NewCacheMonitor(fm, reg, `test`, t.Logf)
+	if _, ok := cm.Update(); !ok {
+		t.Fatal("cache not reported")
+	}
+	if cm.active.Value() != 1 || cm.entries.Value() != 10 || cm.bytes.Value() != 2048 || cm.blocks.Value() != 3 {
+		t.Fatalf("bad gauges %v %v %v %v", cm.active.Value(), cm.entries.Value(), cm.bytes.Value(), cm.blocks.Value())
+	}
+
+	// nothing to flush to while the cache is active
+	if err := cm.Flush(); err != ingest.ErrAllConnsDown {
+		t.Fatalf("flushed with no hot connections: %v", err)
+	}
+	fm.Lock()
+	fm.stats.Active = false
+	fm.Unlock()
+	if err := cm.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if cs, _ := cm.Update(); cs.Entries != 0 || cm.active.Value() != 0 {
+		t.Fatalf("cache not flushed: %+v", cs)
+	}
+}
+
+func TestCacheMonitorNoCache(t *testing.T) {
+	// without a cache there is nothing to monitor, Run returns at once
+	(&CacheMonitor{m: &fakeCacheMuxer{}}).Run(context.Background(), time.Millisecond)
+}
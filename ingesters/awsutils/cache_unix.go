@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyFlush relays the cache flush signal to c.
+func notifyFlush(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
@@ -0,0 +1,61 @@
+//go:build !windows
+// +build !windows
+
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest"
+)
+
+func TestCacheMonitorSignal(t *testing.T) {
+	fm := &fakeCacheMuxer{enabled: true, stats: ingest.CacheStats{Entries: 5}}
+	logs := make(chan string, 16)
+	cm := NewCacheMonitor(fm, nil, `test`, func(f string, args ...interface{}) {
+		select {
+		case logs <- fmt.Sprintf(f, args...):
+		default:
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		cm.Run(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	// the first report means the signal handler is installed
+	select {
+	case <-logs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no cache report")
+	}
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.After(5 * time.Second)
+	for flushed := false; !flushed; {
+		select {
+		case <-logs:
+			fm.Lock()
+			flushed = fm.flushes == 1
+			fm.Unlock()
+		case <-deadline:
+			t.Fatal("cache was not flushed on SIGUSR1")
+		}
+	}
+	cancel()
+	<-done
+}
@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"os"
+)
+
+// notifyFlush does nothing, Windows has no SIGUSR1 to flush the cache with.
+func notifyFlush(c chan<- os.Signal) {}
@@ -0,0 +1,146 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+// Package awsutils contains helpers shared by the ingesters which consume
+// data from AWS services.
+package awsutils
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	stsGlobalRegion = `us-east-1`
+
+	// temporaryKeyPrefix starts the access key IDs STS issues, which expire
+	// and need a session token.
+	temporaryKeyPrefix = `ASIA`
+)
+
+var (
+	ErrPartialStaticKeys     = errors.New("Both an access key ID and a secret access key must be provided")
+	ErrRoleOptionsNoRole     = errors.New("External-ID and Session-Name require Role-ARN")
+	ErrInstanceRoleAndStatic = errors.New("Use-Instance-Role cannot be combined with static access keys")
+	ErrProfileAndOther       = errors.New("AWS-Profile and Credentials-File cannot be combined with Use-Instance-Role or static access keys, " +
+		"use only one of them, Role-ARN may be assumed with any of them")
+)
+
+// Credentials describes where an ingester should get its AWS credentials.
+//
+// Credentials are resolved in the following order:
+//  1. The EC2/ECS instance role, if UseInstanceRole is set
+//  2. Static access keys, if provided
+//  3. A named profile from the shared credentials and config files, if
+//     Profile or CredentialsFile is set
+//  4. The default SDK credential chain
+//
+// Only one of the first three may be configured, they are mutually exclusive
+// rather than overriding each other so that a config never silently uses
+// credentials other than the ones the operator expects.
+// If RoleARN is set, the credentials resolved above are used to assume the
+// role via STS and the temporary role credentials are used for all requests.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	RoleARN         string
+	ExternalID      string
+	SessionName     string
+	UseInstanceRole bool
+	Profile         string // defaults to the AWS_PROFILE environment variable or "default"
+	CredentialsFile string // replaces the default shared files, ~/.aws/credentials and ~/.aws/config
+}
+
+func (c Credentials) useProfile() bool {
+	return c.Profile != `` || c.CredentialsFile != ``
+}
+
+// TemporaryStaticKeys reports whether the static access key ID looks like
+// temporary STS credentials. Static keys are never refreshed, so those stop
+// working once they expire, while the instance role, profiles, and the default
+// SDK chain refresh temporary credentials on their own.
+func (c Credentials) TemporaryStaticKeys() bool {
+	return strings.HasPrefix(c.AccessKeyID, temporaryKeyPrefix)
+}
+
+// Validate checks that the credential options are coherent.
+func (c Credentials) Validate() error {
+	if (c.AccessKeyID == ``) != (c.SecretAccessKey == ``) {
+		return ErrPartialStaticKeys
+	}
+	if c.RoleARN == `` && (c.ExternalID != `` || c.SessionName != ``) {
+		return ErrRoleOptionsNoRole
+	}
+	if c.UseInstanceRole && c.AccessKeyID != `` {
+		return ErrInstanceRoleAndStatic
+	}
+	if c.useProfile() && (c.UseInstanceRole || c.AccessKeyID != ``) {
+		return ErrProfileAndOther
+	}
+	return nil
+}
+
+// NewSession builds an AWS session for the given region using the credential
+// options. An empty region leaves region resolution to the SDK.
+func NewSession(region string, c Credentials) (*session.Session, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	cfg := aws.NewConfig()
+	if region != `` {
+		cfg = cfg.WithRegion(region)
+	}
+	if c.UseInstanceRole {
+		dcfg := defaults.Config()
+		dcfg.MergeIn(cfg)
+		cfg = cfg.WithCredentials(credentials.NewCredentials(defaults.RemoteCredProvider(*dcfg, defaults.Handlers())))
+	} else if c.AccessKeyID != `` {
+		cfg = cfg.WithCredentials(credentials.NewStaticCredentials(c.AccessKeyID, c.SecretAccessKey, ``))
+	}
+	var sess *session.Session
+	var err error
+	if c.useProfile() {
+		opts := session.Options{
+			Config:            *cfg,
+			Profile:           c.Profile,
+			SharedConfigState: session.SharedConfigEnable,
+		}
+		if c.CredentialsFile != `` {
+			opts.SharedConfigFiles = []string{c.CredentialsFile}
+		}
+		sess, err = session.NewSessionWithOptions(opts)
+	} else {
+		sess, err = session.NewSession(cfg)
+	}
+	if err != nil || c.RoleARN == `` {
+		return sess, err
+	}
+
+	// use the base credentials to assume the role, STS is a global service
+	// so when no region is specified we just talk to the global endpoint
+	stsCfg := aws.NewConfig()
+	if region == `` {
+		stsCfg = stsCfg.WithRegion(stsGlobalRegion)
+	}
+	creds := stscreds.NewCredentialsWithClient(sts.New(sess, stsCfg), c.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		if c.ExternalID != `` {
+			p.ExternalID = aws.String(c.ExternalID)
+		}
+		if c.SessionName != `` {
+			p.RoleSessionName = c.SessionName
+		}
+	})
+	return sess.Copy(aws.NewConfig().WithCredentials(creds)), nil
+}
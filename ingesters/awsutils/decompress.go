@@ -0,0 +1,139 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	DecompressNone   = `none`
+	DecompressGzip   = `gzip`
+	DecompressZstd   = `zstd`
+	DecompressSnappy = `snappy`
+	DecompressAuto   = `auto`
+)
+
+var (
+	gzipMagic         = []byte{0x1f, 0x8b}
+	zstdMagic         = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	snappyStreamMagic = []byte("\xff\x06\x00\x00sNaPpY")
+
+	ErrUnknownCompression = errors.New("Unrecognized compression format")
+)
+
+// ParseDecompression normalizes a Decompression option, an empty value means
+// no decompression.
+func ParseDecompression(v string) (string, error) {
+	switch v = strings.ToLower(strings.TrimSpace(v)); v {
+	case ``:
+		return DecompressNone, nil
+	case DecompressNone, DecompressGzip, DecompressZstd, DecompressSnappy, DecompressAuto:
+		return v, nil
+	}
+	return ``, fmt.Errorf("Invalid Decompression %q, must be one of gzip, zstd, snappy, auto, or none", v)
+}
+
+// Decompressor transparently decompresses payloads. It is safe for
+// concurrent use.
+type Decompressor struct {
+	mode   string
+	zstd   *zstd.Decoder
+	failed int32
+}
+
+// NewDecompressor returns a Decompressor for a mode returned by
+// ParseDecompression.
+func NewDecompressor(mode string) (d *Decompressor, err error) {
+	if mode, err = ParseDecompression(mode); err != nil {
+		return
+	}
+	d = &Decompressor{mode: mode}
+	if mode == DecompressZstd || mode == DecompressAuto {
+		if d.zstd, err = zstd.NewReader(nil); err != nil {
+			d = nil
+		}
+	}
+	return
+}
+
+// Enabled returns true if the Decompressor does anything.
+func (d *Decompressor) Enabled() bool {
+	return d != nil && d.mode != DecompressNone
+}
+
+// Decompress returns the decompressed payload. In auto mode data that isn't
+// recognizably compressed is returned untouched. On failure the original data
+// is returned along with the error so that callers can pass it through.
+func (d *Decompressor) Decompress(b []byte) ([]byte, error) {
+	if !d.Enabled() {
+		return b, nil
+	}
+	mode := d.mode
+	if mode == DecompressAuto {
+		if mode = sniff(b); mode == DecompressNone {
+			return b, nil
+		}
+	}
+	out, err := d.decompress(mode, b)
+	if err != nil {
+		return b, err
+	}
+	return out, nil
+}
+
+// FirstFailure returns true the first time it is called, allowing callers to
+// log a decompression failure once rather than for every payload.
+func (d *Decompressor) FirstFailure() bool {
+	return atomic.CompareAndSwapInt32(&d.failed, 0, 1)
+}
+
+func (d *Decompressor) decompress(mode string, b []byte) ([]byte, error) {
+	switch mode {
+	case DecompressGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		return ioutil.ReadAll(gz)
+	case DecompressZstd:
+		return d.zstd.DecodeAll(b, nil)
+	case DecompressSnappy:
+		// producers use both the framed and the raw block formats
+		if bytes.HasPrefix(b, snappyStreamMagic) {
+			return ioutil.ReadAll(snappy.NewReader(bytes.NewReader(b)))
+		}
+		return snappy.Decode(nil, b)
+	}
+	return nil, ErrUnknownCompression
+}
+
+// sniff guesses the compression format from magic bytes. Raw snappy blocks
+// have no header and can't be detected.
+func sniff(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, gzipMagic):
+		return DecompressGzip
+	case bytes.HasPrefix(b, zstdMagic):
+		return DecompressZstd
+	case bytes.HasPrefix(b, snappyStreamMagic):
+		return DecompressSnappy
+	}
+	return DecompressNone
+}
@@ -0,0 +1,94 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+var testPayload = []byte(`{"ts":"2020-01-01T00:00:00Z","msg":"hello hello hello hello"}`)
+
+func compressed(t *testing.T) map[string][]byte {
+	var gzb bytes.Buffer
+	gz := gzip.NewWriter(&gzb)
+	gz.Write(testPayload)
+	gz.Close()
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snb bytes.Buffer
+	sw := snappy.NewBufferedWriter(&snb)
+	sw.Write(testPayload)
+	sw.Close()
+
+	return map[string][]byte{
+		DecompressGzip:   gzb.Bytes(),
+		DecompressZstd:   enc.EncodeAll(testPayload, nil),
+		DecompressSnappy: snb.Bytes(),
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	for mode, b := range compressed(t) {
+		for _, m := range []string{mode, DecompressAuto} {
+			d, err := NewDecompressor(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := d.Decompress(b)
+			if err != nil {
+				t.Fatalf("%s/%s: %v", mode, m, err)
+			}
+			if !bytes.Equal(out, testPayload) {
+				t.Fatalf("%s/%s: bad output %q", mode, m, out)
+			}
+		}
+	}
+
+	// raw snappy blocks only work when asked for explicitly
+	d, _ := NewDecompressor(DecompressSnappy)
+	if out, err := d.Decompress(snappy.Encode(nil, testPayload)); err != nil || !bytes.Equal(out, testPayload) {
+		t.Fatalf("bad snappy block decode: %v %q", err, out)
+	}
+}
+
+func TestDecompressPassthrough(t *testing.T) {
+	d, err := NewDecompressor(DecompressAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := d.Decompress(testPayload); err != nil || !bytes.Equal(out, testPayload) {
+		t.Fatalf("auto mode mangled plain data: %v %q", err, out)
+	}
+
+	// failures hand back the original data
+	if d, err = NewDecompressor(DecompressGzip); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := d.Decompress(testPayload); err == nil || !bytes.Equal(out, testPayload) {
+		t.Fatalf("bad failure handling: %v %q", err, out)
+	}
+	if !d.FirstFailure() || d.FirstFailure() {
+		t.Fatal("FirstFailure did not fire exactly once")
+	}
+
+	if d, err = NewDecompressor(``); err != nil || d.Enabled() {
+		t.Fatal("empty mode should disable decompression")
+	}
+	if _, err = NewDecompressor(`lzma`); err == nil {
+		t.Fatal("accepted unknown mode")
+	}
+}
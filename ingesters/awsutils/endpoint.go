@@ -0,0 +1,52 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Endpoint overrides the endpoint a service client talks to, e.g. a VPC
+// endpoint or a LocalStack instance. The zero value uses the default
+// endpoint for the client's region.
+type Endpoint struct {
+	URL        string
+	DisableSSL bool
+}
+
+// Validate checks that the endpoint URL is absolute.
+func (e Endpoint) Validate() error {
+	if e.URL == `` {
+		return nil
+	}
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return fmt.Errorf("Invalid Endpoint-URL %q: %v", e.URL, err)
+	}
+	if u.Scheme == `` || u.Host == `` {
+		return fmt.Errorf("Invalid Endpoint-URL %q, a scheme and host are required", e.URL)
+	}
+	return nil
+}
+
+// Config returns a client config applying the endpoint overrides, the region
+// is left to the caller so that the override can coexist with it.
+func (e Endpoint) Config() *aws.Config {
+	cfg := aws.NewConfig()
+	if e.URL != `` {
+		cfg = cfg.WithEndpoint(e.URL)
+	}
+	if e.DisableSSL {
+		cfg = cfg.WithDisableSSL(true)
+	}
+	return cfg
+}
@@ -0,0 +1,40 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestEndpoint(t *testing.T) {
+	var e Endpoint
+	if err := e.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := e.Config(); cfg.Endpoint != nil || cfg.DisableSSL != nil {
+		t.Fatal("empty endpoint overrode the defaults")
+	}
+
+	e = Endpoint{URL: `http://localhost:4566`, DisableSSL: true}
+	if err := e.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg := e.Config().WithRegion(`us-east-1`)
+	if aws.StringValue(cfg.Endpoint) != e.URL || !aws.BoolValue(cfg.DisableSSL) || aws.StringValue(cfg.Region) != `us-east-1` {
+		t.Fatalf("bad config: %v", cfg)
+	}
+
+	for _, u := range []string{`localhost:4566`, `kinesis.vpce.amazonaws.com`, `http://`} {
+		if err := (Endpoint{URL: u}).Validate(); err == nil {
+			t.Fatalf("accepted invalid URL %q", u)
+		}
+	}
+}
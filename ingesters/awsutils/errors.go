@@ -0,0 +1,56 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// RequestID returns the ID AWS gave the failed request behind err, which AWS
+// support needs to look into throttling or server errors. It is empty if err
+// did not come from an AWS response.
+func RequestID(err error) string {
+	for err != nil {
+		if rf, ok := err.(awserr.RequestFailure); ok && rf.RequestID() != `` {
+			return rf.RequestID()
+		}
+		aerr, ok := err.(awserr.Error)
+		if !ok {
+			break
+		}
+		err = aerr.OrigErr()
+	}
+	return ``
+}
+
+// ErrorMessage formats err for a log line. AWS errors get their code, HTTP
+// status, and request ID on a single line rather than the several lines the
+// SDK uses, other errors are returned as is.
+func ErrorMessage(err error) string {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		if err == nil {
+			return ``
+		}
+		return err.Error()
+	}
+	msg := aerr.Code()
+	if aerr.Message() != `` {
+		msg += `: ` + aerr.Message()
+	}
+	if rf, ok := err.(awserr.RequestFailure); ok {
+		msg += fmt.Sprintf(" (status code %d, request ID %s)", rf.StatusCode(), rf.RequestID())
+	}
+	if orig := aerr.OrigErr(); orig != nil {
+		msg += `, caused by: ` + ErrorMessage(orig)
+	}
+	return msg
+}
@@ -0,0 +1,43 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestErrorMessage(t *testing.T) {
+	throttled := awserr.NewRequestFailure(awserr.New(`ThrottlingException`, `Rate exceeded`, nil), 400, `5f9e2c1a-0b7d-4c3e-9a61-2d8f4e7b1c90`)
+	if id := RequestID(throttled); id != `5f9e2c1a-0b7d-4c3e-9a61-2d8f4e7b1c90` {
+		t.Fatalf("bad request ID %q", id)
+	}
+	if msg := ErrorMessage(throttled); msg != `ThrottlingException: Rate exceeded (status code 400, request ID 5f9e2c1a-0b7d-4c3e-9a61-2d8f4e7b1c90)` {
+		t.Fatalf("bad message %q", msg)
+	}
+
+	// the request ID of a failure wrapped by the SDK is still found
+	wrapped := awserr.New(`SerializationError`, `failed to decode response`, throttled)
+	if id := RequestID(wrapped); id != `5f9e2c1a-0b7d-4c3e-9a61-2d8f4e7b1c90` {
+		t.Fatalf("bad wrapped request ID %q", id)
+	}
+	if msg := ErrorMessage(wrapped); msg != `SerializationError: failed to decode response, caused by: ThrottlingException: Rate exceeded (status code 400, request ID 5f9e2c1a-0b7d-4c3e-9a61-2d8f4e7b1c90)` {
+		t.Fatalf("bad wrapped message %q", msg)
+	}
+
+	plain := errors.New(`connection refused`)
+	if RequestID(plain) != `` || ErrorMessage(plain) != `connection refused` {
+		t.Fatal("bad handling of a plain error")
+	}
+	if RequestID(awserr.New(`RequestCanceled`, `request context canceled`, plain)) != `` || ErrorMessage(nil) != `` {
+		t.Fatal("request ID for an error without a response")
+	}
+}
@@ -0,0 +1,72 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultHealthProgressWindow is how long an ingester may go without a
+// successful read before it is reported as not ready.
+const DefaultHealthProgressWindow = 5 * time.Minute
+
+// ProgressTracker records the last time an ingester successfully read from
+// its source. It is safe for concurrent use and a nil tracker does nothing.
+type ProgressTracker struct {
+	last int64 // unix nanoseconds
+}
+
+// NewProgressTracker returns a tracker which considers the ingester to have
+// made progress when it was created, giving it a grace period to start up.
+func NewProgressTracker() *ProgressTracker {
+	pt := &ProgressTracker{}
+	pt.Mark()
+	return pt
+}
+
+// Mark records progress.
+func (pt *ProgressTracker) Mark() {
+	if pt != nil {
+		atomic.StoreInt64(&pt.last, time.Now().UnixNano())
+	}
+}
+
+// Since returns how long it has been since progress was last recorded.
+func (pt *ProgressTracker) Since() time.Duration {
+	if pt == nil {
+		return 0
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&pt.last)))
+}
+
+// NewHealthHandler returns a handler for orchestrator probes. /healthz always
+// succeeds while the process is serving requests. /readyz succeeds only if
+// hot reports a connection to at least one indexer, ingest isn't paused, and
+// the progress tracker was marked within the window.
+func NewHealthHandler(hot func() bool, progress *ProgressTracker, pause *Pauser, window time.Duration) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(`/healthz`, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `ok`)
+	})
+	mux.HandleFunc(`/readyz`, func(w http.ResponseWriter, r *http.Request) {
+		if !hot() {
+			http.Error(w, `no indexer connections`, http.StatusServiceUnavailable)
+		} else if pause.Paused() {
+			http.Error(w, `ingest is paused`, http.StatusServiceUnavailable)
+		} else if el := progress.Since(); el > window {
+			http.Error(w, fmt.Sprintf("no successful reads in %v", el.Round(time.Second)), http.StatusServiceUnavailable)
+		} else {
+			fmt.Fprintln(w, `ok`)
+		}
+	})
+	return mux
+}
@@ -0,0 +1,58 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func probe(h http.Handler, path string) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w.Code
+}
+
+func TestHealthHandler(t *testing.T) {
+	hot := false
+	pt := NewProgressTracker()
+	pause := NewPauser(``, nil, `test`, t.Logf)
+	h := NewHealthHandler(func() bool { return hot }, pt, pause, time.Minute)
+
+	if c := probe(h, `/healthz`); c != http.StatusOK {
+		t.Fatalf("bad liveness status: %d", c)
+	}
+	if c := probe(h, `/readyz`); c != http.StatusServiceUnavailable {
+		t.Fatalf("ready without indexer connections: %d", c)
+	}
+	hot = true
+	if c := probe(h, `/readyz`); c != http.StatusOK {
+		t.Fatalf("not ready: %d", c)
+	}
+	// no progress for longer than the window
+	atomic.StoreInt64(&pt.last, time.Now().Add(-2*time.Minute).UnixNano())
+	if c := probe(h, `/readyz`); c != http.StatusServiceUnavailable {
+		t.Fatalf("ready without progress: %d", c)
+	}
+	pt.Mark()
+	if c := probe(h, `/readyz`); c != http.StatusOK {
+		t.Fatalf("not ready after progress: %d", c)
+	}
+	pause.Pause(`test`)
+	if c := probe(h, `/readyz`); c != http.StatusServiceUnavailable {
+		t.Fatalf("ready while paused: %d", c)
+	}
+	pause.Resume(`test`)
+	if c := probe(h, `/readyz`); c != http.StatusOK {
+		t.Fatalf("not ready after resuming: %d", c)
+	}
+}
@@ -0,0 +1,78 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/gravwell/gravwell/v3/timegrinder"
+)
+
+// JSONTimestamp takes the timestamp of JSON payloads from a single field
+// rather than the first timestamp TimeGrinder finds in the whole payload.
+type JSONTimestamp struct {
+	path string
+	keys []string
+}
+
+// NewJSONTimestamp returns an extractor for the field at a dotted path such
+// as event.time, array elements may be addressed as [0]. An empty path
+// returns nil.
+func NewJSONTimestamp(path string) (*JSONTimestamp, error) {
+	if path == `` {
+		return nil, nil
+	}
+	keys := strings.Split(path, `.`)
+	for _, k := range keys {
+		if k == `` {
+			return nil, fmt.Errorf("Invalid JSON path %q, it has an empty field name", path)
+		}
+	}
+	return &JSONTimestamp{path: path, keys: keys}, nil
+}
+
+// Path returns the dotted path of the timestamp field.
+func (jt *JSONTimestamp) Path() string {
+	if jt == nil {
+		return ``
+	}
+	return jt.path
+}
+
+// Extract parses the timestamp field of data with tg, so that any format
+// override applies. It returns false if data is not JSON, the field is
+// missing, or its value is not a timestamp, leaving the caller to fall back
+// to scanning the whole payload. A nil JSONTimestamp never finds anything.
+func (jt *JSONTimestamp) Extract(tg *timegrinder.TimeGrinder, data []byte) (t time.Time, ok bool) {
+	if jt == nil || tg == nil {
+		return
+	}
+	v, dt, _, err := jsonparser.Get(data, jt.keys...)
+	if err != nil {
+		return
+	}
+	switch dt {
+	case jsonparser.String:
+		s, err := jsonparser.ParseString(v)
+		if err != nil {
+			return
+		}
+		v = []byte(s)
+	case jsonparser.Number:
+	default:
+		return
+	}
+	if t, ok, err = tg.Extract(v); err != nil {
+		ok = false
+	}
+	return
+}
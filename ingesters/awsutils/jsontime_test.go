@@ -0,0 +1,60 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/timegrinder"
+)
+
+func TestJSONTimestamp(t *testing.T) {
+	if jt, err := NewJSONTimestamp(``); jt != nil || err != nil {
+		t.Fatal("empty path did not disable the extractor")
+	}
+	if _, err := NewJSONTimestamp(`event..time`); err == nil {
+		t.Fatal("accepted an empty field name")
+	}
+	tg, err := timegrinder.NewTimeGrinder(timegrinder.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jt, err := NewJSONTimestamp(`event.time`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC)
+	// the earlier timestamp is what scanning the whole payload would find
+	if ts, ok := jt.Extract(tg, []byte(`{"received":"2019-01-01T00:00:00Z","event":{"time":"2020-05-06T07:08:09Z"}}`)); !ok || !ts.Equal(want) {
+		t.Fatalf("bad timestamp %v %v", ts, ok)
+	}
+	if ts, ok := jt.Extract(tg, []byte(`{"event":{"time":1588748889}}`)); !ok || !ts.Equal(want) {
+		t.Fatalf("bad epoch timestamp %v %v", ts, ok)
+	}
+	for _, bad := range []string{
+		`not json 2020-05-06T07:08:09Z`,
+		`{"event":{"when":"2020-05-06T07:08:09Z"}}`,
+		`{"event":{"time":"soon"}}`,
+		`{"event":{"time":{"nested":"2020-05-06T07:08:09Z"}}}`,
+	} {
+		if ts, ok := jt.Extract(tg, []byte(bad)); ok {
+			t.Fatalf("found %v in %s", ts, bad)
+		}
+	}
+
+	jt, _ = NewJSONTimestamp(`records.[1].ts`)
+	if ts, ok := jt.Extract(tg, []byte(`{"records":[{"ts":"2019-01-01T00:00:00Z"},{"ts":"2020-05-06T07:08:09Z"}]}`)); !ok || !ts.Equal(want) {
+		t.Fatalf("bad array element timestamp %v %v", ts, ok)
+	}
+	var nj *JSONTimestamp
+	if _, ok := nj.Extract(tg, []byte(`{"time":"2020-05-06T07:08:09Z"}`)); ok {
+		t.Fatal("nil extractor found a timestamp")
+	}
+}
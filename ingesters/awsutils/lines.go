@@ -0,0 +1,64 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"bytes"
+	"strconv"
+)
+
+const DefaultLineDelimiter = "\n"
+
+// LineSplitter breaks a payload holding many delimited lines, such as a batch
+// of log lines from an agent, into the individual lines. A nil LineSplitter
+// does not split.
+type LineSplitter struct {
+	delim []byte
+}
+
+// NewLineSplitter returns a splitter for a Line-Delimiter option, escape
+// sequences such as \r\n or \x00 are accepted. An empty delimiter means a
+// newline. It returns nil if splitting is not enabled.
+func NewLineSplitter(enabled bool, delim string) *LineSplitter {
+	if !enabled {
+		return nil
+	}
+	if delim == `` {
+		delim = DefaultLineDelimiter
+	} else if s, err := strconv.Unquote(`"` + delim + `"`); err == nil && s != `` {
+		delim = s
+	}
+	return &LineSplitter{delim: []byte(delim)}
+}
+
+// Split returns the non-empty lines of data, a trailing line without a
+// delimiter is included. Carriage returns ending newline delimited lines are
+// dropped. The lines share the memory of data. A nil splitter returns data as
+// the only line.
+func (ls *LineSplitter) Split(data []byte) (lines [][]byte) {
+	if ls == nil {
+		return [][]byte{data}
+	}
+	trimCR := bytes.Equal(ls.delim, []byte("\n"))
+	for len(data) > 0 {
+		line := data
+		if i := bytes.Index(data, ls.delim); i >= 0 {
+			line, data = data[:i], data[i+len(ls.delim):]
+		} else {
+			data = nil
+		}
+		if trimCR {
+			line = bytes.TrimRight(line, "\r")
+		}
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return
+}
@@ -0,0 +1,46 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLineSplitter(t *testing.T) {
+	if ls := NewLineSplitter(false, ``); ls != nil {
+		t.Fatal("disabled splitter is not nil")
+	}
+	var nls *LineSplitter
+	if lines := nls.Split([]byte("a\nb")); len(lines) != 1 || string(lines[0]) != "a\nb" {
+		t.Fatalf("nil splitter split: %q", lines)
+	}
+
+	tests := []struct {
+		delim string
+		data  string
+		lines []string
+	}{
+		{``, "a\nb\n", []string{`a`, `b`}},
+		{``, "a\r\n\n\nb", []string{`a`, `b`}}, // blank lines and a trailing partial line
+		{``, "\n\n", nil},
+		{`\x00`, "a\x00b\x00", []string{`a`, `b`}},
+		{`\r\n`, "a\r\nb\nc", []string{`a`, "b\nc"}},
+		{`||`, "a||b|c", []string{`a`, `b|c`}},
+	}
+	for _, tc := range tests {
+		var got []string
+		for _, l := range NewLineSplitter(true, tc.delim).Split([]byte(tc.data)) {
+			got = append(got, string(l))
+		}
+		if !reflect.DeepEqual(got, tc.lines) {
+			t.Fatalf("%q split on %q: %q != %q", tc.data, tc.delim, got, tc.lines)
+		}
+	}
+}
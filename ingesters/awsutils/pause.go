@@ -0,0 +1,134 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// pauseFilePollInterval is how often a Pauser checks for its pause file.
+const pauseFilePollInterval = time.Second
+
+// Pauser lets operators pause ingest for maintenance without stopping the
+// ingester, which would drop its indexer connections. SIGTSTP pauses and
+// SIGCONT resumes, as does creating and removing the pause file if there is
+// one, only the pause file works on Windows. Workers check Resumed before reading from their source and leave their
+// position untouched while paused. It is safe for concurrent use and a nil
+// Pauser is never paused.
+type Pauser struct {
+	file    string
+	logf    func(format string, args ...interface{})
+	gauge   *PromValue
+	mtx     sync.Mutex
+	resumed chan struct{} // nil unless paused, closed on resume
+	since   time.Time
+}
+
+// NewPauser creates a Pauser controlled by signals and, if file isn't empty,
+// by the existence of the file. Its gauge is registered with reg under the
+// prefix, e.g. sqs, a nil reg exports nothing. Pauses and resumes are passed
+// to logf.
+func NewPauser(file string, reg *PromRegistry, prefix string, logf func(format string, args ...interface{})) *Pauser {
+	p := &Pauser{file: file, logf: logf}
+	if reg != nil {
+		p.gauge = reg.Gauge(prefix+`_paused`, `1 while ingest is paused by signal or pause file.`).With()
+	}
+	return p
+}
+
+// Pause stops ingest until Resume is called, reason is logged.
+func (p *Pauser) Pause(reason string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.resumed != nil {
+		return
+	}
+	p.resumed = make(chan struct{})
+	p.since = time.Now()
+	p.gauge.Set(1)
+	p.logf("Ingest paused by %s", reason)
+}
+
+// Resume restarts ingest after a Pause, reason is logged.
+func (p *Pauser) Resume(reason string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.resumed == nil {
+		return
+	}
+	close(p.resumed)
+	p.resumed = nil
+	p.gauge.Set(0)
+	p.logf("Ingest resumed by %s after %v", reason, time.Since(p.since).Round(time.Second))
+}
+
+// Paused returns true while ingest is paused.
+func (p *Pauser) Paused() bool {
+	return p.Resumed() != nil
+}
+
+// Resumed returns a channel which is closed when ingest resumes, or nil if
+// ingest isn't paused.
+func (p *Pauser) Resumed() <-chan struct{} {
+	if p == nil {
+		return nil
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.resumed
+}
+
+// Run handles the pause and resume signals and watches the pause file until
+// ctx is cancelled. A pause file which exists at startup pauses ingest right
+// away.
+func (p *Pauser) Run(ctx context.Context) {
+	sigs := make(chan os.Signal, 1)
+	notifyPause(sigs)
+	defer signal.Stop(sigs)
+	var poll <-chan time.Time
+	var fileSeen bool
+	if p.file != `` {
+		tckr := time.NewTicker(pauseFilePollInterval)
+		defer tckr.Stop()
+		poll = tckr.C
+		fileSeen = p.checkFile(false)
+	}
+	for {
+		select {
+		case sig := <-sigs:
+			if isPauseSignal(sig) {
+				p.Pause(`SIGTSTP`)
+			} else {
+				p.Resume(`SIGCONT`)
+			}
+		case <-poll:
+			fileSeen = p.checkFile(fileSeen)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkFile pauses or resumes when the pause file appears or goes away, so
+// that signals still work while the file is left alone. It returns whether
+// the file exists.
+func (p *Pauser) checkFile(seen bool) bool {
+	_, err := os.Stat(p.file)
+	exists := err == nil
+	if exists && !seen {
+		p.Pause(`pause file ` + p.file)
+	} else if !exists && seen {
+		p.Resume(`removal of pause file ` + p.file)
+	}
+	return exists
+}
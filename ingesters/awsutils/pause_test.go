@@ -0,0 +1,87 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPauser(t *testing.T) {
+	var nilPauser *Pauser
+	if nilPauser.Paused() || nilPauser.Resumed() != nil {
+		t.Fatal("a nil Pauser is paused")
+	}
+
+	reg := NewPromRegistry()
+	p := NewPauser(``, reg, `test`, t.Logf)
+	gauge := p.gauge
+	if p.Paused() || gauge == nil {
+		t.Fatal("paused on creation")
+	}
+	p.Pause(`test`)
+	resumed := p.Resumed()
+	if !p.Paused() || resumed == nil || gauge.Value() != 1 {
+		t.Fatal("not paused")
+	}
+	// pausing twice keeps waiters on the same channel
+	p.Pause(`test`)
+	if p.Resumed() != resumed {
+		t.Fatal("a second pause replaced the resume channel")
+	}
+	select {
+	case <-resumed:
+		t.Fatal("resumed while paused")
+	default:
+	}
+	p.Resume(`test`)
+	select {
+	case <-resumed:
+	default:
+		t.Fatal("resume channel wasn't closed")
+	}
+	if p.Paused() || gauge.Value() != 0 {
+		t.Fatal("still paused after resuming")
+	}
+	p.Resume(`test`)
+}
+
+func TestPauserFile(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `pause`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, `pause`)
+	p := NewPauser(file, nil, `test`, t.Logf)
+
+	if seen := p.checkFile(false); seen || p.Paused() {
+		t.Fatal("paused without a pause file")
+	}
+	if err = ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if seen := p.checkFile(false); !seen || !p.Paused() {
+		t.Fatal("not paused by the pause file")
+	}
+	// a resume signal wins until the file is removed and created again
+	p.Resume(`test`)
+	if p.checkFile(true); p.Paused() {
+		t.Fatal("paused again by a file which was already there")
+	}
+	p.Pause(`test`)
+	if err = os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if seen := p.checkFile(true); seen || p.Paused() {
+		t.Fatal("not resumed by removing the pause file")
+	}
+}
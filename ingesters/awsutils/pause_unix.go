@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyPause relays the pause and resume signals to c.
+func notifyPause(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGTSTP, syscall.SIGCONT)
+}
+
+// isPauseSignal returns true for SIGTSTP, anything else relayed by
+// notifyPause resumes.
+func isPauseSignal(sig os.Signal) bool {
+	return sig == syscall.SIGTSTP
+}
@@ -0,0 +1,25 @@
+//go:build windows
+// +build windows
+
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"os"
+)
+
+// notifyPause does nothing, Windows has no SIGTSTP or SIGCONT so ingest can
+// only be paused with the pause file.
+func notifyPause(c chan<- os.Signal) {}
+
+// isPauseSignal is never called as no signals are relayed.
+func isPauseSignal(sig os.Signal) bool {
+	return false
+}
@@ -0,0 +1,93 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPayloadLogSize = 256
+
+	payloadLogBurst    = 10              // payloads logged back to back before limiting
+	payloadLogInterval = 6 * time.Second // one more payload may be logged after each interval
+)
+
+// PayloadLogger logs an escaped excerpt of payloads which failed processing,
+// so that operators can see what malformed data looks like. At most
+// payloadLogBurst payloads are logged at once and then one per
+// payloadLogInterval, the count of payloads skipped meanwhile is added to the
+// next message. A PayloadLogger is safe for concurrent use and a nil
+// PayloadLogger logs nothing.
+type PayloadLogger struct {
+	sync.Mutex
+	size    int
+	logf    func(format string, args ...interface{}) error
+	tokens  float64
+	last    time.Time
+	skipped uint64
+}
+
+// NewPayloadLogger returns a logger writing the first size bytes of payloads
+// with logf, such as the Warn method of a logger. A size of zero uses
+// DefaultPayloadLogSize.
+func NewPayloadLogger(size int, logf func(format string, args ...interface{}) error) *PayloadLogger {
+	if size <= 0 {
+		size = DefaultPayloadLogSize
+	}
+	return &PayloadLogger{
+		size:   size,
+		logf:   logf,
+		tokens: payloadLogBurst,
+		last:   time.Now(),
+	}
+}
+
+// Log logs the message described by format and args followed by an excerpt of
+// data, unless too many payloads have been logged recently. It returns true if
+// the payload was logged.
+func (pl *PayloadLogger) Log(data []byte, format string, args ...interface{}) bool {
+	if pl == nil {
+		return false
+	}
+	pl.Lock()
+	now := time.Now()
+	pl.tokens += float64(now.Sub(pl.last)) / float64(payloadLogInterval)
+	if pl.tokens > payloadLogBurst {
+		pl.tokens = payloadLogBurst
+	}
+	pl.last = now
+	if pl.tokens < 1 {
+		pl.skipped++
+		pl.Unlock()
+		return false
+	}
+	pl.tokens--
+	skipped := pl.skipped
+	pl.skipped = 0
+	pl.Unlock()
+
+	msg := fmt.Sprintf(format, args...) + `, payload ` + pl.excerpt(data)
+	if skipped > 0 {
+		msg += fmt.Sprintf(", %d more payloads were not logged", skipped)
+	}
+	pl.logf("%s", msg)
+	return true
+}
+
+// excerpt quotes the start of data, escaping anything which isn't printable.
+func (pl *PayloadLogger) excerpt(data []byte) string {
+	if len(data) <= pl.size {
+		return strconv.Quote(string(data))
+	}
+	return fmt.Sprintf("%s (first %d of %d bytes)", strconv.Quote(string(data[:pl.size])), pl.size, len(data))
+}
@@ -0,0 +1,54 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPayloadLogger(t *testing.T) {
+	var lines []string
+	pl := NewPayloadLogger(8, func(format string, args ...interface{}) error {
+		lines = append(lines, fmt.Sprintf(format, args...))
+		return nil
+	})
+	if !pl.Log([]byte("bad\x00\nline and more"), "Failed on queue %s", `q`) {
+		t.Fatal("first payload was not logged")
+	}
+	if want := `Failed on queue q, payload "bad\x00\nlin" (first 8 of 18 bytes)`; lines[0] != want {
+		t.Fatalf("bad log line %q, expected %q", lines[0], want)
+	}
+
+	// a flood is cut off after the burst
+	for i := 1; i < 100; i++ {
+		pl.Log([]byte(`short`), "Failed")
+	}
+	if len(lines) != payloadLogBurst {
+		t.Fatalf("logged %d payloads of a flood, expected %d", len(lines), payloadLogBurst)
+	}
+	if lines[1] != `Failed, payload "short"` {
+		t.Fatalf("bad log line %q", lines[1])
+	}
+
+	// once the limit recovers the skipped payloads are mentioned
+	pl.last = pl.last.Add(-payloadLogInterval)
+	if !pl.Log([]byte(`x`), "Failed") {
+		t.Fatal("payload not logged after the interval")
+	}
+	if last := lines[len(lines)-1]; !strings.HasSuffix(last, `, 90 more payloads were not logged`) {
+		t.Fatalf("skipped payloads not counted: %q", last)
+	}
+
+	var nilLogger *PayloadLogger
+	if nilLogger.Log([]byte(`x`), "Failed") {
+		t.Fatal("nil logger logged")
+	}
+}
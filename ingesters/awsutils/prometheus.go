@@ -0,0 +1,199 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	promCounter = `counter`
+	promGauge   = `gauge`
+
+	promContentType = `text/plain; version=0.0.4; charset=utf-8`
+	promLabelSep    = "\xff"
+)
+
+var (
+	promHelpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// PromRegistry holds a set of metrics and serves them in the Prometheus text
+// exposition format. Only the counters and gauges needed by the ingesters are
+// supported.
+type PromRegistry struct {
+	sync.Mutex
+	families []*PromVec
+}
+
+// PromVec is a family of metrics sharing a name and label names, each set of
+// label values has its own value.
+type PromVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	typ    string
+	labels []string
+	values map[string]*PromValue
+}
+
+// PromValue is a single metric value, safe for concurrent use.
+type PromValue struct {
+	bits   uint64 // first for 64-bit alignment of atomic operations
+	labels []string
+}
+
+func NewPromRegistry() *PromRegistry {
+	return &PromRegistry{}
+}
+
+// Counter registers a family of monotonically increasing values.
+func (r *PromRegistry) Counter(name, help string, labels ...string) *PromVec {
+	return r.register(name, help, promCounter, labels)
+}
+
+// Gauge registers a family of values which may go up and down.
+func (r *PromRegistry) Gauge(name, help string, labels ...string) *PromVec {
+	return r.register(name, help, promGauge, labels)
+}
+
+func (r *PromRegistry) register(name, help, typ string, labels []string) *PromVec {
+	pv := &PromVec{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		values: make(map[string]*PromValue),
+	}
+	r.Lock()
+	r.families = append(r.families, pv)
+	r.Unlock()
+	return pv
+}
+
+// With returns the value for a set of label values, creating it if needed.
+// The label values must be given in the order the labels were registered.
+func (pv *PromVec) With(values ...string) *PromValue {
+	if len(values) != len(pv.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", pv.name, len(pv.labels), len(values)))
+	}
+	key := strings.Join(values, promLabelSep)
+	pv.Lock()
+	defer pv.Unlock()
+	v, ok := pv.values[key]
+	if !ok {
+		v = &PromValue{labels: values}
+		pv.values[key] = v
+	}
+	return v
+}
+
+// Delete drops the value for a set of label values, e.g. when a shard closes.
+func (pv *PromVec) Delete(values ...string) {
+	pv.Lock()
+	delete(pv.values, strings.Join(values, promLabelSep))
+	pv.Unlock()
+}
+
+// Add adds delta to the value, which is a no-op on a nil value.
+func (v *PromValue) Add(delta float64) {
+	if v == nil {
+		return
+	}
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		nv := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, nv) {
+			return
+		}
+	}
+}
+
+// Inc adds one to the value.
+func (v *PromValue) Inc() {
+	v.Add(1)
+}
+
+// Set replaces the value, which is a no-op on a nil value.
+func (v *PromValue) Set(val float64) {
+	if v == nil {
+		return
+	}
+	atomic.StoreUint64(&v.bits, math.Float64bits(val))
+}
+
+// Value returns the current value.
+func (v *PromValue) Value() float64 {
+	if v == nil {
+		return 0
+	}
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// ServeHTTP writes every registered metric in the text exposition format.
+func (r *PromRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set(`Content-Type`, promContentType)
+	bw := bufio.NewWriter(w)
+	r.Lock()
+	families := append([]*PromVec(nil), r.families...)
+	r.Unlock()
+	for _, pv := range families {
+		pv.write(bw)
+	}
+	bw.Flush()
+}
+
+func (pv *PromVec) write(w *bufio.Writer) {
+	pv.Lock()
+	keys := make([]string, 0, len(pv.values))
+	for k := range pv.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	vals := make([]*PromValue, 0, len(keys))
+	for _, k := range keys {
+		vals = append(vals, pv.values[k])
+	}
+	pv.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", pv.name, promHelpEscaper.Replace(pv.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", pv.name, pv.typ)
+	for _, v := range vals {
+		w.WriteString(pv.name)
+		if len(pv.labels) > 0 {
+			w.WriteByte('{')
+			for i, l := range pv.labels {
+				if i > 0 {
+					w.WriteByte(',')
+				}
+				fmt.Fprintf(w, "%s=\"%s\"", l, promLabelEscaper.Replace(v.labels[i]))
+			}
+			w.WriteByte('}')
+		}
+		w.WriteByte(' ')
+		w.WriteString(strconv.FormatFloat(v.Value(), 'g', -1, 64))
+		w.WriteByte('\n')
+	}
+}
+
+// ServeProm starts an HTTP server exposing the registry on /metrics.
+func ServeProm(addr string, r *PromRegistry) (*HTTPServer, error) {
+	mux := http.NewServeMux()
+	mux.Handle(`/metrics`, r)
+	return ListenAndServe(addr, mux)
+}
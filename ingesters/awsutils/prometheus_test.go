@@ -0,0 +1,64 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPromExposition(t *testing.T) {
+	r := NewPromRegistry()
+	c := r.Counter(`test_records_total`, "Records read.", `stream`, `shard`)
+	g := r.Gauge(`test_inflight`, "Messages in flight.")
+	c.With(`b`, `shard-1`).Add(3)
+	c.With(`a`, `sh"ard`).Inc()
+	c.With(`a`, `sh"ard`).Inc()
+	g.With().Set(1.5)
+	c.With(`gone`, `x`).Inc()
+	c.Delete(`gone`, `x`)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+	b, _ := ioutil.ReadAll(w.Result().Body)
+	exp := `# HELP test_records_total Records read.
+# TYPE test_records_total counter
+test_records_total{stream="a",shard="sh\"ard"} 2
+test_records_total{stream="b",shard="shard-1"} 3
+# HELP test_inflight Messages in flight.
+# TYPE test_inflight gauge
+test_inflight 1.5
+`
+	if string(b) != exp {
+		t.Fatalf("bad exposition:\n%s\nexpected:\n%s", b, exp)
+	}
+}
+
+func TestPromNilValue(t *testing.T) {
+	var v *PromValue
+	v.Inc()
+	v.Set(4)
+	if v.Value() != 0 {
+		t.Fatal("nil value is not zero")
+	}
+}
+
+func TestServeProm(t *testing.T) {
+	r := NewPromRegistry()
+	r.Gauge(`up`, `Up.`).With().Set(1)
+	ps, err := ServeProm(`127.0.0.1:0`, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
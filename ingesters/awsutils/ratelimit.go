@@ -0,0 +1,76 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting a consumer to a number of bytes per
+// second, with a burst of one second's worth. Consumers may overdraw the
+// bucket and then wait out the debt, so a single large write never blocks
+// forever. A RateLimiter is safe for concurrent use and a nil RateLimiter
+// never limits.
+type RateLimiter struct {
+	sync.Mutex
+	bps    float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing bps bytes per second, a bps of
+// zero or less disables limiting and returns nil.
+func NewRateLimiter(bps int64) *RateLimiter {
+	if bps <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		bps:    float64(bps),
+		tokens: float64(bps),
+		last:   time.Now(),
+	}
+}
+
+// Reserve takes n bytes from the bucket and returns how long the caller must
+// wait before using them.
+func (rl *RateLimiter) Reserve(n int) time.Duration {
+	if rl == nil {
+		return 0
+	}
+	rl.Lock()
+	defer rl.Unlock()
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.bps
+	if rl.tokens > rl.bps {
+		rl.tokens = rl.bps
+	}
+	rl.last = now
+	rl.tokens -= float64(n)
+	if rl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.tokens / rl.bps * float64(time.Second))
+}
+
+// Wait takes n bytes from the bucket, sleeping until they are available or
+// done is closed. It returns true if the caller was throttled.
+func (rl *RateLimiter) Wait(n int, done <-chan bool) bool {
+	d := rl.Reserve(n)
+	if d <= 0 {
+		return false
+	}
+	tmr := time.NewTimer(d)
+	defer tmr.Stop()
+	select {
+	case <-tmr.C:
+	case <-done:
+	}
+	return true
+}
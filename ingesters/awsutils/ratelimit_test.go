@@ -0,0 +1,44 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if rl := NewRateLimiter(0); rl != nil {
+		t.Fatal("zero rate did not disable the limiter")
+	}
+	var nrl *RateLimiter
+	if nrl.Reserve(1<<30) != 0 || nrl.Wait(1<<30, nil) {
+		t.Fatal("nil limiter throttled")
+	}
+
+	rl := NewRateLimiter(1000)
+	// the initial burst is free
+	if d := rl.Reserve(1000); d != 0 {
+		t.Fatalf("throttled within the burst: %v", d)
+	}
+	// overdrawing by half a second of data costs about half a second
+	if d := rl.Reserve(500); d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatalf("bad delay for the overdraft: %v", d)
+	}
+
+	done := make(chan bool)
+	close(done)
+	start := time.Now()
+	if !rl.Wait(1000, done) {
+		t.Fatal("not throttled while in debt")
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatal("closing done did not cut the wait short")
+	}
+}
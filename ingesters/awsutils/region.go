@@ -0,0 +1,91 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const (
+	RegionSourceConfig   = `configuration`
+	RegionSourceMetadata = `EC2 instance metadata`
+	RegionSourceEnv      = `environment`
+
+	// keeps startup quick when we are not running on EC2
+	metadataTimeout = time.Second
+)
+
+var (
+	ErrNoRegion = errors.New("No Region is configured and none could be found in the EC2 instance metadata, AWS_REGION, or AWS_DEFAULT_REGION")
+
+	detected struct {
+		sync.Mutex
+		done   bool
+		region string
+		source string
+	}
+)
+
+// ResolveRegion returns region if it is set, otherwise the region detected by
+// DetectRegion. The source describes where the region came from, for logging.
+func ResolveRegion(region string) (string, string, error) {
+	if region != `` {
+		return region, RegionSourceConfig, nil
+	}
+	return DetectRegion()
+}
+
+// DetectRegion finds the region of the EC2 instance we are running on using
+// the instance metadata service, falling back to the AWS_REGION and
+// AWS_DEFAULT_REGION environment variables. The IMDSv2 session token flow is
+// used so that it works on instances which require it. The result is cached,
+// the metadata service is only asked once.
+func DetectRegion() (string, string, error) {
+	detected.Lock()
+	defer detected.Unlock()
+	if !detected.done {
+		detected.region, detected.source = detectRegion(``)
+		detected.done = true
+	}
+	if detected.region == `` {
+		return ``, ``, ErrNoRegion
+	}
+	return detected.region, detected.source, nil
+}
+
+// detectRegion asks the metadata service at endpoint, the default one if
+// empty, and then the environment for a region. The endpoint includes the API
+// version path, e.g. http://169.254.169.254/latest.
+func detectRegion(endpoint string) (region, source string) {
+	cfg := aws.NewConfig().
+		WithHTTPClient(&http.Client{Timeout: metadataTimeout}).
+		WithMaxRetries(0)
+	if endpoint != `` {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+	if sess, err := session.NewSession(cfg); err == nil {
+		if region, err = ec2metadata.New(sess).Region(); err == nil && region != `` {
+			return region, RegionSourceMetadata
+		}
+	}
+	for _, v := range []string{`AWS_REGION`, `AWS_DEFAULT_REGION`} {
+		if region = os.Getenv(v); region != `` {
+			return region, RegionSourceEnv
+		}
+	}
+	return ``, ``
+}
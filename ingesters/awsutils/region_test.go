@@ -0,0 +1,66 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// testIMDS behaves like an instance metadata service which requires IMDSv2
+// session tokens.
+func testIMDS(t *testing.T) *httptest.Server {
+	const token = `secret-token`
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == `/latest/api/token`:
+			w.Header().Set(`X-Aws-Ec2-Metadata-Token-Ttl-Seconds`, r.Header.Get(`X-Aws-Ec2-Metadata-Token-Ttl-Seconds`))
+			w.Write([]byte(token))
+		case r.Header.Get(`X-Aws-Ec2-Metadata-Token`) != token:
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == `/latest/dynamic/instance-identity/document`:
+			w.Write([]byte(`{"region": "eu-west-3", "instanceId": "i-0123456789abcdef0"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestDetectRegion(t *testing.T) {
+	defer os.Setenv(`AWS_REGION`, os.Getenv(`AWS_REGION`))
+	defer os.Setenv(`AWS_DEFAULT_REGION`, os.Getenv(`AWS_DEFAULT_REGION`))
+	os.Setenv(`AWS_REGION`, ``)
+	os.Setenv(`AWS_DEFAULT_REGION`, `ap-south-1`)
+
+	srv := testIMDS(t)
+	if r, src := detectRegion(srv.URL + `/latest`); r != `eu-west-3` || src != RegionSourceMetadata {
+		t.Fatalf("bad region from the metadata service: %q %q", r, src)
+	}
+	srv.Close()
+
+	// off EC2 we fall back to the environment
+	if r, src := detectRegion(srv.URL + `/latest`); r != `ap-south-1` || src != RegionSourceEnv {
+		t.Fatalf("bad region from the environment: %q %q", r, src)
+	}
+	os.Setenv(`AWS_REGION`, `us-west-1`)
+	if r, _ := detectRegion(srv.URL + `/latest`); r != `us-west-1` {
+		t.Fatalf("AWS_REGION did not take precedence: %q", r)
+	}
+	os.Setenv(`AWS_REGION`, ``)
+	os.Setenv(`AWS_DEFAULT_REGION`, ``)
+	if r, _ := detectRegion(srv.URL + `/latest`); r != `` {
+		t.Fatalf("detected a region from nowhere: %q", r)
+	}
+
+	if r, src, err := ResolveRegion(`us-east-2`); err != nil || r != `us-east-2` || src != RegionSourceConfig {
+		t.Fatalf("configured region not used: %q %q %v", r, src, err)
+	}
+}
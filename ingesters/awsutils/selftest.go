@@ -0,0 +1,66 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+// SelfTestTimeout is how long SelfTest waits for the canary entries to be
+// handed off to the indexers.
+const SelfTestTimeout = 10 * time.Second
+
+// CanaryMuxer is the part of the ingest muxer used by SelfTest.
+type CanaryMuxer interface {
+	GetTag(string) (entry.EntryTag, error)
+	WriteEntry(*entry.Entry) error
+	Sync(time.Duration) error
+}
+
+// CanaryPayload returns the data of the self-test entry written by an
+// ingester, which can be searched for with the ingester UUID.
+func CanaryPayload(ingester, uuid, tag string, ts time.Time) string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("gravwell-selftest canary ingester=%s uuid=%s host=%s tag=%s time=%s",
+		ingester, uuid, host, tag, ts.UTC().Format(time.RFC3339))
+}
+
+// SelfTest writes a single canary entry to each tag and waits up to the
+// SelfTestTimeout for the muxer to hand them off to the indexers, reporting
+// each tag to out. It checks the path to the indexers only, nothing is read
+// from AWS.
+func SelfTest(m CanaryMuxer, ingester, uuid string, tags []string, out io.Writer) error {
+	now := time.Now()
+	for _, name := range tags {
+		tag, err := m.GetTag(name)
+		if err != nil {
+			return fmt.Errorf("failed to resolve tag %s: %v", name, err)
+		}
+		payload := CanaryPayload(ingester, uuid, name, now)
+		ent := &entry.Entry{
+			TS:   entry.FromStandard(now),
+			Tag:  tag,
+			Data: []byte(payload),
+		}
+		if err := m.WriteEntry(ent); err != nil {
+			return fmt.Errorf("failed to write canary entry to tag %s: %v", name, err)
+		}
+		fmt.Fprintf(out, "Wrote canary entry to tag %s: %s\n", name, payload)
+	}
+	if err := m.Sync(SelfTestTimeout); err != nil {
+		return fmt.Errorf("canary entries were not accepted: %v", err)
+	}
+	fmt.Fprintf(out, "Canary entries accepted for %d tags\n", len(tags))
+	return nil
+}
@@ -0,0 +1,70 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+type fakeCanaryMuxer struct {
+	tags    []string
+	ents    []*entry.Entry
+	syncErr error
+}
+
+func (fm *fakeCanaryMuxer) GetTag(name string) (entry.EntryTag, error) {
+	for i, t := range fm.tags {
+		if t == name {
+			return entry.EntryTag(i), nil
+		}
+	}
+	return 0, errors.New("tag not found")
+}
+
+func (fm *fakeCanaryMuxer) WriteEntry(ent *entry.Entry) error {
+	fm.ents = append(fm.ents, ent)
+	return nil
+}
+
+func (fm *fakeCanaryMuxer) Sync(time.Duration) error {
+	return fm.syncErr
+}
+
+func TestSelfTest(t *testing.T) {
+	fm := &fakeCanaryMuxer{tags: []string{`kinesis`, `metrics`}}
+	var out bytes.Buffer
+	if err := SelfTest(fm, `Kinesis`, `uuid`, fm.tags, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(fm.ents) != 2 {
+		t.Fatalf("wrote %d canary entries for 2 tags", len(fm.ents))
+	}
+	for i, ent := range fm.ents {
+		if int(ent.Tag) != i || !strings.Contains(string(ent.Data), `uuid=uuid`) || !strings.Contains(string(ent.Data), `tag=`+fm.tags[i]) {
+			t.Fatalf("bad canary entry %d: %d %s", i, ent.Tag, ent.Data)
+		}
+	}
+	if !strings.Contains(out.String(), `accepted for 2 tags`) {
+		t.Fatalf("bad output: %s", out.String())
+	}
+
+	if err := SelfTest(fm, `Kinesis`, `uuid`, []string{`missing`}, &out); err == nil {
+		t.Fatal("no error for an unknown tag")
+	}
+	fm.syncErr = errors.New("all connections down")
+	if err := SelfTest(fm, `Kinesis`, `uuid`, fm.tags, &out); err == nil {
+		t.Fatal("no error when the canaries were not synced")
+	}
+}
@@ -0,0 +1,55 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+const serverShutdownTimeout = 5 * time.Second
+
+// HTTPServer serves a handler until it is closed.
+type HTTPServer struct {
+	srv  *http.Server
+	done chan error
+}
+
+// ListenAndServe starts an HTTP server in the background. The listener is
+// opened before returning so that a bad address is reported immediately
+// rather than from the background.
+func ListenAndServe(addr string, h http.Handler) (*HTTPServer, error) {
+	l, err := net.Listen(`tcp`, addr)
+	if err != nil {
+		return nil, err
+	}
+	hs := &HTTPServer{
+		srv:  &http.Server{Handler: h},
+		done: make(chan error, 1),
+	}
+	go func() {
+		hs.done <- hs.srv.Serve(l)
+	}()
+	return hs, nil
+}
+
+// Close stops the server, waiting briefly for in-flight requests to finish.
+func (hs *HTTPServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
+	if err := hs.srv.Shutdown(ctx); err != nil {
+		return err
+	}
+	if err := <-hs.done; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+type sessionKey struct {
+	region string
+	creds  Credentials
+}
+
+// SessionCache shares sessions between clients with the same region and
+// credentials, so that credentials are resolved and roles are assumed once
+// rather than once per client. A SessionCache is safe for concurrent use.
+type SessionCache struct {
+	mtx      sync.Mutex
+	sessions map[sessionKey]*session.Session
+}
+
+// NewSessionCache returns an empty session cache.
+func NewSessionCache() *SessionCache {
+	return &SessionCache{
+		sessions: make(map[sessionKey]*session.Session),
+	}
+}
+
+// Get returns the session for the region and credentials, creating it with
+// NewSession on first use. Failures are not cached. A nil cache creates a new
+// session every time.
+func (sc *SessionCache) Get(region string, c Credentials) (*session.Session, error) {
+	if sc == nil {
+		return NewSession(region, c)
+	}
+	k := sessionKey{region: region, creds: c}
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	if sess, ok := sc.sessions[k]; ok {
+		return sess, nil
+	}
+	sess, err := NewSession(region, c)
+	if err != nil {
+		return nil, err
+	}
+	sc.sessions[k] = sess
+	return sess, nil
+}
+
+// Len returns the number of cached sessions.
+func (sc *SessionCache) Len() int {
+	if sc == nil {
+		return 0
+	}
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	return len(sc.sessions)
+}
@@ -0,0 +1,42 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"testing"
+)
+
+func TestSessionCache(t *testing.T) {
+	sc := NewSessionCache()
+	keys := Credentials{AccessKeyID: `AKID`, SecretAccessKey: `secret`}
+	a, err := sc.Get(`us-east-1`, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := sc.Get(`us-east-1`, keys); err != nil || b != a {
+		t.Fatalf("same region and credentials got a new session: %v", err)
+	}
+	if b, err := sc.Get(`us-west-2`, keys); err != nil || b == a {
+		t.Fatalf("another region shared a session: %v", err)
+	}
+	if b, err := sc.Get(`us-east-1`, Credentials{AccessKeyID: `AKID2`, SecretAccessKey: `secret`}); err != nil || b == a {
+		t.Fatalf("other credentials shared a session: %v", err)
+	}
+	if _, err := sc.Get(`us-east-1`, Credentials{AccessKeyID: `AKID`}); err != ErrPartialStaticKeys {
+		t.Fatalf("bad credentials not rejected: %v", err)
+	}
+	if n := sc.Len(); n != 3 {
+		t.Fatalf("%d sessions cached, expected 3", n)
+	}
+
+	var nc *SessionCache
+	if a, err := nc.Get(`us-east-1`, keys); err != nil || a == nil {
+		t.Fatalf("nil cache did not create a session: %v", err)
+	}
+}
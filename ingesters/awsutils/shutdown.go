@@ -0,0 +1,36 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultShutdownGrace is how long readers are given to finish the batch in
+// hand on shutdown when Shutdown-Grace is unset.
+const DefaultShutdownGrace = 10 * time.Second
+
+// WaitTimeout waits for wg for at most d, returning false if it timed out.
+// A goroutine is left waiting on wg after a timeout.
+func WaitTimeout(wg *sync.WaitGroup, d time.Duration) bool {
+	ch := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	tmr := time.NewTimer(d)
+	defer tmr.Stop()
+	select {
+	case <-ch:
+		return true
+	case <-tmr.C:
+		return false
+	}
+}
@@ -0,0 +1,33 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWaitTimeout(t *testing.T) {
+	var wg sync.WaitGroup
+	if !WaitTimeout(&wg, time.Second) {
+		t.Fatal("timed out on an empty wait group")
+	}
+	wg.Add(1)
+	if WaitTimeout(&wg, 10*time.Millisecond) {
+		t.Fatal("did not time out")
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		wg.Done()
+	}()
+	if !WaitTimeout(&wg, time.Second) {
+		t.Fatal("timed out after the wait group finished")
+	}
+}
@@ -0,0 +1,71 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	OversizeDrop     = `drop`
+	OversizeTruncate = `truncate`
+)
+
+// SizeGuard enforces a maximum entry size so that oversized records are not
+// silently rejected further down the pipeline. A nil SizeGuard allows every
+// entry.
+type SizeGuard struct {
+	max      int
+	truncate bool
+}
+
+// NewSizeGuard returns a guard limiting entry data to max bytes, handling
+// larger entries according to action: drop (the default) or truncate. A max
+// of zero or less disables the guard and returns nil.
+func NewSizeGuard(max int64, action string) (*SizeGuard, error) {
+	var truncate bool
+	switch strings.ToLower(strings.TrimSpace(action)) {
+	case ``, OversizeDrop:
+	case OversizeTruncate:
+		truncate = true
+	default:
+		return nil, fmt.Errorf("Invalid Oversize-Action %q, must be %s or %s", action, OversizeDrop, OversizeTruncate)
+	}
+	if max < 0 {
+		return nil, fmt.Errorf("Invalid Max-Entry-Size %d", max)
+	} else if max == 0 {
+		return nil, nil
+	}
+	return &SizeGuard{max: int(max), truncate: truncate}, nil
+}
+
+// Check applies the limit to an entry, truncating its data if configured to.
+// It returns false if the entry should be dropped, and whether the entry was
+// over the limit.
+func (g *SizeGuard) Check(ent *entry.Entry) (keep, oversized bool) {
+	if g == nil || len(ent.Data) <= g.max {
+		return true, false
+	}
+	if !g.truncate {
+		return false, true
+	}
+	ent.Data = ent.Data[:g.max]
+	return true, true
+}
+
+// Max returns the size limit, zero if there is none.
+func (g *SizeGuard) Max() int {
+	if g == nil {
+		return 0
+	}
+	return g.max
+}
@@ -0,0 +1,50 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"testing"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+func TestSizeGuard(t *testing.T) {
+	if g, err := NewSizeGuard(0, ``); err != nil || g != nil {
+		t.Fatalf("zero size did not disable the guard: %v %v", g, err)
+	}
+	if _, err := NewSizeGuard(10, `shrink`); err == nil {
+		t.Fatal("accepted an invalid action")
+	}
+	if _, err := NewSizeGuard(-1, ``); err == nil {
+		t.Fatal("accepted a negative size")
+	}
+	var ng *SizeGuard
+	if keep, over := ng.Check(&entry.Entry{Data: make([]byte, 1<<20)}); !keep || over {
+		t.Fatal("nil guard limited an entry")
+	}
+
+	g, err := NewSizeGuard(4, ``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keep, over := g.Check(&entry.Entry{Data: []byte(`1234`)}); !keep || over {
+		t.Fatal("entry at the limit was rejected")
+	}
+	if keep, over := g.Check(&entry.Entry{Data: []byte(`12345`)}); keep || !over {
+		t.Fatal("oversized entry was not dropped")
+	}
+
+	if g, err = NewSizeGuard(4, `Truncate`); err != nil {
+		t.Fatal(err)
+	}
+	ent := &entry.Entry{Data: []byte(`12345`)}
+	if keep, over := g.Check(ent); !keep || !over || string(ent.Data) != `1234` {
+		t.Fatalf("oversized entry was not truncated: %q", ent.Data)
+	}
+}
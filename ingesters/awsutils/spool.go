@@ -0,0 +1,481 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	// DefaultSpoolMaxSize caps the spool when Spool-Max-Size is unset.
+	DefaultSpoolMaxSize int64 = 1024 * 1024 * 1024
+
+	spoolWriteTimeout  = 5 * time.Second // wait for a muxer without hot connections before spooling
+	spoolRetryInterval = 5 * time.Second // how often to check whether spooled entries can be replayed
+	spoolSegments      = 8               // the spool is split into this many files, the oldest is dropped when full
+	spoolPrefix        = `spool-`
+	spoolSuffix        = `.seg`
+)
+
+var errUndelivered = errors.New("entries were not accepted by the muxer")
+
+// SpoolMuxer is the part of the ingest muxer used by a Spool.
+type SpoolMuxer interface {
+	WriteEntryContext(context.Context, *entry.Entry) error
+	WriteBatchContext(context.Context, []*entry.Entry) error
+	Hot() (int, error)
+	NegotiateTag(string) (entry.EntryTag, error)
+	LookupTag(entry.EntryTag) (string, bool)
+}
+
+// spoolSegment is a file of spooled entries, each stored as a 2 byte tag name
+// length, the tag name, and the encoded entry.
+type spoolSegment struct {
+	path   string
+	size   int64
+	count  uint64
+	offset int64  // bytes already replayed
+	done   uint64 // entries already replayed
+}
+
+// Spool writes entries through to the ingest muxer, but rather than blocking
+// indefinitely while no indexer is connected it captures them in segment
+// files on disk. A background loop replays spooled entries once the muxer has
+// a hot connection again. When the spool reaches its maximum size the oldest
+// segment is dropped and its entries counted.
+//
+// Entries are spooled after a write waits spoolWriteTimeout without a hot
+// connection, after which every write goes straight to the spool until a
+// connection is hot again. Entries are not spooled if the caller's context is
+// cancelled, the caller still owns them. Spooled entries are replayed in the
+// order they were spooled, but may be interleaved with newer entries.
+type Spool struct {
+	mtx          sync.Mutex
+	m            SpoolMuxer
+	dir          string
+	max          int64
+	segSize      int64
+	writeTimeout time.Duration
+	segs         []*spoolSegment // oldest first
+	cur          *os.File        // open for appending to the newest segment
+	replaying    *spoolSegment
+	next         uint64 // number of the next segment file
+	size         int64
+	spooling     bool // a write timed out, spool until a connection is hot
+	report       func(error)
+
+	spooled, replayed, dropped uint64
+}
+
+// NewSpool opens or creates a spool in dir of at most max bytes, zero uses
+// the DefaultSpoolMaxSize. Entries left from a previous run are replayed. An
+// empty dir disables the spool and returns nil. Problems the background
+// replay runs into are passed to report.
+func NewSpool(dir string, max int64, m SpoolMuxer, report func(error)) (*Spool, error) {
+	if dir == `` {
+		return nil, nil
+	}
+	if max < 0 {
+		return nil, fmt.Errorf("invalid spool size %d", max)
+	} else if max == 0 {
+		max = DefaultSpoolMaxSize
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		m:            m,
+		dir:          dir,
+		max:          max,
+		segSize:      max / spoolSegments,
+		writeTimeout: spoolWriteTimeout,
+		report:       report,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load picks up the segments left by a previous run.
+func (s *Spool) load() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, spoolPrefix+`*`+spoolSuffix))
+	if err != nil {
+		return err
+	}
+	nums := make(map[string]uint64, len(paths))
+	for _, p := range paths {
+		n, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), spoolPrefix), spoolSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		nums[p] = n
+		if n >= s.next {
+			s.next = n + 1
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return nums[paths[i]] < nums[paths[j]] })
+	for _, p := range paths {
+		if _, ok := nums[p]; !ok {
+			continue
+		}
+		seg := &spoolSegment{path: p}
+		if err := readSegment(p, 0, func(string, *entry.Entry, int64) error {
+			seg.count++
+			return nil
+		}); err != nil && s.report != nil {
+			s.report(fmt.Errorf("spool segment %s is damaged, only its first %d entries will be replayed: %v", p, seg.count, err))
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		seg.size = fi.Size()
+		s.size += seg.size
+		s.segs = append(s.segs, seg)
+	}
+	return nil
+}
+
+// NegotiateTag negotiates a tag with the muxer, so that preprocessors can
+// write through the spool.
+func (s *Spool) NegotiateTag(name string) (entry.EntryTag, error) {
+	return s.m.NegotiateTag(name)
+}
+
+// LookupTag returns the name of a tag from the muxer.
+func (s *Spool) LookupTag(tg entry.EntryTag) (string, bool) {
+	return s.m.LookupTag(tg)
+}
+
+// WriteEntry writes an entry to the muxer, spooling it if the muxer can't
+// take it.
+func (s *Spool) WriteEntry(e *entry.Entry) error {
+	return s.WriteEntryContext(context.Background(), e)
+}
+
+// WriteEntryContext writes an entry to the muxer, spooling it if the muxer
+// can't take it.
+func (s *Spool) WriteEntryContext(ctx context.Context, e *entry.Entry) error {
+	err := s.deliver(ctx, func(wctx context.Context) error {
+		return s.m.WriteEntryContext(wctx, e)
+	})
+	if err == errUndelivered {
+		return s.add(e)
+	}
+	return err
+}
+
+// WriteBatch writes entries to the muxer, spooling them if the muxer can't
+// take them.
+func (s *Spool) WriteBatch(ents []*entry.Entry) error {
+	return s.WriteBatchContext(context.Background(), ents)
+}
+
+// WriteBatchContext writes entries to the muxer, spooling them if the muxer
+// can't take them.
+func (s *Spool) WriteBatchContext(ctx context.Context, ents []*entry.Entry) error {
+	err := s.deliver(ctx, func(wctx context.Context) error {
+		return s.m.WriteBatchContext(wctx, ents)
+	})
+	if err == errUndelivered {
+		return s.add(ents...)
+	}
+	return err
+}
+
+// deliver hands entries to the muxer with write. While a connection is hot
+// writes block as usual, otherwise they wait at most the write timeout.
+// errUndelivered means the entries should be spooled.
+func (s *Spool) deliver(ctx context.Context, write func(context.Context) error) error {
+	var err error
+	if n, herr := s.m.Hot(); herr == nil && n > 0 {
+		s.setSpooling(false)
+		err = write(ctx)
+	} else if s.isSpooling() {
+		return errUndelivered
+	} else {
+		wctx, cancel := context.WithTimeout(ctx, s.writeTimeout)
+		err = write(wctx)
+		cancel()
+	}
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	s.setSpooling(true)
+	return errUndelivered
+}
+
+func (s *Spool) isSpooling() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.spooling
+}
+
+func (s *Spool) setSpooling(v bool) {
+	s.mtx.Lock()
+	s.spooling = v
+	s.mtx.Unlock()
+}
+
+// add appends entries to the newest segment, dropping the oldest segments if
+// the spool is full.
+func (s *Spool) add(ents ...*entry.Entry) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var bb bytes.Buffer
+	for _, e := range ents {
+		name, ok := s.m.LookupTag(e.Tag)
+		if !ok || len(e.Data) == 0 || len(name) > 0xffff {
+			s.dropped++
+			continue
+		}
+		bb.Reset()
+		binary.Write(&bb, binary.LittleEndian, uint16(len(name)))
+		bb.WriteString(name)
+		if err := e.EncodeWriter(&bb); err != nil {
+			s.dropped++
+			continue
+		}
+		if err := s.append(bb.Bytes()); err != nil {
+			return err
+		}
+		s.spooled++
+	}
+	s.trim()
+	return nil
+}
+
+// append writes a record to the newest segment, starting a new one when it
+// is full. The caller holds the lock.
+func (s *Spool) append(rec []byte) error {
+	if s.cur == nil {
+		seg := &spoolSegment{path: filepath.Join(s.dir, fmt.Sprintf("%s%016d%s", spoolPrefix, s.next, spoolSuffix))}
+		f, err := os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		s.next++
+		s.cur = f
+		s.segs = append(s.segs, seg)
+	}
+	seg := s.segs[len(s.segs)-1]
+	if _, err := s.cur.Write(rec); err != nil {
+		return err
+	}
+	seg.size += int64(len(rec))
+	seg.count++
+	s.size += int64(len(rec))
+	if seg.size >= s.segSize {
+		s.closeCurrent()
+	}
+	return nil
+}
+
+// closeCurrent closes the segment being appended to. The caller holds the
+// lock.
+func (s *Spool) closeCurrent() {
+	if s.cur != nil {
+		if err := s.cur.Close(); err != nil && s.report != nil {
+			s.report(err)
+		}
+		s.cur = nil
+	}
+}
+
+// trim drops the oldest segments until the spool fits, never the one being
+// replayed or appended to. The caller holds the lock.
+func (s *Spool) trim() {
+	for s.size > s.max {
+		i := 0
+		for i < len(s.segs) && s.segs[i] == s.replaying {
+			i++
+		}
+		if i >= len(s.segs) || (i == len(s.segs)-1 && s.cur != nil) {
+			return
+		}
+		seg := s.segs[i]
+		s.remove(seg)
+		lost := seg.count - seg.done
+		s.dropped += lost
+		if s.report != nil {
+			s.report(fmt.Errorf("spool is full, dropped %d entries", lost))
+		}
+	}
+}
+
+// remove deletes a segment. The caller holds the lock.
+func (s *Spool) remove(seg *spoolSegment) {
+	for i, v := range s.segs {
+		if v == seg {
+			s.segs = append(s.segs[:i], s.segs[i+1:]...)
+			break
+		}
+	}
+	s.size -= seg.size
+	if err := os.Remove(seg.path); err != nil && s.report != nil {
+		s.report(err)
+	}
+}
+
+// Run replays spooled entries whenever the muxer has a hot connection until
+// ctx is cancelled.
+func (s *Spool) Run(ctx context.Context) {
+	ticker := time.NewTicker(spoolRetryInterval)
+	defer ticker.Stop()
+	for {
+		s.replay(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// replay writes spooled segments to the muxer, oldest first, for as long as
+// it has a hot connection.
+func (s *Spool) replay(ctx context.Context) {
+	for ctx.Err() == nil {
+		if n, err := s.m.Hot(); err != nil || n == 0 {
+			return
+		}
+		seg := s.claim()
+		if seg == nil {
+			return
+		}
+		var werr error
+		err := readSegment(seg.path, seg.offset, func(name string, e *entry.Entry, end int64) error {
+			s.mtx.Lock()
+			defer s.mtx.Unlock()
+			// tags created at runtime, e.g. by a routing preprocessor, are
+			// unknown to a restarted muxer until they are negotiated again
+			if tag, err := s.m.NegotiateTag(name); err != nil {
+				s.dropped++
+			} else {
+				e.Tag = tag
+				// the lock is not held while we wait on the muxer
+				s.mtx.Unlock()
+				werr = s.m.WriteEntryContext(ctx, e)
+				s.mtx.Lock()
+				if werr != nil {
+					return werr
+				}
+				s.replayed++
+			}
+			seg.offset = end
+			seg.done++
+			return nil
+		})
+		s.mtx.Lock()
+		s.replaying = nil
+		if err != nil && werr == nil {
+			if s.report != nil {
+				s.report(fmt.Errorf("spool segment %s is damaged, dropped its remaining %d entries: %v", seg.path, seg.count-seg.done, err))
+			}
+			s.dropped += seg.count - seg.done
+		}
+		if werr == nil {
+			s.remove(seg)
+		}
+		s.mtx.Unlock()
+		if werr != nil {
+			// the rest of the segment is replayed from its offset next time
+			return
+		}
+	}
+}
+
+// claim returns the oldest segment for replay, closing the newest segment if
+// it is the only one so that it can be replayed. It returns nil if the spool
+// is empty.
+func (s *Spool) claim() *spoolSegment {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.segs) == 0 {
+		return nil
+	}
+	if len(s.segs) == 1 {
+		s.closeCurrent()
+	}
+	s.replaying = s.segs[0]
+	return s.replaying
+}
+
+// Stats returns the entries spooled, replayed, and dropped since the spool
+// was opened along with the bytes currently spooled.
+func (s *Spool) Stats() (spooled, replayed, dropped uint64, size int64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.spooled, s.replayed, s.dropped, s.size
+}
+
+// Close closes the segment being appended to, spooled entries are kept for
+// the next run.
+func (s *Spool) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.cur != nil {
+		err := s.cur.Close()
+		s.cur = nil
+		return err
+	}
+	return nil
+}
+
+// readSegment calls fn with every record in a segment file from offset
+// along with the offset of the end of the record. Reading stops at the end
+// of the file or at the first error, a partial record at the end of the file
+// is reported as io.ErrUnexpectedEOF.
+func readSegment(pth string, offset int64, fn func(name string, e *entry.Entry, end int64) error) error {
+	f, err := os.Open(pth)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	br := bufio.NewReader(f)
+	for {
+		var l uint16
+		if err := binary.Read(br, binary.LittleEndian, &l); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := make([]byte, l)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		var e entry.Entry
+		if err := e.DecodeReader(br); err != nil {
+			return err
+		}
+		offset += 2 + int64(l) + int64(e.Size())
+		if err := fn(string(name), &e, offset); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,192 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+// fakeSpoolMuxer accepts entries while hot and blocks writes otherwise, like
+// a muxer whose channel has filled up with no indexers connected.
+type fakeSpoolMuxer struct {
+	sync.Mutex
+	hot  bool
+	tags []string
+	ents []*entry.Entry
+}
+
+func (fm *fakeSpoolMuxer) setHot(v bool) {
+	fm.Lock()
+	fm.hot = v
+	fm.Unlock()
+}
+
+func (fm *fakeSpoolMuxer) WriteEntryContext(ctx context.Context, e *entry.Entry) error {
+	return fm.WriteBatchContext(ctx, []*entry.Entry{e})
+}
+
+func (fm *fakeSpoolMuxer) WriteBatchContext(ctx context.Context, ents []*entry.Entry) error {
+	fm.Lock()
+	defer fm.Unlock()
+	if !fm.hot {
+		fm.Unlock()
+		<-ctx.Done()
+		fm.Lock()
+		return ctx.Err()
+	}
+	fm.ents = append(fm.ents, ents...)
+	return nil
+}
+
+func (fm *fakeSpoolMuxer) Hot() (int, error) {
+	fm.Lock()
+	defer fm.Unlock()
+	if fm.hot {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (fm *fakeSpoolMuxer) GetTag(name string) (entry.EntryTag, error) {
+	for i, t := range fm.tags {
+		if t == name {
+			return entry.EntryTag(i), nil
+		}
+	}
+	return 0, errors.New("tag not found")
+}
+
+func (fm *fakeSpoolMuxer) NegotiateTag(name string) (entry.EntryTag, error) {
+	if tg, err := fm.GetTag(name); err == nil {
+		return tg, nil
+	}
+	fm.tags = append(fm.tags, name)
+	return entry.EntryTag(len(fm.tags) - 1), nil
+}
+
+func (fm *fakeSpoolMuxer) LookupTag(tg entry.EntryTag) (string, bool) {
+	if int(tg) < len(fm.tags) {
+		return fm.tags[tg], true
+	}
+	return ``, false
+}
+
+func (fm *fakeSpoolMuxer) data() (r []string) {
+	fm.Lock()
+	defer fm.Unlock()
+	for _, e := range fm.ents {
+		r = append(r, fmt.Sprintf("%s:%s", fm.tags[e.Tag], e.Data))
+	}
+	return
+}
+
+func spoolEntry(tag int, data string) *entry.Entry {
+	return &entry.Entry{TS: entry.Now(), Tag: entry.EntryTag(tag), Data: []byte(data)}
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `spool`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if s, err := NewSpool(``, 0, nil, nil); s != nil || err != nil {
+		t.Fatal("empty dir did not disable the spool")
+	}
+
+	fm := &fakeSpoolMuxer{tags: []string{`a`, `b`}}
+	s, err := NewSpool(dir, 0, fm, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.writeTimeout = 10 * time.Millisecond
+	// the first write waits out the timeout, the rest are spooled right away
+	if err := s.WriteEntry(spoolEntry(0, `one`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteBatch([]*entry.Entry{spoolEntry(1, `two`), spoolEntry(0, `three`)}); err != nil {
+		t.Fatal(err)
+	}
+	// a caller giving up keeps its entries
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.setSpooling(false)
+	if err := s.WriteEntryContext(ctx, spoolEntry(0, `cancelled`)); err == nil {
+		t.Fatal("cancelled write was spooled")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if spooled, _, _, _ := s.Stats(); spooled != 3 {
+		t.Fatalf("spooled %d entries", spooled)
+	}
+
+	// spooled entries survive a restart and are replayed once hot, b was
+	// negotiated at runtime and is negotiated again by the new muxer
+	fm = &fakeSpoolMuxer{tags: []string{`a`}}
+	if s, err = NewSpool(dir, 0, fm, nil); err != nil {
+		t.Fatal(err)
+	}
+	s.replay(context.Background())
+	if len(fm.data()) != 0 {
+		t.Fatal("replayed without a hot connection")
+	}
+	fm.setHot(true)
+	s.replay(context.Background())
+	want := []string{`a:one`, `b:two`, `a:three`}
+	if got := fm.data(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("replayed %v, expected %v", got, want)
+	}
+	if _, replayed, dropped, size := s.Stats(); replayed != 3 || dropped != 0 || size != 0 {
+		t.Fatalf("%d replayed, %d dropped, %d bytes left", replayed, dropped, size)
+	}
+	if segs, _ := filepath.Glob(filepath.Join(dir, `*`+spoolSuffix)); len(segs) != 0 {
+		t.Fatalf("segments left after replay: %v", segs)
+	}
+}
+
+func TestSpoolDropsOldest(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `spool`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fm := &fakeSpoolMuxer{tags: []string{`a`}}
+	// each segment holds about one entry
+	s, err := NewSpool(dir, spoolSegments*64, fm, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.spooling = true
+	for i := 0; i < 20; i++ {
+		if err := s.WriteEntry(spoolEntry(0, fmt.Sprintf("entry %02d %040d", i, 0))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	spooled, _, dropped, size := s.Stats()
+	if spooled != 20 || dropped == 0 || size > s.max+s.segSize {
+		t.Fatalf("%d spooled, %d dropped, %d bytes", spooled, dropped, size)
+	}
+	fm.setHot(true)
+	s.replay(context.Background())
+	got := fm.data()
+	if uint64(len(got)) != spooled-dropped || got[len(got)-1] != fmt.Sprintf("a:entry 19 %040d", 0) {
+		t.Fatalf("replayed %v after dropping %d", got, dropped)
+	}
+}
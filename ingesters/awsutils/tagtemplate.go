@@ -0,0 +1,212 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/buger/jsonparser"
+	"github.com/gravwell/gravwell/v3/ingest"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	// MaxTemplateTags caps the distinct tags a Tag-Template may create, so
+	// that a payload field with unbounded values can't exhaust the tag space.
+	// Entries rendering to further tags get the default tag.
+	MaxTemplateTags = 1024
+
+	tagTemplateJSONPrefix = `json:`
+)
+
+// tagTemplatePart is a literal piece of a template or a placeholder, either
+// metadata or a JSON field.
+type tagTemplatePart struct {
+	lit  string
+	meta string
+	json []string
+}
+
+// TagTemplate builds tag names from a template such as aws-{stream} or
+// app-{json:service.name}. Placeholders name metadata the ingester supplies
+// for each entry or, with a json: prefix, a field of a JSON payload at a dotted
+// path as used by NewJSONTimestamp. Metadata values have characters which
+// can't be used in a tag replaced with dashes, JSON values are used as is and
+// must make a legal tag.
+type TagTemplate struct {
+	tmpl  string
+	parts []tagTemplatePart
+}
+
+// ParseTagTemplate parses a template, its metadata placeholders must be one of
+// names. An empty template returns nil.
+func ParseTagTemplate(tmpl string, names ...string) (*TagTemplate, error) {
+	if tmpl == `` {
+		return nil, nil
+	}
+	tt := &TagTemplate{tmpl: tmpl}
+	for s := tmpl; s != ``; {
+		open := strings.IndexByte(s, '{')
+		if open < 0 {
+			tt.parts = append(tt.parts, tagTemplatePart{lit: s})
+			break
+		} else if open > 0 {
+			tt.parts = append(tt.parts, tagTemplatePart{lit: s[:open]})
+		}
+		end := strings.IndexByte(s[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("Tag-Template %q has an unterminated placeholder", tmpl)
+		}
+		name := s[open+1 : open+end]
+		s = s[open+end+1:]
+		if strings.HasPrefix(name, tagTemplateJSONPrefix) {
+			jt, err := NewJSONTimestamp(strings.TrimPrefix(name, tagTemplateJSONPrefix))
+			if err != nil || jt == nil {
+				return nil, fmt.Errorf("Tag-Template %q has an invalid JSON placeholder {%s}", tmpl, name)
+			}
+			tt.parts = append(tt.parts, tagTemplatePart{json: jt.keys})
+			continue
+		}
+		var known bool
+		for _, n := range names {
+			known = known || n == name
+		}
+		if !known {
+			return nil, fmt.Errorf("Tag-Template %q has unknown placeholder {%s}, expected one of %v or a json: field", tmpl, name, names)
+		}
+		tt.parts = append(tt.parts, tagTemplatePart{meta: name})
+	}
+	// the literal text has to be legal whatever the placeholders render to
+	for _, p := range tt.parts {
+		if p.lit == `` {
+			continue
+		} else if err := ingest.CheckTag(p.lit); err != nil {
+			return nil, fmt.Errorf("Tag-Template %q contains characters which can't be used in a tag", tmpl)
+		}
+	}
+	return tt, nil
+}
+
+// String returns the template as it was given.
+func (tt *TagTemplate) String() string {
+	if tt == nil {
+		return ``
+	}
+	return tt.tmpl
+}
+
+// Render builds the tag name for an entry from its metadata and data. It
+// fails if a placeholder has no value or the result is not a legal tag.
+func (tt *TagTemplate) Render(meta func(string) string, data []byte) (string, error) {
+	var sb strings.Builder
+	for _, p := range tt.parts {
+		switch {
+		case p.lit != ``:
+			sb.WriteString(p.lit)
+		case p.meta != ``:
+			v := meta(p.meta)
+			if v == `` {
+				return ``, fmt.Errorf("no %s for Tag-Template %q", p.meta, tt.tmpl)
+			}
+			sb.WriteString(SanitizeTag(v))
+		default:
+			v, err := jsonparser.GetString(data, p.json...)
+			if err != nil || v == `` {
+				return ``, fmt.Errorf("no field %s for Tag-Template %q", strings.Join(p.json, `.`), tt.tmpl)
+			}
+			sb.WriteString(v)
+		}
+	}
+	tag := sb.String()
+	if err := ingest.CheckTag(tag); err != nil {
+		return ``, fmt.Errorf("Tag-Template %q rendered invalid tag %q: %v", tt.tmpl, tag, err)
+	}
+	return tag, nil
+}
+
+// SanitizeTag replaces the characters of s which can't be used in a tag with
+// dashes.
+func SanitizeTag(s string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(ingest.FORBIDDEN_TAG_SET, r) {
+			return '-'
+		}
+		return r
+	}, s)
+}
+
+// TagResolver renders a TagTemplate for every entry and negotiates the tags
+// with the muxer, caching them by name so the muxer is only asked once per
+// tag. Entries whose tag can't be rendered or negotiated get the default tag.
+// A TagResolver is safe for concurrent use.
+type TagResolver struct {
+	tt        *TagTemplate
+	def       entry.EntryTag
+	negotiate func(string) (entry.EntryTag, error)
+
+	mtx          sync.Mutex
+	tags         map[string]entry.EntryTag
+	bad          map[string]bool
+	renderFailed bool
+}
+
+// NewTagResolver returns a resolver for tt which falls back to def. A nil
+// template returns nil.
+func NewTagResolver(tt *TagTemplate, def entry.EntryTag, negotiate func(string) (entry.EntryTag, error)) *TagResolver {
+	if tt == nil {
+		return nil
+	}
+	return &TagResolver{
+		tt:        tt,
+		def:       def,
+		negotiate: negotiate,
+		tags:      make(map[string]entry.EntryTag),
+		bad:       make(map[string]bool),
+	}
+}
+
+// Tag returns the tag for an entry. If the default tag had to be used the
+// error says why, it is only returned for the first entry which could not be
+// rendered and the first time each tag name fails, so that callers can log it
+// without flooding the log.
+func (tr *TagResolver) Tag(meta func(string) string, data []byte) (entry.EntryTag, error) {
+	name, err := tr.tt.Render(meta, data)
+	tr.mtx.Lock()
+	defer tr.mtx.Unlock()
+	if err != nil {
+		if tr.renderFailed {
+			err = nil
+		}
+		tr.renderFailed = true
+		return tr.def, err
+	}
+	if tag, ok := tr.tags[name]; ok {
+		return tag, nil
+	} else if tr.bad[name] {
+		return tr.def, nil
+	}
+	var tag entry.EntryTag
+	if len(tr.tags) >= MaxTemplateTags {
+		err = fmt.Errorf("Tag-Template %q already created %d tags, using the default tag for %q", tr.tt.tmpl, MaxTemplateTags, name)
+	} else if tag, err = tr.negotiate(name); err == nil {
+		tr.tags[name] = tag
+		return tag, nil
+	} else {
+		err = fmt.Errorf("Failed to negotiate tag %q from Tag-Template %q: %v", name, tr.tt.tmpl, err)
+	}
+	// failing names are neither retried nor reported again, the set is reset
+	// rather than left to grow with unbounded names
+	if len(tr.bad) >= MaxTemplateTags {
+		tr.bad = make(map[string]bool)
+	}
+	tr.bad[name] = true
+	return tr.def, err
+}
@@ -0,0 +1,99 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+func testMeta(name string) string {
+	return map[string]string{`stream`: `web.logs`, `region`: `us-east-1`}[name]
+}
+
+func TestTagTemplate(t *testing.T) {
+	tt, err := ParseTagTemplate(`aws-{stream}-{json:svc.name}`, `stream`, `region`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag, err := tt.Render(testMeta, []byte(`{"svc":{"name":"api"}}`)); err != nil || tag != `aws-web-logs-api` {
+		t.Fatalf("bad render %q: %v", tag, err)
+	}
+	for _, data := range []string{`not json`, `{"svc":{}}`, `{"svc":{"name":"a b"}}`, `{"svc":{"name":""}}`} {
+		if tag, err := tt.Render(testMeta, []byte(data)); err == nil {
+			t.Fatalf("rendered %q from %s", tag, data)
+		}
+	}
+	if tt, err := ParseTagTemplate(`{region}`, `region`); err != nil {
+		t.Fatal(err)
+	} else if _, err = tt.Render(func(string) string { return `` }, nil); err == nil {
+		t.Fatal("rendered a template without metadata")
+	}
+
+	if tt, err = ParseTagTemplate(``); tt != nil || err != nil {
+		t.Fatalf("empty template parsed to %v %v", tt, err)
+	}
+	for _, bad := range []string{`aws-{shard}`, `aws-{stream`, `bad tag-{stream}`, `aws-{json:}`, `aws-{json:a..b}`, `a}b`} {
+		if _, err := ParseTagTemplate(bad, `stream`); err == nil {
+			t.Fatalf("accepted template %q", bad)
+		}
+	}
+}
+
+func TestTagResolver(t *testing.T) {
+	tt, err := ParseTagTemplate(`app-{json:svc}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := map[string]entry.EntryTag{}
+	negotiate := func(name string) (entry.EntryTag, error) {
+		if name == `app-denied` {
+			return 0, errors.New(`no`)
+		}
+		if _, ok := tags[name]; !ok {
+			tags[name] = entry.EntryTag(len(tags) + 1)
+		}
+		return tags[name], nil
+	}
+	tr := NewTagResolver(tt, 0, negotiate)
+	if tag, err := tr.Tag(nil, []byte(`{"svc":"a"}`)); err != nil || tag != 1 {
+		t.Fatalf("bad tag %v: %v", tag, err)
+	}
+	if tag, err := tr.Tag(nil, []byte(`{"svc":"b"}`)); err != nil || tag != 2 {
+		t.Fatalf("bad tag %v: %v", tag, err)
+	}
+	if tag, _ := tr.Tag(nil, []byte(`{"svc":"a"}`)); tag != 1 || len(tags) != 2 {
+		t.Fatalf("cached tag was negotiated again: %v %v", tag, tags)
+	}
+
+	// failures fall back to the default tag and are only reported once
+	for i := 0; i < 2; i++ {
+		tag, err := tr.Tag(nil, []byte(`{}`))
+		if tag != 0 || (err == nil) == (i == 0) {
+			t.Fatalf("render failure %d: %v %v", i, tag, err)
+		}
+		tag, err = tr.Tag(nil, []byte(`{"svc":"denied"}`))
+		if tag != 0 || (err == nil) == (i == 0) {
+			t.Fatalf("negotiation failure %d: %v %v", i, tag, err)
+		}
+	}
+
+	for i := len(tr.tags); i < MaxTemplateTags; i++ {
+		tr.Tag(nil, []byte(fmt.Sprintf(`{"svc":"x%d"}`, i)))
+	}
+	if tag, err := tr.Tag(nil, []byte(`{"svc":"one-too-many"}`)); tag != 0 || err == nil {
+		t.Fatalf("created more than %d tags: %v %v", MaxTemplateTags, tag, err)
+	}
+	if NewTagResolver(nil, 0, negotiate) != nil {
+		t.Fatal("resolver for no template")
+	}
+}
@@ -0,0 +1,314 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	DefaultTeeMaxSize int64 = 64 * 1024 * 1024
+
+	teeQueueSize     = 1024
+	teeFlushInterval = time.Minute // how often buffered S3 tee data is uploaded
+)
+
+var ErrTeeNoBucket = errors.New("Debug-Tee-File S3 URLs must name a bucket, e.g. s3://bucket/prefix/")
+
+// TeeRecord is a raw payload as written to a debug tee, one JSON object per
+// line. Data holds payloads which are valid UTF-8, anything else is in
+// Base64 so that the exact bytes can be recovered.
+type TeeRecord struct {
+	Time   time.Time
+	Source string // stream and shard, or queue
+	ID     string // sequence number or message ID
+	Data   string `json:",omitempty"`
+	Base64 []byte `json:",omitempty"`
+}
+
+// teeSink stores encoded tee records.
+type teeSink interface {
+	write(line []byte) error
+	flush() error
+	close() error
+}
+
+// Tee copies raw payloads to a local file or an S3 prefix for debugging,
+// independently of the ingest path. Writes never block: if the sink falls
+// behind payloads are dropped and counted. A nil Tee does nothing.
+type Tee struct {
+	sink    teeSink
+	ch      chan TeeRecord
+	done    chan struct{}
+	wg      sync.WaitGroup
+	dropped uint64
+	report  func(error)
+}
+
+// NewTee returns a tee writing to target, either a local file path or an
+// s3://bucket/prefix URL. Local files are rotated once they reach maxSize
+// bytes, keeping a single previous file with a .1 suffix, and S3 objects are
+// uploaded once they reach maxSize or every minute. The region and
+// credentials are used for S3 targets only, an empty region is detected with
+// ResolveRegion. Failed writes are passed to report, once until a write
+// succeeds again. An empty target returns nil.
+func NewTee(target string, maxSize int64, region string, creds Credentials, report func(error)) (*Tee, error) {
+	if target == `` {
+		return nil, nil
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultTeeMaxSize
+	}
+	var sink teeSink
+	if bucket, prefix, ok, err := ParseS3URL(target); err != nil {
+		return nil, err
+	} else if ok {
+		if region, _, err = ResolveRegion(region); err != nil {
+			return nil, err
+		}
+		sess, err := NewSession(region, creds)
+		if err != nil {
+			return nil, err
+		}
+		sink = newS3TeeSink(s3.New(sess), bucket, prefix, maxSize)
+	} else {
+		fs, err := newFileTeeSink(target, maxSize)
+		if err != nil {
+			return nil, err
+		}
+		sink = fs
+	}
+	return newTee(sink, report), nil
+}
+
+func newTee(sink teeSink, report func(error)) *Tee {
+	t := &Tee{
+		sink:   sink,
+		ch:     make(chan TeeRecord, teeQueueSize),
+		done:   make(chan struct{}),
+		report: report,
+	}
+	t.wg.Add(1)
+	go t.run()
+	return t
+}
+
+// ParseS3URL splits an s3://bucket/prefix URL, ok is false if target is not
+// an S3 URL.
+func ParseS3URL(target string) (bucket, prefix string, ok bool, err error) {
+	if !strings.HasPrefix(strings.ToLower(target), `s3://`) {
+		return
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return
+	} else if u.Host == `` {
+		err = ErrTeeNoBucket
+		return
+	}
+	return u.Host, strings.TrimPrefix(u.Path, `/`), true, nil
+}
+
+// Write queues a copy of a raw payload, dropping it if the tee is backed up.
+func (t *Tee) Write(source, id string, data []byte) {
+	if t == nil {
+		return
+	}
+	r := TeeRecord{Time: time.Now().UTC(), Source: source, ID: id}
+	if utf8.Valid(data) {
+		r.Data = string(data)
+	} else {
+		r.Base64 = append([]byte(nil), data...)
+	}
+	select {
+	case t.ch <- r:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+// Dropped returns the number of payloads dropped because the tee was backed
+// up.
+func (t *Tee) Dropped() uint64 {
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// Close writes out any queued payloads and closes the sink.
+func (t *Tee) Close() error {
+	if t == nil {
+		return nil
+	}
+	close(t.done)
+	t.wg.Wait()
+	return t.sink.close()
+}
+
+func (t *Tee) run() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(teeFlushInterval)
+	defer ticker.Stop()
+	var failing bool
+	handle := func(err error) {
+		if err != nil && !failing && t.report != nil {
+			t.report(err)
+		}
+		failing = err != nil
+	}
+	write := func(r TeeRecord) {
+		line, err := json.Marshal(r)
+		if err == nil {
+			err = t.sink.write(append(line, '\n'))
+		}
+		handle(err)
+	}
+	for {
+		select {
+		case r := <-t.ch:
+			write(r)
+		case <-ticker.C:
+			handle(t.sink.flush())
+		case <-t.done:
+			for {
+				select {
+				case r := <-t.ch:
+					write(r)
+				default:
+					handle(t.sink.flush())
+					return
+				}
+			}
+		}
+	}
+}
+
+// fileTeeSink appends to a local file, rotating it by size.
+type fileTeeSink struct {
+	path string
+	max  int64
+	fout *os.File
+	size int64
+}
+
+func newFileTeeSink(path string, max int64) (*fileTeeSink, error) {
+	fs := &fileTeeSink{path: path, max: max}
+	if err := fs.open(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *fileTeeSink) open() (err error) {
+	if fs.fout, err = os.OpenFile(fs.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640); err != nil {
+		return
+	}
+	fi, err := fs.fout.Stat()
+	if err != nil {
+		fs.fout.Close()
+		fs.fout = nil
+		return
+	}
+	fs.size = fi.Size()
+	return
+}
+
+func (fs *fileTeeSink) rotate() error {
+	if fs.fout != nil {
+		fs.fout.Close()
+		fs.fout = nil
+	}
+	if err := os.Rename(fs.path, fs.path+`.1`); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return fs.open()
+}
+
+func (fs *fileTeeSink) write(line []byte) error {
+	if fs.fout == nil || (fs.size > 0 && fs.size+int64(len(line)) > fs.max) {
+		// also retries opening a file we previously failed to open
+		if err := fs.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := fs.fout.Write(line)
+	fs.size += int64(n)
+	return err
+}
+
+func (fs *fileTeeSink) flush() error {
+	return nil
+}
+
+func (fs *fileTeeSink) close() error {
+	if fs.fout == nil {
+		return nil
+	}
+	return fs.fout.Close()
+}
+
+// s3Putter is the part of the S3 client used by the tee.
+type s3Putter interface {
+	PutObject(*s3.PutObjectInput) (*s3.PutObjectOutput, error)
+}
+
+// s3TeeSink buffers records and uploads them as objects under a prefix.
+type s3TeeSink struct {
+	svc    s3Putter
+	bucket string
+	prefix string
+	max    int64
+	buf    bytes.Buffer
+}
+
+func newS3TeeSink(svc s3Putter, bucket, prefix string, max int64) *s3TeeSink {
+	return &s3TeeSink{svc: svc, bucket: bucket, prefix: prefix, max: max}
+}
+
+func (ss *s3TeeSink) write(line []byte) (err error) {
+	if ss.buf.Len() > 0 && int64(ss.buf.Len()+len(line)) > ss.max {
+		err = ss.flush()
+	}
+	ss.buf.Write(line)
+	return
+}
+
+// flush uploads the buffered records, they are discarded if the upload fails
+// so that a broken tee cannot grow without bound.
+func (ss *s3TeeSink) flush() error {
+	if ss.buf.Len() == 0 {
+		return nil
+	}
+	defer ss.buf.Reset()
+	key := fmt.Sprintf("%s%s.jsonl", ss.prefix, time.Now().UTC().Format(`20060102T150405.000000000Z`))
+	_, err := ss.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(ss.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(ss.buf.Bytes()),
+	})
+	return err
+}
+
+func (ss *s3TeeSink) close() error {
+	return nil
+}
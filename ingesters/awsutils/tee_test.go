@@ -0,0 +1,127 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func readTeeRecords(t *testing.T, b []byte) (recs []TeeRecord) {
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		var r TeeRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, r)
+	}
+	return
+}
+
+func TestFileTee(t *testing.T) {
+	var nt *Tee
+	nt.Write(`stream/shard`, `1`, []byte(`ignored`))
+	if err := nt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tee, err := NewTee(``, 0, ``, Credentials{}, nil); err != nil || tee != nil {
+		t.Fatalf("empty target did not disable the tee: %v %v", tee, err)
+	}
+
+	dir, err := ioutil.TempDir(``, `tee`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pth := filepath.Join(dir, `tee.jsonl`)
+	// every record is bigger than half the limit, so each rotates the file
+	tee, err := NewTee(pth, 150, ``, Credentials{}, func(err error) { t.Error(err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	tee.Write(`stream/shard`, `1`, []byte("first\npayload"))
+	tee.Write(`stream/shard`, `2`, []byte{0x1f, 0x8b, 0xff})
+	if err := tee.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := ioutil.ReadFile(pth + `.1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, err := ioutil.ReadFile(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := readTeeRecords(t, old), readTeeRecords(t, cur)
+	if len(a) != 1 || a[0].Data != "first\npayload" || a[0].ID != `1` || a[0].Source != `stream/shard` {
+		t.Fatalf("bad rotated records: %+v", a)
+	}
+	if len(b) != 1 || b[0].Data != `` || !bytes.Equal(b[0].Base64, []byte{0x1f, 0x8b, 0xff}) {
+		t.Fatalf("binary payload not preserved: %+v", b)
+	}
+}
+
+type testPutter struct {
+	objects map[string][]byte
+}
+
+func (tp *testPutter) PutObject(in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	b, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	tp.objects[aws.StringValue(in.Bucket)+`/`+aws.StringValue(in.Key)] = b
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestS3Tee(t *testing.T) {
+	for _, bad := range []string{`s3:///prefix`, `s3://`} {
+		if _, _, _, err := ParseS3URL(bad); err == nil {
+			t.Fatalf("accepted %q", bad)
+		}
+	}
+	if _, _, ok, err := ParseS3URL(`/var/log/tee`); ok || err != nil {
+		t.Fatal("local path treated as S3")
+	}
+	bucket, prefix, ok, err := ParseS3URL(`s3://debug/kinesis/`)
+	if err != nil || !ok || bucket != `debug` || prefix != `kinesis/` {
+		t.Fatalf("bad S3 URL parse: %q %q %v %v", bucket, prefix, ok, err)
+	}
+
+	tp := &testPutter{objects: map[string][]byte{}}
+	tee := newTee(newS3TeeSink(tp, bucket, prefix, 1024), nil)
+	for _, d := range []string{`a`, `b`, `c`} {
+		tee.Write(`queue`, d, []byte(d))
+	}
+	if err := tee.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tp.objects) != 1 {
+		t.Fatalf("%d objects uploaded, expected 1", len(tp.objects))
+	}
+	for k, v := range tp.objects {
+		if !strings.HasPrefix(k, `debug/kinesis/`) || !strings.HasSuffix(k, `.jsonl`) {
+			t.Fatalf("bad object key %q", k)
+		}
+		if recs := readTeeRecords(t, v); len(recs) != 3 || recs[2].Data != `c` {
+			t.Fatalf("bad object contents: %+v", recs)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TimestampClamp guards the indexers against garbage timestamps, such as a
+// number in malformed data read as a date decades away. Timestamps further
+// from the current time than the allowed skew are replaced by a fallback,
+// usually the time the data arrived. A nil TimestampClamp accepts every
+// timestamp.
+type TimestampClamp struct {
+	past   time.Duration // zero allows any time in the past
+	future time.Duration // zero allows any time in the future
+	now    func() time.Time
+}
+
+// NewTimestampClamp parses the allowed skew into the past and future, e.g.
+// 720h, where an empty string allows any skew in that direction. It returns
+// nil if neither is set.
+func NewTimestampClamp(past, future string) (*TimestampClamp, error) {
+	if past == `` && future == `` {
+		return nil, nil
+	}
+	tc := &TimestampClamp{now: time.Now}
+	var err error
+	if tc.past, err = parseSkew(past); err != nil {
+		return nil, fmt.Errorf("Invalid Max-Timestamp-Skew-Past %q", past)
+	} else if tc.future, err = parseSkew(future); err != nil {
+		return nil, fmt.Errorf("Invalid Max-Timestamp-Skew-Future %q", future)
+	}
+	return tc, nil
+}
+
+func parseSkew(s string) (time.Duration, error) {
+	if s == `` {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d <= 0 {
+		err = errors.New("skew must be positive")
+	}
+	return d, err
+}
+
+// Clamp returns t if it is within the allowed skew of the current time and
+// fallback otherwise, along with whether t was replaced.
+func (tc *TimestampClamp) Clamp(t, fallback time.Time) (time.Time, bool) {
+	if tc == nil {
+		return t, false
+	}
+	now := tc.now()
+	if (tc.past > 0 && t.Before(now.Add(-tc.past))) || (tc.future > 0 && t.After(now.Add(tc.future))) {
+		return fallback, true
+	}
+	return t, false
+}
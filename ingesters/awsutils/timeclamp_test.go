@@ -0,0 +1,64 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package awsutils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimestampClamp(t *testing.T) {
+	if tc, err := NewTimestampClamp(``, ``); err != nil || tc != nil {
+		t.Fatalf("clamp without any skew: %v %v", tc, err)
+	}
+	for _, bad := range [][2]string{{`junk`, ``}, {``, `-1h`}, {`0s`, ``}} {
+		if _, err := NewTimestampClamp(bad[0], bad[1]); err == nil {
+			t.Fatalf("accepted skew %q", bad)
+		}
+	}
+
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	arrival := now.Add(-time.Second)
+	tc, err := NewTimestampClamp(`720h`, `1h`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.now = func() time.Time { return now }
+	tests := []struct {
+		ts      time.Time
+		clamped bool
+	}{
+		{now, false},
+		{now.Add(-719 * time.Hour), false},
+		{now.Add(59 * time.Minute), false},
+		{now.Add(-721 * time.Hour), true},
+		{now.Add(61 * time.Minute), true},
+		{time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC), true},
+	}
+	for _, tt := range tests {
+		ts, clamped := tc.Clamp(tt.ts, arrival)
+		if clamped != tt.clamped || (clamped && !ts.Equal(arrival)) || (!clamped && !ts.Equal(tt.ts)) {
+			t.Fatalf("bad clamp of %v: %v %v", tt.ts, ts, clamped)
+		}
+	}
+
+	// only the future is limited
+	if tc, err = NewTimestampClamp(``, `1h`); err != nil {
+		t.Fatal(err)
+	}
+	tc.now = func() time.Time { return now }
+	if _, clamped := tc.Clamp(time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC), arrival); clamped {
+		t.Fatal("clamped a past timestamp without a Max-Timestamp-Skew-Past")
+	}
+	var nilClamp *TimestampClamp
+	if ts, clamped := nilClamp.Clamp(now, arrival); clamped || !ts.Equal(now) {
+		t.Fatal("nil clamp replaced a timestamp")
+	}
+}
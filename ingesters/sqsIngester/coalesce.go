@@ -0,0 +1,101 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+const (
+	coalesceOldest = `oldest`
+	coalesceNewest = `newest`
+
+	defaultCoalesceSeparator = "\n"
+)
+
+// parseCoalesceTimestamp normalizes a Coalesce-Timestamp, oldest is the
+// default.
+func parseCoalesceTimestamp(v string) (string, error) {
+	switch m := strings.ToLower(strings.TrimSpace(v)); m {
+	case ``, coalesceOldest:
+		return coalesceOldest, nil
+	case coalesceNewest:
+		return m, nil
+	}
+	return ``, fmt.Errorf("invalid Coalesce-Timestamp %q, must be oldest or newest", v)
+}
+
+// batchCoalescer joins the bodies of every message in a received batch into a
+// single entry for Coalesce-Batch, the inverse of Split-Lines. A nil
+// batchCoalescer leaves messages alone.
+type batchCoalescer struct {
+	sep    []byte
+	newest bool // take the timestamp of the newest message rather than the oldest
+}
+
+// newBatchCoalescer returns the coalescer for the Coalesce-Separator, which
+// accepts escape sequences such as \r\n or \x00 and defaults to a newline, and
+// a normalized Coalesce-Timestamp. It returns nil if coalescing is not enabled.
+func newBatchCoalescer(enabled bool, sep, ts string) *batchCoalescer {
+	if !enabled {
+		return nil
+	}
+	if sep == `` {
+		sep = defaultCoalesceSeparator
+	} else if s, err := strconv.Unquote(`"` + sep + `"`); err == nil {
+		sep = s
+	}
+	return &batchCoalescer{sep: []byte(sep), newest: ts == coalesceNewest}
+}
+
+// Start begins coalescing a batch, it returns nil for a nil batchCoalescer.
+func (bc *batchCoalescer) Start() *coalescedBatch {
+	if bc == nil {
+		return nil
+	}
+	return &coalescedBatch{bc: bc}
+}
+
+// coalescedBatch accumulates the messages of one batch. The messages are held
+// back until the entry is built so that they are only deleted along with it.
+type coalescedBatch struct {
+	bc   *batchCoalescer
+	data []byte
+	ts   entry.Timestamp
+	msgs []pendingMessage
+}
+
+// Add appends the data of a message and its timestamp.
+func (cb *coalescedBatch) Add(data []byte, ts entry.Timestamp, m pendingMessage) {
+	if len(cb.msgs) == 0 || (cb.bc.newest && ts.After(cb.ts)) || (!cb.bc.newest && ts.Before(cb.ts)) {
+		cb.ts = ts
+	}
+	if len(data) > 0 {
+		if len(cb.data) > 0 {
+			cb.data = append(cb.data, cb.bc.sep...)
+		}
+		cb.data = append(cb.data, data...)
+	}
+	cb.msgs = append(cb.msgs, m)
+}
+
+// Take returns the joined data, the chosen timestamp, and the held messages,
+// which is empty if nothing was added or the batch is nil.
+func (cb *coalescedBatch) Take() (data []byte, ts entry.Timestamp, msgs []pendingMessage) {
+	if cb == nil {
+		return
+	}
+	data, ts, msgs = cb.data, cb.ts, cb.msgs
+	cb.data, cb.msgs = nil, nil
+	return
+}
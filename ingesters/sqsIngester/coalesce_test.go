@@ -0,0 +1,68 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+func TestParseCoalesceTimestamp(t *testing.T) {
+	for in, want := range map[string]string{``: coalesceOldest, ` Oldest`: coalesceOldest, `NEWEST`: coalesceNewest} {
+		if got, err := parseCoalesceTimestamp(in); err != nil || got != want {
+			t.Fatalf("parsed %q as %q %v", in, got, err)
+		}
+	}
+	if _, err := parseCoalesceTimestamp(`first`); err == nil {
+		t.Fatal("accepted a bad Coalesce-Timestamp")
+	}
+}
+
+func TestBatchCoalescer(t *testing.T) {
+	var bc *batchCoalescer
+	if cb := bc.Start(); cb != nil {
+		t.Fatal("nil coalescer started a batch")
+	} else if _, _, msgs := cb.Take(); len(msgs) != 0 {
+		t.Fatal("nil batch held messages")
+	}
+	if newBatchCoalescer(false, ``, ``) != nil {
+		t.Fatal("coalescer without Coalesce-Batch")
+	}
+
+	base := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	stamps := []entry.Timestamp{
+		entry.FromStandard(base.Add(time.Minute)),
+		entry.FromStandard(base),
+		entry.FromStandard(base.Add(2 * time.Minute)),
+	}
+	bodies := []string{`a`, ``, `b`}
+	for _, tt := range []struct {
+		sep, ts string
+		data    string
+		want    entry.Timestamp
+	}{
+		{``, coalesceOldest, "a\nb", stamps[1]},
+		{`\r\n`, coalesceNewest, "a\r\nb", stamps[2]},
+		{`, `, coalesceOldest, "a, b", stamps[1]},
+	} {
+		cb := newBatchCoalescer(true, tt.sep, tt.ts).Start()
+		for i, b := range bodies {
+			cb.Add([]byte(b), stamps[i], pendingMessage{end: i})
+		}
+		data, ts, msgs := cb.Take()
+		if string(data) != tt.data || !ts.Equal(tt.want) || len(msgs) != len(bodies) {
+			t.Fatalf("bad batch with %q %s: %q %v %d", tt.sep, tt.ts, data, ts, len(msgs))
+		}
+		if _, _, msgs = cb.Take(); len(msgs) != 0 {
+			t.Fatal("messages taken twice")
+		}
+	}
+}
@@ -19,69 +19,232 @@ import (
 	"github.com/gravwell/gravwell/v3/ingest"
 	"github.com/gravwell/gravwell/v3/ingest/config"
 	"github.com/gravwell/gravwell/v3/ingest/processors"
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
+	"github.com/gravwell/gravwell/v3/timegrinder"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
 const (
 	MAX_CONFIG_SIZE int64 = (1024 * 1024 * 2) //2MB, even this is crazy large
+
+	fifoQueueSuffix = `.fifo`
+
+	defaultWaitTimeSeconds     int64 = 20
+	maxWaitTimeSeconds         int64 = 20
+	defaultMaxNumberOfMessages int64 = 10
+	maxMaxNumberOfMessages     int64 = 10
+
+	defaultMetricsInterval = time.Minute
 )
 
+// messageAttributeNames are the message system attributes which may be given
+// in Attribute-Names.
+var messageAttributeNames = []string{
+	sqs.QueueAttributeNameAll,
+	sqs.MessageSystemAttributeNameSenderId,
+	sqs.MessageSystemAttributeNameSentTimestamp,
+	sqs.MessageSystemAttributeNameApproximateReceiveCount,
+	sqs.MessageSystemAttributeNameApproximateFirstReceiveTimestamp,
+	sqs.MessageSystemAttributeNameSequenceNumber,
+	sqs.MessageSystemAttributeNameMessageDeduplicationId,
+	sqs.MessageSystemAttributeNameMessageGroupId,
+	sqs.MessageSystemAttributeNameAwstraceHeader,
+}
+
+// metadata a Tag-Template can use, besides json: fields of the message
+const (
+	tagVarQueue  = `queue`
+	tagVarRegion = `region`
+)
+
+var tagTemplateVars = []string{tagVarQueue, tagVarRegion}
+
 type queue struct {
 	base
-	Tag_Name     string
-	Queue_URL    string
-	Region       string
-	AKID         string
-	Secret       string
-	Preprocessor []string
+	Tag_Name               string
+	Tag_Template           string // build the tag of each entry from {queue}, {region}, or {json:path}, Tag-Name is the fallback
+	Queue_URL              string
+	Region                 string
+	AKID                   string
+	Secret                 string
+	Role_ARN               string // IAM role to assume with STS
+	External_ID            string
+	Session_Name           string
+	Use_Instance_Role      bool     // use the EC2/ECS instance role rather than static keys
+	AWS_Profile            string   // named profile from the shared credentials file
+	Credentials_File       string   // shared credentials file, defaults to ~/.aws/credentials
+	Delete_On_Ingest       *bool    // delete messages once they are handed to the ingest muxer, defaults to true
+	Delete_Sync_Timeout    string   // wait up to this long for the indexers to acknowledge entries before deleting their messages, e.g. 10s
+	Wait_Time_Seconds      *int64   // long polling wait time, defaults to 20
+	Empty_Receive_Backoff  string   // sleep for up to this long after consecutive empty receives, e.g. 30s
+	Max_Number_Of_Messages int64    // messages per receive call, defaults to 10
+	Unwrap_SNS             bool     // ingest the payload of SNS notification envelopes
+	EventBridge_Mode       string   // envelope or detail to take timestamps from EventBridge events, none (default)
+	S3_Event_Mode          bool     // ingest the objects referenced by S3 event notifications
+	S3_Region              string   // region of the S3 buckets, defaults to the queue region
+	SQS_Extended           bool     // fetch payloads the SQS Extended Client offloaded to S3
+	FIFO                   bool     // preserve message group ordering, implied by a .fifo queue URL
+	Reader_Count           int      // number of concurrent receivers, defaults to 1
+	Receive_Buffer         int      // received batches each reader holds for its Process-Workers, 0 handles a batch before the next receive
+	Process_Workers        int      // goroutines handling the batches of each reader, defaults to 1
+	Decompression          string   // gzip, zstd, snappy, auto, or none (default)
+	Visibility_Extension   string   // keep in-progress messages invisible for this long at a time, e.g. 5m
+	Max_Process_Attempts   int      // give up on a message after this many failures, 0 retries forever
+	Failure_Tag            string   // preserve given up messages in this tag rather than dropping them
+	Endpoint_URL           string   // override the SQS endpoint, defaults to the global Endpoint-URL
+	Disable_SSL            *bool    // defaults to the global Disable-SSL
+	Rate_Limit             string   // cap the data ingested from this queue, same format as the global Rate-Limit
+	Max_Entry_Size         int64    // entries with more data than this are handled by Oversize-Action, 0 is unlimited
+	Oversize_Action        string   // drop (default) or truncate
+	Split_Lines            bool     // make an entry of every line in a message
+	Line_Delimiter         string   // separates lines for Split-Lines, defaults to a newline
+	Coalesce_Batch         bool     // make a single entry of every message in a received batch
+	Coalesce_Separator     string   // joins messages for Coalesce-Batch, defaults to a newline
+	Coalesce_Timestamp     string   // oldest (default) or newest message timestamp for Coalesce-Batch
+	Attribute_Names        []string // extra message system attributes to request, e.g. ApproximateReceiveCount
+	Preprocessor           []string
+
+	regionSource string // where Region came from, see resolveRegions
 }
 
 type base struct {
-	Ignore_Timestamps         bool //Just apply the current timestamp to lines as we get them
+	Ignore_Timestamps         bool //Just apply the time SQS received the message to its lines
 	Assume_Local_Timezone     bool
 	Timezone_Override         string
 	Source_Override           string
 	Timestamp_Format_Override string //override the timestamp format
+	Timestamp_JSON_Path       string // take the timestamp of JSON messages from this field, e.g. event.time
+	Max_Timestamp_Skew_Past   string // extracted timestamps older than this are replaced by the enqueue time
+	Max_Timestamp_Skew_Future string // extracted timestamps further ahead than this are replaced by the enqueue time
+}
+
+type global struct {
+	config.IngestConfig
+	Prometheus_Listen      string // address to serve Prometheus metrics on, e.g. :9101
+	Failure_State_Location string // persist message failure counts across restarts
+	Health_Listen          string // address to serve /healthz and /readyz on, e.g. :9102
+	Health_Progress_Window string // not ready if no queue has been read for this long, e.g. 5m
+	Pause_File             string // ingest is paused while this file exists, SIGTSTP and SIGCONT also pause and resume
+	Endpoint_URL           string // default SQS endpoint, e.g. a VPC endpoint or LocalStack
+	Disable_SSL            bool   // default for talking plain HTTP to the SQS endpoint
+	Metrics_Interval       string // how often to report per-queue metrics, e.g. 60s
+	Metrics_Tag            string // if set, metrics reports are also ingested as JSON entries
+	Debug_Tee_File         string // copy raw messages to this file or s3://bucket/prefix for debugging
+	Debug_Tee_Max_Size     int64  // rotate the tee file or upload an S3 object at this size
+	Debug_Tee_Region       string // region of an S3 tee bucket, detected if unset
+	Log_Bad_Payloads       bool   // log an excerpt of entries which fail preprocessing or timestamp extraction
+	Log_Bad_Payload_Size   int    // bytes of each bad payload to log, defaults to 256
+	Spool_Dir              string // spool entries here while no indexer takes them, replayed later
+	Spool_Max_Size         int64  // drop the oldest spooled entries beyond this size
+	Shutdown_Grace         string // how long readers get to finish their batch on shutdown, e.g. 10s
 }
 
 type cfgReadType struct {
-	Global       config.IngestConfig
-	Queue        map[string]*queue
-	Preprocessor processors.ProcessorConfig
+	Global          global
+	Queue           map[string]*queue
+	Queue_Discovery map[string]*queueDiscovery
+	Preprocessor    processors.ProcessorConfig
 }
 
 type cfgType struct {
 	config.IngestConfig
-	Queue        map[string]*queue
-	Preprocessor processors.ProcessorConfig
+	Prometheus_Listen      string
+	Failure_State_Location string
+	Health_Listen          string
+	Health_Progress_Window string
+	Pause_File             string
+	Endpoint_URL           string
+	Disable_SSL            bool
+	Metrics_Interval       string
+	Metrics_Tag            string
+	Debug_Tee_File         string
+	Debug_Tee_Max_Size     int64
+	Debug_Tee_Region       string
+	Log_Bad_Payloads       bool
+	Log_Bad_Payload_Size   int
+	Spool_Dir              string
+	Spool_Max_Size         int64
+	Shutdown_Grace         string
+	Queue                  map[string]*queue
+	Queue_Discovery        map[string]*queueDiscovery
+	Preprocessor           processors.ProcessorConfig
 }
 
 func GetConfig(path string) (*cfgType, error) {
+	c, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify and set UUID
+	if _, ok := c.IngesterUUID(); !ok {
+		id := uuid.New()
+		if err := c.SetIngesterUUID(id, path); err != nil {
+			return nil, err
+		}
+		if id2, ok := c.IngesterUUID(); !ok || id != id2 {
+			return nil, errors.New("Failed to set a new ingester UUID")
+		}
+	}
+	return c, nil
+}
+
+// loadConfig reads and verifies a config file without modifying it.
+func loadConfig(path string) (*cfgType, error) {
 	//read into the intermediary type to maintain backwards compatibility with the old system
 	var cr cfgReadType
 	if err := config.LoadConfigFile(&cr, path); err != nil {
 		return nil, err
 	}
 	c := &cfgType{
-		IngestConfig: cr.Global,
-		Queue:        cr.Queue,
-		Preprocessor: cr.Preprocessor,
+		IngestConfig:           cr.Global.IngestConfig,
+		Prometheus_Listen:      cr.Global.Prometheus_Listen,
+		Failure_State_Location: cr.Global.Failure_State_Location,
+		Health_Listen:          cr.Global.Health_Listen,
+		Health_Progress_Window: cr.Global.Health_Progress_Window,
+		Pause_File:             cr.Global.Pause_File,
+		Endpoint_URL:           cr.Global.Endpoint_URL,
+		Disable_SSL:            cr.Global.Disable_SSL,
+		Metrics_Interval:       cr.Global.Metrics_Interval,
+		Metrics_Tag:            cr.Global.Metrics_Tag,
+		Debug_Tee_File:         cr.Global.Debug_Tee_File,
+		Debug_Tee_Max_Size:     cr.Global.Debug_Tee_Max_Size,
+		Debug_Tee_Region:       cr.Global.Debug_Tee_Region,
+		Log_Bad_Payloads:       cr.Global.Log_Bad_Payloads,
+		Log_Bad_Payload_Size:   cr.Global.Log_Bad_Payload_Size,
+		Spool_Dir:              cr.Global.Spool_Dir,
+		Spool_Max_Size:         cr.Global.Spool_Max_Size,
+		Shutdown_Grace:         cr.Global.Shutdown_Grace,
+		Queue:                  cr.Queue,
+		Queue_Discovery:        cr.Queue_Discovery,
+		Preprocessor:           cr.Preprocessor,
 	}
 
 	if err := verifyConfig(c); err != nil {
 		return nil, err
+	} else if err = c.resolveRegions(); err != nil {
+		return nil, err
 	}
+	return c, nil
+}
 
-	// Verify and set UUID
-	if _, ok := c.IngesterUUID(); !ok {
-		id := uuid.New()
-		if err := c.SetIngesterUUID(id, path); err != nil {
-			return nil, err
+// resolveRegions fills in the Region of queues and discovery sections which do
+// not specify one, detecting it from the EC2 instance metadata or the
+// environment.
+func (c *cfgType) resolveRegions() (err error) {
+	for k, v := range c.Queue {
+		if v.Region, v.regionSource, err = awsutils.ResolveRegion(v.Region); err != nil {
+			return fmt.Errorf("Queue %s: %v", k, err)
 		}
-		if id2, ok := c.IngesterUUID(); !ok || id != id2 {
-			return nil, errors.New("Failed to set a new ingester UUID")
+	}
+	for k, v := range c.Queue_Discovery {
+		if v.Region, v.regionSource, err = awsutils.ResolveRegion(v.Region); err != nil {
+			return fmt.Errorf("Queue-Discovery %s: %v", k, err)
 		}
 	}
-	return c, nil
+	return nil
 }
 
 func verifyConfig(c *cfgType) error {
@@ -90,52 +253,399 @@ func verifyConfig(c *cfgType) error {
 		return err
 	}
 
-	if len(c.Queue) == 0 {
+	if len(c.Queue) == 0 && len(c.Queue_Discovery) == 0 {
 		return errors.New("No queues specified")
 	}
 
+	if c.Health_Progress_Window != `` {
+		if d, err := time.ParseDuration(c.Health_Progress_Window); err != nil || d <= 0 {
+			return fmt.Errorf("Invalid Health-Progress-Window %q", c.Health_Progress_Window)
+		}
+	}
+
+	if c.Metrics_Interval != `` {
+		if d, err := time.ParseDuration(c.Metrics_Interval); err != nil || d <= 0 {
+			return fmt.Errorf("Invalid Metrics-Interval %q", c.Metrics_Interval)
+		}
+	}
+	if c.Shutdown_Grace != `` {
+		if d, err := time.ParseDuration(c.Shutdown_Grace); err != nil || d < 0 {
+			return fmt.Errorf("Invalid Shutdown-Grace %q", c.Shutdown_Grace)
+		}
+	}
+	if strings.ContainsAny(c.Metrics_Tag, ingest.FORBIDDEN_TAG_SET) {
+		return errors.New("Invalid characters in the Metrics-Tag")
+	}
+
+	if _, _, _, err := awsutils.ParseS3URL(c.Debug_Tee_File); err != nil {
+		return fmt.Errorf("Invalid Debug-Tee-File %q: %v", c.Debug_Tee_File, err)
+	}
+	if c.Debug_Tee_Max_Size < 0 {
+		return fmt.Errorf("Invalid Debug-Tee-Max-Size %d", c.Debug_Tee_Max_Size)
+	}
+	if c.Spool_Max_Size < 0 {
+		return fmt.Errorf("Invalid Spool-Max-Size %d", c.Spool_Max_Size)
+	}
+	if c.Log_Bad_Payload_Size < 0 {
+		return fmt.Errorf("Invalid Log-Bad-Payload-Size %d", c.Log_Bad_Payload_Size)
+	}
+
 	if err := c.Preprocessor.Validate(); err != nil {
 		return err
 	}
 
+	// FIFO ordering is only preserved with a single receiver per queue
+	fifoQueues := map[string]string{}
 	for k, v := range c.Queue {
-		if len(v.Tag_Name) == 0 {
-			v.Tag_Name = `default`
+		if v.Queue_URL == "" {
+			return fmt.Errorf("Queue %s must provide Queue-URL", k)
 		}
-		if strings.ContainsAny(v.Tag_Name, ingest.FORBIDDEN_TAG_SET) {
-			return errors.New("Invalid characters in the Tag-Name for " + k)
+		if err := c.verifyQueue(k, v); err != nil {
+			return err
 		}
-		if v.Timezone_Override != "" {
-			if v.Assume_Local_Timezone {
-				// cannot do both
-				return fmt.Errorf("Cannot specify Assume-Local-Timezone and Timezone-Override in the same listener %v", k)
+		if v.fifo() {
+			if v.readerCount() > 1 {
+				return fmt.Errorf("Queue %s is a FIFO queue and cannot use more than one reader", k)
 			}
-			if _, err := time.LoadLocation(v.Timezone_Override); err != nil {
-				return fmt.Errorf("Invalid timezone override %v in listener %v: %v", v.Timezone_Override, k, err)
+			if other, ok := fifoQueues[v.Queue_URL]; ok {
+				return fmt.Errorf("Queues %s and %s both read FIFO queue %s, only one receiver per FIFO queue is allowed", other, k, v.Queue_URL)
 			}
+			fifoQueues[v.Queue_URL] = k
+		}
+	}
+	for k, v := range c.Queue_Discovery {
+		if err := c.verifyQueueDiscovery(k, v); err != nil {
+			return err
 		}
+	}
 
-		if err := c.Preprocessor.CheckProcessors(v.Preprocessor); err != nil {
-			return fmt.Errorf("Listener %s preprocessor invalid: %v", k, err)
+	return nil
+}
+
+// verifyQueue checks and normalizes the options of a queue, other than its
+// Queue-URL which discovered queues do not have up front.
+func (c *cfgType) verifyQueue(k string, v *queue) error {
+	if len(v.Tag_Name) == 0 {
+		v.Tag_Name = `default`
+	}
+	if strings.ContainsAny(v.Tag_Name, ingest.FORBIDDEN_TAG_SET) {
+		return errors.New("Invalid characters in the Tag-Name for " + k)
+	}
+	if _, err := v.tagTemplate(); err != nil {
+		return fmt.Errorf("Queue %s: %v", k, err)
+	}
+	if v.Timezone_Override != "" {
+		if v.Assume_Local_Timezone {
+			// cannot do both
+			return fmt.Errorf("Cannot specify Assume-Local-Timezone and Timezone-Override in the same listener %v", k)
+		}
+		if _, err := time.LoadLocation(v.Timezone_Override); err != nil {
+			return fmt.Errorf("Invalid timezone override %v in listener %v: %v", v.Timezone_Override, k, err)
 		}
+	}
+	if _, err := v.jsonTimestamp(); err != nil {
+		return fmt.Errorf("Queue %s has invalid Timestamp-JSON-Path: %v", k, err)
+	} else if v.Timestamp_JSON_Path != `` && v.Ignore_Timestamps {
+		return fmt.Errorf("Queue %s cannot combine Timestamp-JSON-Path with Ignore-Timestamps", k)
+	}
+	if tc, err := v.timestampClamp(); err != nil {
+		return fmt.Errorf("Queue %s: %v", k, err)
+	} else if tc != nil && v.Ignore_Timestamps {
+		return fmt.Errorf("Queue %s cannot combine Max-Timestamp-Skew with Ignore-Timestamps", k)
+	}
+	if v.Timestamp_Format_Override != `` {
+		if err := timegrinder.ValidateFormatOverride(v.Timestamp_Format_Override); err != nil {
+			return fmt.Errorf("Invalid timestamp format override %v in queue %v: %v", v.Timestamp_Format_Override, k, err)
+		}
+	}
 
-		if v.Queue_URL == "" {
-			return fmt.Errorf("Queue %s must provide Queue-URL", k)
+	if err := c.Preprocessor.CheckProcessors(v.Preprocessor); err != nil {
+		return fmt.Errorf("Listener %s preprocessor invalid: %v", k, err)
+	}
+
+	if err := v.endpoint(c).Validate(); err != nil {
+		return fmt.Errorf("Queue %s: %v", k, err)
+	}
+	if _, err := config.ParseRate(v.Rate_Limit); err != nil {
+		return fmt.Errorf("Queue %s has invalid Rate-Limit %q: %v", k, v.Rate_Limit, err)
+	}
+	dc, err := awsutils.ParseDecompression(v.Decompression)
+	if err != nil {
+		return fmt.Errorf("Queue %s: %v", k, err)
+	}
+	if _, err := v.sizeGuard(); err != nil {
+		return fmt.Errorf("Queue %s: %v", k, err)
+	}
+	v.Decompression = dc
+	if v.EventBridge_Mode, err = parseEventBridgeMode(v.EventBridge_Mode); err != nil {
+		return fmt.Errorf("Queue %s: %v", k, err)
+	}
+	if v.Coalesce_Timestamp, err = parseCoalesceTimestamp(v.Coalesce_Timestamp); err != nil {
+		return fmt.Errorf("Queue %s: %v", k, err)
+	} else if v.Coalesce_Batch && v.Split_Lines {
+		return fmt.Errorf("Queue %s cannot combine Coalesce-Batch with Split-Lines", k)
+	}
+	if v.Reader_Count < 0 {
+		return fmt.Errorf("Queue %s has invalid Reader-Count %d", k, v.Reader_Count)
+	}
+	if v.Receive_Buffer < 0 {
+		return fmt.Errorf("Queue %s has invalid Receive-Buffer %d", k, v.Receive_Buffer)
+	}
+	if v.Process_Workers < 0 {
+		return fmt.Errorf("Queue %s has invalid Process-Workers %d", k, v.Process_Workers)
+	} else if v.Process_Workers > 1 && v.fifo() {
+		// workers would reorder the messages of a group
+		return fmt.Errorf("Queue %s is FIFO, Process-Workers must be 1", k)
+	}
+	if v.S3_Region != `` && !v.S3_Event_Mode && !v.SQS_Extended {
+		return fmt.Errorf("Queue %s specifies S3-Region without S3-Event-Mode or SQS-Extended", k)
+	}
+	if v.Max_Process_Attempts < 0 {
+		return fmt.Errorf("Queue %s has invalid Max-Process-Attempts %d", k, v.Max_Process_Attempts)
+	}
+	if _, err := v.attributeNames(); err != nil {
+		return fmt.Errorf("Queue %s: %v", k, err)
+	}
+	if v.Failure_Tag != `` {
+		if v.Max_Process_Attempts == 0 {
+			return fmt.Errorf("Queue %s specifies Failure-Tag without Max-Process-Attempts", k)
 		}
-		if v.Region == "" {
-			return fmt.Errorf("Queue %s must provide Region", k)
+		if strings.ContainsAny(v.Failure_Tag, ingest.FORBIDDEN_TAG_SET) {
+			return errors.New("Invalid characters in the Failure-Tag for " + k)
 		}
-		if v.AKID == "" {
-			return fmt.Errorf("Queue %s must provide AKID", k)
+	}
+	if v.Visibility_Extension != `` {
+		if d, err := time.ParseDuration(v.Visibility_Extension); err != nil || d < time.Second || d > maxVisibilityExtension {
+			return fmt.Errorf("Queue %s has invalid Visibility-Extension %q, must be between 1s and %v", k, v.Visibility_Extension, maxVisibilityExtension)
 		}
-		if v.Secret == "" {
-			return fmt.Errorf("Queue %s must provide Secret", k)
+	}
+	if v.Wait_Time_Seconds != nil && (*v.Wait_Time_Seconds < 0 || *v.Wait_Time_Seconds > maxWaitTimeSeconds) {
+		return fmt.Errorf("Queue %s Wait-Time-Seconds %d is out of range, must be between 0 and %d", k, *v.Wait_Time_Seconds, maxWaitTimeSeconds)
+	}
+	if v.Empty_Receive_Backoff != `` {
+		if d, err := time.ParseDuration(v.Empty_Receive_Backoff); err != nil || d <= 0 {
+			return fmt.Errorf("Queue %s has invalid Empty-Receive-Backoff %q", k, v.Empty_Receive_Backoff)
 		}
 	}
-
+	if v.Delete_Sync_Timeout != `` {
+		if d, err := time.ParseDuration(v.Delete_Sync_Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("Queue %s has invalid Delete-Sync-Timeout %q", k, v.Delete_Sync_Timeout)
+		} else if !v.deleteOnIngest() {
+			return fmt.Errorf("Queue %s specifies Delete-Sync-Timeout with Delete-On-Ingest disabled", k)
+		}
+	}
+	if v.Max_Number_Of_Messages == 0 {
+		v.Max_Number_Of_Messages = defaultMaxNumberOfMessages
+	} else if v.Max_Number_Of_Messages < 1 || v.Max_Number_Of_Messages > maxMaxNumberOfMessages {
+		return fmt.Errorf("Queue %s Max-Number-Of-Messages %d is out of range, must be between 1 and %d", k, v.Max_Number_Of_Messages, maxMaxNumberOfMessages)
+	}
+	if err := v.credentials().Validate(); err != nil {
+		return fmt.Errorf("Queue %s has invalid credentials: %v", k, err)
+	}
+	// without static keys, a role, or a profile the default SDK credential
+	// chain is used, which refreshes temporary credentials as they expire
 	return nil
 }
 
+// payloadLogger returns the logger for excerpts of bad payloads, nil unless
+// Log-Bad-Payloads is set.
+func (c *cfgType) payloadLogger(logf func(string, ...interface{}) error) *awsutils.PayloadLogger {
+	if !c.Log_Bad_Payloads {
+		return nil
+	}
+	return awsutils.NewPayloadLogger(c.Log_Bad_Payload_Size, logf)
+}
+
+// healthProgressWindow returns how long the ingester may go without a
+// successful receive before it is reported as not ready.
+func (c *cfgType) healthProgressWindow() time.Duration {
+	if d, err := time.ParseDuration(c.Health_Progress_Window); err == nil && d > 0 {
+		return d
+	}
+	return awsutils.DefaultHealthProgressWindow
+}
+
+// metricsInterval returns how often queue metrics should be reported.
+func (c *cfgType) metricsInterval() time.Duration {
+	if d, err := time.ParseDuration(c.Metrics_Interval); err == nil && d > 0 {
+		return d
+	}
+	return defaultMetricsInterval
+}
+
+// shutdownGrace returns how long readers are given to finish the messages
+// they have received before shutdown cancels them.
+func (c *cfgType) shutdownGrace() time.Duration {
+	if d, err := time.ParseDuration(c.Shutdown_Grace); err == nil && d >= 0 {
+		return d
+	}
+	return awsutils.DefaultShutdownGrace
+}
+
+// credentials returns the AWS credential options for the queue.
+func (q *queue) credentials() awsutils.Credentials {
+	return awsutils.Credentials{
+		AccessKeyID:     q.AKID,
+		SecretAccessKey: q.Secret,
+		RoleARN:         q.Role_ARN,
+		ExternalID:      q.External_ID,
+		SessionName:     q.Session_Name,
+		UseInstanceRole: q.Use_Instance_Role,
+		Profile:         q.AWS_Profile,
+		CredentialsFile: q.Credentials_File,
+	}
+}
+
+// endpoint returns the SQS endpoint overrides for the queue, falling back to
+// the global defaults.
+func (q *queue) endpoint(c *cfgType) awsutils.Endpoint {
+	e := awsutils.Endpoint{
+		URL:        q.Endpoint_URL,
+		DisableSSL: c.Disable_SSL,
+	}
+	if e.URL == `` {
+		e.URL = c.Endpoint_URL
+	}
+	if q.Disable_SSL != nil {
+		e.DisableSSL = *q.Disable_SSL
+	}
+	return e
+}
+
+// rateLimit returns the bytes per second the queue is limited to, zero if it
+// is only limited by the global Rate-Limit.
+func (q *queue) rateLimit() int64 {
+	bps, _ := config.ParseRate(q.Rate_Limit)
+	return bps
+}
+
+// sizeGuard returns the entry size limit of the queue, nil if there is none.
+func (q *queue) sizeGuard() (*awsutils.SizeGuard, error) {
+	return awsutils.NewSizeGuard(q.Max_Entry_Size, q.Oversize_Action)
+}
+
+// lineSplitter returns the message line splitter of the queue, nil if messages
+// are not split.
+func (q *queue) lineSplitter() *awsutils.LineSplitter {
+	return awsutils.NewLineSplitter(q.Split_Lines, q.Line_Delimiter)
+}
+
+// batchCoalescer returns the batch coalescer of the queue, nil if messages are
+// not coalesced.
+func (q *queue) batchCoalescer() *batchCoalescer {
+	return newBatchCoalescer(q.Coalesce_Batch, q.Coalesce_Separator, q.Coalesce_Timestamp)
+}
+
+// deleteOnIngest returns whether successfully ingested messages should be
+// removed from the queue. An unset Delete-On-Ingest defaults to true.
+func (q *queue) deleteOnIngest() bool {
+	return q.Delete_On_Ingest == nil || *q.Delete_On_Ingest
+}
+
+// deleteSyncTimeout returns how long to wait for the indexers to acknowledge
+// the entries of messages before deleting them, zero deletes them as soon as
+// they are handed to the muxer.
+func (q *queue) deleteSyncTimeout() time.Duration {
+	d, _ := time.ParseDuration(q.Delete_Sync_Timeout)
+	return d
+}
+
+// visibilityExtension returns how long to extend the visibility timeout of
+// messages still being processed, zero disables the heartbeat.
+func (q *queue) visibilityExtension() time.Duration {
+	d, _ := time.ParseDuration(q.Visibility_Extension)
+	return d
+}
+
+// emptyReceiveBackoff returns the longest sleep after consecutive empty
+// receives, zero receives again immediately.
+func (q *queue) emptyReceiveBackoff() time.Duration {
+	d, _ := time.ParseDuration(q.Empty_Receive_Backoff)
+	return d
+}
+
+// jsonTimestamp returns the extractor for the Timestamp-JSON-Path, nil if
+// timestamps are only found by scanning messages.
+func (q *queue) jsonTimestamp() (*awsutils.JSONTimestamp, error) {
+	return awsutils.NewJSONTimestamp(q.Timestamp_JSON_Path)
+}
+
+// timestampClamp returns the bounds on extracted timestamps, nil if they are
+// unbounded.
+func (q *queue) timestampClamp() (*awsutils.TimestampClamp, error) {
+	return awsutils.NewTimestampClamp(q.Max_Timestamp_Skew_Past, q.Max_Timestamp_Skew_Future)
+}
+
+// attributeNames returns the message system attributes requested with every
+// receive, the Attribute-Names along with those needed by the queue's
+// features. Names are matched without regard to case.
+func (q *queue) attributeNames() ([]*string, error) {
+	names := []string{sqs.MessageSystemAttributeNameSentTimestamp}
+	if q.fifo() {
+		names = append(names, sqs.MessageSystemAttributeNameMessageGroupId)
+	}
+	if q.Max_Process_Attempts > 0 {
+		names = append(names, sqs.MessageSystemAttributeNameApproximateReceiveCount)
+	}
+	var all bool
+	for _, n := range q.Attribute_Names {
+		var found bool
+		for _, known := range messageAttributeNames {
+			if strings.EqualFold(strings.TrimSpace(n), known) {
+				names = append(names, known)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("invalid Attribute-Names %q", n)
+		}
+		all = all || strings.EqualFold(strings.TrimSpace(n), sqs.QueueAttributeNameAll)
+	}
+	if all {
+		return []*string{aws.String(sqs.QueueAttributeNameAll)}, nil
+	}
+	seen := make(map[string]bool, len(names))
+	var r []*string
+	for _, n := range names {
+		if !seen[n] {
+			seen[n] = true
+			r = append(r, aws.String(n))
+		}
+	}
+	return r, nil
+}
+
+// readerCount returns the number of concurrent receivers for the queue.
+func (q *queue) readerCount() int {
+	if q.Reader_Count <= 0 {
+		return 1
+	}
+	return q.Reader_Count
+}
+
+// fifo returns whether the queue is a FIFO queue.
+func (q *queue) fifo() bool {
+	return q.FIFO || strings.HasSuffix(q.Queue_URL, fifoQueueSuffix)
+}
+
+// s3Region returns the region used to fetch objects in S3 event mode.
+func (q *queue) s3Region() string {
+	if q.S3_Region != `` {
+		return q.S3_Region
+	}
+	return q.Region
+}
+
+// waitTimeSeconds returns the long polling wait time for receive calls. An
+// unset Wait-Time-Seconds defaults to the maximum of 20 seconds.
+func (q *queue) waitTimeSeconds() int64 {
+	if q.Wait_Time_Seconds == nil {
+		return defaultWaitTimeSeconds
+	}
+	return *q.Wait_Time_Seconds
+}
+
 func (c *cfgType) Tags() ([]string, error) {
 	var tags []string
 	tagMp := make(map[string]bool, 1)
@@ -148,11 +658,34 @@ func (c *cfgType) Tags() ([]string, error) {
 			tags = append(tags, v.Tag_Name)
 			tagMp[v.Tag_Name] = true
 		}
+		if v.Failure_Tag != `` && !tagMp[v.Failure_Tag] {
+			tags = append(tags, v.Failure_Tag)
+			tagMp[v.Failure_Tag] = true
+		}
+	}
+	// templated tags are negotiated as queues are discovered
+	for _, v := range c.Queue_Discovery {
+		if v.Tag_Template == `` && v.Tag_Name != `` && !tagMp[v.Tag_Name] {
+			tags = append(tags, v.Tag_Name)
+			tagMp[v.Tag_Name] = true
+		}
+		if v.Failure_Tag != `` && !tagMp[v.Failure_Tag] {
+			tags = append(tags, v.Failure_Tag)
+			tagMp[v.Failure_Tag] = true
+		}
+	}
+	if c.Metrics_Tag != `` && !tagMp[c.Metrics_Tag] {
+		tags = append(tags, c.Metrics_Tag)
 	}
 
-	if len(tags) == 0 {
+	if len(tags) == 0 && len(c.Queue_Discovery) == 0 {
 		return nil, errors.New("No tags specified")
 	}
 	sort.Strings(tags)
 	return tags, nil
 }
+
+// tagTemplate parses the Tag-Template of the queue, nil if there is none.
+func (v *queue) tagTemplate() (*awsutils.TagTemplate, error) {
+	return awsutils.ParseTagTemplate(v.Tag_Template, tagTemplateVars...)
+}
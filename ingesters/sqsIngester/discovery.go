@@ -0,0 +1,195 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+const (
+	defaultDiscoveryInterval = 5 * time.Minute
+	maxListQueuesResults     = 1000 // ListQueues returns at most this many URLs
+
+	discoveryBackoffBase = time.Second
+	discoveryBackoffMax  = 5 * time.Minute
+)
+
+// queueDiscovery reads every queue whose name starts with a prefix, picking up
+// queues as they are created and dropping them once they are deleted. All of
+// the options of a Queue other than Queue-URL apply to each discovered queue.
+type queueDiscovery struct {
+	queue
+	Queue_Name_Prefix  string
+	Tag_Template       string // tag for discovered queues, {queue} is replaced with the queue name, other placeholders are rendered per entry
+	Discovery_Interval string // how often to list the queues, e.g. 5m
+}
+
+func (c *cfgType) verifyQueueDiscovery(k string, v *queueDiscovery) error {
+	if v == nil {
+		return fmt.Errorf("Queue-Discovery %s config is nil", k)
+	}
+	if v.Queue_URL != `` {
+		return fmt.Errorf("Queue-Discovery %s cannot specify a Queue-URL", k)
+	}
+	if v.Queue_Name_Prefix == `` {
+		return fmt.Errorf("Queue-Discovery %s must provide Queue-Name-Prefix", k)
+	}
+	if v.FIFO {
+		return fmt.Errorf("Queue-Discovery %s cannot force FIFO, FIFO queues are detected by name", k)
+	}
+	if err := c.verifyQueue(k, &v.queue); err != nil {
+		return err
+	}
+	// only queue names are sanitized, the rest of the template must be valid
+	if _, err := awsutils.ParseTagTemplate(v.Tag_Template, tagTemplateVars...); err != nil {
+		return fmt.Errorf("Queue-Discovery %s: %v", k, err)
+	}
+	if v.Discovery_Interval != `` {
+		if d, err := time.ParseDuration(v.Discovery_Interval); err != nil || d <= 0 {
+			return fmt.Errorf("Queue-Discovery %s has invalid Discovery-Interval %q", k, v.Discovery_Interval)
+		}
+	}
+	return nil
+}
+
+// tagFor returns the tag for a discovered queue. A Tag-Template using nothing
+// but the queue name is rendered into the tag of the queue, characters which
+// can't be used in a tag, such as the dot in a .fifo suffix, are replaced with
+// dashes. Any other template is returned for the queue to render per entry,
+// falling back to Tag-Name.
+func (qd *queueDiscovery) tagFor(name string) (tag, tmpl string) {
+	tt, err := awsutils.ParseTagTemplate(qd.Tag_Template, tagTemplateVars...)
+	if tt == nil || err != nil {
+		return qd.Tag_Name, ``
+	}
+	if tag, err = tt.Render(func(v string) string {
+		if v == tagVarQueue {
+			return name
+		}
+		return ``
+	}, nil); err == nil {
+		return tag, ``
+	}
+	return qd.Tag_Name, qd.Tag_Template
+}
+
+// discoveryInterval returns how often to look for new and deleted queues.
+func (qd *queueDiscovery) discoveryInterval() time.Duration {
+	if d, err := time.ParseDuration(qd.Discovery_Interval); err == nil && d > 0 {
+		return d
+	}
+	return defaultDiscoveryInterval
+}
+
+// startFunc starts reading a discovered queue, returning a function which
+// stops the readers.
+type startFunc func(name string, q *queue) (stop func(), err error)
+
+// discoverer periodically lists the queues matching a Queue-Discovery section,
+// starting and stopping readers as queues come and go.
+type discoverer struct {
+	name    string
+	def     *queueDiscovery
+	svc     sqsiface.SQSAPI
+	start   startFunc
+	running map[string]func() // queue URL to stop function
+	warned  bool
+}
+
+func newDiscoverer(name string, def *queueDiscovery, svc sqsiface.SQSAPI, start startFunc) *discoverer {
+	return &discoverer{
+		name:    name,
+		def:     def,
+		svc:     svc,
+		start:   start,
+		running: make(map[string]func()),
+	}
+}
+
+// Discover lists the matching queues once, starting readers for new queues and
+// stopping those of queues which no longer exist.
+func (d *discoverer) Discover() error {
+	out, err := d.svc.ListQueues(&sqs.ListQueuesInput{
+		QueueNamePrefix: aws.String(d.def.Queue_Name_Prefix),
+	})
+	if err != nil {
+		return err
+	}
+	if len(out.QueueUrls) >= maxListQueuesResults && !d.warned {
+		// this version of the API can't page, so a longer prefix is needed
+		lg.Warn("Queue-Discovery %s matched %d queues, the most ListQueues returns, some queues may be missed", d.name, len(out.QueueUrls))
+		d.warned = true
+	}
+
+	found := make(map[string]bool, len(out.QueueUrls))
+	for _, u := range out.QueueUrls {
+		url := aws.StringValue(u)
+		found[url] = true
+		if _, ok := d.running[url]; ok {
+			continue
+		}
+		name := path.Base(url)
+		q := d.def.queue
+		q.Queue_URL = url
+		q.Tag_Name, q.Tag_Template = d.def.tagFor(name)
+		if q.fifo() && q.readerCount() > 1 {
+			// ordering is only preserved with a single receiver
+			q.Reader_Count = 1
+		}
+		stop, err := d.start(d.name+`/`+name, &q)
+		if err != nil {
+			// try again on the next pass
+			lg.Error("Failed to start discovered queue %s: %v", url, err)
+			continue
+		}
+		lg.Info("Discovered queue %s with tag %s", url, q.Tag_Name)
+		d.running[url] = stop
+	}
+	for url, stop := range d.running {
+		if !found[url] {
+			lg.Info("Queue %s is gone, stopping its readers", url)
+			stop()
+			delete(d.running, url)
+		}
+	}
+	return nil
+}
+
+// run discovers queues until done is closed, then stops every reader it
+// started. Failed listings, such as when throttled, are retried with a backoff.
+func (d *discoverer) run(done chan bool) {
+	backoff := awsutils.NewBackoff(discoveryBackoffBase, discoveryBackoffMax)
+	for {
+		wait := d.def.discoveryInterval()
+		if err := d.Discover(); err != nil {
+			lg.Error("Failed to list queues for Queue-Discovery %s: %s", d.name, awsutils.ErrorMessage(err))
+			wait = backoff.Next()
+		} else {
+			backoff.Reset()
+		}
+		tmr := time.NewTimer(wait)
+		select {
+		case <-tmr.C:
+		case <-done:
+			tmr.Stop()
+			for _, stop := range d.running {
+				stop()
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// testLister returns whatever queue URLs it currently holds, or err.
+type testLister struct {
+	sqsiface.SQSAPI
+	urls   []string
+	prefix string
+	err    error
+}
+
+func (tl *testLister) ListQueues(in *sqs.ListQueuesInput) (*sqs.ListQueuesOutput, error) {
+	tl.prefix = aws.StringValue(in.QueueNamePrefix)
+	if tl.err != nil {
+		return nil, tl.err
+	}
+	return &sqs.ListQueuesOutput{QueueUrls: aws.StringSlice(tl.urls)}, nil
+}
+
+func TestDiscovery(t *testing.T) {
+	lg = log.NewDiscardLogger()
+	const base = `https://sqs.us-east-1.amazonaws.com/123456789012/`
+	qd := &queueDiscovery{
+		queue:             queue{Region: `us-east-1`, Use_Instance_Role: true, Reader_Count: 4},
+		Queue_Name_Prefix: `tenant-`,
+		Tag_Template:      `sqs-{queue}`,
+	}
+	c := &cfgType{Queue_Discovery: map[string]*queueDiscovery{`tenants`: qd}}
+	if err := c.verifyQueueDiscovery(`tenants`, qd); err != nil {
+		t.Fatal(err)
+	}
+
+	started := map[string]*queue{}
+	stopped := map[string]bool{}
+	start := func(name string, q *queue) (func(), error) {
+		started[name] = q
+		return func() { stopped[name] = true }, nil
+	}
+	tl := &testLister{urls: []string{base + `tenant-a`, base + `tenant-b.fifo`}}
+	d := newDiscoverer(`tenants`, qd, tl, start)
+	if err := d.Discover(); err != nil {
+		t.Fatal(err)
+	}
+	if tl.prefix != `tenant-` {
+		t.Fatalf("bad prefix %q", tl.prefix)
+	}
+	a, b := started[`tenants/tenant-a`], started[`tenants/tenant-b.fifo`]
+	if len(started) != 2 || a == nil || b == nil {
+		t.Fatalf("bad started queues: %v", started)
+	}
+	if a.Queue_URL != base+`tenant-a` || a.Tag_Name != `sqs-tenant-a` || a.readerCount() != 4 {
+		t.Fatalf("bad queue: %+v", a)
+	}
+	if b.Tag_Name != `sqs-tenant-b-fifo` || b.readerCount() != 1 {
+		t.Fatalf("bad FIFO queue: %+v", b)
+	}
+
+	// a failed listing changes nothing
+	tl.err = errors.New("Throttling: Rate exceeded")
+	if err := d.Discover(); err == nil || len(stopped) != 0 {
+		t.Fatal("failed listing was not reported or stopped queues")
+	}
+
+	tl.err = nil
+	tl.urls = []string{base + `tenant-a`, base + `tenant-c`}
+	if err := d.Discover(); err != nil {
+		t.Fatal(err)
+	}
+	if len(started) != 3 || started[`tenants/tenant-c`] == nil {
+		t.Fatalf("new queue not started: %v", started)
+	}
+	if len(stopped) != 1 || !stopped[`tenants/tenant-b.fifo`] {
+		t.Fatalf("deleted queue not stopped: %v", stopped)
+	}
+
+	qd.Tag_Template = `bad tag {queue}`
+	if err := c.verifyQueueDiscovery(`tenants`, qd); err == nil {
+		t.Fatal("accepted a template with forbidden characters")
+	}
+
+	// templates using more than the queue name are rendered per entry
+	qd.Tag_Template = `{queue}-{json:app}`
+	qd.Tag_Name = `fallback`
+	if err := c.verifyQueueDiscovery(`tenants`, qd); err != nil {
+		t.Fatal(err)
+	}
+	if tag, tmpl := qd.tagFor(`tenant-d`); tag != `fallback` || tmpl != qd.Tag_Template {
+		t.Fatalf("bad per entry template %q %q", tag, tmpl)
+	}
+}
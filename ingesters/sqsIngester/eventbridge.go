@@ -0,0 +1,72 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	eventBridgeNone     = `none`
+	eventBridgeEnvelope = `envelope` // ingest the whole event
+	eventBridgeDetail   = `detail`   // ingest only the detail object
+)
+
+// eventBridgeEvent is the envelope EventBridge (formerly CloudWatch Events)
+// puts around events it delivers to an SQS queue.
+type eventBridgeEvent struct {
+	Version    string
+	ID         string
+	DetailType string `json:"detail-type"`
+	Source     string
+	Account    string
+	Time       string
+	Region     string
+	Resources  []string
+	Detail     json.RawMessage
+}
+
+// parseEventBridgeMode normalizes an EventBridge-Mode, none is returned as an
+// empty mode.
+func parseEventBridgeMode(v string) (string, error) {
+	switch m := strings.ToLower(strings.TrimSpace(v)); m {
+	case ``, eventBridgeNone:
+		return ``, nil
+	case eventBridgeEnvelope, eventBridgeDetail:
+		return m, nil
+	}
+	return ``, fmt.Errorf("invalid EventBridge-Mode %q, must be envelope, detail, or none", v)
+}
+
+// unwrapEventBridge parses an EventBridge event, returning the data to ingest
+// for the mode along with the time of the event. If the body is not an
+// EventBridge event ok is false and the body should be ingested as is. The
+// timestamp is zero if the event time is missing or malformed.
+func unwrapEventBridge(body []byte, mode string) (msg []byte, ts time.Time, ok bool) {
+	var ev eventBridgeEvent
+	if err := json.Unmarshal(body, &ev); err != nil {
+		return
+	}
+	if ev.Source == `` || ev.DetailType == `` || len(ev.Detail) == 0 {
+		return
+	}
+	if mode == eventBridgeDetail {
+		msg = []byte(ev.Detail)
+	} else {
+		msg = body
+	}
+	if t, err := time.Parse(time.RFC3339Nano, ev.Time); err == nil {
+		ts = t
+	}
+	ok = true
+	return
+}
@@ -0,0 +1,66 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const testEventBridgeEvent = `{
+  "version": "0",
+  "id": "6a7e8feb-b491-4cf7-a9f1-bf3703467718",
+  "detail-type": "EC2 Instance State-change Notification",
+  "source": "aws.ec2",
+  "account": "111122223333",
+  "time": "2017-12-22T18:43:48Z",
+  "region": "us-west-1",
+  "resources": ["arn:aws:ec2:us-west-1:123456789012:instance/i-1234567890abcdef0"],
+  "detail": {"instance-id": "i-1234567890abcdef0", "state": "terminated"}
+}`
+
+func TestUnwrapEventBridge(t *testing.T) {
+	exp := time.Date(2017, 12, 22, 18, 43, 48, 0, time.UTC)
+	msg, ts, ok := unwrapEventBridge([]byte(testEventBridgeEvent), eventBridgeDetail)
+	if !ok || string(msg) != `{"instance-id": "i-1234567890abcdef0", "state": "terminated"}` || !ts.Equal(exp) {
+		t.Fatalf("bad detail: %q %v %v", msg, ts, ok)
+	}
+	msg, ts, ok = unwrapEventBridge([]byte(testEventBridgeEvent), eventBridgeEnvelope)
+	if !ok || string(msg) != testEventBridgeEvent || !ts.Equal(exp) {
+		t.Fatalf("bad envelope: %q %v %v", msg, ts, ok)
+	}
+
+	bodies := []string{
+		`just some text`,
+		`{"foo":"bar"}`,
+		`{"source":"aws.ec2","detail":{}}`,
+		`{"source":"aws.ec2","detail-type":"Scheduled Event"}`,
+	}
+	for _, b := range bodies {
+		if _, _, ok := unwrapEventBridge([]byte(b), eventBridgeDetail); ok {
+			t.Fatalf("unwrapped non-EventBridge body %q", b)
+		}
+	}
+	// a bad time still unwraps, just without a timestamp
+	msg, ts, ok = unwrapEventBridge([]byte(`{"source":"app","detail-type":"x","time":"yesterday","detail":[1]}`), eventBridgeDetail)
+	if !ok || string(msg) != `[1]` || !ts.IsZero() {
+		t.Fatalf("bad unwrap with invalid time: %q %v %v", msg, ts, ok)
+	}
+}
+
+func TestParseEventBridgeMode(t *testing.T) {
+	for in, exp := range map[string]string{``: ``, `None`: ``, ` Detail `: eventBridgeDetail, `ENVELOPE`: eventBridgeEnvelope} {
+		if m, err := parseEventBridgeMode(in); err != nil || m != exp {
+			t.Fatalf("EventBridge-Mode %q parsed to %q: %v", in, m, err)
+		}
+	}
+	if _, err := parseEventBridgeMode(`payload`); err == nil {
+		t.Fatal("accepted an invalid EventBridge-Mode")
+	}
+}
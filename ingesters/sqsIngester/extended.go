@@ -0,0 +1,79 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Pointer classes written by the SQS Extended Client Library, the legacy
+// class is used by releases before the payload offloading library split off.
+const (
+	extendedPointerClass       = `software.amazon.payloadoffloading.PayloadS3Pointer`
+	legacyExtendedPointerClass = `com.amazon.sqs.javamessaging.MessageS3Pointer`
+)
+
+// extendedPointer is the location of a payload the SQS Extended Client
+// offloaded to S3.
+type extendedPointer struct {
+	S3BucketName string `json:"s3BucketName"`
+	S3Key        string `json:"s3Key"`
+}
+
+// parseExtendedPointer returns the S3 object holding the real payload of a
+// message sent with the SQS Extended Client. The body is a JSON array of the
+// pointer class and the pointer, ok is false for any other body.
+func parseExtendedPointer(body []byte) (obj s3Object, ok bool) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 || body[0] != '[' {
+		return
+	}
+	var parts []json.RawMessage
+	if err := json.Unmarshal(body, &parts); err != nil || len(parts) != 2 {
+		return
+	}
+	var class string
+	if err := json.Unmarshal(parts[0], &class); err != nil {
+		return
+	} else if class != extendedPointerClass && class != legacyExtendedPointerClass {
+		return
+	}
+	var p extendedPointer
+	if err := json.Unmarshal(parts[1], &p); err != nil || p.S3BucketName == `` || p.S3Key == `` {
+		return
+	}
+	return s3Object{Bucket: p.S3BucketName, Key: p.S3Key}, true
+}
+
+// fetchPayload reads an offloaded payload in full.
+func fetchPayload(svc s3API, obj s3Object) ([]byte, error) {
+	out, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(obj.Bucket),
+		Key:    aws.String(obj.Key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return ioutil.ReadAll(out.Body)
+}
+
+// deletePayload removes an offloaded payload once its message is deleted.
+func deletePayload(svc s3API, obj s3Object) error {
+	_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(obj.Bucket),
+		Key:    aws.String(obj.Key),
+	})
+	return err
+}
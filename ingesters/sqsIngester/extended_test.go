@@ -0,0 +1,102 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeS3 implements s3API over a map of bucket/key to object contents.
+type fakeS3 struct {
+	sync.Mutex
+	objects map[string][]byte
+	deleted []string
+}
+
+func (fs *fakeS3) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	b, ok := fs.objects[aws.StringValue(in.Bucket)+`/`+aws.StringValue(in.Key)]
+	if !ok {
+		return nil, errors.New("NoSuchKey")
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(b))}, nil
+}
+
+func (fs *fakeS3) DeleteObject(in *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	k := aws.StringValue(in.Bucket) + `/` + aws.StringValue(in.Key)
+	delete(fs.objects, k)
+	fs.deleted = append(fs.deleted, k)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestParseExtendedPointer(t *testing.T) {
+	good := map[string]s3Object{
+		`["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"bucket","s3Key":"a/b"}]`: {Bucket: `bucket`, Key: `a/b`},
+		` ["com.amazon.sqs.javamessaging.MessageS3Pointer", {"s3BucketName":"old","s3Key":"c"}] `:        {Bucket: `old`, Key: `c`},
+	}
+	for body, want := range good {
+		if obj, ok := parseExtendedPointer([]byte(body)); !ok || obj != want {
+			t.Fatalf("bad pointer from %s: %+v %v", body, obj, ok)
+		}
+	}
+	for _, body := range []string{
+		`plain text`,
+		`["some.other.Class",{"s3BucketName":"bucket","s3Key":"a"}]`,
+		`["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"bucket"}]`,
+		`["software.amazon.payloadoffloading.PayloadS3Pointer"]`,
+		`[1,2]`,
+	} {
+		if _, ok := parseExtendedPointer([]byte(body)); ok {
+			t.Fatalf("%s treated as a pointer", body)
+		}
+	}
+}
+
+func TestConsumeExtended(t *testing.T) {
+	var tw testEntryWriter
+	hcfg := newTestHandler(t, &tw)
+	hcfg.sqsExtended = true
+	fs := &fakeS3{objects: map[string][]byte{`bucket/big`: []byte(`the real payload`)}}
+	hcfg.s3svc = fs
+	fq := &fakeQueue{script: []fakeReceive{{bodies: []string{
+		`["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"bucket","s3Key":"big"}]`,
+		`["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"bucket","s3Key":"missing"}]`,
+		`small`,
+	}}}}
+	stop, _ := startConsumer(t, hcfg, fq)
+	waitFor(t, `2 messages to be deleted`, func() bool { return fq.deletes() == 2 })
+	stop()
+
+	tw.Lock()
+	defer tw.Unlock()
+	if len(tw.ents) != 2 || string(tw.ents[0].Data) != `the real payload` || string(tw.ents[1].Data) != `small` {
+		t.Fatalf("bad entries: %v", tw.ents)
+	}
+	// the message whose payload couldn't be fetched is left for redelivery
+	for _, h := range fq.deleted {
+		if h == `msg-2` {
+			t.Fatal("deleted a message whose payload was not ingested")
+		}
+	}
+	fs.Lock()
+	defer fs.Unlock()
+	if len(fs.deleted) != 1 || fs.deleted[0] != `bucket/big` {
+		t.Fatalf("bad payload deletes: %v", fs.deleted)
+	}
+}
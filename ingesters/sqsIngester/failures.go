@@ -0,0 +1,104 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingesters/utils"
+)
+
+// SQS retains messages for at most 14 days, failures older than that can
+// never be seen again
+const failureRetention = 14 * 24 * time.Hour
+
+type failureRecord struct {
+	Count int
+	Last  time.Time
+}
+
+// failureTracker counts processing failures of messages across redeliveries so
+// that messages which can never be ingested are eventually given up on. The
+// counts are optionally persisted so that they survive a restart.
+type failureTracker struct {
+	sync.Mutex
+	counts map[string]failureRecord
+	state  *utils.State
+}
+
+// newFailureTracker creates a tracker, loading any counts persisted in the
+// state file. A nil state keeps the counts in memory only.
+func newFailureTracker(state *utils.State) (*failureTracker, error) {
+	ft := &failureTracker{
+		counts: make(map[string]failureRecord),
+		state:  state,
+	}
+	if state != nil {
+		// an empty state file is treated as no state
+		if err := state.Read(&ft.counts); err != nil && err != utils.ErrNoState && err != io.EOF {
+			return nil, err
+		}
+		if ft.counts == nil {
+			ft.counts = make(map[string]failureRecord)
+		}
+	}
+	return ft, nil
+}
+
+func failureKey(queue, id string) string {
+	return queue + `/` + id
+}
+
+// Fail records a failed attempt at processing a message and returns the number
+// of failed attempts so far.
+func (ft *failureTracker) Fail(key string) int {
+	ft.Lock()
+	defer ft.Unlock()
+	now := time.Now()
+	for k, v := range ft.counts {
+		if now.Sub(v.Last) > failureRetention {
+			delete(ft.counts, k)
+		}
+	}
+	r := ft.counts[key]
+	r.Count++
+	r.Last = now
+	ft.counts[key] = r
+	ft.persist()
+	return r.Count
+}
+
+// Count returns the number of failed attempts at processing a message.
+func (ft *failureTracker) Count(key string) int {
+	ft.Lock()
+	defer ft.Unlock()
+	return ft.counts[key].Count
+}
+
+// Clear forgets the failures of a message that has been ingested or dropped.
+func (ft *failureTracker) Clear(key string) {
+	ft.Lock()
+	defer ft.Unlock()
+	if _, ok := ft.counts[key]; ok {
+		delete(ft.counts, key)
+		ft.persist()
+	}
+}
+
+// persist writes the counts to the state file, the caller must hold the lock.
+func (ft *failureTracker) persist() {
+	if ft.state == nil {
+		return
+	}
+	if err := ft.state.Write(ft.counts); err != nil {
+		lg.Error("Failed to write failure state: %v", err)
+	}
+}
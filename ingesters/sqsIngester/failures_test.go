@@ -0,0 +1,54 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gravwell/gravwell/v3/ingest/log"
+	"github.com/gravwell/gravwell/v3/ingesters/utils"
+)
+
+func TestFailureTracker(t *testing.T) {
+	lg = log.NewDiscardLogger()
+	dir, err := ioutil.TempDir(``, `sqsfail`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	st, err := utils.NewState(filepath.Join(dir, `failures.state`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft, err := newFailureTracker(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := failureKey(`queue`, `a`), failureKey(`queue`, `b`)
+	ft.Fail(a)
+	if n := ft.Fail(a); n != 2 {
+		t.Fatalf("bad failure count: %d", n)
+	}
+	ft.Fail(b)
+	ft.Clear(b)
+
+	// counts survive a restart
+	if ft, err = newFailureTracker(st); err != nil {
+		t.Fatal(err)
+	}
+	if n := ft.Count(a); n != 2 {
+		t.Fatalf("failure count not persisted: %d", n)
+	}
+	if n := ft.Count(b); n != 0 {
+		t.Fatalf("cleared failure count persisted: %d", n)
+	}
+}
@@ -0,0 +1,75 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Error codes SQS returns when it cannot use the KMS key of an SSE-KMS queue
+// to decrypt received messages.
+const (
+	errCodeKmsAccessDenied    = `KMS.AccessDeniedException`
+	errCodeKmsDisabled        = `KMS.DisabledException`
+	errCodeKmsInvalidKeyUsage = `KMS.InvalidKeyUsageException`
+	errCodeKmsInvalidState    = `KMS.InvalidStateException`
+	errCodeKmsNotFound        = `KMS.NotFoundException`
+	errCodeKmsOptInRequired   = `KMS.OptInRequired`
+	errCodeKmsThrottled       = `KMS.ThrottlingException`
+)
+
+var kmsHints = map[string]string{
+	errCodeKmsAccessDenied:    `the ingester's IAM identity is likely missing kms:Decrypt on the key, grant it in the IAM policy and make sure the key policy allows it`,
+	errCodeKmsDisabled:        `the key is disabled, enable it or change the KmsMasterKeyId of the queue`,
+	errCodeKmsInvalidKeyUsage: `the key is not a symmetric encryption key, change the KmsMasterKeyId of the queue`,
+	errCodeKmsInvalidState:    `the key cannot be used in its current state, e.g. pending deletion, cancel the deletion or change the KmsMasterKeyId of the queue`,
+	errCodeKmsNotFound:        `the key does not exist, change the KmsMasterKeyId of the queue`,
+	errCodeKmsOptInRequired:   `the account is not subscribed to KMS`,
+	errCodeKmsThrottled:       `KMS is throttling decryption, raise the KmsDataKeyReusePeriodSeconds of the queue or the KMS request quota`,
+}
+
+// kmsHint returns remediation advice if err is a failure to use the KMS key
+// of an SSE-KMS queue, and an empty string otherwise.
+func kmsHint(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return kmsHints[aerr.Code()]
+	}
+	return ``
+}
+
+// queueKmsKey returns the KMS key of a queue, or a placeholder if it cannot be
+// looked up.
+func queueKmsKey(svc sqsAPI, queue string) string {
+	out, err := svc.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(queue),
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameKmsMasterKeyId)},
+	})
+	if err == nil {
+		if key := aws.StringValue(out.Attributes[sqs.QueueAttributeNameKmsMasterKeyId]); key != `` {
+			return key
+		}
+	}
+	return `(unknown)`
+}
+
+// receiveError describes a failed receive. SQS reports KMS failures on SSE-KMS
+// queues with little context, those name the key and what likely needs fixing.
+func receiveError(svc sqsAPI, queue string, err error) string {
+	if hint := kmsHint(err); hint != `` {
+		return fmt.Sprintf("sqs receive message from SSE-KMS queue %s failed using KMS key %s, %s: %s",
+			queue, queueKmsKey(svc, queue), hint, awsutils.ErrorMessage(err))
+	}
+	return fmt.Sprintf("sqs receive message: %s", awsutils.ErrorMessage(err))
+}
@@ -0,0 +1,48 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// kmsQueue is a fakeQueue encrypted with a KMS key.
+type kmsQueue struct {
+	fakeQueue
+}
+
+func (kq *kmsQueue) GetQueueAttributes(in *sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
+	return &sqs.GetQueueAttributesOutput{Attributes: map[string]*string{
+		sqs.QueueAttributeNameKmsMasterKeyId: aws.String(`alias/ingest`),
+	}}, nil
+}
+
+func TestReceiveError(t *testing.T) {
+	err := awserr.New(errCodeKmsAccessDenied, `The ciphertext refers to a customer master key that does not exist`, nil)
+	msg := receiveError(&kmsQueue{}, `https://sqs/queue`, err)
+	if !strings.Contains(msg, `alias/ingest`) || !strings.Contains(msg, `kms:Decrypt`) || !strings.Contains(msg, errCodeKmsAccessDenied) {
+		t.Fatalf("bad KMS error message %q", msg)
+	}
+	if msg = receiveError(&fakeQueue{}, `https://sqs/queue`, awserr.New(errCodeKmsDisabled, `disabled`, nil)); !strings.Contains(msg, `(unknown)`) {
+		t.Fatalf("bad message for a queue without a key %q", msg)
+	}
+
+	// other errors are reported as they are
+	for _, err := range []error{errors.New(`network down`), awserr.New(sqs.ErrCodeOverLimit, `over`, nil)} {
+		if msg := receiveError(&kmsQueue{}, `https://sqs/queue`, err); msg != `sqs receive message: `+err.Error() {
+			t.Fatalf("bad message %q", msg)
+		}
+	}
+}
@@ -9,36 +9,49 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime/debug"
 	"runtime/pprof"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gravwell/gravwell/v3/ingest"
 	"github.com/gravwell/gravwell/v3/ingest/entry"
 	"github.com/gravwell/gravwell/v3/ingest/log"
 	"github.com/gravwell/gravwell/v3/ingest/processors"
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
 	"github.com/gravwell/gravwell/v3/ingesters/utils"
 	"github.com/gravwell/gravwell/v3/ingesters/version"
+	"github.com/gravwell/gravwell/v3/timegrinder"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/sqs"
 )
 
 const (
-	defaultConfigLoc     = `/opt/gravwell/etc/sqs.conf`
-	ingesterName         = `sqsIngester`
-	batchSize            = 512
-	maxDataSize      int = 8 * 1024 * 1024
-	initDataSize     int = 512 * 1024
+	defaultConfigLoc       = `/opt/gravwell/etc/sqs.conf`
+	ingesterName           = `sqsIngester`
+	batchSize              = 512
+	batchFlushInterval     = 500 * time.Millisecond
+	receiveBackoffBase     = 100 * time.Millisecond
+	receiveBackoffMax      = 30 * time.Second
+	emptyBackoffBase       = time.Second     // first sleep after an empty receive, doubled on each one after
+	maxDeleteBatch         = 10              // SQS limit on entries per DeleteMessageBatch
+	panicRestartDelay      = 5 * time.Second // wait before relaunching a reader which panicked
+	maxDataSize        int = 8 * 1024 * 1024
+	initDataSize       int = 512 * 1024
 )
 
 var (
@@ -47,29 +60,88 @@ var (
 	verbose        = flag.Bool("v", false, "Display verbose status updates to stdout")
 	stderrOverride = flag.String("stderr", "", "Redirect stderr to a shared memory file")
 	ver            = flag.Bool("version", false, "Print the version information and exit")
+	validate       = flag.Bool("validate", false, "Validate the configuration and AWS access, then exit")
+	selftest       = flag.Bool("selftest", false, "Write a canary entry to every configured tag once connected to the indexers, then exit")
 
 	v    bool
 	lg   *log.Logger
 	igst *ingest.IngestMuxer
 )
 
+// sqsAPI is the part of the SQS client used to consume a queue, it is
+// satisfied by *sqs.SQS and faked in the tests.
+type sqsAPI interface {
+	ReceiveMessageWithContext(aws.Context, *sqs.ReceiveMessageInput, ...request.Option) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessageBatch(*sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error)
+	ChangeMessageVisibilityBatch(*sqs.ChangeMessageVisibilityBatchInput) (*sqs.ChangeMessageVisibilityBatchOutput, error)
+	GetQueueAttributes(*sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error)
+}
+
+// syncer waits for the entries handed to the ingest muxer to be acknowledged
+// by the indexers, it is satisfied by *ingest.IngestMuxer.
+type syncer interface {
+	Sync(time.Duration) error
+}
+
+// s3API is the part of the S3 client used to fetch the objects referenced by
+// messages, it is satisfied by *s3.S3 and faked in the tests.
+type s3API interface {
+	GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error)
+	DeleteObject(*s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error)
+}
+
 type handlerConfig struct {
 	queue            string
+	svc              sqsAPI // shared by every reader of the queue
 	region           string
-	akid             string
-	secret           string
+	creds            awsutils.Credentials
+	endpoint         awsutils.Endpoint
 	tag              entry.EntryTag
+	tagger           *awsutils.TagResolver // nil unless the queue has a Tag-Template
 	ignoreTimestamps bool
 	setLocalTime     bool
 	timezoneOverride string
 	src              net.IP
 	formatOverride   string
+	deleteOnIngest   bool
+	syncTimeout      time.Duration // wait this long for entries to be acknowledged before deleting, zero doesn't wait
+	sync             syncer
+	waitTime         int64
+	emptyBackoff     time.Duration // cap on sleeps after empty receives, zero doesn't sleep
+	maxMessages      int64
+	unwrapSNS        bool
+	eventBridge      string
+	receiveBuffer    int // batches held for the processWorkers
+	processWorkers   int
+	s3EventMode      bool
+	s3Region         string
+	sqsExtended      bool
+	s3svc            s3API // shared by every reader in S3 event mode or with SQS-Extended
+	fifo             bool
+	attributeNames   []*string // message system attributes requested with each receive
+	decomp           *awsutils.Decompressor
+	metrics          *queueMetrics
+	visExtension     time.Duration
+	maxAttempts      int
+	failureTag       entry.EntryTag
+	failureTagName   string
+	failures         *failureTracker
+	limiter          *awsutils.RateLimiter // shared by every reader of the queue
+	guard            *awsutils.SizeGuard
+	clamp            *awsutils.TimestampClamp
+	coalesce         *batchCoalescer
+	lines            *awsutils.LineSplitter  // nil unless messages are split into lines
+	jsonTime         *awsutils.JSONTimestamp // nil unless Timestamp-JSON-Path is set
+	tee              *awsutils.Tee           // nil unless Debug-Tee-File is set
+	payloads         *awsutils.PayloadLogger // nil unless Log-Bad-Payloads is set
+	pause            *awsutils.Pauser
 	wg               *sync.WaitGroup
 	done             chan bool
-	proc             *processors.ProcessorSet
+	ctx              context.Context // cancelled along with done to abort in-flight receives
+	proc             *procSet        // swapped on SIGHUP when preprocessors change
 }
 
-func init() {
+func handleFlags() {
 	flag.Parse()
 	if *ver {
 		version.PrintVersion(os.Stdout)
@@ -94,6 +166,14 @@ func init() {
 }
 
 func main() {
+	handleFlags()
+	if *validate {
+		if err := validateConfig(*confLoc, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Validation failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
@@ -112,6 +192,9 @@ func main() {
 		return
 	}
 
+	if err = lg.SetFormatString(cfg.Log_Format); err != nil {
+		lg.FatalCode(0, "Invalid Log Format \"%s\": %v", cfg.Log_Format, err)
+	}
 	if len(cfg.Log_File) > 0 {
 		fout, err := os.OpenFile(cfg.Log_File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
 		if err != nil {
@@ -127,6 +210,19 @@ func main() {
 		}
 	}
 
+	for k, v := range cfg.Queue {
+		if v.credentials().TemporaryStaticKeys() {
+			lg.Warn("Queue %s AKID looks like temporary STS credentials, which are never refreshed and stop working once they expire, "+
+				"use Role-ARN, Use-Instance-Role, AWS-Profile, or no keys for the default AWS credential chain", k)
+		}
+	}
+	for k, v := range cfg.Queue_Discovery {
+		if v.credentials().TemporaryStaticKeys() {
+			lg.Warn("Queue-Discovery %s AKID looks like temporary STS credentials, which are never refreshed and stop working once they expire, "+
+				"use Role-ARN, Use-Instance-Role, AWS-Profile, or no keys for the default AWS credential chain", k)
+		}
+	}
+
 	tags, err := cfg.Tags()
 	if err != nil {
 		lg.FatalCode(0, "Failed to get tags from configuration: %v\n", err)
@@ -169,6 +265,7 @@ func main() {
 		igCfg.CacheConfig.FileBackingLocation = cfg.LocalFileCachePath()
 		igCfg.CacheConfig.MaxCacheSize = cfg.MaxCachedData()
 	}
+	igCfg.PublicKey, igCfg.PrivateKey = cfg.TLSClientCert()
 	igst, err = ingest.NewUniformMuxer(igCfg)
 	if err != nil {
 		lg.Fatal("Failed build our ingest system: %v\n", err)
@@ -187,63 +284,340 @@ func main() {
 		return
 	}
 	debugout("Successfully connected to ingesters\n")
+	if *selftest {
+		if err := awsutils.SelfTest(igst, ingesterName, id.String(), tags, os.Stdout); err != nil {
+			lg.FatalCode(0, "Self-test failed: %v", err)
+		}
+		igst.Close()
+		os.Exit(0)
+	}
 	var wg sync.WaitGroup
 	done := make(chan bool)
+	ctx, cancel := context.WithCancel(context.Background())
 
-	// make sqs connections
-	for k, v := range cfg.Queue {
+	var prom *promMetrics
+	var promServer *awsutils.HTTPServer
+	var reg *awsutils.PromRegistry
+	if cfg.Prometheus_Listen != `` {
+		reg = awsutils.NewPromRegistry()
+		prom = newPromMetrics(reg)
+		if promServer, err = awsutils.ServeProm(cfg.Prometheus_Listen, reg); err != nil {
+			lg.Fatal("Failed to start Prometheus listener on %s: %v", cfg.Prometheus_Listen, err)
+		}
+		debugout("Serving Prometheus metrics on %s\n", cfg.Prometheus_Listen)
+	}
+
+	// SIGTSTP or the Pause-File stop receiving until SIGCONT or its removal
+	pause := awsutils.NewPauser(cfg.Pause_File, reg, `sqs`, func(f string, args ...interface{}) {
+		lg.Info(f, args...)
+	})
+
+	var progress *awsutils.ProgressTracker
+	var healthServer *awsutils.HTTPServer
+	if cfg.Health_Listen != `` {
+		progress = awsutils.NewProgressTracker()
+		hot := func() bool {
+			n, err := igst.Hot()
+			return err == nil && n > 0
+		}
+		h := awsutils.NewHealthHandler(hot, progress, pause, cfg.healthProgressWindow())
+		if healthServer, err = awsutils.ListenAndServe(cfg.Health_Listen, h); err != nil {
+			lg.Fatal("Failed to start health listener on %s: %v", cfg.Health_Listen, err)
+		}
+		debugout("Serving health probes on %s\n", cfg.Health_Listen)
+	}
+
+	var metricsTag entry.EntryTag
+	if cfg.Metrics_Tag != `` {
+		if metricsTag, err = igst.GetTag(cfg.Metrics_Tag); err != nil {
+			lg.Fatal("Can't resolve metrics tag %v: %v", cfg.Metrics_Tag, err)
+		}
+	}
+
+	// failure counts are shared by every queue, keyed by queue and message ID
+	var failState *utils.State
+	if cfg.Failure_State_Location != `` {
+		if failState, err = utils.NewState(cfg.Failure_State_Location, 0600); err != nil {
+			lg.Fatal("Couldn't open failure state file: %v", err)
+		}
+	}
+	failures, err := newFailureTracker(failState)
+	if err != nil {
+		lg.Fatal("Couldn't read failure state file: %v", err)
+	}
+
+	// S3 tees use the default credential chain, queues may each have their own
+	tee, err := awsutils.NewTee(cfg.Debug_Tee_File, cfg.Debug_Tee_Max_Size, cfg.Debug_Tee_Region, awsutils.Credentials{}, func(err error) {
+		lg.Warn("Failed to write to Debug-Tee-File %s: %v", cfg.Debug_Tee_File, err)
+	})
+	if err != nil {
+		lg.Fatal("Failed to open Debug-Tee-File %s: %v", cfg.Debug_Tee_File, err)
+	} else if tee != nil {
+		lg.Warn("Copying raw messages to Debug-Tee-File %s", cfg.Debug_Tee_File)
+	}
+	payloads := cfg.payloadLogger(lg.Warn)
+
+	metrics := &metricsReporter{}
+	if cfg.Metrics_Tag != `` {
+		metrics.SetEntryTag(igst, metricsTag)
+	}
+	metrics.SetPauser(pause)
+
+	spool, err := awsutils.NewSpool(cfg.Spool_Dir, cfg.Spool_Max_Size, igst, func(err error) {
+		lg.Warn("Failed to replay spooled entries from %s: %v", cfg.Spool_Dir, err)
+	})
+	if err != nil {
+		lg.Fatal("Failed to open Spool-Dir %s: %v", cfg.Spool_Dir, err)
+	}
+	// entries are written through the spool if there is one
+	var wtr procWriter = igst
+	// the spool keeps replaying until the readers have stopped
+	var swg sync.WaitGroup
+	if spool != nil {
+		wtr = spool
+		swg.Add(1)
+		go func() {
+			defer swg.Done()
+			spool.Run(ctx)
+		}()
+	}
+	// report the ingest cache while indexers are away, SIGUSR1 flushes it
+	cm := awsutils.NewCacheMonitor(igst, reg, `sqs`, func(f string, args ...interface{}) {
+		lg.Info(f, args...)
+	})
+	swg.Add(1)
+	go func() {
+		defer swg.Done()
+		cm.Run(ctx, cfg.metricsInterval())
+	}()
+	swg.Add(1)
+	go func() {
+		defer swg.Done()
+		pause.Run(ctx)
+	}()
+
+	// processor sets are tracked so that a SIGHUP can rebuild them
+	rl := newReloader(*confLoc, cfg, wtr)
+
+	// queues in the same region with the same credentials share a session
+	sessions := awsutils.NewSessionCache()
+
+	// newHandler builds the handler config shared by every reader of a queue,
+	// tags of discovered queues are negotiated with the indexers on the fly
+	newHandler := func(k string, v *queue, psrc procSource, wg *sync.WaitGroup, done chan bool, ctx context.Context) (*handlerConfig, error) {
 		var src net.IP
 
 		if v.Source_Override != `` {
 			src = net.ParseIP(v.Source_Override)
 			if src == nil {
-				lg.FatalCode(0, "Listener %v invalid source override, \"%s\" is not an IP address", k, v.Source_Override)
+				return nil, fmt.Errorf("Listener %v invalid source override, \"%s\" is not an IP address", k, v.Source_Override)
 			}
 		} else if cfg.Source_Override != `` {
 			// global override
 			src = net.ParseIP(cfg.Source_Override)
 			if src == nil {
-				lg.FatalCode(0, "Global Source-Override is invalid")
+				return nil, errors.New("Global Source-Override is invalid")
 			}
 		}
 
 		//get the tag for this listener
-		tag, err := igst.GetTag(v.Tag_Name)
+		tag, err := igst.NegotiateTag(v.Tag_Name)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to resolve tag \"%s\" for %s: %v", v.Tag_Name, k, err)
+		}
+		templ, err := v.tagTemplate()
 		if err != nil {
-			lg.Fatal("Failed to resolve tag \"%s\" for %s: %v\n", v.Tag_Name, k, err)
+			return nil, fmt.Errorf("Invalid Tag-Template for %s: %v", k, err)
 		}
 
 		hcfg := &handlerConfig{
 			queue:            v.Queue_URL,
 			region:           v.Region,
-			akid:             v.AKID,
-			secret:           v.Secret,
+			creds:            v.credentials(),
+			endpoint:         v.endpoint(cfg),
 			tag:              tag,
+			tagger:           awsutils.NewTagResolver(templ, tag, igst.NegotiateTag),
 			ignoreTimestamps: v.Ignore_Timestamps,
 			setLocalTime:     v.Assume_Local_Timezone,
 			timezoneOverride: v.Timezone_Override,
 			formatOverride:   v.Timestamp_Format_Override,
+			deleteOnIngest:   v.deleteOnIngest(),
+			syncTimeout:      v.deleteSyncTimeout(),
+			sync:             igst,
+			waitTime:         v.waitTimeSeconds(),
+			emptyBackoff:     v.emptyReceiveBackoff(),
+			maxMessages:      v.Max_Number_Of_Messages,
+			unwrapSNS:        v.Unwrap_SNS,
+			eventBridge:      v.EventBridge_Mode,
+			receiveBuffer:    v.Receive_Buffer,
+			processWorkers:   v.Process_Workers,
+			s3EventMode:      v.S3_Event_Mode,
+			sqsExtended:      v.SQS_Extended,
+			s3Region:         v.s3Region(),
+			fifo:             v.fifo(),
+			metrics:          newQueueMetrics(prom, progress, k),
+			visExtension:     v.visibilityExtension(),
+			maxAttempts:      v.Max_Process_Attempts,
+			failureTagName:   v.Failure_Tag,
+			failures:         failures,
+			limiter:          awsutils.NewRateLimiter(v.rateLimit()),
+			lines:            v.lineSplitter(),
+			coalesce:         v.batchCoalescer(),
+			tee:              tee,
+			payloads:         payloads,
+			pause:            pause,
 			src:              src,
-			wg:               &wg,
+			wg:               wg,
 			done:             done,
+			ctx:              ctx,
 		}
 
-		if hcfg.proc, err = cfg.Preprocessor.ProcessorSet(igst, v.Preprocessor); err != nil {
-			lg.Fatal("Preprocessor failure: %v", err)
+		// checked along with the config
+		hcfg.jsonTime, _ = v.jsonTimestamp()
+		hcfg.clamp, _ = v.timestampClamp()
+		hcfg.attributeNames, _ = v.attributeNames()
+
+		if v.Failure_Tag != `` {
+			if hcfg.failureTag, err = igst.NegotiateTag(v.Failure_Tag); err != nil {
+				return nil, fmt.Errorf("Failed to resolve failure tag \"%s\" for %s: %v", v.Failure_Tag, k, err)
+			}
+		}
+
+		sess, err := sessions.Get(hcfg.region, hcfg.creds)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create AWS session for queue %s: %v", k, err)
+		}
+		hcfg.svc = sqs.New(sess, hcfg.endpoint.Config())
+		if hcfg.s3EventMode || hcfg.sqsExtended {
+			if sess, err = sessions.Get(hcfg.s3Region, hcfg.creds); err != nil {
+				return nil, fmt.Errorf("Failed to create S3 session for queue %s: %v", k, err)
+			}
+			hcfg.s3svc = s3.New(sess)
+		}
+
+		if hcfg.guard, err = v.sizeGuard(); err != nil {
+			return nil, fmt.Errorf("Queue %s: %v", k, err)
 		}
 
+		if hcfg.decomp, err = awsutils.NewDecompressor(v.Decompression); err != nil {
+			return nil, fmt.Errorf("Failed to create decompressor for %s: %v", k, err)
+		}
+
+		if hcfg.proc, err = rl.build(psrc); err != nil {
+			return nil, err
+		}
+		return hcfg, nil
+	}
+
+	// every reader shares the handler config and processor set, each
+	// one builds its own timegrinder and batch
+	startReaders := func(hcfg *handlerConfig, v *queue) {
+		metrics.Add(hcfg.metrics)
+		for i := 0; i < v.readerCount(); i++ {
+			hcfg.wg.Add(1)
+			go queueRunner(hcfg)
+		}
+	}
+
+	// make sqs connections
+	for k, v := range cfg.Queue {
+		lg.Info("Queue %s using region %s from the %s", k, v.Region, v.regionSource)
+		hcfg, err := newHandler(k, v, procSource{section: k}, &wg, done, ctx)
+		if err != nil {
+			lg.Fatal("%v", err)
+		}
+		startReaders(hcfg, v)
+	}
+
+	// discovered queues each get their own done channel and context so that
+	// their readers can be stopped when the queue goes away
+	for k, v := range cfg.Queue_Discovery {
+		lg.Info("Queue-Discovery %s using region %s from the %s", k, v.Region, v.regionSource)
+		sess, err := sessions.Get(v.Region, v.credentials())
+		if err != nil {
+			lg.Fatal("Failed to create AWS session for Queue-Discovery %s: %v", k, err)
+		}
+		svc := sqs.New(sess, v.endpoint(cfg).Config())
+		psrc := procSource{discovery: true, section: k}
+		start := func(name string, q *queue) (func(), error) {
+			var qwg sync.WaitGroup
+			qdone := make(chan bool)
+			qctx, qcancel := context.WithCancel(ctx)
+			hcfg, err := newHandler(name, q, psrc, &qwg, qdone, qctx)
+			if err != nil {
+				qcancel()
+				return nil, err
+			}
+			startReaders(hcfg, q)
+			return func() {
+				close(qdone)
+				if grace := cfg.shutdownGrace(); !awsutils.WaitTimeout(&qwg, grace) {
+					lg.Warn("Readers of queue %s did not finish within %v, cancelling them", name, grace)
+				}
+				qcancel()
+				qwg.Wait()
+				metrics.Remove(hcfg.metrics)
+				if err := rl.release(hcfg.proc); err != nil {
+					lg.Warn("Failed to close preprocessors for %s: %v", name, err)
+				}
+			}, nil
+		}
+		d := newDiscoverer(k, v, svc, start)
 		wg.Add(1)
-		go queueRunner(hcfg)
+		go func() {
+			defer wg.Done()
+			d.run(done)
+		}()
 	}
 
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		metrics.run(igst, cfg.metricsInterval(), done)
+	}()
+
+	debugout("Sharing %d AWS sessions between %d queues\n", sessions.Len(), len(cfg.Queue))
 	debugout("Running\n")
 
-	//listen for signals so we can close gracefully
-	utils.WaitForQuit()
+	//listen for signals so we can close gracefully, SIGHUP reloads preprocessors
+	waitForQuit(rl)
 
-	// wait for graceful shutdown
+	// wait for graceful shutdown, readers finish the messages they have
+	// received unless that takes longer than the Shutdown-Grace
 	close(done)
+	if grace := cfg.shutdownGrace(); !awsutils.WaitTimeout(&wg, grace) {
+		lg.Warn("Readers did not finish within the Shutdown-Grace of %v, cancelling them", grace)
+	}
+	cancel()
 	wg.Wait()
+	swg.Wait()
+	if err := rl.Close(); err != nil {
+		lg.Error("Failed to close preprocessors: %v", err)
+	}
+	if spool != nil {
+		if err := spool.Close(); err != nil {
+			lg.Error("Failed to close Spool-Dir %s: %v", cfg.Spool_Dir, err)
+		}
+		spooled, replayed, dropped, size := spool.Stats()
+		lg.Info("Spooled %d entries, replayed %d, dropped %d, %d bytes left in %s", spooled, replayed, dropped, size, cfg.Spool_Dir)
+	}
+	if err := tee.Close(); err != nil {
+		lg.Error("Failed to close Debug-Tee-File %s: %v", cfg.Debug_Tee_File, err)
+	}
+	if n := tee.Dropped(); n > 0 {
+		lg.Warn("Debug-Tee-File %s fell behind and skipped %d messages", cfg.Debug_Tee_File, n)
+	}
+
+	if promServer != nil {
+		if err := promServer.Close(); err != nil {
+			lg.Error("Failed to stop Prometheus listener: %v", err)
+		}
+	}
+	if healthServer != nil {
+		if err := healthServer.Close(); err != nil {
+			lg.Error("Failed to stop health listener: %v", err)
+		}
+	}
 
 	if err := igst.Sync(time.Second); err != nil {
 		lg.Error("Failed to sync: %v\n", err)
@@ -260,84 +634,698 @@ func debugout(format string, args ...interface{}) {
 	fmt.Printf(format, args...)
 }
 
+// queueRunner consumes a queue until shutdown, relaunching the reader after
+// panicRestartDelay if it panics.
 func queueRunner(hcfg *handlerConfig) {
 	defer hcfg.wg.Done()
 
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region:      aws.String(hcfg.region),
-		Credentials: credentials.NewStaticCredentials(hcfg.akid, hcfg.secret, ""),
-	}))
-
-	svc := sqs.New(sess)
-
-	c := make(chan *sqs.ReceiveMessageOutput)
 	for {
-		// aws uses string pointers, so we have to decalre it on the
-		// stack in order to take it's reference... why aws, why......
-		an := "SentTimestamp"
-		req := &sqs.ReceiveMessageInput{
-			AttributeNames: []*string{&an},
+		var tg *timegrinder.TimeGrinder
+		var err error
+		if !hcfg.ignoreTimestamps {
+			if tg, err = newTimeGrinder(hcfg); err != nil {
+				lg.Error("Failed to create timegrinder for queue %s: %v", hcfg.queue, err)
+				return
+			}
 		}
-
-		req = req.SetQueueUrl(hcfg.queue)
-		err := req.Validate()
-		if err != nil {
-			lg.Error("sqs request validation: %v", err)
+		if !consumeRecovered(hcfg, tg) {
+			return
+		}
+		select {
+		case <-time.After(panicRestartDelay):
+		case <-hcfg.done:
 			return
 		}
+	}
+}
 
-		var out *sqs.ReceiveMessageOutput
-		go func() {
-			o, err := svc.ReceiveMessage(req)
-			if err != nil {
-				lg.Error("sqs receive message: %v", err)
-				c <- nil
+// consumeRecovered consumes the queue, returning true if the reader panicked.
+// Messages it had received but not finished with are redelivered once their
+// visibility timeout expires.
+func consumeRecovered(hcfg *handlerConfig, tg *timegrinder.TimeGrinder) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			hcfg.metrics.Panic()
+			lg.Critical("Reader of queue %s panicked, relaunching it in %v: %v\n%s", hcfg.queue, panicRestartDelay, r, debug.Stack())
+		}
+	}()
+	consumeQueue(hcfg, hcfg.svc, tg, hcfg.s3svc)
+	return
+}
+
+// consumeQueue receives and ingests messages from a queue until done is closed.
+// Failed receives are retried with a backoff, a consumer only exits on
+// shutdown. With a Receive-Buffer or several Process-Workers, received batches
+// are handed over to the workers so that slow processing doesn't hold up
+// receiving, otherwise each batch is handled before the next receive.
+func consumeQueue(hcfg *handlerConfig, svc sqsAPI, tg *timegrinder.TimeGrinder, s3svc s3API) {
+	var vk *visibilityKeeper
+	if hcfg.visExtension > 0 {
+		vk = newVisibilityKeeper(svc, hcfg.queue, hcfg.visExtension)
+		defer vk.Close()
+	}
+
+	if hcfg.receiveBuffer == 0 && hcfg.processWorkers <= 1 {
+		handle, flush := newMessageHandler(hcfg, svc, tg, s3svc, vk)
+		defer flush()
+		receiveMessages(hcfg, svc, vk, hcfg.done, func(msgs []*sqs.Message) bool {
+			handle(msgs)
+			return true
+		}, flush)
+		return
+	}
+
+	// batches wait here until a worker is free, their visibility is already
+	// extended; batches still waiting at shutdown are redelivered
+	batches := make(chan []*sqs.Message, hcfg.receiveBuffer)
+	// a worker which panics stops the reader, which panics in turn so that it
+	// is relaunched like any other reader
+	panicked := make(chan interface{}, 1)
+	stop := make(chan bool)
+	go func() {
+		select {
+		case <-hcfg.done:
+		case r := <-panicked:
+			panicked <- r
+		}
+		close(stop)
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < hcfg.processWorkers || i == 0; i++ {
+		wtg := tg
+		if i > 0 && tg != nil {
+			// timegrinders hold state, every worker needs its own
+			var err error
+			if wtg, err = newTimeGrinder(hcfg); err != nil {
+				lg.Error("Failed to create timegrinder for queue %s: %v", hcfg.queue, err)
+				break
 			}
-			c <- o
+		}
+		handle, flush := newMessageHandler(hcfg, svc, wtg, s3svc, vk)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					select {
+					case panicked <- fmt.Sprintf("%v\n%s", r, debug.Stack()):
+					default:
+					}
+				}
+			}()
+			processBatches(batches, stop, handle, flush)
 		}()
+	}
+	receiveMessages(hcfg, svc, vk, stop, func(msgs []*sqs.Message) bool {
+		select {
+		case batches <- msgs:
+			return true
+		case <-stop:
+			return false
+		}
+	}, nil)
+	wg.Wait()
+	select {
+	case r := <-panicked:
+		panic(fmt.Sprintf("Process-Workers goroutine: %v", r))
+	default:
+	}
+}
 
+// processBatches is a Process-Workers goroutine, it handles received batches
+// until stop is closed, finishing the batch in hand.
+func processBatches(batches <-chan []*sqs.Message, stop chan bool, handle func([]*sqs.Message), flush func() error) {
+	ticker := time.NewTicker(batchFlushInterval)
+	defer ticker.Stop()
+	defer flush()
+	for {
 		select {
-		case out = <-c:
-			if out == nil {
-				return
+		case msgs := <-batches:
+			handle(msgs)
+		case <-ticker.C:
+			flush()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// confirm waits for the indexers to acknowledge every entry handed to the muxer
+// so far when the queue has a Delete-Sync-Timeout, returning false if they
+// haven't within the timeout. The n messages the entries came from should
+// then be left to be redelivered rather than deleted.
+func (hcfg *handlerConfig) confirm(n int) bool {
+	if hcfg.syncTimeout <= 0 {
+		return true
+	}
+	if err := hcfg.sync.Sync(hcfg.syncTimeout); err != nil {
+		lg.Warn("Entries of %d messages from queue %s were not acknowledged within %v, leaving the messages to be redelivered: %v", n, hcfg.queue, hcfg.syncTimeout, err)
+		hcfg.metrics.Error()
+		return false
+	}
+	return true
+}
+
+// newMessageHandler returns a function which handles a received batch of
+// messages, adding their entries to a pending batch, and one which writes the
+// pending batch and deletes the messages it came from. They are not safe for
+// concurrent use, every worker needs its own.
+func newMessageHandler(hcfg *handlerConfig, svc sqsAPI, tg *timegrinder.TimeGrinder, s3svc s3API, vk *visibilityKeeper) (handle func([]*sqs.Message), flush func() error) {
+	// deadLetter removes a message which has failed too many times, first
+	// writing it to the failure tag if one is configured. It returns true if
+	// the message was deleted.
+	deadLetter := func(m *sqs.Message, key string) bool {
+		id := aws.StringValue(m.MessageId)
+		var received string
+		if n, ok := m.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]; ok {
+			received = fmt.Sprintf(", received %s times", aws.StringValue(n))
+		}
+		if hcfg.failureTagName != `` {
+			if err := igst.WriteEntry(&entry.Entry{
+				SRC:  hcfg.src,
+				TS:   sentTimestamp(m),
+				Tag:  hcfg.failureTag,
+				Data: []byte(aws.StringValue(m.Body)),
+			}); err != nil {
+				lg.Error("Failed to preserve message %s from queue %s: %v", id, hcfg.queue, err)
+				return false
 			}
-		case <-hcfg.done:
+			lg.Warn("Moved message %s from queue %s to tag %s after %d failed attempts%s", id, hcfg.queue, hcfg.failureTagName, hcfg.failures.Count(key), received)
+		} else {
+			lg.Warn("Dropped message %s from queue %s after %d failed attempts%s", id, hcfg.queue, hcfg.failures.Count(key), received)
+		}
+		if !hcfg.confirm(1) || deleteMessages(svc, hcfg.queue, []*string{m.ReceiptHandle}, hcfg.metrics) == 0 {
+			// keep the count so that we try again on redelivery
+			return false
+		}
+		hcfg.failures.Clear(key)
+		return true
+	}
+	// failed records a failed attempt at processing a message and dead letters
+	// it once it has failed too many times, returning true if it was deleted.
+	failed := func(m *sqs.Message) bool {
+		if hcfg.maxAttempts <= 0 {
+			return false
+		}
+		key := failureKey(hcfg.queue, aws.StringValue(m.MessageId))
+		if hcfg.failures.Fail(key) < hcfg.maxAttempts {
+			return false
+		}
+		return deadLetter(m, key)
+	}
+
+	// skip gives up on a message for this delivery after a failure, it is
+	// redelivered unless it has now failed too many times. On FIFO queues the
+	// rest of its message group is held back until it is redelivered.
+	skip := func(v *sqs.Message, blocked map[string]bool, group string) {
+		vk.Untrack(v.ReceiptHandle)
+		if failed(v) {
+			// it is gone, so it no longer holds back its group
+			hcfg.metrics.Done(1, 1)
 			return
 		}
+		hcfg.metrics.Done(1, 0)
+		blocked[group] = true
+	}
+	// deletePayloads removes the objects offloaded by the SQS Extended Client
+	// once their messages are deleted. If a delete in the batch failed we
+	// can't tell which messages remain, so the objects are left in place
+	// rather than leaving a redelivered pointer with nothing to fetch.
+	deletePayloads := func(written []pendingMessage, allDeleted bool) {
+		for _, m := range written {
+			if m.payload == nil {
+				continue
+			}
+			id := aws.StringValue(m.msg.MessageId)
+			if !allDeleted {
+				lg.Warn("Left the payload of message %s in s3://%s/%s, not every message in its batch was deleted", id, m.payload.Bucket, m.payload.Key)
+			} else if err := deletePayload(s3svc, *m.payload); err != nil {
+				lg.Error("Failed to delete the payload of message %s from s3://%s/%s: %s", id, m.payload.Bucket, m.payload.Key, awsutils.ErrorMessage(err))
+				hcfg.metrics.Error()
+			}
+		}
+	}
 
-		// we may have multiple packed messages
-		for _, v := range out.Messages {
-			msg := []byte(*v.Body)
+	// entries are handed to the muxer in batches, the messages in the pending
+	// batch are only deleted once all of their entries are written
+	var pending []*entry.Entry
+	var msgs []pendingMessage
+	flush = func() (err error) {
+		if len(pending) == 0 && len(msgs) == 0 {
+			return
+		}
+		var sz int
+		for _, ent := range pending {
+			sz += len(ent.Data)
+		}
+		if len(pending) > 0 {
+			// while we wait here nothing else is received from the queue
+			if hcfg.limiter.Wait(sz, hcfg.done) {
+				debugout("Queue %s throttled by its Rate-Limit\n", hcfg.queue)
+			}
+			err = hcfg.proc.ProcessBatch(pending)
+		}
+		written := msgs
+		var bad *sqs.Message
+		if err != nil {
+			// leave the messages in the queue so that they are redelivered
+			lg.Error("Sending %d entries: %v", len(pending), err)
+			hcfg.metrics.Error()
+			written = nil
+			sz = 0
+			if be, ok := err.(*processors.BatchError); ok {
+				for _, ent := range pending[:be.Index] {
+					sz += len(ent.Data)
+				}
+				// messages whose entries all precede the failure were written
+				i := 0
+				for i < len(msgs) && msgs[i].end <= be.Index {
+					i++
+				}
+				written = msgs[:i]
+				if i < len(msgs) {
+					bad = msgs[i].msg
+					hcfg.payloads.Log(pending[be.Index].Data, "Failed to process an entry of message %s from queue %s: %v", aws.StringValue(bad.MessageId), hcfg.queue, be.Err)
+				}
+			}
+		}
+		handles := make([]*string, 0, len(msgs))
+		for _, m := range msgs {
+			handles = append(handles, m.msg.ReceiptHandle)
+		}
+		vk.Untrack(handles...)
+		var deleted int
+		if hcfg.deleteOnIngest && len(written) > 0 && hcfg.confirm(len(written)) {
+			// this includes messages which produced no entries
+			deleted = deleteMessages(svc, hcfg.queue, handles[:len(written)], hcfg.metrics)
+			deletePayloads(written, deleted == len(written))
+		}
+		if hcfg.maxAttempts > 0 {
+			for _, m := range written {
+				hcfg.failures.Clear(failureKey(hcfg.queue, aws.StringValue(m.msg.MessageId)))
+			}
+		}
+		if bad != nil && failed(bad) {
+			deleted++
+		}
+		hcfg.metrics.Ingested(sz)
+		hcfg.metrics.Done(len(msgs), deleted)
+		pending = nil
+		msgs = nil
+		return
+	}
+	// oversized entries are counted, only the first is logged
+	var warnedSize bool
+	guard := func(ent *entry.Entry) bool {
+		keep, oversized := hcfg.guard.Check(ent)
+		if oversized {
+			hcfg.metrics.Oversize(!keep)
+			if !warnedSize {
+				lg.Warn("Queue %s has entries over the Max-Entry-Size of %d bytes, see the metrics for counts", hcfg.queue, hcfg.guard.Max())
+				warnedSize = true
+			}
+		}
+		return keep
+	}
+	add := func(ent *entry.Entry) error {
+		if !guard(ent) {
+			return nil
+		}
+		pending = append(pending, ent)
+		if len(pending) >= batchSize {
+			return flush()
+		}
+		return nil
+	}
+	// timestamp prefers the Timestamp-JSON-Path field, then the time of the
+	// SNS notification or EventBridge event the data came in if there was
+	// one, then the first timestamp in the data, and finally the time SQS
+	// received the message, which is all Ignore-Timestamps uses. Timestamps
+	// taken from the data outside the Max-Timestamp-Skew are replaced by the
+	// time SQS received the message.
+	clamp := func(t time.Time, data []byte, m *sqs.Message) entry.Timestamp {
+		sent := sentTimestamp(m)
+		t, clamped := hcfg.clamp.Clamp(t, sent.StandardTime())
+		if clamped {
+			hcfg.metrics.Clamped()
+			hcfg.payloads.Log(data, "Timestamp of message %s on queue %s is outside the Max-Timestamp-Skew, using the enqueue time", aws.StringValue(m.MessageId), hcfg.queue)
+			return sent
+		}
+		return entry.FromStandard(t)
+	}
+	timestamp := func(data []byte, m *sqs.Message, notified time.Time) entry.Timestamp {
+		if hcfg.ignoreTimestamps {
+			return sentTimestamp(m)
+		} else if t, ok := hcfg.jsonTime.Extract(tg, data); ok {
+			return clamp(t, data, m)
+		} else if !notified.IsZero() {
+			return entry.FromStandard(notified)
+		} else if t, ok, err := tg.Extract(data); err == nil && ok {
+			return clamp(t, data, m)
+		}
+		hcfg.payloads.Log(data, "Failed to extract a timestamp from message %s on queue %s", aws.StringValue(m.MessageId), hcfg.queue)
+		return sentTimestamp(m)
+	}
 
-			var ts entry.Timestamp
-			if !hcfg.ignoreTimestamps {
-				// grab the timestamp from SQS
-				t, mok := v.Attributes["SentTimestamp"]
-				if !mok {
-					lg.Error("SQS did not provide timestamp for message: %v", v.Attributes)
-				} else {
-					ut, err := strconv.ParseInt(*t, 10, 64)
+	// we may have multiple packed messages. Messages are handled in the
+	// order SQS hands them to us; on FIFO queues a failure holds back the
+	// rest of its message group so that it is redelivered in order.
+	handle = func(batch []*sqs.Message) {
+		blocked := map[string]bool{}
+		coalesced := hcfg.coalesce.Start()
+		for _, v := range batch {
+			group := aws.StringValue(v.Attributes[sqs.MessageSystemAttributeNameMessageGroupId])
+			if hcfg.fifo && blocked[group] {
+				vk.Untrack(v.ReceiptHandle)
+				hcfg.metrics.Done(1, 0)
+				continue
+			}
+			if hcfg.maxAttempts > 0 {
+				// a message we failed to dead letter last time around
+				key := failureKey(hcfg.queue, aws.StringValue(v.MessageId))
+				if hcfg.failures.Count(key) >= hcfg.maxAttempts && deadLetter(v, key) {
+					vk.Untrack(v.ReceiptHandle)
+					hcfg.metrics.Done(1, 1)
+					continue
+				}
+			}
+			body := []byte(aws.StringValue(v.Body))
+			hcfg.tee.Write(hcfg.queue, aws.StringValue(v.MessageId), body)
+			var payload *s3Object
+			if hcfg.sqsExtended {
+				if obj, ok := parseExtendedPointer(body); ok {
+					// the message and the object are kept until the payload
+					// has been written
+					b, err := fetchPayload(s3svc, obj)
 					if err != nil {
-						lg.Error("parseint on unix time: %v", *t)
-					} else {
-						ts = entry.UnixTime(ut/1000, 0)
+						lg.Error("Failed to fetch the payload of message %s on queue %s from s3://%s/%s: %s", aws.StringValue(v.MessageId), hcfg.queue, obj.Bucket, obj.Key, awsutils.ErrorMessage(err))
+						hcfg.metrics.Error()
+						skip(v, blocked, group)
+						continue
 					}
+					body, payload = b, &obj
 				}
-			} else {
-				ts = entry.Now()
+			}
+			msg, err := hcfg.decomp.Decompress(body)
+			if err != nil && hcfg.decomp.FirstFailure() {
+				// pass the raw body through rather than dropping it
+				lg.Warn("Failed to decompress message on queue %s, passing compressed messages through: %v", hcfg.queue, err)
+			}
+
+			// the time of the SNS notification or EventBridge event the data
+			// came in, an EventBridge event may itself have come through SNS
+			var envTS time.Time
+			if hcfg.unwrapSNS {
+				if m, t, ok := unwrapSNS(msg); ok {
+					msg, envTS = m, t
+				}
+			}
+			if hcfg.eventBridge != `` {
+				if m, t, ok := unwrapEventBridge(msg, hcfg.eventBridge); ok {
+					msg = m
+					if !t.IsZero() {
+						envTS = t
+					}
+				}
+			}
+
+			if hcfg.s3EventMode {
+				if objs, ok := parseS3Event(msg); ok {
+					// the message is only removed once every line of every
+					// object it references has been written
+					if err := ingestObjects(s3svc, objs, func(line []byte) error {
+						return add(&entry.Entry{
+							SRC:  hcfg.src,
+							TS:   timestamp(line, v, time.Time{}),
+							Tag:  entryTag(hcfg, line),
+							Data: line,
+						})
+					}); err != nil {
+						lg.Error("Failed to ingest S3 objects from queue %s: %s", hcfg.queue, awsutils.ErrorMessage(err))
+						hcfg.metrics.Error()
+						skip(v, blocked, group)
+						continue
+					}
+					msgs = append(msgs, pendingMessage{msg: v, end: len(pending), payload: payload})
+					continue
+				}
+			}
+
+			// with Coalesce-Batch the message waits for the rest of the batch
+			if coalesced != nil {
+				coalesced.Add(msg, timestamp(msg, v, envTS), pendingMessage{msg: v, payload: payload})
+				continue
 			}
 
+			// with Split-Lines every line gets its own entry and timestamp
+			for _, line := range hcfg.lines.Split(msg) {
+				ent := &entry.Entry{
+					SRC:  hcfg.src,
+					TS:   timestamp(line, v, envTS),
+					Tag:  entryTag(hcfg, line),
+					Data: line,
+				}
+				if guard(ent) {
+					pending = append(pending, ent)
+				}
+			}
+			msgs = append(msgs, pendingMessage{msg: v, end: len(pending), payload: payload})
+		}
+		// the coalesced messages are only deleted once their entry is written
+		if data, ts, held := coalesced.Take(); len(held) > 0 {
 			ent := &entry.Entry{
 				SRC:  hcfg.src,
 				TS:   ts,
-				Tag:  hcfg.tag,
-				Data: msg,
+				Tag:  entryTag(hcfg, data),
+				Data: data,
+			}
+			if guard(ent) {
+				pending = append(pending, ent)
+			}
+			for i := range held {
+				held[i].end = len(pending)
+			}
+			msgs = append(msgs, held...)
+		}
+		if len(pending) >= batchSize || len(pending) == 0 {
+			flush()
+		}
+	}
+	return
+}
+
+// receiveMessages receives batches of messages from a queue and passes them to
+// deliver, until done is closed or deliver returns false. Messages are tracked
+// by vk from the time they are received. If flush is set it is called
+// periodically to write partial batches. Nothing is received while ingest is
+// paused.
+func receiveMessages(hcfg *handlerConfig, svc sqsAPI, vk *visibilityKeeper, done chan bool, deliver func([]*sqs.Message) bool, flush func() error) {
+	var tick <-chan time.Time
+	if flush != nil {
+		ticker := time.NewTicker(batchFlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	// buffered so that an in-flight receive never blocks after we shut down,
+	// and it only uses copies of the handler state since it may outlive us
+	c := make(chan *sqs.ReceiveMessageOutput, 1)
+	ctx, queue, metrics := hcfg.ctx, hcfg.queue, hcfg.metrics
+	var receiving bool
+	var receiveStart time.Time
+	backoff := awsutils.NewBackoff(receiveBackoffBase, receiveBackoffMax)
+	var retry <-chan time.Time // set while backing off after a failed or empty receive
+	var idle *awsutils.Backoff
+	if hcfg.emptyBackoff > 0 {
+		base := emptyBackoffBase
+		if base > hcfg.emptyBackoff {
+			base = hcfg.emptyBackoff
+		}
+		idle = awsutils.NewBackoff(base, hcfg.emptyBackoff)
+	}
+	for {
+		// while paused no receives are started, messages already received are
+		// still handled
+		resumed := hcfg.pause.Resumed()
+		if !receiving && retry == nil && resumed == nil {
+			req := &sqs.ReceiveMessageInput{
+				AttributeNames:      hcfg.attributeNames,
+				MaxNumberOfMessages: aws.Int64(hcfg.maxMessages),
+				WaitTimeSeconds:     aws.Int64(hcfg.waitTime),
+			}
+			if hcfg.fifo {
+				req.SetReceiveRequestAttemptId(uuid.New().String())
 			}
 
-			if err = hcfg.proc.Process(ent); err != nil {
-				lg.Error("Sending message: %v", err)
+			req = req.SetQueueUrl(hcfg.queue)
+			err := req.Validate()
+			if err != nil {
+				lg.Error("sqs request validation: %v", err)
 				return
 			}
+
+			receiveStart = time.Now()
+			go func() {
+				o, err := svc.ReceiveMessageWithContext(ctx, req)
+				if err != nil {
+					if ctx.Err() == nil {
+						lg.Error("%s", receiveError(svc, queue, err))
+						metrics.Error()
+					}
+					c <- nil
+					return
+				}
+				c <- o
+			}()
+			receiving = true
+		}
+
+		var out *sqs.ReceiveMessageOutput
+		select {
+		case out = <-c:
+			receiving = false
+			if out == nil {
+				// throttling and network trouble are usually transient
+				retry = time.After(backoff.Next())
+				continue
+			}
+			backoff.Reset()
+		case <-retry:
+			retry = nil
+			continue
+		case <-resumed:
+			continue
+		case <-tick:
+			flush()
+			continue
+		case <-done:
+			return
+		}
+
+		hcfg.metrics.Received(len(out.Messages), time.Since(receiveStart))
+		if idle != nil {
+			if len(out.Messages) == 0 {
+				// a quiet queue, sleep longer after every empty receive
+				retry = time.After(idle.Next())
+				continue
+			}
+			idle.Reset()
+		}
+		vk.Track(out.Messages)
+		if !deliver(out.Messages) {
+			return
+		}
+	}
+}
+
+// pendingMessage is a message whose entries are in the pending batch, end is
+// the length of the batch after its last entry was added.
+type pendingMessage struct {
+	msg     *sqs.Message
+	end     int
+	payload *s3Object // offloaded by the SQS Extended Client
+}
+
+// ingestObjects reads every line of a set of S3 objects, stopping at the first
+// failure.
+func ingestObjects(svc s3API, objs []s3Object, fn func([]byte) error) error {
+	for _, obj := range objs {
+		if err := ingestObject(svc, obj, fn); err != nil {
+			return fmt.Errorf("s3://%s/%s: %v", obj.Bucket, obj.Key, err)
+		}
+	}
+	return nil
+}
+
+// newTimeGrinder builds a TimeGrinder honoring the timezone and format
+// overrides of a handler.
+func newTimeGrinder(hcfg *handlerConfig) (tg *timegrinder.TimeGrinder, err error) {
+	tcfg := timegrinder.Config{
+		EnableLeftMostSeed: true,
+		FormatOverride:     hcfg.formatOverride,
+	}
+	if tg, err = timegrinder.NewTimeGrinder(tcfg); err != nil {
+		return
+	}
+	if hcfg.setLocalTime {
+		tg.SetLocalTime()
+	}
+	if hcfg.timezoneOverride != `` {
+		err = tg.SetTimezone(hcfg.timezoneOverride)
+	}
+	return
+}
+
+// entryTag returns the tag of an entry, rendered from the Tag-Template if the
+// queue has one.
+func entryTag(hcfg *handlerConfig, data []byte) entry.EntryTag {
+	if hcfg.tagger == nil {
+		return hcfg.tag
+	}
+	tag, err := hcfg.tagger.Tag(func(name string) string {
+		switch name {
+		case tagVarQueue:
+			return path.Base(hcfg.queue)
+		case tagVarRegion:
+			return hcfg.region
+		}
+		return ``
+	}, data)
+	if err != nil {
+		lg.Warn("Falling back to Tag-Name on queue %s: %v", hcfg.queue, err)
+	}
+	return tag
+}
+
+// sentTimestamp returns the time at which SQS received a message, falling
+// back to the current time if the attribute is missing or malformed.
+func sentTimestamp(m *sqs.Message) entry.Timestamp {
+	t, ok := m.Attributes["SentTimestamp"]
+	if !ok || t == nil {
+		lg.Error("SQS did not provide timestamp for message: %v", m.Attributes)
+		return entry.Now()
+	}
+	ut, err := strconv.ParseInt(*t, 10, 64)
+	if err != nil {
+		lg.Error("parseint on unix time: %v", *t)
+		return entry.Now()
+	}
+	return entry.UnixTime(ut/1000, (ut%1000)*int64(time.Millisecond))
+}
+
+// deleteMessages removes ingested messages from the queue. SQS only accepts
+// a handful of messages per delete request, so the receipt handles are sent in
+// chunks. Failures are logged and otherwise ignored; the messages will simply
+// be redelivered once their visibility timeout expires. The number of messages
+// deleted is returned.
+func deleteMessages(svc sqsAPI, queue string, handles []*string, qm *queueMetrics) (deleted int) {
+	for len(handles) > 0 {
+		n := len(handles)
+		if n > maxDeleteBatch {
+			n = maxDeleteBatch
+		}
+		req := &sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(queue),
+		}
+		for i, h := range handles[:n] {
+			req.Entries = append(req.Entries, &sqs.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(i)),
+				ReceiptHandle: h,
+			})
+		}
+		handles = handles[n:]
+
+		out, err := svc.DeleteMessageBatch(req)
+		if err != nil {
+			lg.Error("sqs delete message batch: %s", awsutils.ErrorMessage(err))
+			qm.Error()
+			continue
+		}
+		deleted += len(out.Successful)
+		for _, f := range out.Failed {
+			lg.Error("sqs delete message %s failed: %s", aws.StringValue(f.Id), aws.StringValue(f.Message))
+			qm.Error()
 		}
 	}
+	return
 }
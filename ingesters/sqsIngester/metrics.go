@@ -0,0 +1,318 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest"
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
+)
+
+type entryWriter interface {
+	WriteEntry(*entry.Entry) error
+}
+
+// promMetrics are the Prometheus metric families shared by every queue.
+type promMetrics struct {
+	received *awsutils.PromVec
+	deleted  *awsutils.PromVec
+	errors   *awsutils.PromVec
+	inFlight *awsutils.PromVec
+	oversize *awsutils.PromVec
+	panics   *awsutils.PromVec
+	clamped  *awsutils.PromVec
+}
+
+func newPromMetrics(r *awsutils.PromRegistry) *promMetrics {
+	return &promMetrics{
+		received: r.Counter(`sqs_messages_received_total`, `Messages received from the queue.`, `queue`),
+		deleted:  r.Counter(`sqs_messages_deleted_total`, `Messages deleted from the queue after ingest.`, `queue`),
+		errors:   r.Counter(`sqs_process_errors_total`, `Failures receiving, processing, or deleting messages.`, `queue`),
+		inFlight: r.Gauge(`sqs_messages_in_flight`, `Messages received but not yet ingested and deleted.`, `queue`),
+		oversize: r.Counter(`sqs_oversize_entries_total`, `Entries over the Max-Entry-Size, by how they were handled.`, `queue`, `action`),
+		panics:   r.Counter(`sqs_reader_panics_total`, `Readers of the queue which panicked and were relaunched.`, `queue`),
+		clamped:  r.Counter(`sqs_timestamps_clamped_total`, `Extracted timestamps outside the Max-Timestamp-Skew, replaced by the enqueue time.`, `queue`),
+	}
+}
+
+// queueMetrics are the values of a single queue, shared by all of its
+// readers. A nil *queueMetrics is valid and records nothing.
+type queueMetrics struct {
+	name string
+
+	// counters accumulated between reports
+	sync.Mutex
+	nReceived uint64
+	nDeleted  uint64
+	nBytes    uint64
+	nErrors   uint64
+	nEmpty    uint64
+	nReceives uint64
+	latency   time.Duration
+	nDropped  uint64 // oversized entries
+	nTrunc    uint64
+	nPanics   uint64
+	nClamped  uint64
+
+	// optional Prometheus values, these are never reset
+	received  *awsutils.PromValue
+	deleted   *awsutils.PromValue
+	errors    *awsutils.PromValue
+	inFlight  *awsutils.PromValue
+	dropped   *awsutils.PromValue
+	truncated *awsutils.PromValue
+	panics    *awsutils.PromValue
+	clamped   *awsutils.PromValue
+	progress  *awsutils.ProgressTracker
+}
+
+// newQueueMetrics returns the metrics of a queue, either of the Prometheus
+// families or the progress tracker may be nil.
+func newQueueMetrics(pm *promMetrics, progress *awsutils.ProgressTracker, name string) *queueMetrics {
+	qm := &queueMetrics{name: name, progress: progress}
+	if pm != nil {
+		qm.received = pm.received.With(name)
+		qm.deleted = pm.deleted.With(name)
+		qm.errors = pm.errors.With(name)
+		qm.inFlight = pm.inFlight.With(name)
+		qm.dropped = pm.oversize.With(name, awsutils.OversizeDrop)
+		qm.truncated = pm.oversize.With(name, awsutils.OversizeTruncate)
+		qm.panics = pm.panics.With(name)
+		qm.clamped = pm.clamped.With(name)
+	}
+	return qm
+}
+
+// Received counts messages handed to us by a successful receive call, which
+// may be empty, along with how long the call took.
+func (qm *queueMetrics) Received(n int, latency time.Duration) {
+	if qm != nil {
+		qm.progress.Mark()
+		qm.received.Add(float64(n))
+		qm.inFlight.Add(float64(n))
+		qm.Lock()
+		qm.nReceived += uint64(n)
+		qm.nReceives++
+		qm.latency += latency
+		if n == 0 {
+			qm.nEmpty++
+		}
+		qm.Unlock()
+	}
+}
+
+// Done counts messages we are finished with, deleted is how many of them were
+// removed from the queue.
+func (qm *queueMetrics) Done(n, deleted int) {
+	if qm != nil {
+		qm.inFlight.Add(-float64(n))
+		qm.deleted.Add(float64(deleted))
+		qm.Lock()
+		qm.nDeleted += uint64(deleted)
+		qm.Unlock()
+	}
+}
+
+// Ingested counts bytes of entry data handed to the muxer.
+func (qm *queueMetrics) Ingested(bytes int) {
+	if qm != nil {
+		qm.Lock()
+		qm.nBytes += uint64(bytes)
+		qm.Unlock()
+	}
+}
+
+// Error counts a failure.
+func (qm *queueMetrics) Error() {
+	if qm != nil {
+		qm.errors.Inc()
+		qm.Lock()
+		qm.nErrors++
+		qm.Unlock()
+	}
+}
+
+// Oversize counts an entry over the Max-Entry-Size which was dropped or
+// truncated.
+func (qm *queueMetrics) Oversize(dropped bool) {
+	if qm != nil {
+		qm.Lock()
+		if dropped {
+			qm.nDropped++
+			qm.dropped.Inc()
+		} else {
+			qm.nTrunc++
+			qm.truncated.Inc()
+		}
+		qm.Unlock()
+	}
+}
+
+// Panic counts a reader which panicked.
+func (qm *queueMetrics) Panic() {
+	if qm != nil {
+		qm.panics.Inc()
+		qm.Lock()
+		qm.nPanics++
+		qm.Unlock()
+	}
+}
+
+// Clamped counts an extracted timestamp outside the Max-Timestamp-Skew.
+func (qm *queueMetrics) Clamped() {
+	if qm != nil {
+		qm.clamped.Inc()
+		qm.Lock()
+		qm.nClamped++
+		qm.Unlock()
+	}
+}
+
+// queueReport summarizes a queue over a single reporting interval.
+type queueReport struct {
+	Queue                 string
+	Received              uint64
+	Deleted               uint64
+	Bytes                 uint64
+	Errors                uint64
+	EmptyReceives         uint64
+	MessagesPerSecond     float64
+	BytesPerSecond        float64
+	AverageReceiveLatency int64 // milliseconds, including any long polling wait
+	OversizeDropped       uint64
+	OversizeTruncated     uint64
+	ReaderPanics          uint64
+	TimestampsClamped     uint64
+	Paused                bool `json:",omitempty"` // ingest paused by signal or Pause-File
+}
+
+// Report returns the counters accumulated since the last report summarized
+// over the elapsed time, then zeroes them.
+func (qm *queueMetrics) Report(elapsed time.Duration) (r queueReport) {
+	qm.Lock()
+	r = queueReport{
+		Queue:             qm.name,
+		Received:          qm.nReceived,
+		Deleted:           qm.nDeleted,
+		Bytes:             qm.nBytes,
+		Errors:            qm.nErrors,
+		EmptyReceives:     qm.nEmpty,
+		OversizeDropped:   qm.nDropped,
+		OversizeTruncated: qm.nTrunc,
+		ReaderPanics:      qm.nPanics,
+		TimestampsClamped: qm.nClamped,
+	}
+	if qm.nReceives > 0 {
+		r.AverageReceiveLatency = (qm.latency / time.Duration(qm.nReceives)).Milliseconds()
+	}
+	qm.nReceived, qm.nDeleted, qm.nBytes, qm.nErrors, qm.nEmpty = 0, 0, 0, 0, 0
+	qm.nReceives, qm.latency, qm.nDropped, qm.nTrunc, qm.nPanics = 0, 0, 0, 0, 0
+	qm.nClamped = 0
+	qm.Unlock()
+	if secs := elapsed.Seconds(); secs > 0 {
+		r.MessagesPerSecond = float64(r.Received) / secs
+		r.BytesPerSecond = float64(r.Bytes) / secs
+	}
+	return
+}
+
+// metricsReporter periodically reports the metrics of every queue, logging
+// the reports and optionally ingesting them as JSON entries. Queues may be
+// added and removed while it runs.
+type metricsReporter struct {
+	sync.Mutex
+	queues []*queueMetrics
+
+	wtr     entryWriter
+	tag     entry.EntryTag
+	emitTag bool
+	pause   *awsutils.Pauser
+}
+
+// Add starts reporting on a queue.
+func (mr *metricsReporter) Add(qm *queueMetrics) {
+	mr.Lock()
+	mr.queues = append(mr.queues, qm)
+	sort.Slice(mr.queues, func(i, j int) bool { return mr.queues[i].name < mr.queues[j].name })
+	mr.Unlock()
+}
+
+// Remove stops reporting on a queue, its final partial interval is dropped.
+func (mr *metricsReporter) Remove(qm *queueMetrics) {
+	mr.Lock()
+	for i, v := range mr.queues {
+		if v == qm {
+			mr.queues = append(mr.queues[:i], mr.queues[i+1:]...)
+			break
+		}
+	}
+	mr.Unlock()
+}
+
+// SetEntryTag causes reports to be written as entries with the given tag.
+func (mr *metricsReporter) SetEntryTag(wtr entryWriter, tag entry.EntryTag) {
+	mr.wtr = wtr
+	mr.tag = tag
+	mr.emitTag = true
+}
+
+// SetPauser causes reports to note when ingest is paused.
+func (mr *metricsReporter) SetPauser(p *awsutils.Pauser) {
+	mr.pause = p
+}
+
+// run emits a report for every queue each interval until done is closed.
+func (mr *metricsReporter) run(lgr ingest.IngestLogger, interval time.Duration, done chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		now := time.Now()
+		elapsed := now.Sub(last)
+		last = now
+		mr.Lock()
+		queues := append([]*queueMetrics(nil), mr.queues...)
+		mr.Unlock()
+		for _, qm := range queues {
+			r := qm.Report(elapsed)
+			r.Paused = mr.pause.Paused()
+			lgr.Info("Queue %s: %d received (%.1f/s), %d deleted, %d bytes (%.1f/s), %d errors, %d empty receives, average receive latency %dms, %d oversize entries dropped, %d truncated, %d reader panics, %d timestamps clamped",
+				r.Queue, r.Received, r.MessagesPerSecond, r.Deleted, r.Bytes, r.BytesPerSecond, r.Errors, r.EmptyReceives, r.AverageReceiveLatency, r.OversizeDropped, r.OversizeTruncated, r.ReaderPanics, r.TimestampsClamped)
+			if err := mr.emit(r); err != nil {
+				lg.Error("Failed to write metrics entry for queue %s: %v", r.Queue, err)
+			}
+		}
+	}
+}
+
+// emit writes the report as a JSON entry if a metrics tag is configured.
+func (mr *metricsReporter) emit(r queueReport) error {
+	if !mr.emitTag {
+		return nil
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return mr.wtr.WriteEntry(&entry.Entry{
+		TS:   entry.Now(),
+		Tag:  mr.tag,
+		Data: b,
+	})
+}
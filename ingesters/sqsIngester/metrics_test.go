@@ -0,0 +1,96 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+)
+
+type testEntryWriter struct {
+	sync.Mutex
+	ents []*entry.Entry
+}
+
+func (tw *testEntryWriter) WriteEntry(ent *entry.Entry) error {
+	tw.Lock()
+	tw.ents = append(tw.ents, ent)
+	tw.Unlock()
+	return nil
+}
+
+func (tw *testEntryWriter) WriteEntryContext(ctx context.Context, ent *entry.Entry) error {
+	return tw.WriteEntry(ent)
+}
+
+func (tw *testEntryWriter) count() int {
+	tw.Lock()
+	defer tw.Unlock()
+	return len(tw.ents)
+}
+
+func TestQueueReport(t *testing.T) {
+	qm := newQueueMetrics(nil, nil, `queue`)
+	qm.Received(10, 100*time.Millisecond)
+	qm.Received(0, 300*time.Millisecond)
+	qm.Ingested(4096)
+	qm.Done(10, 8)
+	qm.Error()
+	qm.Oversize(true)
+	qm.Oversize(false)
+	qm.Oversize(false)
+
+	r := qm.Report(2 * time.Second)
+	exp := queueReport{
+		Queue:                 `queue`,
+		Received:              10,
+		Deleted:               8,
+		Bytes:                 4096,
+		Errors:                1,
+		EmptyReceives:         1,
+		MessagesPerSecond:     5,
+		BytesPerSecond:        2048,
+		AverageReceiveLatency: 200,
+		OversizeDropped:       1,
+		OversizeTruncated:     2,
+	}
+	if r != exp {
+		t.Fatalf("bad report:\n%+v\nexpected\n%+v", r, exp)
+	}
+	if r = qm.Report(time.Second); r != (queueReport{Queue: `queue`}) {
+		t.Fatalf("counters not reset: %+v", r)
+	}
+
+	var tw testEntryWriter
+	mr := &metricsReporter{}
+	mr.Add(qm)
+	mr.Add(newQueueMetrics(nil, nil, `another`))
+	if len(mr.queues) != 2 || mr.queues[0].name != `another` {
+		t.Fatalf("queues not sorted: %v", mr.queues)
+	}
+	mr.Remove(qm)
+	if len(mr.queues) != 1 || mr.queues[0].name != `another` {
+		t.Fatalf("queue not removed: %v", mr.queues)
+	}
+	mr.SetEntryTag(&tw, 7)
+	if err := mr.emit(exp); err != nil {
+		t.Fatal(err)
+	}
+	var got queueReport
+	if len(tw.ents) != 1 || tw.ents[0].Tag != 7 {
+		t.Fatalf("bad metrics entries: %v", tw.ents)
+	} else if err := json.Unmarshal(tw.ents[0].Data, &got); err != nil || got != exp {
+		t.Fatalf("bad metrics entry %s: %v", tw.ents[0].Data, err)
+	}
+}
@@ -0,0 +1,731 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+	"github.com/gravwell/gravwell/v3/ingest/processors"
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
+	"github.com/gravwell/gravwell/v3/timegrinder"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// fakeReceive is one scripted receive, either an error or messages with the
+// given bodies.
+type fakeReceive struct {
+	bodies []string
+	err    error
+}
+
+// fakeQueue implements sqsAPI, handing out its scripted receives in order.
+// Once the script runs out receives long poll until they are cancelled. Each
+// message gets a unique ID which is also its receipt handle.
+type fakeQueue struct {
+	sync.Mutex
+	script    []fakeReceive
+	sent      int
+	deleted   []string
+	extended  map[string]int // visibility extensions by receipt handle
+	cancelled int
+	sentAt    time.Time // SentTimestamp of every message, unset if zero
+}
+
+func (fq *fakeQueue) ReceiveMessageWithContext(ctx aws.Context, in *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	fq.Lock()
+	defer fq.Unlock()
+	if len(fq.script) == 0 {
+		fq.Unlock()
+		<-ctx.Done()
+		fq.Lock()
+		fq.cancelled++
+		return nil, ctx.Err()
+	}
+	r := fq.script[0]
+	fq.script = fq.script[1:]
+	if r.err != nil {
+		return nil, r.err
+	}
+	out := &sqs.ReceiveMessageOutput{}
+	for _, b := range r.bodies {
+		fq.sent++
+		id := fmt.Sprintf("msg-%d", fq.sent)
+		m := &sqs.Message{
+			MessageId:     aws.String(id),
+			ReceiptHandle: aws.String(id),
+			Body:          aws.String(b),
+		}
+		if !fq.sentAt.IsZero() {
+			m.Attributes = map[string]*string{
+				sqs.MessageSystemAttributeNameSentTimestamp: aws.String(strconv.FormatInt(fq.sentAt.UnixNano()/int64(time.Millisecond), 10)),
+			}
+		}
+		out.Messages = append(out.Messages, m)
+	}
+	return out, nil
+}
+
+func (fq *fakeQueue) DeleteMessageBatch(in *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
+	fq.Lock()
+	defer fq.Unlock()
+	out := &sqs.DeleteMessageBatchOutput{}
+	for _, e := range in.Entries {
+		fq.deleted = append(fq.deleted, aws.StringValue(e.ReceiptHandle))
+		out.Successful = append(out.Successful, &sqs.DeleteMessageBatchResultEntry{Id: e.Id})
+	}
+	return out, nil
+}
+
+func (fq *fakeQueue) ChangeMessageVisibilityBatch(in *sqs.ChangeMessageVisibilityBatchInput) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	fq.Lock()
+	defer fq.Unlock()
+	if fq.extended == nil {
+		fq.extended = make(map[string]int)
+	}
+	out := &sqs.ChangeMessageVisibilityBatchOutput{}
+	for _, e := range in.Entries {
+		fq.extended[aws.StringValue(e.ReceiptHandle)]++
+		out.Successful = append(out.Successful, &sqs.ChangeMessageVisibilityBatchResultEntry{Id: e.Id})
+	}
+	return out, nil
+}
+
+func (fq *fakeQueue) GetQueueAttributes(in *sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
+	return &sqs.GetQueueAttributesOutput{Attributes: map[string]*string{
+		sqs.QueueAttributeNameVisibilityTimeout: aws.String(`30`),
+	}}, nil
+}
+
+func (fq *fakeQueue) deletes() int {
+	fq.Lock()
+	defer fq.Unlock()
+	return len(fq.deleted)
+}
+
+func (fq *fakeQueue) extensions(handle string) int {
+	fq.Lock()
+	defer fq.Unlock()
+	return fq.extended[handle]
+}
+
+// blockingWriter holds up every write until release is closed.
+type blockingWriter struct {
+	testEntryWriter
+	release chan struct{}
+}
+
+func (bw *blockingWriter) WriteEntry(ent *entry.Entry) error {
+	<-bw.release
+	return bw.testEntryWriter.WriteEntry(ent)
+}
+
+func (bw *blockingWriter) WriteEntryContext(ctx context.Context, ent *entry.Entry) error {
+	return bw.WriteEntry(ent)
+}
+
+// newTestHandler returns the handler config of a queue ingesting into tw.
+func newTestHandler(t *testing.T, tw *testEntryWriter) *handlerConfig {
+	lg = log.NewDiscardLogger()
+	decomp, err := awsutils.NewDecompressor(``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &handlerConfig{
+		queue:            `https://sqs.us-east-1.amazonaws.com/123456789012/test`,
+		ignoreTimestamps: true,
+		deleteOnIngest:   true,
+		maxMessages:      defaultMaxNumberOfMessages,
+		decomp:           decomp,
+		metrics:          newQueueMetrics(nil, nil, `test`),
+		proc:             &procSet{ps: processors.NewProcessorSet(tw)},
+	}
+}
+
+// startConsumer consumes the fake queue in the background. The exited
+// channel is closed when the consumer returns, stop shuts it down and waits
+// for it.
+func startConsumer(t *testing.T, hcfg *handlerConfig, fq *fakeQueue) (stop func(), exited chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	hcfg.ctx = ctx
+	hcfg.done = make(chan bool)
+	exited = make(chan struct{})
+	var tg *timegrinder.TimeGrinder
+	if !hcfg.ignoreTimestamps {
+		var err error
+		if tg, err = newTimeGrinder(hcfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go func() {
+		consumeQueue(hcfg, fq, tg, hcfg.s3svc)
+		close(exited)
+	}()
+	stop = func() {
+		close(hcfg.done)
+		cancel()
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			t.Fatal("consumer did not exit on shutdown")
+		}
+	}
+	return
+}
+
+// waitFor polls cond until it returns true.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestConsumeQueueRecovers(t *testing.T) {
+	var tw testEntryWriter
+	hcfg := newTestHandler(t, &tw)
+	fq := &fakeQueue{script: []fakeReceive{
+		{err: errors.New("connection reset by peer")},
+		{bodies: []string{`hello msg-1`}},
+		{bodies: []string{`hello msg-2`}},
+		{bodies: []string{`hello msg-3`}},
+	}}
+	stop, exited := startConsumer(t, hcfg, fq)
+	waitFor(t, `the consumer to recover`, func() bool {
+		select {
+		case <-exited:
+			t.Fatal("consumer exited after a failed receive")
+		default:
+		}
+		return tw.count() >= 3
+	})
+	stop()
+
+	waitFor(t, `the in-flight receive to be cancelled`, func() bool {
+		fq.Lock()
+		defer fq.Unlock()
+		return fq.cancelled == 1
+	})
+	if n := fq.deletes(); n != 3 {
+		t.Fatalf("%d messages deleted, expected 3", n)
+	}
+}
+
+func TestConsumeKeepMessages(t *testing.T) {
+	var tw testEntryWriter
+	hcfg := newTestHandler(t, &tw)
+	hcfg.deleteOnIngest = false
+	fq := &fakeQueue{script: []fakeReceive{{bodies: []string{`a`, `b`}}}}
+	stop, _ := startConsumer(t, hcfg, fq)
+	waitFor(t, `entries`, func() bool { return tw.count() == 2 })
+	stop()
+	if n := fq.deletes(); n != 0 {
+		t.Fatalf("%d messages deleted without Delete-On-Ingest", n)
+	}
+}
+
+// fakeSyncer stands in for the muxer's acknowledgement of entries.
+type fakeSyncer struct {
+	sync.Mutex
+	err   error
+	syncs int
+}
+
+func (fs *fakeSyncer) Sync(time.Duration) error {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.syncs++
+	return fs.err
+}
+
+func (fs *fakeSyncer) count() int {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.syncs
+}
+
+func TestConsumeDeleteSync(t *testing.T) {
+	var tw testEntryWriter
+	hcfg := newTestHandler(t, &tw)
+	fs := &fakeSyncer{err: errors.New("timed out")}
+	hcfg.sync, hcfg.syncTimeout = fs, time.Second
+	fq := &fakeQueue{script: []fakeReceive{{bodies: []string{`a`, `b`}}}}
+	stop, _ := startConsumer(t, hcfg, fq)
+	waitFor(t, `a sync`, func() bool { return fs.count() == 1 })
+	stop()
+	if n := fq.deletes(); n != 0 {
+		t.Fatalf("%d messages deleted without an acknowledgement", n)
+	}
+
+	// once acknowledged the messages are deleted
+	fs.err = nil
+	hcfg = newTestHandler(t, &tw)
+	hcfg.sync, hcfg.syncTimeout = fs, time.Second
+	fq = &fakeQueue{script: []fakeReceive{{bodies: []string{`a`, `b`}}}}
+	stop, _ = startConsumer(t, hcfg, fq)
+	waitFor(t, `deletes`, func() bool { return fq.deletes() == 2 })
+	stop()
+	if n := fs.count(); n != 2 {
+		t.Fatalf("synced %d times, expected 2", n)
+	}
+}
+
+func TestConsumeUnwrapSNS(t *testing.T) {
+	var tw testEntryWriter
+	hcfg := newTestHandler(t, &tw)
+	hcfg.unwrapSNS = true
+	hcfg.ignoreTimestamps = false
+	fq := &fakeQueue{script: []fakeReceive{{bodies: []string{testSNSEnvelope}}}}
+	stop, _ := startConsumer(t, hcfg, fq)
+	waitFor(t, `the message to be deleted`, func() bool { return fq.deletes() == 1 })
+	stop()
+
+	if tw.count() != 1 || string(tw.ents[0].Data) != `{"foo":"bar"}` {
+		t.Fatalf("SNS envelope not unwrapped: %v", tw.ents)
+	}
+	if exp := time.Date(2012, 5, 2, 0, 54, 6, 655000000, time.UTC); !tw.ents[0].TS.StandardTime().Equal(exp) {
+		t.Fatalf("bad timestamp %v, expected the notification time", tw.ents[0].TS)
+	}
+}
+
+func TestConsumeEventBridge(t *testing.T) {
+	var tw testEntryWriter
+	hcfg := newTestHandler(t, &tw)
+	hcfg.eventBridge = eventBridgeDetail
+	hcfg.ignoreTimestamps = false
+	fq := &fakeQueue{script: []fakeReceive{{bodies: []string{testEventBridgeEvent, `not an event`}}}}
+	stop, _ := startConsumer(t, hcfg, fq)
+	waitFor(t, `the messages to be deleted`, func() bool { return fq.deletes() == 2 })
+	stop()
+
+	if tw.count() != 2 || string(tw.ents[0].Data) != `{"instance-id": "i-1234567890abcdef0", "state": "terminated"}` || string(tw.ents[1].Data) != `not an event` {
+		t.Fatalf("bad entries: %v", tw.ents)
+	}
+	if exp := time.Date(2017, 12, 22, 18, 43, 48, 0, time.UTC); !tw.ents[0].TS.StandardTime().Equal(exp) {
+		t.Fatalf("bad timestamp %v, expected the event time", tw.ents[0].TS)
+	}
+}
+
+func TestConsumeProcessWorkers(t *testing.T) {
+	var tw testEntryWriter
+	hcfg := newTestHandler(t, &tw)
+	hcfg.receiveBuffer = 2
+	hcfg.processWorkers = 3
+	fq := &fakeQueue{script: []fakeReceive{
+		{bodies: []string{`a`, `b`}},
+		{bodies: []string{`c`}},
+		{bodies: []string{`d`, `e`, `f`}},
+		{bodies: []string{`g`}},
+	}}
+	stop, _ := startConsumer(t, hcfg, fq)
+	waitFor(t, `the messages to be deleted`, func() bool { return fq.deletes() == 7 })
+	stop()
+	if tw.count() != 7 {
+		t.Fatalf("bad entry count %d", tw.count())
+	}
+}
+
+func TestConsumeProcessWorkerPanic(t *testing.T) {
+	var tw testEntryWriter
+	hcfg := newTestHandler(t, &tw)
+	hcfg.processWorkers = 2
+	hcfg.proc.ps.AddProcessor(panicProcessor{})
+	hcfg.svc = &fakeQueue{script: []fakeReceive{{bodies: []string{`boom`}}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hcfg.ctx = ctx
+	hcfg.done = make(chan bool)
+	// the worker panic takes down the reader, which is then relaunched
+	if !consumeRecovered(hcfg, nil) {
+		t.Fatal("worker panic was not reported")
+	}
+	if r := hcfg.metrics.Report(time.Second); r.ReaderPanics != 1 {
+		t.Fatalf("%d panics counted", r.ReaderPanics)
+	}
+}
+
+func TestConsumeTagTemplate(t *testing.T) {
+	var tw testEntryWriter
+	hcfg := newTestHandler(t, &tw)
+	hcfg.queue = `https://sqs.us-east-1.amazonaws.com/123456789012/orders.fifo`
+	tt, err := (&queue{Tag_Template: `{queue}-{json:kind}`}).tagTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var negotiated []string
+	hcfg.tagger = awsutils.NewTagResolver(tt, hcfg.tag, func(name string) (entry.EntryTag, error) {
+		negotiated = append(negotiated, name)
+		return entry.EntryTag(10 + len(negotiated)), nil
+	})
+	fq := &fakeQueue{script: []fakeReceive{{bodies: []string{`{"kind":"new"}`, `plain`, `{"kind":"new"}`}}}}
+	stop, _ := startConsumer(t, hcfg, fq)
+	waitFor(t, `the messages to be deleted`, func() bool { return fq.deletes() == 3 })
+	stop()
+
+	if tw.count() != 3 || tw.ents[0].Tag != 11 || tw.ents[1].Tag != hcfg.tag || tw.ents[2].Tag != 11 {
+		t.Fatalf("bad entry tags: %v", tw.ents)
+	}
+	if len(negotiated) != 1 || negotiated[0] != `orders-fifo-new` {
+		t.Fatalf("bad negotiated tags %v", negotiated)
+	}
+}
+
+func TestConsumeVisibilityExtension(t *testing.T) {
+	bw := blockingWriter{release: make(chan struct{})}
+	hcfg := newTestHandler(t, &bw.testEntryWriter)
+	hcfg.proc = &procSet{ps: processors.NewProcessorSet(&bw)}
+	hcfg.visExtension = 2 * time.Second // heartbeats every second
+	fq := &fakeQueue{script: []fakeReceive{{bodies: []string{`slow`}}}}
+	stop, _ := startConsumer(t, hcfg, fq)
+
+	// the message is held while its write is stuck
+	waitFor(t, `a visibility extension`, func() bool { return fq.extensions(`msg-1`) > 0 })
+	if fq.deletes() != 0 {
+		t.Fatal("message deleted before it was written")
+	}
+	close(bw.release)
+	waitFor(t, `the message to be deleted`, func() bool { return fq.deletes() == 1 })
+	stop()
+	if bw.count() != 1 {
+		t.Fatalf("bad entry count %d", bw.count())
+	}
+}
+
+func TestConsumeSplitLines(t *testing.T) {
+	var tw testEntryWriter
+	hcfg := newTestHandler(t, &tw)
+	hcfg.lines = awsutils.NewLineSplitter(true, ``)
+	body := "one\r\n\ntwo\nthree"
+	fq := &fakeQueue{script: []fakeReceive{{bodies: []string{body}}, {bodies: []string{body}}, {bodies: []string{body}}}}
+	stop, _ := startConsumer(t, hcfg, fq)
+	waitFor(t, `3 messages to be deleted`, func() bool { return fq.deletes() == 3 })
+	stop()
+
+	tw.Lock()
+	defer tw.Unlock()
+	if len(tw.ents) != 9 {
+		t.Fatalf("%d entries from 3 messages of 3 lines", len(tw.ents))
+	}
+	for i, ent := range tw.ents {
+		if want := []string{`one`, `two`, `three`}[i%3]; string(ent.Data) != want {
+			t.Fatalf("entry %d is %q, expected %q", i, ent.Data, want)
+		}
+	}
+}
+
+func TestConsumeCoalesceBatch(t *testing.T) {
+	bw := blockingWriter{release: make(chan struct{})}
+	hcfg := newTestHandler(t, &bw.testEntryWriter)
+	hcfg.proc = &procSet{ps: processors.NewProcessorSet(&bw)}
+	hcfg.ignoreTimestamps = false
+	hcfg.coalesce = newBatchCoalescer(true, `\t`, coalesceNewest)
+	fq := &fakeQueue{script: []fakeReceive{
+		{bodies: []string{`2020-06-01T12:00:00Z a`, `2020-06-01T14:00:00Z b`, `2020-06-01T13:00:00Z c`}},
+		{bodies: []string{`2020-06-02T12:00:00Z d`}},
+	}}
+	stop, _ := startConsumer(t, hcfg, fq)
+
+	// nothing is deleted until the coalesced entry is written
+	waitFor(t, `4 messages to be received`, func() bool { return hcfg.metrics.Report(time.Second).Received > 0 })
+	time.Sleep(50 * time.Millisecond)
+	if fq.deletes() != 0 {
+		t.Fatal("coalesced messages deleted before their entry was written")
+	}
+	close(bw.release)
+	waitFor(t, `4 messages to be deleted`, func() bool { return fq.deletes() == 4 })
+	stop()
+
+	bw.Lock()
+	defer bw.Unlock()
+	want := []struct {
+		data string
+		ts   time.Time
+	}{
+		{"2020-06-01T12:00:00Z a\t2020-06-01T14:00:00Z b\t2020-06-01T13:00:00Z c", time.Date(2020, 6, 1, 14, 0, 0, 0, time.UTC)},
+		{`2020-06-02T12:00:00Z d`, time.Date(2020, 6, 2, 12, 0, 0, 0, time.UTC)},
+	}
+	if len(bw.ents) != len(want) {
+		t.Fatalf("%d entries from 2 batches", len(bw.ents))
+	}
+	for i, ent := range bw.ents {
+		if string(ent.Data) != want[i].data || !ent.TS.StandardTime().Equal(want[i].ts) {
+			t.Fatalf("entry %d is %q at %v", i, ent.Data, ent.TS)
+		}
+	}
+}
+
+func TestConsumeDebugTee(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `tee`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pth := filepath.Join(dir, `tee.jsonl`)
+
+	var tw testEntryWriter
+	hcfg := newTestHandler(t, &tw)
+	if hcfg.tee, err = awsutils.NewTee(pth, 0, ``, awsutils.Credentials{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	fq := &fakeQueue{script: []fakeReceive{{bodies: []string{`a`, `b`}}}}
+	stop, _ := startConsumer(t, hcfg, fq)
+	waitFor(t, `entries`, func() bool { return tw.count() == 2 })
+	stop()
+	if err := hcfg.tee.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recs []awsutils.TeeRecord
+	for _, ln := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var r awsutils.TeeRecord
+		if err := json.Unmarshal([]byte(ln), &r); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, r)
+	}
+	if len(recs) != 2 || recs[0].Source != hcfg.queue || recs[0].ID != `msg-1` || recs[1].Data != `b` {
+		t.Fatalf("bad tee records: %+v", recs)
+	}
+}
+
+func TestConsumeEmptyReceiveBackoff(t *testing.T) {
+	var tw testEntryWriter
+	hcfg := newTestHandler(t, &tw)
+	hcfg.emptyBackoff = time.Hour
+	script := make([]fakeReceive, 100)
+	fq := &fakeQueue{script: append(script, fakeReceive{bodies: []string{`late`}})}
+	stop, _ := startConsumer(t, hcfg, fq)
+	time.Sleep(300 * time.Millisecond)
+	stop()
+
+	// without the backoff the empty receives would all be spun through
+	fq.Lock()
+	defer fq.Unlock()
+	if n := 101 - len(fq.script); n > 5 {
+		t.Fatalf("%d receives of an empty queue in 300ms", n)
+	}
+}
+
+func TestConsumePaused(t *testing.T) {
+	var tw testEntryWriter
+	hcfg := newTestHandler(t, &tw)
+	hcfg.pause = awsutils.NewPauser(``, nil, `sqs`, t.Logf)
+	hcfg.pause.Pause(`test`)
+	fq := &fakeQueue{script: []fakeReceive{{bodies: []string{`a`, `b`}}}}
+	stop, _ := startConsumer(t, hcfg, fq)
+	defer stop()
+	time.Sleep(100 * time.Millisecond)
+	fq.Lock()
+	received := len(fq.script) == 0
+	fq.Unlock()
+	if received || tw.count() != 0 {
+		t.Fatal("received messages while paused")
+	}
+	hcfg.pause.Resume(`test`)
+	waitFor(t, `entries after resuming`, func() bool { return tw.count() == 2 })
+}
+
+func TestConsumeTimestampJSONPath(t *testing.T) {
+	var tw testEntryWriter
+	hcfg := newTestHandler(t, &tw)
+	hcfg.ignoreTimestamps = false
+	var err error
+	if hcfg.jsonTime, err = awsutils.NewJSONTimestamp(`detail.eventTime`); err != nil {
+		t.Fatal(err)
+	}
+	fq := &fakeQueue{script: []fakeReceive{{bodies: []string{
+		`{"time":"2019-01-01T00:00:00Z","detail":{"eventTime":"2020-06-01T12:00:00Z"}}`,
+		`{"time":"2019-01-01T00:00:00Z","detail":{}}`,
+	}}}}
+	stop, _ := startConsumer(t, hcfg, fq)
+	waitFor(t, `2 messages to be deleted`, func() bool { return fq.deletes() == 2 })
+	stop()
+
+	tw.Lock()
+	defer tw.Unlock()
+	if len(tw.ents) != 2 {
+		t.Fatalf("%d entries from 2 messages", len(tw.ents))
+	}
+	want := []time.Time{
+		time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC),
+		time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC), // no field, the message is scanned
+	}
+	for i, ent := range tw.ents {
+		if !ent.TS.StandardTime().Equal(want[i]) {
+			t.Fatalf("entry %d has timestamp %v, expected %v", i, ent.TS.StandardTime(), want[i])
+		}
+	}
+}
+
+func TestConsumeIgnoreTimestamps(t *testing.T) {
+	var tw testEntryWriter
+	hcfg := newTestHandler(t, &tw)
+	sent := time.Date(2020, 6, 1, 12, 0, 0, 250*int(time.Millisecond), time.UTC)
+	fq := &fakeQueue{sentAt: sent, script: []fakeReceive{{bodies: []string{
+		`event at 2019-01-01T00:00:00Z`,
+		`no timestamp here`,
+	}}}}
+	stop, _ := startConsumer(t, hcfg, fq)
+	waitFor(t, `2 messages to be deleted`, func() bool { return fq.deletes() == 2 })
+	stop()
+
+	tw.Lock()
+	defer tw.Unlock()
+	if len(tw.ents) != 2 {
+		t.Fatalf("%d entries from 2 messages", len(tw.ents))
+	}
+	// timestamps in the data are ignored in favor of the SentTimestamp
+	for i, ent := range tw.ents {
+		if ts := ent.TS.StandardTime(); !ts.Equal(sent) {
+			t.Fatalf("entry %d has timestamp %v, expected the SentTimestamp %v", i, ts, sent)
+		}
+	}
+}
+
+func TestConsumeTimestampClamp(t *testing.T) {
+	var tw testEntryWriter
+	hcfg := newTestHandler(t, &tw)
+	hcfg.ignoreTimestamps = false
+	var err error
+	if hcfg.clamp, err = awsutils.NewTimestampClamp(`720h`, `1h`); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	fresh := now.Add(-time.Hour).UTC().Truncate(time.Second)
+	fq := &fakeQueue{script: []fakeReceive{{bodies: []string{
+		`event at ` + fresh.Format(time.RFC3339),
+		`event at 1999-01-01T00:00:00Z`,
+		`event at 2099-01-01T00:00:00Z`,
+	}}}}
+	stop, _ := startConsumer(t, hcfg, fq)
+	waitFor(t, `3 messages to be deleted`, func() bool { return fq.deletes() == 3 })
+	stop()
+
+	tw.Lock()
+	defer tw.Unlock()
+	if len(tw.ents) != 3 {
+		t.Fatalf("%d entries from 3 messages", len(tw.ents))
+	}
+	if ts := tw.ents[0].TS.StandardTime(); !ts.Equal(fresh) {
+		t.Fatalf("timestamp within the skew was changed to %v", ts)
+	}
+	// the fake queue sets no SentTimestamp so clamped entries get the current time
+	for _, ent := range tw.ents[1:] {
+		if ts := ent.TS.StandardTime(); ts.Before(now.Add(-time.Minute)) || ts.After(time.Now()) {
+			t.Fatalf("timestamp %v wasn't clamped", ts)
+		}
+	}
+	if r := hcfg.metrics.Report(time.Second); r.TimestampsClamped != 2 {
+		t.Fatalf("%d timestamps clamped, expected 2", r.TimestampsClamped)
+	}
+}
+
+// panicProcessor panics on entries containing boom.
+type panicProcessor struct{}
+
+func (panicProcessor) Process(ent *entry.Entry) ([]*entry.Entry, error) {
+	if strings.Contains(string(ent.Data), `boom`) {
+		panic(`boom`)
+	}
+	return []*entry.Entry{ent}, nil
+}
+
+func (panicProcessor) Close() error {
+	return nil
+}
+
+func TestConsumeRecovered(t *testing.T) {
+	var tw testEntryWriter
+	hcfg := newTestHandler(t, &tw)
+	hcfg.proc.ps.AddProcessor(panicProcessor{})
+	fq := &fakeQueue{script: []fakeReceive{{bodies: []string{`boom`}}}}
+	hcfg.svc = fq
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hcfg.ctx = ctx
+	hcfg.done = make(chan bool)
+	if !consumeRecovered(hcfg, nil) {
+		t.Fatal("panic was not reported")
+	}
+	if r := hcfg.metrics.Report(time.Second); r.ReaderPanics != 1 {
+		t.Fatalf("%d panics counted", r.ReaderPanics)
+	}
+	if fq.deletes() != 0 {
+		t.Fatal("deleted the message the reader panicked on")
+	}
+
+	// the relaunched reader carries on with the queue
+	fq.Lock()
+	fq.script = []fakeReceive{{bodies: []string{`fine`}}}
+	fq.Unlock()
+	exited := make(chan bool)
+	go func() {
+		exited <- consumeRecovered(hcfg, nil)
+	}()
+	waitFor(t, `the message to be deleted`, func() bool { return fq.deletes() == 1 })
+	close(hcfg.done)
+	cancel()
+	if <-exited {
+		t.Fatal("relaunched reader panicked")
+	}
+	if tw.count() != 1 {
+		t.Fatalf("%d entries ingested", tw.count())
+	}
+}
+
+func TestAttributeNames(t *testing.T) {
+	names := func(q *queue) (r []string) {
+		ans, err := q.attributeNames()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range ans {
+			r = append(r, aws.StringValue(n))
+		}
+		return
+	}
+	q := &queue{}
+	if got := names(q); len(got) != 1 || got[0] != sqs.MessageSystemAttributeNameSentTimestamp {
+		t.Fatalf("bad default attributes %v", got)
+	}
+	// features add what they need, configured names are canonicalized and deduplicated
+	q = &queue{Queue_URL: `https://sqs.us-east-1.amazonaws.com/123456789012/test.fifo`, Max_Process_Attempts: 3, Attribute_Names: []string{`approximatereceivecount`, ` SenderId `}}
+	want := []string{`SentTimestamp`, `MessageGroupId`, `ApproximateReceiveCount`, `SenderId`}
+	if got := names(q); strings.Join(got, `,`) != strings.Join(want, `,`) {
+		t.Fatalf("attributes %v, expected %v", got, want)
+	}
+	q.Attribute_Names = append(q.Attribute_Names, `all`)
+	if got := names(q); len(got) != 1 || got[0] != `All` {
+		t.Fatalf("bad attributes with All %v", got)
+	}
+	q.Attribute_Names = []string{`NotAnAttribute`}
+	if _, err := q.attributeNames(); err == nil {
+		t.Fatal("accepted an invalid attribute name")
+	}
+}
@@ -0,0 +1,224 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/gravwell/gravwell/v3/ingest/processors"
+)
+
+var ErrRestartRequired = errors.New("configuration changes other than preprocessors require a restart")
+
+// procWriter is what a processor set writes its entries to, normally the
+// ingest muxer.
+type procWriter interface {
+	WriteEntry(*entry.Entry) error
+	WriteEntryContext(context.Context, *entry.Entry) error
+	processors.Tagger
+}
+
+// procSet wraps a queue's processor set so that it can be swapped out while
+// readers are using it. A batch in flight holds the read lock, so a swap
+// waits for it to finish.
+type procSet struct {
+	sync.RWMutex
+	ps *processors.ProcessorSet
+}
+
+func (p *procSet) ProcessBatch(ents []*entry.Entry) error {
+	p.RLock()
+	defer p.RUnlock()
+	return p.ps.ProcessBatch(ents)
+}
+
+// swap installs a new processor set and returns the old one.
+func (p *procSet) swap(ps *processors.ProcessorSet) (old *processors.ProcessorSet) {
+	p.Lock()
+	old, p.ps = p.ps, ps
+	p.Unlock()
+	return
+}
+
+func (p *procSet) Close() error {
+	p.Lock()
+	defer p.Unlock()
+	return p.ps.Close()
+}
+
+// procSource identifies the config section a processor set was built from,
+// either a Queue or a Queue-Discovery section.
+type procSource struct {
+	discovery bool
+	section   string
+}
+
+// reloader tracks the processor sets of the running queues so that they can
+// be rebuilt when the preprocessor configuration changes.
+type reloader struct {
+	sync.Mutex
+	path string
+	cfg  *cfgType
+	wtr  procWriter
+	sets map[*procSet]procSource
+}
+
+func newReloader(path string, cfg *cfgType, wtr procWriter) *reloader {
+	return &reloader{
+		path: path,
+		cfg:  cfg,
+		wtr:  wtr,
+		sets: make(map[*procSet]procSource),
+	}
+}
+
+// build creates a processor set for a config section using the current
+// configuration and tracks it for reloads.
+func (rl *reloader) build(src procSource) (*procSet, error) {
+	rl.Lock()
+	defer rl.Unlock()
+	ps, err := rl.newSet(rl.cfg, src)
+	if err != nil {
+		return nil, err
+	}
+	p := &procSet{ps: ps}
+	rl.sets[p] = src
+	return p, nil
+}
+
+// release stops tracking a processor set and closes it.
+func (rl *reloader) release(p *procSet) error {
+	rl.Lock()
+	delete(rl.sets, p)
+	rl.Unlock()
+	return p.Close()
+}
+
+func (rl *reloader) newSet(cfg *cfgType, src procSource) (*processors.ProcessorSet, error) {
+	var names []string
+	if src.discovery {
+		v, ok := cfg.Queue_Discovery[src.section]
+		if !ok {
+			return nil, fmt.Errorf("Queue-Discovery %s does not exist", src.section)
+		}
+		names = v.Preprocessor
+	} else {
+		v, ok := cfg.Queue[src.section]
+		if !ok {
+			return nil, fmt.Errorf("Queue %s does not exist", src.section)
+		}
+		names = v.Preprocessor
+	}
+	ps, err := cfg.Preprocessor.ProcessorSet(rl.wtr, names)
+	if err != nil {
+		return nil, fmt.Errorf("Preprocessor failure: %v", err)
+	}
+	return ps, nil
+}
+
+// Reload re-reads the config file and, if only preprocessors have changed,
+// rebuilds the processor set of every running queue. Every new set is built
+// before any is swapped in, so a bad config leaves the running sets in place.
+func (rl *reloader) Reload() error {
+	rl.Lock()
+	defer rl.Unlock()
+	nc, err := loadConfig(rl.path)
+	if err != nil {
+		return err
+	}
+	if restartRequired(rl.cfg, nc) {
+		return ErrRestartRequired
+	}
+	built := make(map[*procSet]*processors.ProcessorSet, len(rl.sets))
+	for p, src := range rl.sets {
+		ps, err := rl.newSet(nc, src)
+		if err != nil {
+			for _, ps := range built {
+				ps.Close()
+			}
+			return err
+		}
+		built[p] = ps
+	}
+	for p, ps := range built {
+		if err := p.swap(ps).Close(); err != nil {
+			lg.Warn("Failed to close replaced preprocessors: %v", err)
+		}
+	}
+	rl.cfg = nc
+	return nil
+}
+
+// Close closes every tracked processor set.
+func (rl *reloader) Close() (err error) {
+	rl.Lock()
+	defer rl.Unlock()
+	for p := range rl.sets {
+		if lerr := p.Close(); lerr != nil {
+			err = lerr
+		}
+		delete(rl.sets, p)
+	}
+	return
+}
+
+// restartRequired reports whether two configs differ in anything other than
+// their preprocessors.
+func restartRequired(a, b *cfgType) bool {
+	return !reflect.DeepEqual(withoutPreprocessors(a), withoutPreprocessors(b))
+}
+
+func withoutPreprocessors(c *cfgType) cfgType {
+	r := *c
+	r.Preprocessor = nil
+	r.Queue = make(map[string]*queue, len(c.Queue))
+	for k, v := range c.Queue {
+		q := *v
+		q.Preprocessor = nil
+		r.Queue[k] = &q
+	}
+	r.Queue_Discovery = make(map[string]*queueDiscovery, len(c.Queue_Discovery))
+	for k, v := range c.Queue_Discovery {
+		d := *v
+		d.Preprocessor = nil
+		r.Queue_Discovery[k] = &d
+	}
+	return r
+}
+
+// waitForQuit blocks until a quit signal arrives, reloading the preprocessors
+// on every SIGHUP.
+func waitForQuit(rl *reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	defer signal.Stop(hup)
+	defer signal.Stop(quit)
+	for {
+		select {
+		case <-hup:
+			if err := rl.Reload(); err != nil {
+				lg.Warn("Failed to reload preprocessors from %s: %v", rl.path, err)
+			} else {
+				lg.Info("Reloaded preprocessors from %s", rl.path)
+			}
+		case <-quit:
+			return
+		}
+	}
+}
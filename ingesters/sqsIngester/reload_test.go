@@ -0,0 +1,194 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gravwell/gravwell/v3/ingest/entry"
+	"github.com/gravwell/gravwell/v3/ingest/log"
+)
+
+const reloadTestConfig = `
+[Global]
+Ingest-Secret = secret
+Pipe-Backend-Target=/tmp/nothing
+[Queue "q"]
+	Region="us-east-1"
+	Queue-URL="https://sqs.us-east-1.amazonaws.com/123456789012/q"
+	Tag-Name=%q
+	Use-Instance-Role=true
+	%s
+[Preprocessor "gz"]
+	Type=gzip
+	Passthrough-Non-Gzip=true
+`
+
+// taggingWriter lets a testEntryWriter stand in for the muxer, negotiating
+// tags in order.
+type taggingWriter struct {
+	testEntryWriter
+	tags []string
+}
+
+func (tw *taggingWriter) NegotiateTag(name string) (entry.EntryTag, error) {
+	tw.Lock()
+	defer tw.Unlock()
+	for i, t := range tw.tags {
+		if t == name {
+			return entry.EntryTag(i), nil
+		}
+	}
+	tw.tags = append(tw.tags, name)
+	return entry.EntryTag(len(tw.tags) - 1), nil
+}
+
+func (tw *taggingWriter) LookupTag(tag entry.EntryTag) (string, bool) {
+	tw.Lock()
+	defer tw.Unlock()
+	if int(tag) < len(tw.tags) {
+		return tw.tags[tag], true
+	}
+	return ``, false
+}
+
+func TestReload(t *testing.T) {
+	lg = log.NewDiscardLogger()
+	dir, err := ioutil.TempDir(``, `sqsreload`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pth := filepath.Join(dir, `sqs.conf`)
+	write := func(tag, extra string) {
+		if err := ioutil.WriteFile(pth, []byte(fmt.Sprintf(reloadTestConfig, tag, extra)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte(`hello`))
+	gw.Close()
+	compressed := buf.Bytes()
+	// send writes a compressed entry and returns what came out the other side
+	var tw taggingWriter
+	send := func(p *procSet) string {
+		tw.ents = nil
+		if err := p.ProcessBatch([]*entry.Entry{{Data: compressed}}); err != nil {
+			t.Fatal(err)
+		} else if len(tw.ents) != 1 {
+			t.Fatalf("bad entry count %d", len(tw.ents))
+		}
+		return string(tw.ents[0].Data)
+	}
+
+	write(`sqs`, ``)
+	cfg, err := loadConfig(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := newReloader(pth, cfg, &tw)
+	p, err := rl.build(procSource{section: `q`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if send(p) != string(compressed) {
+		t.Fatal("entry was altered without preprocessors")
+	}
+
+	// adding a preprocessor swaps in a new set
+	write(`sqs`, `Preprocessor=gz`)
+	if err := rl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if s := send(p); s != `hello` {
+		t.Fatalf("preprocessor not reloaded: %q", s)
+	}
+
+	// anything else needs a restart and leaves the running set alone
+	write(`other`, ``)
+	if err := rl.Reload(); err != ErrRestartRequired {
+		t.Fatalf("bad error for a tag change: %v", err)
+	}
+	write(`sqs`, `Preprocessor=missing`)
+	if err := rl.Reload(); err == nil {
+		t.Fatal("reloaded a bad config")
+	}
+	if s := send(p); s != `hello` {
+		t.Fatalf("running set changed by a failed reload: %q", s)
+	}
+
+	if err := rl.release(p); err != nil {
+		t.Fatal(err)
+	} else if len(rl.sets) != 0 {
+		t.Fatal("released set still tracked")
+	}
+}
+
+const routingTestConfig = `
+[Global]
+Ingest-Secret = secret
+Pipe-Backend-Target=/tmp/nothing
+[Queue "q"]
+	Region="us-east-1"
+	Queue-URL="https://sqs.us-east-1.amazonaws.com/123456789012/q"
+	Tag-Name=sqs
+	Use-Instance-Role=true
+	Preprocessor=route
+[Preprocessor "route"]
+	Type=regexrouter
+	Regex="^(?P<app>\\S+) "
+	Route-Extraction=app
+	Route=web:sqs-web
+	Route=db:sqs-db
+`
+
+// A routing preprocessor can send the messages of one queue to several tags,
+// the tag it sets replaces the queue's Tag-Name.
+func TestPreprocessorRouting(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `sqsroute`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pth := filepath.Join(dir, `sqs.conf`)
+	if err := ioutil.WriteFile(pth, []byte(routingTestConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := &taggingWriter{tags: []string{`sqs`}}
+	rl := newReloader(pth, cfg, tw)
+
+	hcfg := newTestHandler(t, &tw.testEntryWriter)
+	if hcfg.proc, err = rl.build(procSource{section: `q`}); err != nil {
+		t.Fatal(err)
+	}
+	fq := &fakeQueue{script: []fakeReceive{{bodies: []string{`web GET /`, `db SELECT 1`, `cron tick`}}}}
+	stop, _ := startConsumer(t, hcfg, fq)
+	waitFor(t, `entries`, func() bool { return tw.count() == 3 })
+	stop()
+	for i, want := range []string{`sqs-web`, `sqs-db`, `sqs`} {
+		tw.Lock()
+		tag := tw.ents[i].Tag
+		tw.Unlock()
+		if name, _ := tw.LookupTag(tag); name != want {
+			t.Fatalf("entry %d went to %q, expected %q", i, name, want)
+		}
+	}
+}
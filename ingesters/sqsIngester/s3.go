@@ -0,0 +1,139 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	s3EventSource        = `aws:s3`
+	s3ObjectCreatedEvent = `ObjectCreated:`
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+)
+
+// s3Event is the notification S3 sends when objects in a bucket change.
+type s3Event struct {
+	Records []s3EventRecord
+}
+
+type s3EventRecord struct {
+	EventSource string `json:"eventSource"`
+	EventName   string `json:"eventName"`
+	S3          struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key  string `json:"key"`
+			Size int64  `json:"size"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+type s3Object struct {
+	Bucket string
+	Key    string
+}
+
+// parseS3Event returns the objects created according to an S3 event
+// notification. If the body is not an S3 notification ok is false. Test events
+// and notifications for anything other than created objects produce an empty
+// object list.
+func parseS3Event(body []byte) (objs []s3Object, ok bool) {
+	var ev s3Event
+	if err := json.Unmarshal(body, &ev); err != nil {
+		return
+	}
+	if ev.Records == nil {
+		// S3 sends a test event when notifications are first configured
+		var te struct {
+			Event string
+		}
+		if err := json.Unmarshal(body, &te); err == nil && te.Event == `s3:TestEvent` {
+			ok = true
+		}
+		return
+	}
+	for _, r := range ev.Records {
+		if r.EventSource != s3EventSource {
+			return nil, false
+		}
+		if !strings.HasPrefix(r.EventName, s3ObjectCreatedEvent) {
+			continue
+		}
+		// object keys are URL encoded in event notifications
+		key, err := url.QueryUnescape(r.S3.Object.Key)
+		if err != nil {
+			key = r.S3.Object.Key
+		}
+		objs = append(objs, s3Object{
+			Bucket: r.S3.Bucket.Name,
+			Key:    key,
+		})
+	}
+	ok = true
+	return
+}
+
+// ingestObject fetches an S3 object and calls fn on each line. Gzip compressed
+// objects are decompressed transparently.
+func ingestObject(svc s3API, obj s3Object, fn func([]byte) error) error {
+	out, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(obj.Bucket),
+		Key:    aws.String(obj.Key),
+	})
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+	return readLines(out.Body, fn)
+}
+
+// readLines calls fn with every non-empty line in the reader, decompressing
+// the data first if it is gzip compressed.
+func readLines(r io.Reader, fn func([]byte) error) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, initDataSize), maxDataSize)
+	for sc.Scan() {
+		line := bytes.TrimRight(sc.Bytes(), "\r")
+		if len(line) == 0 {
+			continue
+		}
+		// the scanner reuses its buffer, so hand off a copy
+		if err := fn(append([]byte(nil), line...)); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
@@ -0,0 +1,67 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+)
+
+const testS3Event = `{"Records":[
+	{"eventSource":"aws:s3","eventName":"ObjectCreated:Put","awsRegion":"us-west-2",
+	 "s3":{"bucket":{"name":"logs"},"object":{"key":"2020/01/my+file%3A1.log.gz","size":1024}}},
+	{"eventSource":"aws:s3","eventName":"ObjectRemoved:Delete","awsRegion":"us-west-2",
+	 "s3":{"bucket":{"name":"logs"},"object":{"key":"old.log"}}}
+]}`
+
+func TestParseS3Event(t *testing.T) {
+	objs, ok := parseS3Event([]byte(testS3Event))
+	if !ok {
+		t.Fatal("failed to parse S3 event")
+	}
+	if len(objs) != 1 {
+		t.Fatalf("got %d objects, expected 1", len(objs))
+	}
+	if objs[0].Bucket != `logs` || objs[0].Key != `2020/01/my file:1.log.gz` {
+		t.Fatalf("bad object: %+v", objs[0])
+	}
+
+	if objs, ok = parseS3Event([]byte(`{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"logs"}`)); !ok || len(objs) != 0 {
+		t.Fatal("failed to handle S3 test event")
+	}
+	for _, b := range []string{`not json`, `{"foo":"bar"}`, `{"Records":[{"eventSource":"aws:sns"}]}`} {
+		if _, ok = parseS3Event([]byte(b)); ok {
+			t.Fatalf("parsed non-S3 body %q", b)
+		}
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	data := "line one\r\nline two\n\nline three"
+	var gzdata bytes.Buffer
+	gz := gzip.NewWriter(&gzdata)
+	gz.Write([]byte(data))
+	gz.Close()
+
+	for _, r := range []*bytes.Reader{bytes.NewReader([]byte(data)), bytes.NewReader(gzdata.Bytes())} {
+		var lines []string
+		err := readLines(r, func(b []byte) error {
+			lines = append(lines, string(b))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(lines, `|`) != `line one|line two|line three` {
+			t.Fatalf("bad lines: %q", lines)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	snsNotificationType = `Notification`
+)
+
+// snsEnvelope is the JSON document SNS wraps around messages it delivers to
+// an SQS queue which is subscribed to a topic without raw message delivery.
+type snsEnvelope struct {
+	Type      string
+	MessageId string
+	TopicArn  string
+	Subject   string
+	Message   *string
+	Timestamp string
+}
+
+// unwrapSNS extracts the payload of an SNS notification envelope along with
+// the time SNS published it. If the body is not an SNS notification ok is
+// false and the body should be ingested as is. The timestamp is zero if the
+// envelope timestamp is missing or malformed.
+func unwrapSNS(body []byte) (msg []byte, ts time.Time, ok bool) {
+	var env snsEnvelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		return
+	}
+	if env.Type != snsNotificationType || env.TopicArn == `` || env.Message == nil {
+		return
+	}
+	msg = []byte(*env.Message)
+	if t, err := time.Parse(time.RFC3339Nano, env.Timestamp); err == nil {
+		ts = t
+	}
+	ok = true
+	return
+}
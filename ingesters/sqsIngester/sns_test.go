@@ -0,0 +1,59 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const testSNSEnvelope = `{
+  "Type" : "Notification",
+  "MessageId" : "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324",
+  "TopicArn" : "arn:aws:sns:us-west-2:123456789012:MyTopic",
+  "Subject" : "My First Message",
+  "Message" : "{\"foo\":\"bar\"}",
+  "Timestamp" : "2012-05-02T00:54:06.655Z",
+  "SignatureVersion" : "1",
+  "Signature" : "EXAMPLEw6JRN...",
+  "SigningCertURL" : "https://sns.us-west-2.amazonaws.com/SimpleNotificationService-f3ecfb7224c7233fe7bb5f59f96de52f.pem",
+  "UnsubscribeURL" : "https://sns.us-west-2.amazonaws.com/?Action=Unsubscribe"
+}`
+
+func TestUnwrapSNS(t *testing.T) {
+	msg, ts, ok := unwrapSNS([]byte(testSNSEnvelope))
+	if !ok {
+		t.Fatal("failed to unwrap SNS envelope")
+	}
+	if string(msg) != `{"foo":"bar"}` {
+		t.Fatalf("bad message: %q", msg)
+	}
+	if exp := time.Date(2012, 5, 2, 0, 54, 6, 655000000, time.UTC); !ts.Equal(exp) {
+		t.Fatalf("bad timestamp %v != %v", ts, exp)
+	}
+}
+
+func TestUnwrapSNSPassthrough(t *testing.T) {
+	bodies := []string{
+		`just some text`,
+		`{"foo":"bar"}`,
+		`{"Type":"SubscriptionConfirmation","TopicArn":"arn:aws:sns:us-west-2:123456789012:MyTopic","Message":"confirm"}`,
+		`{"Type":"Notification","TopicArn":"arn:aws:sns:us-west-2:123456789012:MyTopic"}`,
+	}
+	for _, b := range bodies {
+		if _, _, ok := unwrapSNS([]byte(b)); ok {
+			t.Fatalf("unwrapped non-SNS body %q", b)
+		}
+	}
+	// a bad timestamp still unwraps, just without a time
+	msg, ts, ok := unwrapSNS([]byte(`{"Type":"Notification","TopicArn":"arn","Message":"hi","Timestamp":"yesterday"}`))
+	if !ok || string(msg) != `hi` || !ts.IsZero() {
+		t.Fatalf("bad unwrap with invalid timestamp: %q %v %v", msg, ts, ok)
+	}
+}
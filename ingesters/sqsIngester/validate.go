@@ -0,0 +1,99 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// validateConfig loads and verifies a configuration and confirms that every
+// configured queue can be read with its credentials, writing a summary to w.
+// Nothing is ingested and no state is written; the ingester UUID is not added
+// to the config file if it is missing.
+func validateConfig(path string, w io.Writer) error {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	conns, err := cfg.Targets()
+	if err != nil {
+		return err
+	}
+	tags, err := cfg.Tags()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Configuration %s is valid\n", path)
+	fmt.Fprintf(w, "Targets: %v\n", conns)
+	fmt.Fprintf(w, "Tags: %v\n", tags)
+
+	var failed int
+	sessions := awsutils.NewSessionCache()
+	names := make([]string, 0, len(cfg.Queue))
+	for k := range cfg.Queue {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		q := cfg.Queue[k]
+		sess, err := sessions.Get(q.Region, q.credentials())
+		if err != nil {
+			fmt.Fprintf(w, "Queue %s (%s): FAILED: %v\n", k, q.Queue_URL, err)
+			failed++
+			continue
+		}
+		out, err := sqs.New(sess, q.endpoint(cfg).Config()).GetQueueAttributes(&sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(q.Queue_URL),
+			AttributeNames: []*string{aws.String(sqs.QueueAttributeNameApproximateNumberOfMessages)},
+		})
+		if err != nil {
+			fmt.Fprintf(w, "Queue %s (%s): FAILED: %v\n", k, q.Queue_URL, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(w, "Queue %s (%s): OK, approximately %s messages\n", k, q.Queue_URL,
+			aws.StringValue(out.Attributes[sqs.QueueAttributeNameApproximateNumberOfMessages]))
+	}
+
+	names = names[:0]
+	for k := range cfg.Queue_Discovery {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		qd := cfg.Queue_Discovery[k]
+		sess, err := sessions.Get(qd.Region, qd.credentials())
+		if err != nil {
+			fmt.Fprintf(w, "Queue-Discovery %s (%s*): FAILED: %v\n", k, qd.Queue_Name_Prefix, err)
+			failed++
+			continue
+		}
+		out, err := sqs.New(sess, qd.endpoint(cfg).Config()).ListQueues(&sqs.ListQueuesInput{
+			QueueNamePrefix: aws.String(qd.Queue_Name_Prefix),
+		})
+		if err != nil {
+			fmt.Fprintf(w, "Queue-Discovery %s (%s*): FAILED: %v\n", k, qd.Queue_Name_Prefix, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(w, "Queue-Discovery %s (%s*): OK, %d queues\n", k, qd.Queue_Name_Prefix, len(out.QueueUrls))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d AWS checks failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gravwell/gravwell/v3/ingesters/awsutils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	maxVisibilityExtension = 12 * time.Hour // SQS limit on a message's visibility timeout
+	minHeartbeatInterval   = time.Second
+	maxVisibilityBatch     = 10 // SQS limit on entries per ChangeMessageVisibilityBatch
+)
+
+// visibilityKeeper extends the visibility timeout of messages that are still
+// being processed so that SQS does not redeliver them while we work, which
+// matters when an S3 object or a slow preprocessor takes longer than the
+// queue's visibility timeout.
+type visibilityKeeper struct {
+	sync.Mutex
+	svc       sqsAPI
+	queue     string
+	extension time.Duration
+	interval  time.Duration
+	handles   map[string]bool
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// newVisibilityKeeper starts a heartbeat which extends the visibility timeout
+// of tracked messages to extension. Heartbeats are sent at half of the
+// queue's own visibility timeout or of the extension, whichever is shorter,
+// so that a message never becomes visible between heartbeats.
+func newVisibilityKeeper(svc sqsAPI, queue string, extension time.Duration) *visibilityKeeper {
+	vk := &visibilityKeeper{
+		svc:       svc,
+		queue:     queue,
+		extension: extension,
+		interval:  extension / 2,
+		handles:   make(map[string]bool),
+		done:      make(chan struct{}),
+	}
+	if qt, err := queueVisibilityTimeout(svc, queue); err != nil {
+		lg.Warn("Failed to get the visibility timeout of queue %s, heartbeats will be sent every %v: %s", queue, vk.interval, awsutils.ErrorMessage(err))
+	} else if qt/2 < vk.interval {
+		vk.interval = qt / 2
+	}
+	if vk.interval < minHeartbeatInterval {
+		vk.interval = minHeartbeatInterval
+	}
+	vk.wg.Add(1)
+	go vk.run()
+	return vk
+}
+
+// queueVisibilityTimeout returns the default visibility timeout of a queue.
+func queueVisibilityTimeout(svc sqsAPI, queue string) (time.Duration, error) {
+	out, err := svc.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(queue),
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameVisibilityTimeout)},
+	})
+	if err != nil {
+		return 0, err
+	}
+	secs, err := strconv.Atoi(aws.StringValue(out.Attributes[sqs.QueueAttributeNameVisibilityTimeout]))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+// Track starts extending the visibility of messages. A nil keeper does nothing.
+func (vk *visibilityKeeper) Track(msgs []*sqs.Message) {
+	if vk == nil {
+		return
+	}
+	vk.Lock()
+	for _, m := range msgs {
+		vk.handles[aws.StringValue(m.ReceiptHandle)] = true
+	}
+	vk.Unlock()
+}
+
+// Untrack stops extending the visibility of messages, either because they are
+// about to be deleted or because they should be redelivered.
+func (vk *visibilityKeeper) Untrack(handles ...*string) {
+	if vk == nil {
+		return
+	}
+	vk.Lock()
+	for _, h := range handles {
+		delete(vk.handles, aws.StringValue(h))
+	}
+	vk.Unlock()
+}
+
+// Close stops the heartbeat. Messages still tracked become visible again once
+// their last extension expires.
+func (vk *visibilityKeeper) Close() {
+	if vk == nil {
+		return
+	}
+	close(vk.done)
+	vk.wg.Wait()
+}
+
+func (vk *visibilityKeeper) run() {
+	defer vk.wg.Done()
+	ticker := time.NewTicker(vk.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			vk.heartbeat()
+		case <-vk.done:
+			return
+		}
+	}
+}
+
+// heartbeat extends the visibility timeout of every tracked message.
+func (vk *visibilityKeeper) heartbeat() {
+	vk.Lock()
+	handles := make([]string, 0, len(vk.handles))
+	for h := range vk.handles {
+		handles = append(handles, h)
+	}
+	vk.Unlock()
+
+	secs := aws.Int64(int64(vk.extension / time.Second))
+	for len(handles) > 0 {
+		n := len(handles)
+		if n > maxVisibilityBatch {
+			n = maxVisibilityBatch
+		}
+		req := &sqs.ChangeMessageVisibilityBatchInput{
+			QueueUrl: aws.String(vk.queue),
+		}
+		for i, h := range handles[:n] {
+			req.Entries = append(req.Entries, &sqs.ChangeMessageVisibilityBatchRequestEntry{
+				Id:                aws.String(strconv.Itoa(i)),
+				ReceiptHandle:     aws.String(h),
+				VisibilityTimeout: secs,
+			})
+		}
+		handles = handles[n:]
+
+		out, err := vk.svc.ChangeMessageVisibilityBatch(req)
+		if err != nil {
+			lg.Error("sqs change message visibility batch: %s", awsutils.ErrorMessage(err))
+			continue
+		}
+		for _, f := range out.Failed {
+			// the message may have been deleted since we took the snapshot
+			debugout("sqs change message visibility %s failed: %s\n", aws.StringValue(f.Id), aws.StringValue(f.Message))
+		}
+	}
+}
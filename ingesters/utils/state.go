@@ -9,8 +9,12 @@
 package utils
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/gob"
 	"errors"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
@@ -23,10 +27,13 @@ var (
 	ErrNoState          = errors.New("No state available")
 )
 
+var gzipMagic = []byte{0x1f, 0x8b}
+
 type State struct {
 	sync.Mutex
-	fpath string
-	perm  os.FileMode
+	fpath    string
+	perm     os.FileMode
+	compress bool
 }
 
 func NewState(pth string, perm os.FileMode) (s *State, err error) {
@@ -55,12 +62,20 @@ func NewState(pth string, perm os.FileMode) (s *State, err error) {
 	return
 }
 
+// SetCompression enables gzip compression of the state when it is written.
+// Reads handle compressed and uncompressed files either way.
+func (s *State) SetCompression(compress bool) {
+	s.Lock()
+	s.compress = compress
+	s.Unlock()
+}
+
 func (s *State) Write(f interface{}) (err error) {
 	s.Lock()
 	var fout *safefile.File
 	if fout, err = safefile.Create(s.fpath, s.perm); err == nil {
 		n := fout.Name() //incase we have to destroy it
-		if err = gob.NewEncoder(fout).Encode(f); err != nil {
+		if err = s.encode(fout, f); err != nil {
 			fout.File.Close()
 			os.Remove(n)
 		} else if err = fout.Commit(); err != nil {
@@ -80,7 +95,7 @@ func (s *State) Read(f interface{}) (err error) {
 			err = ErrNoState
 		}
 	} else {
-		if err = gob.NewDecoder(fin).Decode(f); err == nil {
+		if err = decode(fin, f); err == nil {
 			err = fin.Close()
 		} else {
 			fin.Close()
@@ -89,3 +104,30 @@ func (s *State) Read(f interface{}) (err error) {
 	s.Unlock()
 	return
 }
+
+func (s *State) encode(w io.Writer, f interface{}) error {
+	if !s.compress {
+		return gob.NewEncoder(w).Encode(f)
+	}
+	gz := gzip.NewWriter(w)
+	if err := gob.NewEncoder(gz).Encode(f); err != nil {
+		gz.Close()
+		return err
+	}
+	return gz.Close()
+}
+
+// decode reads a gob encoded state which may be gzip compressed, a gob stream
+// can never begin with the gzip magic bytes.
+func decode(r io.Reader, f interface{}) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return gob.NewDecoder(gz).Decode(f)
+	}
+	return gob.NewDecoder(br).Decode(f)
+}
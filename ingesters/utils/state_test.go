@@ -105,3 +105,41 @@ func TestUpdates(t *testing.T) {
 		t.Fatal("Readout is wrong")
 	}
 }
+
+func TestCompressedState(t *testing.T) {
+	pth := filepath.Join(tdir, "state4")
+	s, err := NewState(pth, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tv := testS{
+		Foo: `test`,
+		Bar: 2,
+		Baz: 2.2,
+	}
+	// an uncompressed file is still read once compression is enabled
+	if err = s.Write(tv); err != nil {
+		t.Fatal(err)
+	}
+	s.SetCompression(true)
+	var tv2 testS
+	if err = s.Read(&tv2); err != nil || !reflect.DeepEqual(tv, tv2) {
+		t.Fatal("Readout of uncompressed state is wrong", err)
+	}
+
+	tv.Bar = 3
+	if err = s.Write(tv); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(pth); err != nil {
+		t.Fatal(err)
+	} else if len(b) < 2 || b[0] != 0x1f || b[1] != 0x8b {
+		t.Fatal("state was not compressed")
+	}
+	// and a compressed file is read with compression disabled
+	s.SetCompression(false)
+	var tv3 testS
+	if err = s.Read(&tv3); err != nil || !reflect.DeepEqual(tv, tv3) {
+		t.Fatal("Readout of compressed state is wrong", err)
+	}
+}